@@ -5,6 +5,7 @@ import (
 	"errors"
 	"flag"
 	"fmt"
+	"io"
 	"log"
 	"net/http"
 	"os"
@@ -17,6 +18,7 @@ import (
 	"piapi/internal/adminapi"
 	"piapi/internal/adminui"
 	"piapi/internal/config"
+	"piapi/internal/ledger"
 	"piapi/internal/logging"
 	"piapi/internal/metrics"
 	"piapi/internal/server"
@@ -27,12 +29,21 @@ func main() {
 	showVersion := flag.Bool("version", false, "show version information")
 	configPath := flag.String("config", "config.yaml", "path to config.yaml")
 	listenAddr := flag.String("listen", ":9200", "HTTP listen address")
+	ledgerPath := flag.String("ledger", "", "path to the usage ledger file (default: piapi-ledger.json next to the config; \"off\" disables budgets)")
+	encryptSecret := flag.Bool("encrypt-secret", false, "read a secret from stdin, print its enc: value under "+config.MasterKeyEnv+" and exit")
 	flag.Parse()
 
 	if *showVersion {
 		fmt.Println(version.Full())
 		os.Exit(0)
 	}
+	if *encryptSecret {
+		if err := printEncryptedSecret(); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+		os.Exit(0)
+	}
 
 	baseLogger, err := logging.NewLogger()
 	if err != nil {
@@ -65,10 +76,48 @@ func main() {
 	if err := config.WatchFile(rootCtx, manager, *configPath, configLogger.Infof); err != nil {
 		configLogger.Fatalw("failed to start config watcher", "error", err)
 	}
+	manager.StartHealthChecks(rootCtx, baseLogger.Named("health").Sugar().Infof)
+	// SIGHUP reloads the config without a file change, e.g. after a referenced
+	// secret file or environment value was rotated.
+	hupCh := make(chan os.Signal, 1)
+	signal.Notify(hupCh, syscall.SIGHUP)
+	go func() {
+		for {
+			select {
+			case <-rootCtx.Done():
+				return
+			case <-hupCh:
+				if err := manager.LoadFromFile(*configPath); err != nil {
+					metrics.ObserveConfigReload(false)
+					configLogger.Warnw("config reload failed", "error", err)
+				} else {
+					metrics.ObserveConfigReload(true)
+					configLogger.Infow("config reloaded", "reason", "SIGHUP")
+				}
+			}
+		}
+	}()
 
+	usageLedger, err := openLedger(resolveLedgerPath(*ledgerPath, *configPath))
+	if err != nil {
+		sugar.Fatalw("failed to open usage ledger", "error", err)
+	}
+	if usageLedger != nil {
+		ledgerLogger := baseLogger.Named("ledger").Sugar()
+		go usageLedger.Run(rootCtx, ledger.DefaultFlushInterval, func(err error) {
+			ledgerLogger.Warnw("failed to flush usage ledger", "error", err)
+		})
+		sugar.Infow("usage ledger enabled", "path", usageLedger.Path())
+	} else {
+		sugar.Infow("usage ledger disabled; budgets are not enforced")
+	}
+
+	const writeTimeout = 300 * time.Second
 	gateway := &server.Gateway{
-		Config: manager,
-		Logger: baseLogger.Named("gateway"),
+		Config:       manager,
+		Logger:       baseLogger.Named("gateway"),
+		Ledger:       usageLedger,
+		WriteTimeout: writeTimeout,
 	}
 
 	adminToken := os.Getenv("PIAPI_ADMIN_TOKEN")
@@ -87,6 +136,9 @@ func main() {
 	if adminToken != "" {
 		adminLogger := baseLogger.Named("admin")
 		adminHandler := adminapi.NewHandler(manager, *configPath, adminToken, adminLogger)
+		if usageLedger != nil {
+			adminHandler.SetLedger(usageLedger)
+		}
 		mux.Handle("/piadmin/api/", server.RequestIDMiddleware(http.StripPrefix("/piadmin/api", adminHandler)))
 
 		// Serve admin UI
@@ -103,7 +155,7 @@ func main() {
 		Addr:         *listenAddr,
 		Handler:      mux,
 		ReadTimeout:  30 * time.Second,
-		WriteTimeout: 300 * time.Second, // 5 minutes for streaming responses
+		WriteTimeout: writeTimeout, // lifted by the gateway for services with stream timeouts
 		IdleTimeout:  2 * time.Minute,
 	}
 
@@ -132,9 +184,34 @@ func main() {
 	if err := srv.Shutdown(ctx); err != nil {
 		sugar.Fatalw("graceful shutdown failed", "error", err)
 	}
+	if usageLedger != nil {
+		// Requests drained by Shutdown may have recorded usage after the last periodic flush.
+		if err := usageLedger.Flush(); err != nil {
+			sugar.Warnw("failed to flush usage ledger", "error", err)
+		}
+	}
 	sugar.Infow("shutdown complete")
 }
 
+// printEncryptedSecret encrypts the secret read from stdin for use as a provider
+// key value.
+func printEncryptedSecret() error {
+	data, err := io.ReadAll(os.Stdin)
+	if err != nil {
+		return fmt.Errorf("read secret: %w", err)
+	}
+	secret := strings.TrimSpace(string(data))
+	if secret == "" {
+		return errors.New("secret is empty")
+	}
+	value, err := config.EncryptSecret(secret)
+	if err != nil {
+		return err
+	}
+	fmt.Println(value)
+	return nil
+}
+
 func ensureDevConfig(path string) error {
 	_, err := os.Stat(path)
 	if err == nil || !errors.Is(err, os.ErrNotExist) {
@@ -160,6 +237,29 @@ func ensureDevConfig(path string) error {
 	return nil
 }
 
+// resolveLedgerPath applies the --ledger / PIAPI_LEDGER settings; an empty result
+// disables the ledger.
+func resolveLedgerPath(flagValue, configPath string) string {
+	path := strings.TrimSpace(flagValue)
+	if path == "" {
+		path = strings.TrimSpace(os.Getenv("PIAPI_LEDGER"))
+	}
+	switch strings.ToLower(path) {
+	case "":
+		return filepath.Join(filepath.Dir(configPath), "piapi-ledger.json")
+	case "off", "none", "false":
+		return ""
+	}
+	return path
+}
+
+func openLedger(path string) (*ledger.Ledger, error) {
+	if path == "" {
+		return nil, nil
+	}
+	return ledger.Open(path)
+}
+
 func parseBool(value string) bool {
 	if value == "" {
 		return false
@@ -0,0 +1,217 @@
+package adminapi
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strings"
+
+	"piapi/internal/config"
+	"piapi/internal/ledger"
+)
+
+const maxBudgetPayloadSize = 64 << 10
+
+var errLedgerDisabled = errors.New("usage ledger not configured")
+
+// budgetStatus reports a configured budget of a user, or of one service of a user.
+type budgetStatus struct {
+	User        string              `json:"user"`
+	ServiceType string              `json:"service_type,omitempty"`
+	Daily       *budgetPeriodStatus `json:"daily,omitempty"`
+	Monthly     *budgetPeriodStatus `json:"monthly,omitempty"`
+}
+
+type budgetPeriodStatus struct {
+	ledger.Balance
+	Limit     config.BudgetLimit `json:"limit"`
+	Remaining ledger.Usage       `json:"remaining"`
+	Exhausted bool               `json:"exhausted"`
+}
+
+// budgetAdjustment is the body of the reset and top-up endpoints.
+type budgetAdjustment struct {
+	User        string  `json:"user"`
+	ServiceType string  `json:"service_type"`
+	Period      string  `json:"period"`
+	Tokens      int64   `json:"tokens"`
+	Cost        float64 `json:"cost"`
+}
+
+// SetLedger enables the budget endpoints backed by l.
+func (h *Handler) SetLedger(l *ledger.Ledger) {
+	h.ledger = l
+}
+
+func (h *Handler) handleGetBudgets(w http.ResponseWriter, r *http.Request) {
+	cfg, ok := h.budgetPrecheck(w)
+	if !ok {
+		return
+	}
+	statuses := h.budgetStatuses(cfg, strings.TrimSpace(r.URL.Query().Get("user")))
+	h.writeJSON(w, statuses, "budgets")
+}
+
+func (h *Handler) handleResetBudget(w http.ResponseWriter, r *http.Request) {
+	h.adjustBudget(w, r, func(adj budgetAdjustment, periods []ledger.Period) error {
+		for _, p := range periods {
+			h.ledger.Reset(adj.User, adj.ServiceType, p)
+		}
+		return nil
+	})
+}
+
+func (h *Handler) handleTopUpBudget(w http.ResponseWriter, r *http.Request) {
+	h.adjustBudget(w, r, func(adj budgetAdjustment, periods []ledger.Period) error {
+		if adj.Tokens < 0 || adj.Cost < 0 {
+			return errors.New("tokens and cost must not be negative")
+		}
+		if adj.Tokens == 0 && adj.Cost == 0 {
+			return errors.New("tokens or cost is required")
+		}
+		if len(periods) != 1 {
+			return errors.New("period is required")
+		}
+		h.ledger.TopUp(adj.User, adj.ServiceType, periods[0], ledger.Usage{Tokens: adj.Tokens, Cost: adj.Cost})
+		return nil
+	})
+}
+
+// adjustBudget decodes and validates an adjustment, applies it, persists the ledger
+// and responds with the user's updated budgets. An empty period means both periods.
+func (h *Handler) adjustBudget(w http.ResponseWriter, r *http.Request, apply func(budgetAdjustment, []ledger.Period) error) {
+	cfg, ok := h.budgetPrecheck(w)
+	if !ok {
+		return
+	}
+
+	var adj budgetAdjustment
+	if err := json.NewDecoder(io.LimitReader(r.Body, maxBudgetPayloadSize)).Decode(&adj); err != nil {
+		h.badRequest(w, fmt.Errorf("decode body: %w", err))
+		return
+	}
+	adj.User = strings.TrimSpace(adj.User)
+	adj.ServiceType = strings.TrimSpace(adj.ServiceType)
+	if adj.User == "" {
+		h.badRequest(w, errors.New("user is required"))
+		return
+	}
+	user := findUserByName(cfg, adj.User)
+	if user == nil {
+		writeError(w, http.StatusNotFound, fmt.Errorf("%w: '%s'", config.ErrUserNotFound, adj.User))
+		return
+	}
+	if adj.ServiceType != "" {
+		if _, ok := user.Services[adj.ServiceType]; !ok {
+			writeError(w, http.StatusNotFound, fmt.Errorf("%w for user '%s'", config.ErrServiceNotFound, adj.User))
+			return
+		}
+	}
+
+	periods := []ledger.Period{ledger.Daily, ledger.Monthly}
+	if p := strings.TrimSpace(adj.Period); p != "" {
+		period, err := ledger.ParsePeriod(p)
+		if err != nil {
+			h.badRequest(w, err)
+			return
+		}
+		periods = []ledger.Period{period}
+	}
+
+	if err := apply(adj, periods); err != nil {
+		h.badRequest(w, err)
+		return
+	}
+	if err := h.ledger.Flush(); err != nil {
+		h.internalError(w, fmt.Errorf("flush ledger: %w", err))
+		return
+	}
+
+	h.writeJSON(w, h.budgetStatuses(cfg, adj.User), "budgets")
+}
+
+func (h *Handler) budgetPrecheck(w http.ResponseWriter) (*config.Config, bool) {
+	if h.ledger == nil {
+		writeError(w, http.StatusServiceUnavailable, errLedgerDisabled)
+		return nil, false
+	}
+	if h.manager == nil {
+		h.internalError(w, errors.New("configuration not loaded"))
+		return nil, false
+	}
+	cfg := h.manager.Current()
+	if cfg == nil {
+		writeError(w, http.StatusServiceUnavailable, config.ErrConfigNotLoaded)
+		return nil, false
+	}
+	return cfg, true
+}
+
+// budgetStatuses lists configured budgets, optionally for a single user name.
+func (h *Handler) budgetStatuses(cfg *config.Config, onlyUser string) []budgetStatus {
+	statuses := make([]budgetStatus, 0)
+	for _, u := range cfg.Users {
+		if u.Name == "" || (onlyUser != "" && u.Name != onlyUser) {
+			continue
+		}
+		if u.Budget != nil {
+			statuses = append(statuses, h.budgetStatus(u.Name, "", u.Budget))
+		}
+		for svcType, route := range u.Services {
+			if route.Budget != nil {
+				statuses = append(statuses, h.budgetStatus(u.Name, svcType, route.Budget))
+			}
+		}
+	}
+	sort.Slice(statuses, func(i, j int) bool {
+		a, b := statuses[i], statuses[j]
+		if a.User != b.User {
+			return a.User < b.User
+		}
+		return a.ServiceType < b.ServiceType
+	})
+	return statuses
+}
+
+func (h *Handler) budgetStatus(user, serviceType string, budget *config.BudgetConfig) budgetStatus {
+	status := budgetStatus{User: user, ServiceType: serviceType}
+	period := func(p ledger.Period, limit *config.BudgetLimit) *budgetPeriodStatus {
+		if limit == nil || (limit.Tokens <= 0 && limit.Cost <= 0) {
+			return nil
+		}
+		l := ledger.Limit{Tokens: limit.Tokens, Cost: limit.Cost}
+		balance := h.ledger.Balance(user, serviceType, p)
+		return &budgetPeriodStatus{
+			Balance:   balance,
+			Limit:     *limit,
+			Remaining: balance.Remaining(l),
+			Exhausted: balance.Exhausted(l),
+		}
+	}
+	status.Daily = period(ledger.Daily, budget.Daily)
+	status.Monthly = period(ledger.Monthly, budget.Monthly)
+	return status
+}
+
+func findUserByName(cfg *config.Config, name string) *config.User {
+	for i := range cfg.Users {
+		if cfg.Users[i].Name == name {
+			return &cfg.Users[i]
+		}
+	}
+	return nil
+}
+
+func (h *Handler) writeJSON(w http.ResponseWriter, v interface{}, what string) {
+	payload, err := json.Marshal(v)
+	if err != nil {
+		h.internalError(w, fmt.Errorf("marshal %s: %w", what, err))
+		return
+	}
+	w.Header().Set("Content-Type", jsonContentType)
+	w.WriteHeader(http.StatusOK)
+	_, _ = w.Write(payload)
+}
@@ -17,6 +17,7 @@ import (
 	"go.uber.org/zap"
 
 	"piapi/internal/config"
+	"piapi/internal/ledger"
 	"piapi/internal/logging"
 )
 
@@ -32,6 +33,7 @@ type Handler struct {
 	configPath string
 	token      string
 	logger     *zap.Logger
+	ledger     *ledger.Ledger
 
 	mu sync.Mutex
 }
@@ -69,6 +71,22 @@ func (h *Handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 		h.handleGetConfigStructured(w, r)
 	case matchPath(path, "stats/routes") && r.Method == http.MethodGet:
 		h.handleGetRouteStats(w, r)
+	case matchPath(path, "stats/keys") && r.Method == http.MethodGet:
+		h.handleGetKeyStats(w, r)
+	case matchPath(path, "keys/enable") && r.Method == http.MethodPost:
+		h.handleEnableKey(w, r)
+	case matchPath(path, "stats/ratelimits") && r.Method == http.MethodGet:
+		h.handleGetRateLimitStats(w, r)
+	case matchPath(path, "budgets") && r.Method == http.MethodGet:
+		h.handleGetBudgets(w, r)
+	case matchPath(path, "budgets/reset") && r.Method == http.MethodPost:
+		h.handleResetBudget(w, r)
+	case matchPath(path, "budgets/topup") && r.Method == http.MethodPost:
+		h.handleTopUpBudget(w, r)
+	case matchPath(path, "users/key") && r.Method == http.MethodPost:
+		h.handleRotateUserKey(w, r)
+	case matchPath(path, "secrets/reveal") && r.Method == http.MethodPost:
+		h.handleRevealSecret(w, r)
 	case matchPath(path, "dashboard/logs") && r.Method == http.MethodGet:
 		h.handleGetDashboardLogs(w, r)
 	case matchPath(path, "dashboard/stats") && r.Method == http.MethodGet:
@@ -102,6 +120,11 @@ func (h *Handler) handleGetConfigRaw(w http.ResponseWriter, _ *http.Request) {
 		h.internalError(w, fmt.Errorf("read config: %w", err))
 		return
 	}
+	data, err = redactConfigYAML(data)
+	if err != nil {
+		h.internalError(w, err)
+		return
+	}
 	w.Header().Set("Content-Type", yamlContentType)
 	w.WriteHeader(http.StatusOK)
 	_, _ = w.Write(data)
@@ -113,7 +136,7 @@ func (h *Handler) handleGetConfigStructured(w http.ResponseWriter, _ *http.Reque
 		h.internalError(w, errors.New("configuration not loaded"))
 		return
 	}
-	payload, err := json.Marshal(cfg)
+	payload, err := json.Marshal(redactConfig(cfg))
 	if err != nil {
 		h.internalError(w, fmt.Errorf("marshal config: %w", err))
 		return
@@ -131,6 +154,14 @@ func (h *Handler) handleGetRouteStats(w http.ResponseWriter, r *http.Request) {
 
 	apiKey := strings.TrimSpace(r.URL.Query().Get("apiKey"))
 	service := strings.TrimSpace(r.URL.Query().Get("service"))
+	// Clients only see masked keys, so users may also be named.
+	if userName := strings.TrimSpace(r.URL.Query().Get("user")); userName != "" && apiKey == "" {
+		apiKey = h.userID(userName)
+		if apiKey == "" {
+			writeError(w, http.StatusNotFound, fmt.Errorf("%w: '%s'", config.ErrUserNotFound, userName))
+			return
+		}
+	}
 
 	stats, err := h.manager.RuntimeStatus(apiKey, service)
 	if err != nil {
@@ -147,6 +178,9 @@ func (h *Handler) handleGetRouteStats(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	for i := range stats {
+		stats[i].LastError = logging.GlobalRedactor.Redact(stats[i].LastError)
+	}
 	payload, err := json.Marshal(stats)
 	if err != nil {
 		h.internalError(w, fmt.Errorf("marshal stats: %w", err))
@@ -158,6 +192,122 @@ func (h *Handler) handleGetRouteStats(w http.ResponseWriter, r *http.Request) {
 	_, _ = w.Write(payload)
 }
 
+// userID returns the identifier RuntimeStatus expects for the named user: the
+// API key, or the apiKeyHash of hashed users.
+func (h *Handler) userID(name string) string {
+	cfg := h.manager.Current()
+	if cfg == nil {
+		return ""
+	}
+	for _, user := range cfg.Users {
+		if user.Name == name {
+			if user.APIKey != "" {
+				return user.APIKey
+			}
+			return user.APIKeyHash
+		}
+	}
+	return ""
+}
+
+func (h *Handler) handleGetKeyStats(w http.ResponseWriter, _ *http.Request) {
+	if h.manager == nil {
+		h.internalError(w, errors.New("configuration not loaded"))
+		return
+	}
+
+	stats, err := h.manager.KeyHealth()
+	if err != nil {
+		if errors.Is(err, config.ErrConfigNotLoaded) {
+			writeError(w, http.StatusServiceUnavailable, err)
+			return
+		}
+		h.internalError(w, err)
+		return
+	}
+
+	for i := range stats {
+		stats[i].LastError = logging.GlobalRedactor.Redact(stats[i].LastError)
+	}
+	payload, err := json.Marshal(stats)
+	if err != nil {
+		h.internalError(w, fmt.Errorf("marshal key stats: %w", err))
+		return
+	}
+
+	w.Header().Set("Content-Type", jsonContentType)
+	w.WriteHeader(http.StatusOK)
+	_, _ = w.Write(payload)
+}
+
+// handleEnableKey clears the invalid mark a provider key got from repeated 401 or
+// 403 responses, once its owner has fixed the key upstream.
+func (h *Handler) handleEnableKey(w http.ResponseWriter, r *http.Request) {
+	var body struct {
+		Provider string `json:"provider"`
+		Key      string `json:"key"`
+	}
+	if err := json.NewDecoder(io.LimitReader(r.Body, maxRevealPayloadSize)).Decode(&body); err != nil {
+		h.badRequest(w, fmt.Errorf("decode body: %w", err))
+		return
+	}
+	body.Provider = strings.TrimSpace(body.Provider)
+	body.Key = strings.TrimSpace(body.Key)
+	if body.Provider == "" || body.Key == "" {
+		h.badRequest(w, errors.New("provider and key are required"))
+		return
+	}
+
+	stats, err := h.manager.EnableKey(body.Provider, body.Key)
+	if err != nil {
+		switch {
+		case errors.Is(err, config.ErrProviderKeyNotFound):
+			writeError(w, http.StatusNotFound, err)
+		case errors.Is(err, config.ErrConfigNotLoaded):
+			writeError(w, http.StatusServiceUnavailable, err)
+		default:
+			h.internalError(w, err)
+		}
+		return
+	}
+	h.logger.Info("provider key enabled via admin API",
+		zap.String("provider", body.Provider),
+		zap.String("key", body.Key),
+		zap.String("remote_addr", r.RemoteAddr),
+	)
+	for i := range stats {
+		stats[i].LastError = logging.GlobalRedactor.Redact(stats[i].LastError)
+	}
+	h.writeJSON(w, stats, "key stats")
+}
+
+func (h *Handler) handleGetRateLimitStats(w http.ResponseWriter, _ *http.Request) {
+	if h.manager == nil {
+		h.internalError(w, errors.New("configuration not loaded"))
+		return
+	}
+
+	stats, err := h.manager.RateLimits()
+	if err != nil {
+		if errors.Is(err, config.ErrConfigNotLoaded) {
+			writeError(w, http.StatusServiceUnavailable, err)
+			return
+		}
+		h.internalError(w, err)
+		return
+	}
+
+	payload, err := json.Marshal(stats)
+	if err != nil {
+		h.internalError(w, fmt.Errorf("marshal rate limit stats: %w", err))
+		return
+	}
+
+	w.Header().Set("Content-Type", jsonContentType)
+	w.WriteHeader(http.StatusOK)
+	_, _ = w.Write(payload)
+}
+
 func (h *Handler) handlePutConfigRaw(w http.ResponseWriter, r *http.Request) {
 	bodyReader := http.MaxBytesReader(w, r.Body, maxConfigPayloadSize)
 	defer bodyReader.Close()
@@ -174,6 +324,16 @@ func (h *Handler) handlePutConfigRaw(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	original, err := os.ReadFile(h.configPath)
+	if err != nil {
+		h.internalError(w, fmt.Errorf("read config: %w", err))
+		return
+	}
+	if payload, err = unmaskConfigYAML(payload, original); err != nil {
+		h.badRequest(w, err)
+		return
+	}
+
 	if _, err := config.ParseYAML(payload); err != nil {
 		h.badRequest(w, fmt.Errorf("invalid config: %w", err))
 		return
@@ -311,12 +471,25 @@ func (h *Handler) handleGetDashboardStats(w http.ResponseWriter, r *http.Request
 	// Calculate stats from request log store
 	requestStats := calculateRequestStats()
 
+	// Keys rejected by their upstream stay out of rotation until an admin acts, so
+	// they are listed up front.
+	invalidKeys := []config.KeyHealthStatus{}
+	if keys, err := h.manager.KeyHealth(); err == nil {
+		for _, key := range keys {
+			if key.Invalid {
+				key.LastError = logging.GlobalRedactor.Redact(key.LastError)
+				invalidKeys = append(invalidKeys, key)
+			}
+		}
+	}
+
 	// Combine stats
 	stats := map[string]interface{}{
 		"request_stats": requestStats,
 		"providers":     extractProviderNames(cfg),
 		"users":         extractUserNames(cfg),
 		"service_types": extractServiceTypes(cfg),
+		"invalid_keys":  invalidKeys,
 	}
 
 	payload, err := json.Marshal(stats)
@@ -337,6 +510,7 @@ func calculateRequestStats() map[string]interface{} {
 			"success_rate":   0.0,
 			"avg_latency_ms": 0.0,
 			"error_count":    0,
+			"token_usage":    tokenTotals{},
 			"by_service":     map[string]interface{}{},
 			"by_provider":    map[string]interface{}{},
 			"by_user":        map[string]interface{}{},
@@ -353,6 +527,7 @@ func calculateRequestStats() map[string]interface{} {
 			"success_rate":   0.0,
 			"avg_latency_ms": 0.0,
 			"error_count":    0,
+			"token_usage":    tokenTotals{},
 			"by_service":     map[string]interface{}{},
 			"by_provider":    map[string]interface{}{},
 			"by_user":        map[string]interface{}{},
@@ -365,6 +540,7 @@ func calculateRequestStats() map[string]interface{} {
 	byService := make(map[string]map[string]int)
 	byProvider := make(map[string]map[string]int)
 	byUser := make(map[string]map[string]int)
+	var tokens tokenTotals
 
 	for _, log := range allLogs {
 		// Count successes (2xx and 3xx)
@@ -409,6 +585,15 @@ func calculateRequestStats() map[string]interface{} {
 		} else {
 			byUser[log.User]["error"]++
 		}
+
+		// Token usage, when the upstream reported it
+		if u := log.Usage; u != nil {
+			tokens.add(u)
+			for _, bucket := range []map[string]int{byService[log.ServiceType], byProvider[log.Provider], byUser[log.User]} {
+				bucket["prompt_tokens"] += int(u.PromptTokens)
+				bucket["completion_tokens"] += int(u.CompletionTokens)
+			}
+		}
 	}
 
 	successRate := 0.0
@@ -427,12 +612,30 @@ func calculateRequestStats() map[string]interface{} {
 		"error_count":    errorCount,
 		"success_rate":   successRate,
 		"avg_latency_ms": avgLatency,
+		"token_usage":    tokens,
 		"by_service":     byService,
 		"by_provider":    byProvider,
 		"by_user":        byUser,
 	}
 }
 
+// tokenTotals sums token usage across request log entries.
+type tokenTotals struct {
+	PromptTokens     int64 `json:"prompt_tokens"`
+	CompletionTokens int64 `json:"completion_tokens"`
+	CacheReadTokens  int64 `json:"cache_read_tokens"`
+	CacheWriteTokens int64 `json:"cache_write_tokens"`
+	TotalTokens      int64 `json:"total_tokens"`
+}
+
+func (t *tokenTotals) add(u *logging.TokenUsage) {
+	t.PromptTokens += u.PromptTokens
+	t.CompletionTokens += u.CompletionTokens
+	t.CacheReadTokens += u.CacheReadTokens
+	t.CacheWriteTokens += u.CacheWriteTokens
+	t.TotalTokens += u.PromptTokens + u.CompletionTokens
+}
+
 func extractProviderNames(cfg *config.Config) []string {
 	names := make([]string, 0, len(cfg.Providers))
 	for _, p := range cfg.Providers {
@@ -0,0 +1,292 @@
+package adminapi
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"go.uber.org/zap"
+	"gopkg.in/yaml.v3"
+
+	"piapi/internal/config"
+	"piapi/internal/logging"
+)
+
+const maxRevealPayloadSize = 4 << 10
+
+// maskedMarker appears in every masked value. A submitted config value containing
+// it is taken to be a masked secret.
+const maskedMarker = "****"
+
+// revealResponse carries a single secret as written in the config file.
+type revealResponse struct {
+	Provider string `json:"provider,omitempty"`
+	Key      string `json:"key,omitempty"`
+	User     string `json:"user,omitempty"`
+	Value    string `json:"value"`
+}
+
+// handleRevealSecret returns the full value of one provider key or user key. It
+// is the only admin operation that exposes a secret; each call is logged.
+func (h *Handler) handleRevealSecret(w http.ResponseWriter, r *http.Request) {
+	var body struct {
+		Provider string `json:"provider"`
+		Key      string `json:"key"`
+		User     string `json:"user"`
+	}
+	if err := json.NewDecoder(io.LimitReader(r.Body, maxRevealPayloadSize)).Decode(&body); err != nil {
+		h.badRequest(w, fmt.Errorf("decode body: %w", err))
+		return
+	}
+	body.Provider = strings.TrimSpace(body.Provider)
+	body.Key = strings.TrimSpace(body.Key)
+	body.User = strings.TrimSpace(body.User)
+	if (body.User == "") == (body.Provider == "") {
+		h.badRequest(w, errors.New("exactly one of provider or user is required"))
+		return
+	}
+	if body.Provider != "" && body.Key == "" {
+		h.badRequest(w, errors.New("key is required with provider"))
+		return
+	}
+
+	cfg := h.manager.Current()
+	if cfg == nil {
+		writeError(w, http.StatusServiceUnavailable, config.ErrConfigNotLoaded)
+		return
+	}
+	resp := revealResponse{Provider: body.Provider, Key: body.Key, User: body.User}
+	found := false
+	if body.Provider != "" {
+		for _, provider := range cfg.Providers {
+			if provider.Name == body.Provider {
+				resp.Value, found = provider.APIKeys[body.Key]
+				break
+			}
+		}
+		if !found {
+			writeError(w, http.StatusNotFound, fmt.Errorf("provider key '%s/%s' not found", body.Provider, body.Key))
+			return
+		}
+	} else {
+		for _, user := range cfg.Users {
+			if user.Name == body.User {
+				resp.Value, found = user.APIKey, true
+				break
+			}
+		}
+		if !found {
+			writeError(w, http.StatusNotFound, fmt.Errorf("%w: '%s'", config.ErrUserNotFound, body.User))
+			return
+		}
+		if resp.Value == "" {
+			writeError(w, http.StatusNotFound, fmt.Errorf("user '%s' is declared by apiKeyHash; its key cannot be revealed", body.User))
+			return
+		}
+	}
+
+	h.logger.Info("secret revealed via admin API",
+		zap.String("provider", body.Provider),
+		zap.String("key", body.Key),
+		zap.String("user", body.User),
+		zap.String("remote_addr", r.RemoteAddr),
+	)
+	w.Header().Set("Cache-Control", "no-store")
+	h.writeJSON(w, resp, "secret")
+}
+
+// maskSecretValue masks a provider or user key value. Secret references name
+// where the secret lives rather than the secret itself and are returned as is.
+func maskSecretValue(value string) string {
+	if value == "" || config.IsSecretReference(value) {
+		return value
+	}
+	return logging.MaskSecret(value)
+}
+
+// maskProxyURL masks the password of a proxy URL, leaving the rest readable.
+// Values without a password, including "direct", are returned as is.
+func maskProxyURL(value string) string {
+	u, err := url.Parse(value)
+	if err != nil || u.User == nil {
+		return value
+	}
+	password, ok := u.User.Password()
+	if !ok || password == "" {
+		return value
+	}
+	// Splice the mask into the value as written; re-encoding the URL would escape it.
+	start := strings.Index(value, "://")
+	if start < 0 {
+		return maskSecretValue(value)
+	}
+	start += len("://")
+	authority := value[start:]
+	if end := strings.IndexAny(authority, "/?#"); end >= 0 {
+		authority = authority[:end]
+	}
+	userinfo := authority[:strings.LastIndex(authority, "@")]
+	colon := strings.Index(userinfo, ":")
+	return value[:start+colon+1] + maskSecretValue(password) + value[start+len(userinfo):]
+}
+
+// redactConfig returns a copy of cfg with provider keys, proxy passwords and user
+// keys masked.
+func redactConfig(cfg *config.Config) *config.Config {
+	out := *cfg
+	out.Providers = make([]config.Provider, len(cfg.Providers))
+	for i, provider := range cfg.Providers {
+		keys := make(map[string]string, len(provider.APIKeys))
+		for name, value := range provider.APIKeys {
+			keys[name] = maskSecretValue(value)
+		}
+		provider.APIKeys = keys
+		if provider.Transport != nil {
+			transport := *provider.Transport
+			transport.Proxy = maskProxyURL(transport.Proxy)
+			provider.Transport = &transport
+		}
+		out.Providers[i] = provider
+	}
+	out.Users = make([]config.User, len(cfg.Users))
+	for i, user := range cfg.Users {
+		user.APIKey = maskSecretValue(user.APIKey)
+		out.Users[i] = user
+	}
+	return &out
+}
+
+// secretNodes indexes the provider key, proxy URL and user key scalars of a config
+// document by "provider/<name>/<key>", "proxy/<name>" and "user/<name>".
+func secretNodes(root *yaml.Node) map[string]*yaml.Node {
+	out := make(map[string]*yaml.Node)
+	if root.Kind != yaml.DocumentNode || len(root.Content) == 0 {
+		return out
+	}
+	doc := root.Content[0]
+	if providers := mappingValue(doc, "providers"); providers != nil && providers.Kind == yaml.SequenceNode {
+		for _, provider := range providers.Content {
+			name := mappingValue(provider, "name")
+			if name == nil {
+				continue
+			}
+			if proxy := mappingValue(mappingValue(provider, "transport"), "proxy"); proxy != nil && proxy.Kind == yaml.ScalarNode {
+				out["proxy/"+name.Value] = proxy
+			}
+			keys := mappingValue(provider, "apiKeys")
+			if keys == nil || keys.Kind != yaml.MappingNode {
+				continue
+			}
+			for i := 0; i+1 < len(keys.Content); i += 2 {
+				if value := keys.Content[i+1]; value.Kind == yaml.ScalarNode {
+					out["provider/"+name.Value+"/"+keys.Content[i].Value] = value
+				}
+			}
+		}
+	}
+	if users := mappingValue(doc, "users"); users != nil && users.Kind == yaml.SequenceNode {
+		for _, user := range users.Content {
+			name := mappingValue(user, "name")
+			key := mappingValue(user, "apiKey")
+			if name != nil && key != nil && key.Kind == yaml.ScalarNode {
+				out["user/"+name.Value] = key
+			}
+		}
+	}
+	return out
+}
+
+// maskNode masks the value of the secret node at path, as indexed by secretNodes.
+func maskNode(path, value string) string {
+	if strings.HasPrefix(path, "proxy/") {
+		return maskProxyURL(value)
+	}
+	return maskSecretValue(value)
+}
+
+// redactConfigYAML masks the secrets of a config document, preserving the rest
+// of it, including comments.
+func redactConfigYAML(doc []byte) ([]byte, error) {
+	var root yaml.Node
+	if err := yaml.Unmarshal(doc, &root); err != nil {
+		return nil, fmt.Errorf("parse config yaml: %w", err)
+	}
+	changed := false
+	for path, node := range secretNodes(&root) {
+		if masked := maskNode(path, node.Value); masked != node.Value {
+			node.Value = masked
+			node.Tag = "!!str"
+			node.Style = yaml.DoubleQuotedStyle
+			changed = true
+		}
+	}
+	if !changed {
+		return doc, nil
+	}
+	return encodeYAML(&root)
+}
+
+// unmaskConfigYAML puts back the secrets of original into a submitted document
+// whose values are still masked, so that a config read from the admin API can be
+// saved unchanged. A masked value is matched by location first, then by being
+// the mask of exactly one original secret; a masked value that cannot be matched
+// is rejected rather than written.
+func unmaskConfigYAML(payload, original []byte) ([]byte, error) {
+	if !bytes.Contains(payload, []byte(maskedMarker)) {
+		return payload, nil
+	}
+	var root yaml.Node
+	if err := yaml.Unmarshal(payload, &root); err != nil {
+		// Leave syntax errors to config validation.
+		return payload, nil
+	}
+	var originalRoot yaml.Node
+	if err := yaml.Unmarshal(original, &originalRoot); err != nil {
+		return nil, fmt.Errorf("parse existing config yaml: %w", err)
+	}
+	originals := secretNodes(&originalRoot)
+	byMask := make(map[string][]string)
+	for path, node := range originals {
+		if masked := maskNode(path, node.Value); masked != node.Value {
+			byMask[masked] = append(byMask[masked], node.Value)
+		}
+	}
+
+	changed := false
+	for path, node := range secretNodes(&root) {
+		if !strings.Contains(node.Value, maskedMarker) {
+			continue
+		}
+		if orig, ok := originals[path]; ok && maskNode(path, orig.Value) == node.Value {
+			node.Value = orig.Value
+		} else if candidates := byMask[node.Value]; len(candidates) == 1 {
+			node.Value = candidates[0]
+		} else {
+			return nil, fmt.Errorf("%s: value is masked; enter the full secret", path)
+		}
+		node.Style = 0
+		changed = true
+	}
+	if !changed {
+		return payload, nil
+	}
+	return encodeYAML(&root)
+}
+
+func encodeYAML(root *yaml.Node) ([]byte, error) {
+	var buf bytes.Buffer
+	enc := yaml.NewEncoder(&buf)
+	enc.SetIndent(2)
+	if err := enc.Encode(root); err != nil {
+		return nil, fmt.Errorf("encode config yaml: %w", err)
+	}
+	if err := enc.Close(); err != nil {
+		return nil, fmt.Errorf("encode config yaml: %w", err)
+	}
+	return buf.Bytes(), nil
+}
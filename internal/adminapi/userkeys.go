@@ -0,0 +1,134 @@
+package adminapi
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+
+	"piapi/internal/config"
+)
+
+const maxUserKeyPayloadSize = 4 << 10
+
+// userKeyResponse carries a newly generated key. The key itself is not stored
+// anywhere and cannot be retrieved again.
+type userKeyResponse struct {
+	User       string `json:"user"`
+	APIKey     string `json:"api_key"`
+	APIKeyHash string `json:"api_key_hash"`
+}
+
+// handleRotateUserKey generates a new key for a user, replaces the user's apiKey or
+// apiKeyHash in the config file with the hash of the new key, and returns the key.
+func (h *Handler) handleRotateUserKey(w http.ResponseWriter, r *http.Request) {
+	var body struct {
+		User string `json:"user"`
+	}
+	if err := json.NewDecoder(io.LimitReader(r.Body, maxUserKeyPayloadSize)).Decode(&body); err != nil {
+		h.badRequest(w, fmt.Errorf("decode body: %w", err))
+		return
+	}
+	body.User = strings.TrimSpace(body.User)
+	if body.User == "" {
+		h.badRequest(w, errors.New("user is required"))
+		return
+	}
+
+	key, err := config.GenerateAPIKey()
+	if err != nil {
+		h.internalError(w, err)
+		return
+	}
+	hash, err := config.HashAPIKey(key)
+	if err != nil {
+		h.internalError(w, err)
+		return
+	}
+
+	original, err := os.ReadFile(h.configPath)
+	if err != nil {
+		h.internalError(w, fmt.Errorf("read config: %w", err))
+		return
+	}
+	updated, err := setUserKeyHash(original, body.User, hash)
+	if err != nil {
+		if errors.Is(err, config.ErrUserNotFound) {
+			writeError(w, http.StatusNotFound, err)
+			return
+		}
+		h.badRequest(w, err)
+		return
+	}
+	if err := h.writeConfig(updated); err != nil {
+		h.internalError(w, err)
+		return
+	}
+
+	w.Header().Set("Cache-Control", "no-store")
+	h.writeJSON(w, userKeyResponse{User: body.User, APIKey: key, APIKeyHash: hash}, "user key")
+}
+
+// setUserKeyHash edits the YAML document so that the named user is declared by
+// hash. Other content, including comments, is preserved.
+func setUserKeyHash(doc []byte, userName, hash string) ([]byte, error) {
+	var root yaml.Node
+	if err := yaml.Unmarshal(doc, &root); err != nil {
+		return nil, fmt.Errorf("parse config yaml: %w", err)
+	}
+	if root.Kind != yaml.DocumentNode || len(root.Content) == 0 {
+		return nil, errors.New("config is empty")
+	}
+	users := mappingValue(root.Content[0], "users")
+	if users == nil || users.Kind != yaml.SequenceNode {
+		return nil, fmt.Errorf("%w: '%s'", config.ErrUserNotFound, userName)
+	}
+
+	var target *yaml.Node
+	for _, user := range users.Content {
+		if name := mappingValue(user, "name"); name != nil && name.Value == userName {
+			if target != nil {
+				return nil, fmt.Errorf("user name '%s' is not unique", userName)
+			}
+			target = user
+		}
+	}
+	if target == nil {
+		return nil, fmt.Errorf("%w: '%s'", config.ErrUserNotFound, userName)
+	}
+
+	content := make([]*yaml.Node, 0, len(target.Content)+2)
+	for i := 0; i+1 < len(target.Content); i += 2 {
+		switch target.Content[i].Value {
+		case "apiKey", "apiKeyHash":
+			continue
+		}
+		content = append(content, target.Content[i], target.Content[i+1])
+		if target.Content[i].Value == "name" {
+			content = append(content, scalarNode("apiKeyHash"), scalarNode(hash))
+		}
+	}
+	target.Content = content
+	return encodeYAML(&root)
+}
+
+func mappingValue(node *yaml.Node, key string) *yaml.Node {
+	if node == nil || node.Kind != yaml.MappingNode {
+		return nil
+	}
+	for i := 0; i+1 < len(node.Content); i += 2 {
+		if node.Content[i].Value == key {
+			return node.Content[i+1]
+		}
+	}
+	return nil
+}
+
+func scalarNode(value string) *yaml.Node {
+	return &yaml.Node{Kind: yaml.ScalarNode, Tag: "!!str", Value: value}
+}
@@ -0,0 +1,141 @@
+package config
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"math"
+	"strings"
+)
+
+// Request attributes the consistent_hash strategy can hash.
+const (
+	hashSourceHeader = "header"
+	hashSourceUser   = "user"
+	hashSourcePrompt = "prompt"
+
+	defaultHashHeader       = "X-Session-Id"
+	defaultHashPromptPrefix = 1024
+)
+
+// promptFields are the top-level request fields holding the prompt, in the order
+// they are hashed: Anthropic Messages' system and messages, OpenAI Responses'
+// instructions and input, Chat Completions' messages and legacy completions' prompt.
+// Of a list of messages only the first is hashed, so the value stays the same as
+// the conversation grows.
+var promptFields = []string{"system", "instructions", "messages", "input", "prompt"}
+
+// resolveConsistentHash validates a consistentHash block and fills in defaults.
+func resolveConsistentHash(cfg *ConsistentHashConfig) (ConsistentHashConfig, error) {
+	out := ConsistentHashConfig{}
+	if cfg != nil {
+		out = *cfg
+	}
+	out.Source = strings.ToLower(strings.TrimSpace(out.Source))
+	switch out.Source {
+	case "":
+		out.Source = hashSourceHeader
+	case hashSourceHeader, hashSourceUser, hashSourcePrompt:
+	default:
+		return out, fmt.Errorf("consistentHash.source '%s' is not header, user or prompt", cfg.Source)
+	}
+	out.Header = strings.TrimSpace(out.Header)
+	if out.Header == "" {
+		out.Header = defaultHashHeader
+	}
+	if !validHeaderName(out.Header) {
+		return out, fmt.Errorf("consistentHash.header '%s' is not a valid header name", out.Header)
+	}
+	if out.PromptPrefix < 0 {
+		return out, errors.New("consistentHash.promptPrefix must not be negative")
+	}
+	if out.PromptPrefix == 0 {
+		out.PromptPrefix = defaultHashPromptPrefix
+	}
+	return out, nil
+}
+
+// affinityKey returns the value consistent_hash routes the request on: the
+// configured attribute, or the user when the request does not carry it.
+func affinityKey(cfg ConsistentHashConfig, userID string, opts ResolveOptions) string {
+	switch cfg.Source {
+	case hashSourceHeader:
+		if v := strings.TrimSpace(opts.Header.Get(cfg.Header)); v != "" {
+			return hashSourceHeader + "\x00" + v
+		}
+	case hashSourcePrompt:
+		if prefix := promptPrefix(opts.Body, cfg.PromptPrefix); prefix != "" {
+			return hashSourcePrompt + "\x00" + prefix
+		}
+	}
+	return hashSourceUser + "\x00" + userID
+}
+
+// promptPrefix returns the first n bytes of the system prompt and first message of
+// a JSON request body, as sent. It returns "" when body is not a JSON object.
+func promptPrefix(body []byte, n int) string {
+	var fields map[string]json.RawMessage
+	if err := json.Unmarshal(body, &fields); err != nil {
+		return ""
+	}
+	var b strings.Builder
+	for _, name := range promptFields {
+		if b.Len() >= n {
+			break
+		}
+		value := fields[name]
+		var list []json.RawMessage
+		if err := json.Unmarshal(value, &list); err == nil {
+			value = nil
+			if len(list) > 0 {
+				value = list[0]
+			}
+		}
+		b.Write(value)
+	}
+	prefix := b.String()
+	if len(prefix) > n {
+		prefix = prefix[:n]
+	}
+	return prefix
+}
+
+// pickConsistentHash returns the eligible candidate that ranks highest for key by
+// weighted rendezvous hashing. A candidate's rank depends only on the key and the
+// candidate itself, so one leaving the eligible set moves only the keys it held,
+// and they return to it when it comes back.
+func pickConsistentHash(eligible []*resolvedCandidate, key string) *resolvedCandidate {
+	var (
+		best      *resolvedCandidate
+		bestScore float64
+	)
+	for _, c := range eligible {
+		h := fnv.New64a()
+		h.Write([]byte(key))
+		h.Write([]byte{0})
+		h.Write([]byte(c.id))
+		// Map the hash onto (0, 1); scoring -w/ln(u) gives each candidate a share
+		// of the keys proportional to its weight.
+		u := (float64(mix64(h.Sum64())>>11) + 0.5) / (1 << 53)
+		w := float64(c.weight)
+		if w <= 0 {
+			w = 1
+		}
+		if score := -w / math.Log(u); best == nil || score > bestScore {
+			best, bestScore = c, score
+		}
+	}
+	return best
+}
+
+// mix64 is the splitmix64 finalizer. It spreads FNV hashes of inputs differing
+// only in their last bytes over all 64 bits.
+func mix64(x uint64) uint64 {
+	x ^= x >> 30
+	x *= 0xbf58476d1ce4e5b9
+	x ^= x >> 27
+	x *= 0x94d049bb133111eb
+	x ^= x >> 31
+	return x
+}
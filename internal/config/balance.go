@@ -0,0 +1,103 @@
+package config
+
+import (
+	"math"
+	"math/rand/v2"
+	"sync/atomic"
+	"time"
+)
+
+// latencyEWMAAlpha is the weight of the newest sample in the time-to-first-byte
+// average used by least_latency.
+const latencyEWMAAlpha = 0.2
+
+// recordLatency folds the time to first byte of one response into the key's
+// moving average.
+func (h *keyHealth) recordLatency(ttfb time.Duration) {
+	sample := float64(ttfb) / float64(time.Millisecond)
+	for {
+		old := atomic.LoadUint64(&h.latencyEWMA)
+		next := sample
+		// Zero bits mean no sample yet; the first one is taken as is.
+		if old != 0 {
+			prev := math.Float64frombits(old)
+			next = prev + latencyEWMAAlpha*(sample-prev)
+		}
+		if atomic.CompareAndSwapUint64(&h.latencyEWMA, old, math.Float64bits(next)) {
+			break
+		}
+	}
+	atomic.AddUint64(&h.latencySamples, 1)
+}
+
+// latency returns the average time to first byte in milliseconds, or 0 before the
+// first sample.
+func (h *keyHealth) latency() float64 {
+	return atomicLoadFloat64(&h.latencyEWMA)
+}
+
+// outstanding returns the requests routed to the key that were not released yet.
+func (h *keyHealth) outstanding() int64 {
+	return atomic.LoadInt64(&h.inFlight)
+}
+
+// ReportLatency records the time to first byte of a successful upstream response of
+// a provider key. It feeds the least_latency strategy of every route using the key.
+func (m *Manager) ReportLatency(serviceType, providerName, providerKeyName string, ttfb time.Duration) {
+	m.mu.RLock()
+	data := m.data
+	m.mu.RUnlock()
+	if data == nil {
+		return
+	}
+	if h, ok := data.health[keyHealthID{provider: providerName, keyName: providerKeyName, serviceType: serviceType}]; ok {
+		h.recordLatency(ttfb)
+	}
+}
+
+// latencyExploreInterval is how often least_latency sends a pick to the next
+// candidate in rotation instead of the fastest, so that the average of a slow key
+// that recovered is brought up to date.
+const latencyExploreInterval = 20
+
+// pickLeastLatency returns the eligible candidate with the lowest average time to
+// first byte. Candidates without a sample count as fastest, so that each gets
+// measured; ties are broken in rotation. Every latencyExploreInterval-th pick goes
+// to the candidates in turn regardless of their latency.
+func pickLeastLatency(svc *resolvedUserService, eligible []*resolvedCandidate) *resolvedCandidate {
+	n := atomic.AddUint64(&svc.rrCounter, 1) - 1
+	if n%latencyExploreInterval == latencyExploreInterval-1 {
+		return eligible[int((n/latencyExploreInterval)%uint64(len(eligible)))]
+	}
+	offset := int(n % uint64(len(eligible)))
+	var (
+		best        *resolvedCandidate
+		bestLatency float64
+	)
+	for i := range eligible {
+		c := eligible[(offset+i)%len(eligible)]
+		if latency := c.health.latency(); best == nil || latency < bestLatency {
+			best, bestLatency = c, latency
+		}
+	}
+	return best
+}
+
+// pickLeastOutstanding samples two eligible candidates at random and returns the one
+// with fewer requests in flight, which spreads load nearly as well as scanning every
+// candidate without herding concurrent picks onto the same one.
+func pickLeastOutstanding(eligible []*resolvedCandidate) *resolvedCandidate {
+	if len(eligible) == 1 {
+		return eligible[0]
+	}
+	i := rand.IntN(len(eligible))
+	j := rand.IntN(len(eligible) - 1)
+	if j >= i {
+		j++
+	}
+	a, b := eligible[i], eligible[j]
+	if b.health.outstanding() < a.health.outstanding() {
+		return b
+	}
+	return a
+}
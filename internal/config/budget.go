@@ -0,0 +1,38 @@
+package config
+
+import "fmt"
+
+// Cost estimates the price of a request from its token counts. A nil pricing is free.
+func (p *PricingConfig) Cost(promptTokens, completionTokens, cacheReadTokens, cacheWriteTokens int64) float64 {
+	if p == nil {
+		return 0
+	}
+	const perTokens = 1_000_000
+	return (float64(promptTokens)*p.Prompt +
+		float64(completionTokens)*p.Completion +
+		float64(cacheReadTokens)*p.CacheRead +
+		float64(cacheWriteTokens)*p.CacheWrite) / perTokens
+}
+
+func validatePricing(p *PricingConfig) error {
+	if p == nil {
+		return nil
+	}
+	if p.Prompt < 0 || p.Completion < 0 || p.CacheRead < 0 || p.CacheWrite < 0 {
+		return fmt.Errorf("pricing must not be negative")
+	}
+	return nil
+}
+
+func validateBudget(b *BudgetConfig) error {
+	if b == nil {
+		return nil
+	}
+	if l := b.Daily; l != nil && (l.Tokens < 0 || l.Cost < 0) {
+		return fmt.Errorf("budget.daily must not be negative")
+	}
+	if l := b.Monthly; l != nil && (l.Tokens < 0 || l.Cost < 0) {
+		return fmt.Errorf("budget.monthly must not be negative")
+	}
+	return nil
+}
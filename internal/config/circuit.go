@@ -0,0 +1,264 @@
+package config
+
+import (
+	"fmt"
+	"math/rand/v2"
+	"sync"
+	"time"
+
+	"piapi/internal/metrics"
+)
+
+const (
+	defaultBreakerFailureThreshold = 1
+	defaultBreakerWindow           = 60 * time.Second
+	defaultBreakerOpenTimeout      = 30 * time.Second
+	defaultBreakerMaxOpenTimeout   = 10 * time.Minute
+	defaultBreakerHalfOpenRequests = 1
+
+	// breakerJitter is the fraction by which open durations are varied, so that keys
+	// opened together are not retried together.
+	breakerJitter = 0.2
+)
+
+// circuitState is the state of a circuit breaker. The values are those exported by
+// the piapi_circuit_state gauge.
+type circuitState int
+
+const (
+	circuitClosed circuitState = iota
+	circuitHalfOpen
+	circuitOpen
+)
+
+func (s circuitState) String() string {
+	switch s {
+	case circuitHalfOpen:
+		return "half_open"
+	case circuitOpen:
+		return "open"
+	default:
+		return "closed"
+	}
+}
+
+// resolveCircuitBreaker validates a circuitBreaker block and fills in defaults.
+func resolveCircuitBreaker(cfg *CircuitBreakerConfig) (CircuitBreakerConfig, error) {
+	out := CircuitBreakerConfig{}
+	if cfg != nil {
+		if cfg.FailureThreshold < 0 {
+			return out, fmt.Errorf("circuitBreaker.failureThreshold must not be negative")
+		}
+		if cfg.HalfOpenRequests < 0 {
+			return out, fmt.Errorf("circuitBreaker.halfOpenRequests must not be negative")
+		}
+		out = *cfg
+	}
+	if out.FailureThreshold == 0 {
+		out.FailureThreshold = defaultBreakerFailureThreshold
+	}
+	if out.Window == 0 {
+		out.Window = Duration(defaultBreakerWindow)
+	}
+	if out.OpenTimeout == 0 {
+		out.OpenTimeout = Duration(defaultBreakerOpenTimeout)
+	}
+	if out.MaxOpenTimeout == 0 {
+		out.MaxOpenTimeout = Duration(defaultBreakerMaxOpenTimeout)
+		if out.MaxOpenTimeout < out.OpenTimeout {
+			out.MaxOpenTimeout = out.OpenTimeout
+		}
+	}
+	if out.MaxOpenTimeout < out.OpenTimeout {
+		return out, fmt.Errorf("circuitBreaker.maxOpenTimeout must not be shorter than openTimeout")
+	}
+	if out.HalfOpenRequests == 0 {
+		out.HalfOpenRequests = defaultBreakerHalfOpenRequests
+	}
+	return out, nil
+}
+
+// circuitBreaker tracks the state of one provider key for one service type.
+type circuitBreaker struct {
+	mu       sync.Mutex
+	settings CircuitBreakerConfig
+	state    circuitState
+	// failures holds the times of recent failures while closed, oldest first.
+	failures  []time.Time
+	openUntil time.Time
+	// reopens counts failed trials since the circuit last closed; it is the
+	// exponent of the open duration.
+	reopens int
+	// trials and successes count the trial requests admitted and succeeded in the
+	// current half-open period; lastTrial is when the latest one was admitted.
+	trials    int
+	successes int
+	lastTrial time.Time
+	// onChange, when set, is told about every state transition.
+	onChange func(circuitState)
+}
+
+func (b *circuitBreaker) setSettings(settings CircuitBreakerConfig) {
+	b.mu.Lock()
+	b.settings = settings
+	b.mu.Unlock()
+}
+
+// available reports whether a request could be admitted at now, without taking a
+// trial slot.
+func (b *circuitBreaker) available(now time.Time) bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	switch b.state {
+	case circuitOpen:
+		return !now.Before(b.openUntil)
+	case circuitHalfOpen:
+		return b.trialAvailable(now)
+	default:
+		return true
+	}
+}
+
+// admit lets a request through, turning an expired open circuit half-open and
+// taking a trial slot while half-open. It reports false when the request must go
+// elsewhere.
+func (b *circuitBreaker) admit(now time.Time) bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	switch b.state {
+	case circuitClosed:
+		return true
+	case circuitOpen:
+		if now.Before(b.openUntil) {
+			return false
+		}
+		b.trials, b.successes = 0, 0
+		b.transition(circuitHalfOpen)
+	}
+	if !b.trialAvailable(now) {
+		return false
+	}
+	if b.trials >= b.settings.HalfOpenRequests {
+		// The earlier trials never reported back; start over.
+		b.trials, b.successes = 0, 0
+	}
+	b.trials++
+	b.lastTrial = now
+	return true
+}
+
+// trialAvailable reports whether a half-open circuit has a trial slot. Slots taken
+// by trials that did not report within OpenTimeout are given back.
+func (b *circuitBreaker) trialAvailable(now time.Time) bool {
+	return b.trials < b.settings.HalfOpenRequests || now.Sub(b.lastTrial) >= b.settings.OpenTimeout.Std()
+}
+
+// record applies the outcome of a call. Results reported while open come from
+// requests started before the circuit opened and are ignored.
+func (b *circuitBreaker) record(now time.Time, failure bool) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	switch b.state {
+	case circuitClosed:
+		if !failure {
+			return
+		}
+		cutoff := now.Add(-b.settings.Window.Std())
+		kept := b.failures[:0]
+		for _, t := range b.failures {
+			if t.After(cutoff) {
+				kept = append(kept, t)
+			}
+		}
+		b.failures = append(kept, now)
+		if len(b.failures) >= b.settings.FailureThreshold {
+			b.open(now)
+		}
+	case circuitHalfOpen:
+		if failure {
+			b.reopens++
+			b.open(now)
+			return
+		}
+		b.successes++
+		if b.successes >= b.settings.HalfOpenRequests {
+			b.failures = nil
+			b.reopens = 0
+			b.transition(circuitClosed)
+		}
+	}
+}
+
+// release gives back the trial slot of a call whose outcome says nothing about the
+// key's health, such as a 429, without counting it as a success or a failure.
+func (b *circuitBreaker) release() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.state == circuitHalfOpen && b.trials > 0 {
+		b.trials--
+	}
+}
+
+// reset closes the circuit, as after a passing health check.
+func (b *circuitBreaker) reset() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.state == circuitClosed {
+		return
+	}
+	b.failures = nil
+	b.reopens = 0
+	b.transition(circuitClosed)
+}
+
+func (b *circuitBreaker) open(now time.Time) {
+	d := b.settings.OpenTimeout.Std()
+	for i := 0; i < b.reopens && d < b.settings.MaxOpenTimeout.Std(); i++ {
+		d *= 2
+	}
+	if limit := b.settings.MaxOpenTimeout.Std(); d > limit {
+		d = limit
+	}
+	d = time.Duration(float64(d) * (1 - breakerJitter + 2*breakerJitter*rand.Float64()))
+	b.openUntil = now.Add(d)
+	b.failures = nil
+	b.transition(circuitOpen)
+}
+
+func (b *circuitBreaker) transition(state circuitState) {
+	if b.state == state {
+		return
+	}
+	b.state = state
+	if b.onChange != nil {
+		b.onChange(state)
+	}
+}
+
+// snapshot returns the state and, while open, when the circuit may turn half-open.
+func (b *circuitBreaker) snapshot() (circuitState, *time.Time) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.state != circuitOpen {
+		return b.state, nil
+	}
+	until := b.openUntil
+	return b.state, &until
+}
+
+// publishCircuitStates exports the breaker state of every provider key of next and
+// drops the series of keys that are no longer configured.
+func (next *resolvedConfig) publishCircuitStates(prev *resolvedConfig) {
+	for _, h := range next.health {
+		state, _ := h.breaker.snapshot()
+		metrics.SetCircuitState(h.id.serviceType, h.id.provider, h.id.keyName, int(state))
+	}
+	if prev == nil {
+		return
+	}
+	for id := range prev.health {
+		if _, ok := next.health[id]; !ok {
+			metrics.ForgetCircuit(id.serviceType, id.provider, id.keyName)
+		}
+	}
+}
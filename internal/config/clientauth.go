@@ -0,0 +1,54 @@
+package config
+
+import (
+	"fmt"
+	"strings"
+)
+
+// DefaultClientAuthStyles are accepted by service types without a clientAuth entry.
+var DefaultClientAuthStyles = []string{ClientAuthBearer, ClientAuthXAPIKey, ClientAuthXGoogAPIKey}
+
+// resolveClientAuth validates the clientAuth section and returns the styles of each
+// configured service type.
+func resolveClientAuth(raw map[string]ClientAuthConfig) (map[string][]string, error) {
+	out := make(map[string][]string, len(raw))
+	for serviceType, cfg := range raw {
+		trimmedType := strings.TrimSpace(serviceType)
+		if trimmedType == "" {
+			return nil, fmt.Errorf("clientAuth: service type must not be empty")
+		}
+		if len(cfg.Styles) == 0 {
+			return nil, fmt.Errorf("clientAuth '%s': styles must not be empty", trimmedType)
+		}
+		styles := make([]string, 0, len(cfg.Styles))
+		seen := make(map[string]struct{}, len(cfg.Styles))
+		for _, style := range cfg.Styles {
+			style = strings.ToLower(strings.TrimSpace(style))
+			switch style {
+			case ClientAuthBearer, ClientAuthXAPIKey, ClientAuthXGoogAPIKey, ClientAuthQuery:
+			default:
+				return nil, fmt.Errorf("clientAuth '%s': unsupported style '%s'", trimmedType, style)
+			}
+			if _, dup := seen[style]; dup {
+				continue
+			}
+			seen[style] = struct{}{}
+			styles = append(styles, style)
+		}
+		out[trimmedType] = styles
+	}
+	return out, nil
+}
+
+// ClientAuthStyles returns the credential styles accepted for serviceType.
+func (m *Manager) ClientAuthStyles(serviceType string) []string {
+	m.mu.RLock()
+	data := m.data
+	m.mu.RUnlock()
+	if data != nil {
+		if styles, ok := data.clientAuth[serviceType]; ok {
+			return styles
+		}
+	}
+	return DefaultClientAuthStyles
+}
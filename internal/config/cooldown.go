@@ -0,0 +1,203 @@
+package config
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"piapi/internal/metrics"
+)
+
+const (
+	defaultUpstreamCooldown    = 30 * time.Second
+	defaultUpstreamMaxCooldown = 10 * time.Minute
+)
+
+// resolveUpstreamRateLimit validates an upstreamRateLimit block and fills in defaults.
+func resolveUpstreamRateLimit(cfg *UpstreamRateLimitConfig) (UpstreamRateLimitConfig, error) {
+	out := UpstreamRateLimitConfig{}
+	if cfg != nil {
+		if cfg.DefaultCooldown < 0 || cfg.MaxCooldown < 0 {
+			return out, fmt.Errorf("upstreamRateLimit cooldowns must not be negative")
+		}
+		if cfg.MinRemainingRequests < 0 || cfg.MinRemainingTokens < 0 {
+			return out, fmt.Errorf("upstreamRateLimit remaining thresholds must not be negative")
+		}
+		out = *cfg
+	}
+	if out.DefaultCooldown == 0 {
+		out.DefaultCooldown = Duration(defaultUpstreamCooldown)
+	}
+	if out.MaxCooldown == 0 {
+		out.MaxCooldown = Duration(defaultUpstreamMaxCooldown)
+		if out.MaxCooldown < out.DefaultCooldown {
+			out.MaxCooldown = out.DefaultCooldown
+		}
+	}
+	if out.MaxCooldown < out.DefaultCooldown {
+		return out, fmt.Errorf("upstreamRateLimit.maxCooldown must not be shorter than defaultCooldown")
+	}
+	return out, nil
+}
+
+// quotaHeader names the remaining-quota and reset headers of one provider limit.
+type quotaHeader struct {
+	remaining string
+	reset     string
+	tokens    bool
+}
+
+var quotaHeaders = []quotaHeader{
+	// OpenAI and compatible APIs report resets as durations such as "6m0s".
+	{remaining: "X-Ratelimit-Remaining-Requests", reset: "X-Ratelimit-Reset-Requests"},
+	{remaining: "X-Ratelimit-Remaining-Tokens", reset: "X-Ratelimit-Reset-Tokens", tokens: true},
+	// Anthropic reports resets as RFC 3339 times.
+	{remaining: "Anthropic-Ratelimit-Requests-Remaining", reset: "Anthropic-Ratelimit-Requests-Reset"},
+	{remaining: "Anthropic-Ratelimit-Tokens-Remaining", reset: "Anthropic-Ratelimit-Tokens-Reset", tokens: true},
+	{remaining: "Anthropic-Ratelimit-Input-Tokens-Remaining", reset: "Anthropic-Ratelimit-Input-Tokens-Reset", tokens: true},
+	{remaining: "Anthropic-Ratelimit-Output-Tokens-Remaining", reset: "Anthropic-Ratelimit-Output-Tokens-Reset", tokens: true},
+}
+
+// Reasons a key is cooled down, as exported by piapi_key_cooldowns_total.
+const (
+	cooldownRateLimited = "rate_limited"
+	cooldownLowQuota    = "low_quota"
+)
+
+// rateLimitCooldown returns until when a key that answered with status and header
+// should not be selected, and why. It returns the zero time when the response
+// calls for no cooldown.
+func rateLimitCooldown(now time.Time, status int, header http.Header, settings UpstreamRateLimitConfig) (time.Time, string) {
+	var until time.Time
+	for _, q := range quotaHeaders {
+		remaining, err := strconv.ParseInt(strings.TrimSpace(header.Get(q.remaining)), 10, 64)
+		if err != nil {
+			continue
+		}
+		threshold := settings.MinRemainingRequests
+		if q.tokens {
+			threshold = settings.MinRemainingTokens
+		}
+		if remaining > threshold {
+			continue
+		}
+		if reset, ok := parseQuotaReset(now, header.Get(q.reset)); ok && reset.After(until) {
+			until = reset
+		}
+	}
+
+	reason := cooldownLowQuota
+	if status == http.StatusTooManyRequests {
+		reason = cooldownRateLimited
+		// Retry-After is the upstream's own answer; the quota resets are a fallback.
+		if after, ok := parseRetryAfter(now, header); ok {
+			until = after
+		}
+		if !until.After(now) {
+			until = now.Add(settings.DefaultCooldown.Std())
+		}
+	}
+	if !until.After(now) {
+		return time.Time{}, ""
+	}
+	if limit := now.Add(settings.MaxCooldown.Std()); until.After(limit) {
+		until = limit
+	}
+	return until, reason
+}
+
+// parseRetryAfter reads retry-after-ms, sent by OpenAI, or Retry-After in seconds
+// or as an HTTP date.
+func parseRetryAfter(now time.Time, header http.Header) (time.Time, bool) {
+	if v := strings.TrimSpace(header.Get("Retry-After-Ms")); v != "" {
+		if ms, err := strconv.ParseFloat(v, 64); err == nil && ms >= 0 {
+			return now.Add(time.Duration(ms * float64(time.Millisecond))), true
+		}
+	}
+	v := strings.TrimSpace(header.Get("Retry-After"))
+	if v == "" {
+		return time.Time{}, false
+	}
+	if seconds, err := strconv.ParseInt(v, 10, 64); err == nil && seconds >= 0 {
+		return now.Add(time.Duration(seconds) * time.Second), true
+	}
+	if t, err := http.ParseTime(v); err == nil {
+		return t, true
+	}
+	return time.Time{}, false
+}
+
+// parseQuotaReset reads a reset header given as an RFC 3339 time, a Go-style
+// duration or a number of seconds.
+func parseQuotaReset(now time.Time, v string) (time.Time, bool) {
+	v = strings.TrimSpace(v)
+	if v == "" {
+		return time.Time{}, false
+	}
+	if t, err := time.Parse(time.RFC3339, v); err == nil {
+		return t, true
+	}
+	if d, err := time.ParseDuration(v); err == nil && d >= 0 {
+		return now.Add(d), true
+	}
+	if seconds, err := strconv.ParseFloat(v, 64); err == nil && seconds >= 0 {
+		return now.Add(time.Duration(seconds * float64(time.Second))), true
+	}
+	return time.Time{}, false
+}
+
+// coolDown keeps the key from being selected until until, unless it already is for
+// longer. It reports whether the key was selectable before.
+func (h *keyHealth) coolDown(now, until time.Time) bool {
+	for {
+		current := atomic.LoadInt64(&h.cooldownUntil)
+		if current >= until.UnixNano() {
+			return false
+		}
+		if atomic.CompareAndSwapInt64(&h.cooldownUntil, current, until.UnixNano()) {
+			return current <= now.UnixNano()
+		}
+	}
+}
+
+// cooldown returns the end of the key's cooldown, or nil when it is not cooling down.
+func (h *keyHealth) cooldown(now time.Time) *time.Time {
+	until := atomic.LoadInt64(&h.cooldownUntil)
+	if until <= now.UnixNano() {
+		return nil
+	}
+	t := time.Unix(0, until)
+	return &t
+}
+
+// available reports whether the key may be selected at now.
+func (h *keyHealth) available(now time.Time) bool {
+	return atomic.LoadInt64(&h.invalidSince) == 0 && h.cooldown(now) == nil && h.breaker.available(now)
+}
+
+// ReportRateLimits applies the rate-limit signals of an upstream response to the
+// provider key that received it. A 429, or a remaining quota at or below the
+// service's threshold, cools the key down for every route that uses it.
+func (m *Manager) ReportRateLimits(serviceType, providerName, providerKeyName string, status int, header http.Header) {
+	m.mu.RLock()
+	data := m.data
+	m.mu.RUnlock()
+	if data == nil {
+		return
+	}
+	h, ok := data.health[keyHealthID{provider: providerName, keyName: providerKeyName, serviceType: serviceType}]
+	if !ok {
+		return
+	}
+	now := time.Now()
+	until, reason := rateLimitCooldown(now, status, header, *h.rateLimit.Load())
+	if until.IsZero() {
+		return
+	}
+	if h.coolDown(now, until) {
+		metrics.ObserveKeyCooldown(serviceType, providerName, reason)
+	}
+}
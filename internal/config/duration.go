@@ -0,0 +1,97 @@
+package config
+
+import (
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+// Duration is a time.Duration that is written as a Go duration string ("30s", "5m")
+// in both YAML and JSON so config snapshots stay human-readable.
+type Duration time.Duration
+
+// Std returns the value as a time.Duration.
+func (d Duration) Std() time.Duration {
+	return time.Duration(d)
+}
+
+// String implements fmt.Stringer.
+func (d Duration) String() string {
+	return time.Duration(d).String()
+}
+
+// IsZero reports whether the duration is unset; used by omitempty.
+func (d Duration) IsZero() bool {
+	return d == 0
+}
+
+// UnmarshalYAML accepts duration strings and plain integers (interpreted as seconds).
+func (d *Duration) UnmarshalYAML(node *yaml.Node) error {
+	var raw string
+	if err := node.Decode(&raw); err != nil {
+		return err
+	}
+	parsed, err := parseDuration(raw)
+	if err != nil {
+		return err
+	}
+	*d = parsed
+	return nil
+}
+
+// MarshalYAML implements yaml.Marshaler.
+func (d Duration) MarshalYAML() (interface{}, error) {
+	return d.String(), nil
+}
+
+// MarshalJSON implements json.Marshaler.
+func (d Duration) MarshalJSON() ([]byte, error) {
+	return json.Marshal(d.String())
+}
+
+// UnmarshalJSON implements json.Unmarshaler.
+func (d *Duration) UnmarshalJSON(b []byte) error {
+	var raw interface{}
+	if err := json.Unmarshal(b, &raw); err != nil {
+		return err
+	}
+	switch v := raw.(type) {
+	case string:
+		parsed, err := parseDuration(v)
+		if err != nil {
+			return err
+		}
+		*d = parsed
+	case float64:
+		*d = Duration(time.Duration(v * float64(time.Second)))
+	case nil:
+		*d = 0
+	default:
+		return fmt.Errorf("invalid duration %v", raw)
+	}
+	return nil
+}
+
+func parseDuration(raw string) (Duration, error) {
+	raw = strings.TrimSpace(raw)
+	if raw == "" {
+		return 0, nil
+	}
+	if parsed, err := time.ParseDuration(raw); err == nil {
+		if parsed < 0 {
+			return 0, fmt.Errorf("duration %q must not be negative", raw)
+		}
+		return Duration(parsed), nil
+	}
+	if seconds, err := strconv.ParseInt(raw, 10, 64); err == nil {
+		if seconds < 0 {
+			return 0, fmt.Errorf("duration %q must not be negative", raw)
+		}
+		return Duration(time.Duration(seconds) * time.Second), nil
+	}
+	return 0, fmt.Errorf("invalid duration %q", raw)
+}
@@ -9,4 +9,16 @@ var (
     ErrUserNotFound        = errors.New("user api key not found")
     ErrServiceNotFound     = errors.New("service type not found")
     ErrNoActiveUpstream    = errors.New("no active upstream candidate")
+    ErrRateLimited         = errors.New("rate limit exceeded")
+    ErrModelNotSupported   = errors.New("model not supported")
+    // ErrUpstreamTimeout is wrapped by errors passed to ReportResult when an
+    // upstream call exceeded one of its service's timeouts.
+    ErrUpstreamTimeout     = errors.New("upstream timeout")
+    ErrProviderKeyNotFound = errors.New("provider key not found")
+    // ErrUpstreamBusy is returned by Resolve when every candidate is at its key's
+    // concurrency limit and the request could not be queued, or timed out queueing.
+    ErrUpstreamBusy        = errors.New("upstream keys busy")
+    // ErrUpstreamAuth is passed to ReportResult with a 403 response whose error
+    // body says the upstream rejected the key, rather than the request.
+    ErrUpstreamAuth        = errors.New("upstream rejected provider key")
 )
@@ -0,0 +1,255 @@
+package config
+
+import (
+	"fmt"
+	"net/http"
+	"net/textproto"
+	"strings"
+)
+
+// HeaderTemplateVars lists the placeholders header values may use, written as
+// "{{name}}".
+var HeaderTemplateVars = []string{
+	"user",           // user name
+	"request_id",     // gateway request ID
+	"service",        // service type
+	"provider",       // provider name
+	"provider_key",   // provider key name, never its value
+	"model",          // requested model after aliases
+	"upstream_model", // model sent upstream
+}
+
+// protectedHeaders are managed by the HTTP transport and cannot be changed by a
+// header policy.
+var protectedHeaders = map[string]struct{}{
+	"Host":              {},
+	"Content-Length":    {},
+	"Transfer-Encoding": {},
+	"Connection":        {},
+}
+
+// normalizeHeaderPolicy validates a header policy and canonicalizes its header
+// names. It returns nil for an empty policy.
+func normalizeHeaderPolicy(p *HeaderPolicy) (*HeaderPolicy, error) {
+	if p == nil {
+		return nil, nil
+	}
+	request, err := normalizeHeaderRules(p.Request)
+	if err != nil {
+		return nil, fmt.Errorf("headers.request: %w", err)
+	}
+	response, err := normalizeHeaderRules(p.Response)
+	if err != nil {
+		return nil, fmt.Errorf("headers.response: %w", err)
+	}
+	if request == nil && response == nil {
+		return nil, nil
+	}
+	return &HeaderPolicy{Request: request, Response: response}, nil
+}
+
+func normalizeHeaderRules(r *HeaderRules) (*HeaderRules, error) {
+	if r == nil || (len(r.Set) == 0 && len(r.Add) == 0 && len(r.Remove) == 0) {
+		return nil, nil
+	}
+	out := &HeaderRules{}
+	var err error
+	if out.Set, err = normalizeHeaderValues(r.Set, "set"); err != nil {
+		return nil, err
+	}
+	if out.Add, err = normalizeHeaderValues(r.Add, "add"); err != nil {
+		return nil, err
+	}
+	for _, name := range r.Remove {
+		canonical, err := canonicalHeaderName(name)
+		if err != nil {
+			return nil, fmt.Errorf("remove: %w", err)
+		}
+		out.Remove = append(out.Remove, canonical)
+	}
+	return out, nil
+}
+
+func normalizeHeaderValues(values map[string]string, field string) (map[string]string, error) {
+	if len(values) == 0 {
+		return nil, nil
+	}
+	out := make(map[string]string, len(values))
+	for name, value := range values {
+		canonical, err := canonicalHeaderName(name)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", field, err)
+		}
+		if _, dup := out[canonical]; dup {
+			return nil, fmt.Errorf("%s: duplicate header '%s'", field, canonical)
+		}
+		if sanitizeHeaderValue(value) != value {
+			return nil, fmt.Errorf("%s: header '%s' has an invalid value", field, canonical)
+		}
+		if err := validateHeaderTemplate(value); err != nil {
+			return nil, fmt.Errorf("%s: header '%s': %w", field, canonical, err)
+		}
+		out[canonical] = value
+	}
+	return out, nil
+}
+
+func canonicalHeaderName(name string) (string, error) {
+	name = strings.TrimSpace(name)
+	if !validHeaderName(name) {
+		return "", fmt.Errorf("invalid header name '%s'", name)
+	}
+	canonical := textproto.CanonicalMIMEHeaderKey(name)
+	if _, ok := protectedHeaders[canonical]; ok {
+		return "", fmt.Errorf("header '%s' cannot be changed", canonical)
+	}
+	return canonical, nil
+}
+
+// validHeaderName reports whether name is an RFC 7230 token.
+func validHeaderName(name string) bool {
+	if name == "" {
+		return false
+	}
+	for _, r := range name {
+		switch {
+		case r >= 'a' && r <= 'z', r >= 'A' && r <= 'Z', r >= '0' && r <= '9':
+		case strings.ContainsRune("!#$%&'*+-.^_`|~", r):
+		default:
+			return false
+		}
+	}
+	return true
+}
+
+// validateHeaderTemplate checks that every "{{...}}" placeholder in value is known.
+func validateHeaderTemplate(value string) error {
+	for rest := value; ; {
+		start := strings.Index(rest, "{{")
+		if start < 0 {
+			return nil
+		}
+		end := strings.Index(rest[start:], "}}")
+		if end < 0 {
+			return fmt.Errorf("unterminated placeholder in '%s'", value)
+		}
+		name := strings.TrimSpace(rest[start+2 : start+end])
+		known := false
+		for _, v := range HeaderTemplateVars {
+			if v == name {
+				known = true
+				break
+			}
+		}
+		if !known {
+			return fmt.Errorf("unknown placeholder '{{%s}}'", name)
+		}
+		rest = rest[start+end+2:]
+	}
+}
+
+// mergeHeaderPolicies layers policies from least to most specific. For the same
+// header, a more specific Set or Add replaces a less specific one, and a more
+// specific Remove drops the less specific Set and Add.
+func mergeHeaderPolicies(layers ...*HeaderPolicy) *HeaderPolicy {
+	var request, response []*HeaderRules
+	for _, layer := range layers {
+		if layer != nil {
+			request = append(request, layer.Request)
+			response = append(response, layer.Response)
+		}
+	}
+	merged := &HeaderPolicy{Request: mergeHeaderRules(request), Response: mergeHeaderRules(response)}
+	if merged.Request == nil && merged.Response == nil {
+		return nil
+	}
+	return merged
+}
+
+func mergeHeaderRules(layers []*HeaderRules) *HeaderRules {
+	var out *HeaderRules
+	for _, layer := range layers {
+		if layer == nil {
+			continue
+		}
+		if out == nil {
+			out = &HeaderRules{}
+		}
+		for _, name := range layer.Remove {
+			delete(out.Set, name)
+			delete(out.Add, name)
+			out.Remove = appendUnique(out.Remove, name)
+		}
+		for name, value := range layer.Set {
+			if out.Set == nil {
+				out.Set = make(map[string]string)
+			}
+			out.Set[name] = value
+		}
+		for name, value := range layer.Add {
+			if out.Add == nil {
+				out.Add = make(map[string]string)
+			}
+			out.Add[name] = value
+		}
+	}
+	return out
+}
+
+func appendUnique(list []string, value string) []string {
+	for _, v := range list {
+		if v == value {
+			return list
+		}
+	}
+	return append(list, value)
+}
+
+// Apply rewrites h according to the rules, expanding placeholders with vars.
+func (r *HeaderRules) Apply(h http.Header, vars map[string]string) {
+	if r == nil {
+		return
+	}
+	for _, name := range r.Remove {
+		h.Del(name)
+	}
+	for name, value := range r.Set {
+		h.Set(name, expandHeaderTemplate(value, vars))
+	}
+	for name, value := range r.Add {
+		h.Add(name, expandHeaderTemplate(value, vars))
+	}
+}
+
+func expandHeaderTemplate(value string, vars map[string]string) string {
+	if !strings.Contains(value, "{{") {
+		return value
+	}
+	var b strings.Builder
+	for {
+		start := strings.Index(value, "{{")
+		if start < 0 {
+			break
+		}
+		end := strings.Index(value[start:], "}}")
+		if end < 0 {
+			break
+		}
+		b.WriteString(value[:start])
+		b.WriteString(sanitizeHeaderValue(vars[strings.TrimSpace(value[start+2:start+end])]))
+		value = value[start+end+2:]
+	}
+	b.WriteString(value)
+	return b.String()
+}
+
+// sanitizeHeaderValue drops characters that are not allowed in header values, so a
+// user name or model cannot inject headers.
+func sanitizeHeaderValue(s string) string {
+	return strings.Map(func(r rune) rune {
+		if r == '\t' || (r >= 0x20 && r != 0x7f) {
+			return r
+		}
+		return -1
+	}, s)
+}
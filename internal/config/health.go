@@ -0,0 +1,304 @@
+package config
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"math"
+	"net/http"
+	"sort"
+	"sync/atomic"
+	"time"
+
+	"piapi/internal/metrics"
+)
+
+// keyHealthID identifies a provider key as used for one service type.
+type keyHealthID struct {
+	provider    string
+	keyName     string
+	serviceType string
+}
+
+// keyHealth is the health state shared by every candidate that routes to the same
+// provider key for the same service type, regardless of which user owns the route.
+type keyHealth struct {
+	id keyHealthID
+	// fingerprint identifies the key value and upstream endpoint; state is only
+	// carried across reloads when it is unchanged.
+	fingerprint string
+	// secret identifies the key value alone. The invalid mark follows it across
+	// reloads, so that only a new key value or EnableKey re-enables a revoked key.
+	secret string
+
+	breaker circuitBreaker
+	// rateLimit holds the service's upstreamRateLimit settings, and cooldownUntil
+	// the time in Unix nanoseconds until which the upstream rate limits the key.
+	rateLimit     atomic.Pointer[UpstreamRateLimitConfig]
+	cooldownUntil int64
+	// authFailures counts consecutive 401 and 403 responses. invalidSince, the time
+	// in Unix nanoseconds the key was marked invalid, and invalidStatus, the status
+	// that did it, are zero while the key is valid.
+	authFailures  int64
+	invalidSince  int64
+	invalidStatus int64
+	// probe is the outcome of the latest health check, if the service has one.
+	probe atomic.Pointer[HealthCheckStatus]
+	// latencyEWMA is the moving average of the time to first byte in milliseconds
+	// (float64 bits, zero before the first of latencySamples), and inFlight counts
+	// the routes resolved to the key and not released yet.
+	latencyEWMA    uint64
+	latencySamples uint64
+	inFlight       int64
+
+	totalRequests uint64
+	totalErrors   uint64
+	totalTimeouts uint64
+	lastStatus    int64
+	lastUpdated   int64
+	lastError     atomic.Value
+	// Adaptive error rate smoothing parameters
+	adaptiveLastUpdate int64
+	adaptiveFailures   uint64 // float64 bits
+	adaptiveSamples    uint64 // float64 bits
+	adaptiveErrorRate  uint64 // float64 bits cache
+}
+
+// healthRegistry indexes keyHealth entries of one resolved configuration.
+type healthRegistry map[keyHealthID]*keyHealth
+
+// forKey returns the shared entry for a key of provider, creating it on first use.
+// It is only called while parsing, before the configuration is published.
+func (r healthRegistry) forKey(provider *resolvedProvider, keyName, serviceType string) *keyHealth {
+	name := provider.provider.Name
+	id := keyHealthID{provider: name, keyName: keyName, serviceType: serviceType}
+	h, ok := r[id]
+	if !ok {
+		h = &keyHealth{
+			id:          id,
+			fingerprint: keyFingerprint(provider.keys[keyName], provider.services[serviceType]),
+			secret:      secretFingerprint(provider.keys[keyName]),
+		}
+		h.breaker.settings = provider.breakers[serviceType]
+		h.breaker.onChange = func(state circuitState) {
+			metrics.SetCircuitState(serviceType, name, keyName, int(state))
+		}
+		rateLimit := provider.rateLimits[serviceType]
+		h.rateLimit.Store(&rateLimit)
+		r[id] = h
+	}
+	return h
+}
+
+// keyFingerprint hashes what makes a provider key a distinct upstream identity,
+// without keeping another plaintext copy of the secret around.
+func keyFingerprint(keyValue string, svc Service) string {
+	sum := sha256.Sum256([]byte(keyValue + "\x00" + svc.BaseURL))
+	return hex.EncodeToString(sum[:])
+}
+
+// secretFingerprint hashes a key value on its own.
+func secretFingerprint(keyValue string) string {
+	sum := sha256.Sum256([]byte(keyValue))
+	return hex.EncodeToString(sum[:])
+}
+
+func (h *keyHealth) smoothedErrorRate() float64 {
+	rate := atomicLoadFloat64(&h.adaptiveErrorRate)
+	if rate < 0 {
+		return 0
+	}
+	if rate > 1 {
+		return 1
+	}
+	return rate
+}
+
+// record applies the outcome of one upstream call to the shared key state.
+func (h *keyHealth) record(now time.Time, status int, err error, failure bool) {
+	atomic.AddUint64(&h.totalRequests, 1)
+	atomic.StoreInt64(&h.lastStatus, int64(status))
+	atomic.StoreInt64(&h.lastUpdated, now.UnixNano())
+	if failure {
+		atomic.AddUint64(&h.totalErrors, 1)
+	}
+	if errors.Is(err, ErrUpstreamTimeout) {
+		atomic.AddUint64(&h.totalTimeouts, 1)
+	}
+	h.lastError.Store(describeFailure(status, err))
+
+	// A rate-limited key is cooled down rather than tripped, but a 429 must not
+	// close the breaker either, and adaptive_rr steers away from it like an error.
+	throttled := status == http.StatusTooManyRequests
+	updateAdaptiveMetrics(h, now, failure || throttled)
+	if throttled {
+		h.breaker.release()
+	} else {
+		h.breaker.record(now, failure)
+	}
+	h.recordAuth(now, status, err)
+}
+
+func describeFailure(status int, err error) string {
+	if err != nil {
+		return err.Error()
+	}
+	if status >= 500 || status == http.StatusTooManyRequests || status == http.StatusUnauthorized || status == http.StatusForbidden {
+		return fmt.Sprintf("upstream status %d", status)
+	}
+	return ""
+}
+
+func loadLastError(v *atomic.Value) string {
+	if raw := v.Load(); raw != nil {
+		if s, ok := raw.(string); ok {
+			return s
+		}
+	}
+	return ""
+}
+
+func updateAdaptiveMetrics(h *keyHealth, now time.Time, failure bool) {
+	if adaptiveTauSeconds <= 0 {
+		return
+	}
+	last := atomic.LoadInt64(&h.adaptiveLastUpdate)
+	var failures float64
+	var samples float64
+	if last > 0 {
+		elapsed := float64(now.UnixNano()-last) / 1e9
+		if elapsed < 0 {
+			elapsed = 0
+		}
+		decay := math.Exp(-elapsed / adaptiveTauSeconds)
+		failures = atomicLoadFloat64(&h.adaptiveFailures) * decay
+		samples = atomicLoadFloat64(&h.adaptiveSamples) * decay
+	} else {
+		failures = 0
+		samples = 0
+	}
+	if failure {
+		failures += 1
+	}
+	samples += 1
+	atomicStoreFloat64(&h.adaptiveFailures, failures)
+	atomicStoreFloat64(&h.adaptiveSamples, samples)
+	atomic.StoreInt64(&h.adaptiveLastUpdate, now.UnixNano())
+	errRate := 0.0
+	if samples > 0 {
+		errRate = failures / samples
+	}
+	if errRate < 0 {
+		errRate = 0
+	} else if errRate > 1 {
+		errRate = 1
+	}
+	atomicStoreFloat64(&h.adaptiveErrorRate, errRate)
+}
+
+// KeyHealthStatus captures the shared health of one provider key for a service type.
+type KeyHealthStatus struct {
+	ProviderName    string             `json:"provider_name"`
+	ProviderKeyName string             `json:"provider_key_name"`
+	ServiceType     string             `json:"service_type"`
+	Routes          int                `json:"routes"`
+	Healthy         bool               `json:"healthy"`
+	CircuitState    string             `json:"circuit_state"`
+	Invalid         bool               `json:"invalid"`
+	InvalidSince    *time.Time         `json:"invalid_since,omitempty"`
+	InvalidStatus   int                `json:"invalid_status,omitempty"`
+	UnhealthyUntil  *time.Time         `json:"unhealthy_until,omitempty"`
+	CooldownUntil   *time.Time         `json:"cooldown_until,omitempty"`
+	TotalRequests   uint64             `json:"total_requests"`
+	TotalErrors     uint64             `json:"total_errors"`
+	TotalTimeouts   uint64             `json:"total_timeouts,omitempty"`
+	ErrorRate       float64            `json:"error_rate"`
+	SmoothedError   float64            `json:"smoothed_error_rate,omitempty"`
+	LatencyEWMAMs   float64            `json:"latency_ewma_ms,omitempty"`
+	LatencySamples  uint64             `json:"latency_samples,omitempty"`
+	InFlight        int64              `json:"in_flight"`
+	LastStatus      int                `json:"last_status"`
+	LastError       string             `json:"last_error,omitempty"`
+	LastUpdated     time.Time          `json:"last_updated,omitempty"`
+	HealthCheck     *HealthCheckStatus `json:"health_check,omitempty"`
+}
+
+// KeyHealth returns the shared health of every provider key referenced by a user route,
+// ordered by provider, key name and service type.
+func (m *Manager) KeyHealth() ([]KeyHealthStatus, error) {
+	m.mu.RLock()
+	data := m.data
+	m.mu.RUnlock()
+
+	if data == nil {
+		return nil, ErrConfigNotLoaded
+	}
+	return data.keyHealthStatuses(), nil
+}
+
+// keyHealthStatuses reports the health of every key of c; see KeyHealth.
+func (c *resolvedConfig) keyHealthStatuses() []KeyHealthStatus {
+	routes := make(map[*keyHealth]int, len(c.health))
+	for _, user := range c.users {
+		for _, svc := range user.services {
+			for _, c := range svc.candidates {
+				routes[c.health]++
+			}
+		}
+	}
+
+	statuses := make([]KeyHealthStatus, 0, len(c.health))
+	for _, h := range c.health {
+		total := atomic.LoadUint64(&h.totalRequests)
+		errors := atomic.LoadUint64(&h.totalErrors)
+		state, unhealthyUntil := h.breaker.snapshot()
+		invalidSince, invalidStatus := h.invalid()
+		var lastUpdated time.Time
+		if ts := atomic.LoadInt64(&h.lastUpdated); ts > 0 {
+			lastUpdated = time.Unix(0, ts)
+		}
+		errorRate := 0.0
+		if total > 0 {
+			errorRate = float64(errors) / float64(total)
+		}
+
+		statuses = append(statuses, KeyHealthStatus{
+			ProviderName:    h.id.provider,
+			ProviderKeyName: h.id.keyName,
+			ServiceType:     h.id.serviceType,
+			Routes:          routes[h],
+			Healthy:         state == circuitClosed && invalidSince == nil,
+			CircuitState:    state.String(),
+			Invalid:         invalidSince != nil,
+			InvalidSince:    invalidSince,
+			InvalidStatus:   invalidStatus,
+			UnhealthyUntil:  unhealthyUntil,
+			CooldownUntil:   h.cooldown(time.Now()),
+			TotalRequests:   total,
+			TotalErrors:     errors,
+			TotalTimeouts:   atomic.LoadUint64(&h.totalTimeouts),
+			ErrorRate:       errorRate,
+			SmoothedError:   h.smoothedErrorRate(),
+			LatencyEWMAMs:   h.latency(),
+			LatencySamples:  atomic.LoadUint64(&h.latencySamples),
+			InFlight:        h.outstanding(),
+			LastStatus:      int(atomic.LoadInt64(&h.lastStatus)),
+			LastError:       loadLastError(&h.lastError),
+			LastUpdated:     lastUpdated,
+			HealthCheck:     h.healthCheckStatus(),
+		})
+	}
+
+	sort.Slice(statuses, func(i, j int) bool {
+		a, b := statuses[i], statuses[j]
+		if a.ProviderName != b.ProviderName {
+			return a.ProviderName < b.ProviderName
+		}
+		if a.ProviderKeyName != b.ProviderKeyName {
+			return a.ProviderKeyName < b.ProviderKeyName
+		}
+		return a.ServiceType < b.ServiceType
+	})
+	return statuses
+}
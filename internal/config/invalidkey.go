@@ -0,0 +1,126 @@
+package config
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"sync/atomic"
+	"time"
+)
+
+// invalidKeyThreshold is the number of consecutive authentication failures after
+// which a provider key is taken to be revoked or invalid.
+const invalidKeyThreshold = 3
+
+// authErrorCodes are the error types and codes upstreams send with a 403 when they
+// reject the key itself: OpenAI's invalid_api_key and Anthropic's
+// authentication_error. Any other 403 refuses the request, for example a model the
+// key's account cannot use, and says nothing about the key.
+var authErrorCodes = map[string]bool{
+	"invalid_api_key":      true,
+	"authentication_error": true,
+}
+
+// IsAuthErrorBody reports whether the JSON error body of a 403 response says the
+// upstream rejected the key itself. The gateway reports such responses to
+// ReportResult with ErrUpstreamAuth.
+func IsAuthErrorBody(body []byte) bool {
+	var envelope struct {
+		Error json.RawMessage `json:"error"`
+	}
+	if err := json.Unmarshal(body, &envelope); err != nil {
+		return false
+	}
+	var fields struct {
+		Type string `json:"type"`
+		// Code is a string for OpenAI and a number for Gemini.
+		Code json.RawMessage `json:"code"`
+	}
+	if err := json.Unmarshal(envelope.Error, &fields); err != nil {
+		return false
+	}
+	var code string
+	_ = json.Unmarshal(fields.Code, &code)
+	return authErrorCodes[fields.Type] || authErrorCodes[code]
+}
+
+// isAuthFailure reports whether a response says the upstream rejected the key
+// itself: a 401, or a 403 reported with ErrUpstreamAuth.
+func isAuthFailure(status int, err error) bool {
+	switch status {
+	case http.StatusUnauthorized:
+		return true
+	case http.StatusForbidden:
+		return errors.Is(err, ErrUpstreamAuth)
+	}
+	return false
+}
+
+// recordAuth tracks consecutive authentication failures of the key and marks it
+// invalid once they reach invalidKeyThreshold. Any other upstream response breaks
+// the run; transport errors, which carry no status, leave it alone. It reports
+// whether this call invalidated the key.
+func (h *keyHealth) recordAuth(now time.Time, status int, err error) bool {
+	if status == 0 {
+		return false
+	}
+	if !isAuthFailure(status, err) {
+		atomic.StoreInt64(&h.authFailures, 0)
+		return false
+	}
+	if atomic.AddInt64(&h.authFailures, 1) < invalidKeyThreshold {
+		return false
+	}
+	if !atomic.CompareAndSwapInt64(&h.invalidSince, 0, now.UnixNano()) {
+		return false
+	}
+	atomic.StoreInt64(&h.invalidStatus, int64(status))
+	return true
+}
+
+// invalid returns when the key was marked invalid and the status that did it, or
+// nil when the key is valid.
+func (h *keyHealth) invalid() (*time.Time, int) {
+	since := atomic.LoadInt64(&h.invalidSince)
+	if since == 0 {
+		return nil, 0
+	}
+	t := time.Unix(0, since)
+	return &t, int(atomic.LoadInt64(&h.invalidStatus))
+}
+
+// EnableKey clears the invalid mark of a provider key, for every service type it
+// is used for, and returns the key's health afterwards. Keys whose value changes
+// in the config are re-enabled by the reload instead.
+func (m *Manager) EnableKey(providerName, providerKeyName string) ([]KeyHealthStatus, error) {
+	m.mu.RLock()
+	data := m.data
+	m.mu.RUnlock()
+	if data == nil {
+		return nil, ErrConfigNotLoaded
+	}
+
+	found := false
+	for id, h := range data.health {
+		if id.provider != providerName || id.keyName != providerKeyName {
+			continue
+		}
+		found = true
+		atomic.StoreInt64(&h.authFailures, 0)
+		atomic.StoreInt64(&h.invalidStatus, 0)
+		atomic.StoreInt64(&h.invalidSince, 0)
+	}
+	if !found {
+		return nil, fmt.Errorf("%w: '%s/%s'", ErrProviderKeyNotFound, providerName, providerKeyName)
+	}
+
+	statuses := data.keyHealthStatuses()
+	out := statuses[:0]
+	for _, s := range statuses {
+		if s.ProviderName == providerName && s.ProviderKeyName == providerKeyName {
+			out = append(out, s)
+		}
+	}
+	return out, nil
+}
@@ -0,0 +1,220 @@
+package config
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"piapi/internal/metrics"
+)
+
+const (
+	defaultKeyMaxQueue     = 100
+	defaultKeyQueueTimeout = 10 * time.Second
+)
+
+// resolveKeyLimit validates a keyLimits entry and fills in defaults.
+func resolveKeyLimit(cfg KeyLimitConfig) (KeyLimitConfig, error) {
+	if cfg.MaxConcurrent <= 0 {
+		return cfg, errors.New("maxConcurrent must be positive")
+	}
+	if cfg.MaxQueue < 0 {
+		return cfg, errors.New("maxQueue must not be negative")
+	}
+	if cfg.QueueTimeout < 0 {
+		return cfg, errors.New("queueTimeout must not be negative")
+	}
+	if cfg.MaxQueue == 0 {
+		cfg.MaxQueue = defaultKeyMaxQueue
+	}
+	if cfg.QueueTimeout == 0 {
+		cfg.QueueTimeout = Duration(defaultKeyQueueTimeout)
+	}
+	return cfg, nil
+}
+
+// keySlots limits the requests in flight on one provider key. Slots freed while
+// requests are queued are handed to the oldest waiter, so queued requests are not
+// overtaken by new ones. A nil keySlots is a key without a limit.
+type keySlots struct {
+	provider string
+	keyName  string
+
+	mu       sync.Mutex
+	settings KeyLimitConfig
+	inFlight int
+	// waiters are the queued requests, oldest first. A slot is handed over by
+	// closing the waiter's channel.
+	waiters []chan struct{}
+}
+
+func newKeySlots(provider, keyName string, settings KeyLimitConfig) *keySlots {
+	return &keySlots{provider: provider, keyName: keyName, settings: settings}
+}
+
+// setSettings applies reloaded limits while keeping the requests in flight and
+// queued. A raised limit is handed to waiters at once.
+func (s *keySlots) setSettings(settings KeyLimitConfig) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.settings = settings
+	s.grant()
+	s.publish()
+}
+
+// available reports whether a request could take a slot without queueing.
+func (s *keySlots) available() bool {
+	if s == nil {
+		return true
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return len(s.waiters) == 0 && s.inFlight < s.settings.MaxConcurrent
+}
+
+// tryAcquire takes a slot unless the key is saturated or requests are queued.
+func (s *keySlots) tryAcquire() bool {
+	if s == nil {
+		return true
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if len(s.waiters) > 0 || s.inFlight >= s.settings.MaxConcurrent {
+		return false
+	}
+	s.inFlight++
+	s.publish()
+	return true
+}
+
+// release frees a slot taken by tryAcquire or wait.
+func (s *keySlots) release() {
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.inFlight > 0 {
+		s.inFlight--
+	}
+	s.grant()
+	s.publish()
+}
+
+// queued returns the number of requests waiting for a slot.
+func (s *keySlots) queued() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return len(s.waiters)
+}
+
+// wait takes a slot, queueing for up to the key's queue timeout when none is free.
+// It fails with ErrUpstreamBusy when the queue is full or the wait times out, and
+// with ctx's error when ctx is done first.
+func (s *keySlots) wait(ctx context.Context) error {
+	s.mu.Lock()
+	if len(s.waiters) == 0 && s.inFlight < s.settings.MaxConcurrent {
+		s.inFlight++
+		s.publish()
+		s.mu.Unlock()
+		return nil
+	}
+	if len(s.waiters) >= s.settings.MaxQueue {
+		s.mu.Unlock()
+		return fmt.Errorf("%w: queue of provider key '%s/%s' is full", ErrUpstreamBusy, s.provider, s.keyName)
+	}
+	ready := make(chan struct{})
+	s.waiters = append(s.waiters, ready)
+	timeout := s.settings.QueueTimeout.Std()
+	s.publish()
+	s.mu.Unlock()
+
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+	var err error
+	select {
+	case <-ready:
+		return nil
+	case <-timer.C:
+		err = fmt.Errorf("%w: no slot of provider key '%s/%s' freed within %s", ErrUpstreamBusy, s.provider, s.keyName, timeout)
+	case <-ctx.Done():
+		err = ctx.Err()
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for i, w := range s.waiters {
+		if w == ready {
+			s.waiters = append(s.waiters[:i], s.waiters[i+1:]...)
+			s.publish()
+			return err
+		}
+	}
+	// The slot was handed over while giving up; pass it on.
+	s.inFlight--
+	s.grant()
+	s.publish()
+	return err
+}
+
+// grant hands free slots to waiters. It is called with s.mu held.
+func (s *keySlots) grant() {
+	for len(s.waiters) > 0 && s.inFlight < s.settings.MaxConcurrent {
+		close(s.waiters[0])
+		s.waiters = s.waiters[1:]
+		s.inFlight++
+	}
+}
+
+// publish exports the key's concurrency. It is called with s.mu held.
+func (s *keySlots) publish() {
+	metrics.SetKeyConcurrency(s.provider, s.keyName, s.inFlight, len(s.waiters))
+}
+
+// slots returns the concurrency limit of the candidate's key, or nil when the key
+// has none.
+func (c *resolvedCandidate) slots() *keySlots {
+	return c.provider.slots[c.providerKeyName]
+}
+
+// queueCandidate is the fallback of Resolve when every candidate is saturated: it
+// waits for a slot on the key with the shortest queue among the candidates skipped
+// only for being at their limit. It returns ErrNoActiveUpstream when there is none.
+func queueCandidate(svc *resolvedUserService, opts ResolveOptions) (*resolvedCandidate, error) {
+	now := time.Now()
+	var (
+		best       *resolvedCandidate
+		bestQueued int
+	)
+	for _, c := range svc.candidates {
+		slots := c.slots()
+		if slots == nil || !c.enabled || isExcluded(c.id, opts.Exclude) || !c.supportsModel(opts.Model) {
+			continue
+		}
+		if !c.health.available(now) {
+			continue
+		}
+		if queued := slots.queued(); best == nil || queued < bestQueued {
+			best, bestQueued = c, queued
+		}
+	}
+	if best == nil {
+		return nil, ErrNoActiveUpstream
+	}
+
+	ctx := opts.Context
+	if ctx == nil {
+		ctx = context.Background()
+	}
+	slots := best.slots()
+	if err := slots.wait(ctx); err != nil {
+		return nil, err
+	}
+	if !best.health.breaker.admit(time.Now()) {
+		slots.release()
+		return nil, ErrNoActiveUpstream
+	}
+	return best, nil
+}
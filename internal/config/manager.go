@@ -1,8 +1,12 @@
 package config
 
 import (
+	"context"
+	"errors"
 	"fmt"
 	"math"
+	"net/http"
+	"net/url"
 	"os"
 	"sort"
 	"strconv"
@@ -13,13 +17,18 @@ import (
 
 	"gopkg.in/yaml.v3"
 
+	"piapi/internal/logging"
 	"piapi/internal/metrics"
+	"piapi/internal/protocol"
 )
 
 // Manager stores the parsed configuration and provides concurrent-safe lookups.
 type Manager struct {
 	mu   sync.RWMutex
 	data *resolvedConfig
+	// limiters outlives individual configurations so reloads keep rate limit state.
+	limiters rateLimiterRegistry
+	probes   healthProber
 }
 
 const (
@@ -27,6 +36,16 @@ const (
 	strategyWeightedRR    = "weighted_rr"
 	strategyAdaptiveRR    = "adaptive_rr"
 	strategyStickyHealthy = "sticky_healthy"
+	// strategyLeastLatency picks the candidate with the lowest average time to first
+	// byte, and strategyLeastOutstanding the one with fewer requests in flight of two
+	// sampled at random.
+	strategyLeastLatency     = "least_latency"
+	strategyLeastOutstanding = "least_outstanding"
+	// strategyConsistentHash keeps requests that share a session, user or prompt on
+	// the same candidate; see ConsistentHashConfig.
+	strategyConsistentHash = "consistent_hash"
+
+	defaultFailoverMaxAttempts = 3
 )
 
 var (
@@ -71,17 +90,39 @@ func atomicStoreFloat64(addr *uint64, val float64) {
 type resolvedConfig struct {
 	raw       *Config
 	providers map[string]*resolvedProvider
-	users     map[string]*resolvedUser
+	// users is keyed by user ID: the API key, or apiKeyHash for hashed users.
+	users  map[string]*resolvedUser
+	keys   *userKeyIndex
+	health healthRegistry
+	// clientAuth holds the credential styles of service types listed in clientAuth.
+	clientAuth map[string][]string
 }
 
 type resolvedProvider struct {
+	// provider keeps key values as written, so secret references are not expanded
+	// in Current or Route.Provider; keys holds the resolved secrets.
 	provider Provider
 	services map[string]Service
+	keys     map[string]string
+	// breakers holds the circuit breaker settings of each service type, with
+	// defaults applied.
+	breakers map[string]CircuitBreakerConfig
+	// rateLimits holds the upstreamRateLimit settings of each service type, with
+	// defaults applied.
+	rateLimits map[string]UpstreamRateLimitConfig
+	// healthChecks holds the health check of each service type that has one, with
+	// defaults applied.
+	healthChecks map[string]*HealthCheckConfig
+	transports   *providerTransports
+	// slots holds the concurrency limit of each key listed in keyLimits.
+	slots map[string]*keySlots
 }
 
 type resolvedUser struct {
-	user     User
-	services map[string]*resolvedUserService
+	id        string
+	user      User
+	services  map[string]*resolvedUserService
+	rateLimit RateLimitConfig
 }
 
 type resolvedUserService struct {
@@ -89,40 +130,118 @@ type resolvedUserService struct {
 	strategy   string
 	candidates []*resolvedCandidate
 	rrCounter  uint64
+	// swrrMu guards the current weights of the candidates, used by the smooth
+	// weighted round robin of weighted_rr and adaptive_rr.
+	swrrMu sync.Mutex
 	// adaptive weights / sticky state
-	stickyIndex int32
+	stickyIndex  int32
+	failover     FailoverConfig
+	rateLimit    RateLimitConfig
+	modelAliases map[string]string
+	// consistentHash is set for the consistent_hash strategy, with defaults applied.
+	consistentHash ConsistentHashConfig
 }
 
 type resolvedCandidate struct {
+	id              string
 	provider        *resolvedProvider
 	providerKeyName string
 	providerKey     string
 	weight          int
 	enabled         bool
 	tags            []string
+	// models and serviceModels are the candidate's and the provider service's model
+	// patterns; a requested model must match both.
+	models          []string
+	serviceModels   []string
+	serviceModelMap map[string]string
+	// headers is the candidate's header policy merged over its route's and service's.
+	headers *HeaderPolicy
+
+	// currentWeight is the candidate's smooth weighted round robin state, guarded by
+	// its route's swrrMu.
+	currentWeight float64
+
+	// health is shared with every other route using the same provider key and service.
+	health *keyHealth
+	// stats holds route-local counters backing the per-user view in RuntimeStatus.
+	stats *candidateStats
+}
 
-	// unhealthyUntil stores UnixNano timestamp; 0 means healthy
-	unhealthyUntil int64
-
+// candidateStats are per-route request counters. They live behind a pointer so a
+// config reload can hand them to the matching candidate of the new configuration.
+type candidateStats struct {
 	totalRequests uint64
 	totalErrors   uint64
+	totalTimeouts uint64
 	lastStatus    int64
 	lastUpdated   int64
 	lastError     atomic.Value
-	// Adaptive error rate smoothing parameters
-	adaptiveLastUpdate int64
-	adaptiveFailures   uint64 // float64 bits
-	adaptiveSamples    uint64 // float64 bits
-	adaptiveErrorRate  uint64 // float64 bits cache
 }
 
 // Route encapsulates the routing decision for a user and service type.
 type Route struct {
-	User             User
+	User User
+	// UserID identifies the user to ReportResult and RuntimeStatus: the API key, or
+	// apiKeyHash for users declared by hash.
+	UserID           string
 	Provider         Provider
 	Service          Service
 	UpstreamKeyName  string
 	UpstreamKeyValue string
+	// Failover carries the effective failover policy of the user's route.
+	Failover FailoverConfig
+	// Model is the requested model after the route's aliases were applied, and
+	// UpstreamModel is that model renamed by the service's model map. Both are empty
+	// when the request named no model.
+	Model         string
+	UpstreamModel string
+	// Headers is the header policy of the service, route and candidate combined.
+	Headers *HeaderPolicy
+	// Transport carries the provider's transport settings and the service's
+	// connection timeouts. It is nil when neither is configured.
+	Transport http.RoundTripper
+
+	// release ends the request on the candidate: it frees the concurrency slot held
+	// on a key with keyLimits and lowers the key's in-flight count.
+	release func()
+}
+
+// CandidateID identifies the upstream candidate chosen for this route.
+func (r *Route) CandidateID() string {
+	return candidateID(r.Provider.Name, r.UpstreamKeyName)
+}
+
+// Release ends the route's request on its provider key, freeing its concurrency
+// slot and in-flight count. It must be called once the upstream call is done; later
+// calls do nothing.
+func (r *Route) Release() {
+	if r.release != nil {
+		r.release()
+	}
+}
+
+// ResolveOptions narrows candidate selection for a single Resolve call.
+type ResolveOptions struct {
+	// Exclude lists candidate IDs (see Route.CandidateID) that must not be selected,
+	// typically the ones already tried by the current request.
+	Exclude []string
+	// Model, when set, is the model requested by the client. The route's aliases are
+	// applied to it and only candidates that support the result are selected.
+	Model string
+	// Context, when set, ends the wait for a concurrency slot once it is done.
+	Context context.Context
+	// Header and Body are the client's request headers and buffered body, read by
+	// the consistent_hash strategy.
+	Header http.Header
+	Body   []byte
+
+	// affinity is the value consistent_hash routes on, set by ResolveWithOptions.
+	affinity string
+}
+
+func candidateID(providerName, providerKeyName string) string {
+	return providerName + "/" + providerKeyName
 }
 
 // NewManager constructs an empty manager.
@@ -144,10 +263,37 @@ func (m *Manager) LoadFromFile(path string) error {
 
 	m.mu.Lock()
 	defer m.mu.Unlock()
+	cfg.inherit(m.data)
+	cfg.publishCircuitStates(m.data)
+	m.limiters.sync(cfg)
 	m.data = cfg
+	logging.GlobalRedactor.SetSecrets(cfg.secrets())
+	m.probes.restart(cfg)
 	return nil
 }
 
+// secrets lists the resolved provider keys, proxy passwords and plaintext user
+// keys, for masking in logs.
+func (c *resolvedConfig) secrets() []string {
+	var out []string
+	for _, provider := range c.providers {
+		for _, value := range provider.keys {
+			out = append(out, value)
+		}
+		if t := provider.provider.Transport; t != nil {
+			if u, err := url.Parse(t.Proxy); err == nil {
+				if password, ok := u.User.Password(); ok {
+					out = append(out, password)
+				}
+			}
+		}
+	}
+	for key := range c.keys.plain {
+		out = append(out, key)
+	}
+	return out
+}
+
 // Current returns a copy of the raw configuration for inspection.
 func (m *Manager) Current() *Config {
 	m.mu.RLock()
@@ -161,6 +307,11 @@ func (m *Manager) Current() *Config {
 
 // Resolve determines the upstream route for the given user apiKey and service type.
 func (m *Manager) Resolve(apiKey, serviceType string) (*Route, error) {
+	return m.ResolveWithOptions(apiKey, serviceType, ResolveOptions{})
+}
+
+// ResolveWithOptions is Resolve with additional selection constraints.
+func (m *Manager) ResolveWithOptions(apiKey, serviceType string, opts ResolveOptions) (*Route, error) {
 	if apiKey == "" {
 		return nil, ErrAPIKeyRequired
 	}
@@ -176,7 +327,7 @@ func (m *Manager) Resolve(apiKey, serviceType string) (*Route, error) {
 		return nil, ErrConfigNotLoaded
 	}
 
-	user, ok := data.users[apiKey]
+	user, ok := data.keys.lookup(apiKey)
 	if !ok {
 		return nil, ErrUserNotFound
 	}
@@ -186,22 +337,54 @@ func (m *Manager) Resolve(apiKey, serviceType string) (*Route, error) {
 		return nil, fmt.Errorf("%w for user '%s'", ErrServiceNotFound, user.user.Name)
 	}
 
-	cand := selectCandidate(resolvedSvc)
+	if opts.Model != "" {
+		opts.Model = mapModel(resolvedSvc.modelAliases, opts.Model)
+		if !anyCandidateSupports(resolvedSvc, opts.Model) {
+			return nil, &ModelNotSupportedError{User: user.user.Name, ServiceType: serviceType, Model: opts.Model}
+		}
+	}
+
+	if resolvedSvc.strategy == strategyConsistentHash {
+		opts.affinity = affinityKey(resolvedSvc.consistentHash, user.id, opts)
+	}
+
+	cand := selectCandidate(resolvedSvc, opts)
 	if cand == nil {
-		return nil, ErrNoActiveUpstream
+		var err error
+		if cand, err = queueCandidate(resolvedSvc, opts); err != nil {
+			return nil, err
+		}
 	}
 
 	service, ok := cand.provider.services[serviceType]
 	if !ok {
+		cand.slots().release()
 		return nil, fmt.Errorf("%w for provider '%s'", ErrServiceNotFound, cand.provider.provider.Name)
 	}
 
 	route := &Route{
 		User:             user.user,
+		UserID:           user.id,
 		Provider:         cand.provider.provider,
 		Service:          service,
 		UpstreamKeyName:  cand.providerKeyName,
 		UpstreamKeyValue: cand.providerKey,
+		Failover:         resolvedSvc.failover,
+		Headers:          cand.headers,
+		Transport:        cand.provider.transports.forService(service.Timeouts),
+	}
+	if opts.Model != "" {
+		route.Model = opts.Model
+		route.UpstreamModel = mapModel(service.ModelMap, opts.Model)
+	}
+	health, slots := cand.health, cand.slots()
+	atomic.AddInt64(&health.inFlight, 1)
+	var once sync.Once
+	route.release = func() {
+		once.Do(func() {
+			atomic.AddInt64(&health.inFlight, -1)
+			slots.release()
+		})
 	}
 	return route, nil
 }
@@ -213,6 +396,7 @@ func parse(b []byte) (*resolvedConfig, error) {
 	}
 
 	providers := make(map[string]*resolvedProvider, len(raw.Providers))
+	health := make(healthRegistry)
 
 	for i, p := range raw.Providers {
 		name := strings.TrimSpace(p.Name)
@@ -227,6 +411,7 @@ func parse(b []byte) (*resolvedConfig, error) {
 			return nil, fmt.Errorf("provider '%s': apiKeys must not be empty", name)
 		}
 		sanitizedKeys := make(map[string]string, len(p.APIKeys))
+		secrets := make(map[string]string, len(p.APIKeys))
 		for key, value := range p.APIKeys {
 			trimmedKey := strings.TrimSpace(key)
 			if trimmedKey == "" {
@@ -239,10 +424,18 @@ func parse(b []byte) (*resolvedConfig, error) {
 			if trimmedValue == "" {
 				return nil, fmt.Errorf("provider '%s': apiKey '%s' value must not be empty", name, trimmedKey)
 			}
+			secret, err := resolveSecret(trimmedValue)
+			if err != nil {
+				return nil, fmt.Errorf("provider '%s': apiKey '%s': %w", name, trimmedKey, err)
+			}
 			sanitizedKeys[trimmedKey] = trimmedValue
+			secrets[trimmedKey] = secret
 		}
 
 		services := make(map[string]Service, len(p.Services))
+		breakers := make(map[string]CircuitBreakerConfig, len(p.Services))
+		rateLimits := make(map[string]UpstreamRateLimitConfig, len(p.Services))
+		healthChecks := make(map[string]*HealthCheckConfig)
 		sanitizedServices := make([]Service, 0, len(p.Services))
 		for j, svc := range p.Services {
 			svcType := strings.TrimSpace(svc.Type)
@@ -256,9 +449,62 @@ func parse(b []byte) (*resolvedConfig, error) {
 			if baseURL == "" {
 				return nil, fmt.Errorf("provider '%s' services[%d]: baseUrl is required", name, j)
 			}
+			if err := validatePricing(svc.Pricing); err != nil {
+				return nil, fmt.Errorf("provider '%s' services[%d]: %w", name, j, err)
+			}
+			models, err := normalizeModelPatterns(svc.Models)
+			if err != nil {
+				return nil, fmt.Errorf("provider '%s' services[%d]: %w", name, j, err)
+			}
+			modelMap, err := normalizeModelMap(svc.ModelMap, "modelMap")
+			if err != nil {
+				return nil, fmt.Errorf("provider '%s' services[%d]: %w", name, j, err)
+			}
+			proto := strings.ToLower(strings.TrimSpace(svc.Protocol))
+			if proto != "" && !protocol.Valid(proto) {
+				return nil, fmt.Errorf("provider '%s' services[%d]: unsupported protocol '%s'", name, j, svc.Protocol)
+			}
+			if svc.ChatOnly {
+				if proto != "" && proto != protocol.OpenAI {
+					return nil, fmt.Errorf("provider '%s' services[%d]: chatOnly requires protocol '%s', got '%s'", name, j, protocol.OpenAI, proto)
+				}
+				proto = protocol.OpenAI
+			}
+			headers, err := normalizeHeaderPolicy(svc.Headers)
+			if err != nil {
+				return nil, fmt.Errorf("provider '%s' services[%d]: %w", name, j, err)
+			}
+			timeouts, err := normalizeTimeouts(svc.Timeouts)
+			if err != nil {
+				return nil, fmt.Errorf("provider '%s' services[%d]: %w", name, j, err)
+			}
+			breaker, err := resolveCircuitBreaker(svc.CircuitBreaker)
+			if err != nil {
+				return nil, fmt.Errorf("provider '%s' services[%d]: %w", name, j, err)
+			}
+			rateLimit, err := resolveUpstreamRateLimit(svc.UpstreamRateLimit)
+			if err != nil {
+				return nil, fmt.Errorf("provider '%s' services[%d]: %w", name, j, err)
+			}
+			healthCheck, err := resolveHealthCheck(svc.HealthCheck)
+			if err != nil {
+				return nil, fmt.Errorf("provider '%s' services[%d]: %w", name, j, err)
+			}
 			sanitized := Service{
-				Type:    svcType,
-				BaseURL: baseURL,
+				Type:     svcType,
+				BaseURL:  baseURL,
+				Pricing:  svc.Pricing,
+				Models:   models,
+				ModelMap: modelMap,
+				Protocol: proto,
+				ChatOnly: svc.ChatOnly,
+				Headers:  headers,
+				Timeouts: timeouts,
+				// Kept as written; defaults are applied in breakers, rateLimits and
+				// healthChecks.
+				CircuitBreaker:    svc.CircuitBreaker,
+				UpstreamRateLimit: svc.UpstreamRateLimit,
+				HealthCheck:       svc.HealthCheck,
 			}
 
 			auth := AuthConfig{
@@ -291,28 +537,99 @@ func parse(b []byte) (*resolvedConfig, error) {
 
 			sanitized.Auth = &auth
 			services[svcType] = sanitized
+			breakers[svcType] = breaker
+			rateLimits[svcType] = rateLimit
+			if healthCheck != nil {
+				healthChecks[svcType] = healthCheck
+			}
 			sanitizedServices = append(sanitizedServices, sanitized)
 		}
 
+		transport, err := normalizeTransport(p.Transport)
+		if err != nil {
+			return nil, fmt.Errorf("provider '%s': %w", name, err)
+		}
+		transports, err := newProviderTransports(transport)
+		if err != nil {
+			return nil, fmt.Errorf("provider '%s': %w", name, err)
+		}
+
+		var keyLimits map[string]KeyLimitConfig
+		slots := make(map[string]*keySlots, len(p.KeyLimits))
+		for key, limit := range p.KeyLimits {
+			keyName := strings.TrimSpace(key)
+			if _, ok := secrets[keyName]; !ok {
+				return nil, fmt.Errorf("provider '%s': keyLimits names unknown apiKey '%s'", name, keyName)
+			}
+			if _, exists := slots[keyName]; exists {
+				return nil, fmt.Errorf("provider '%s': duplicate keyLimits entry '%s'", name, keyName)
+			}
+			resolvedLimit, err := resolveKeyLimit(limit)
+			if err != nil {
+				return nil, fmt.Errorf("provider '%s': keyLimits '%s': %w", name, keyName, err)
+			}
+			if keyLimits == nil {
+				keyLimits = make(map[string]KeyLimitConfig, len(p.KeyLimits))
+			}
+			// Kept as written; defaults are applied in slots.
+			keyLimits[keyName] = limit
+			slots[keyName] = newKeySlots(name, keyName, resolvedLimit)
+		}
+
 		resolved := &resolvedProvider{
 			provider: Provider{
-				Name:     name,
-				APIKeys:  sanitizedKeys,
-				Services: sanitizedServices,
+				Name:      name,
+				APIKeys:   sanitizedKeys,
+				Services:  sanitizedServices,
+				Transport: transport,
+				KeyLimits: keyLimits,
 			},
-			services: services,
+			services:     services,
+			keys:         secrets,
+			breakers:     breakers,
+			rateLimits:   rateLimits,
+			healthChecks: healthChecks,
+			transports:   transports,
+			slots:        slots,
 		}
 		providers[name] = resolved
 		raw.Providers[i] = resolved.provider
 	}
 
 	users := make(map[string]*resolvedUser, len(raw.Users))
+	keys := newUserKeyIndex()
+	// Users sharing a name would share their budgets, as the usage ledger is keyed
+	// by user name, so names must be unique once any budget is configured.
+	var (
+		userIndexByName = make(map[string]int, len(raw.Users))
+		duplicateName   error
+		anyBudget       bool
+	)
 	for i, u := range raw.Users {
 		apiKey := strings.TrimSpace(u.APIKey)
-		if apiKey == "" {
-			return nil, fmt.Errorf("users[%d]: apiKey is required", i)
+		keyHash := strings.TrimSpace(u.APIKeyHash)
+		switch {
+		case apiKey == "" && keyHash == "":
+			return nil, fmt.Errorf("users[%d]: apiKey or apiKeyHash is required", i)
+		case apiKey != "" && keyHash != "":
+			return nil, fmt.Errorf("users[%d]: apiKey and apiKeyHash are mutually exclusive", i)
 		}
-		if _, exists := users[apiKey]; exists {
+		userID := apiKey
+		var (
+			salt   string
+			digest []byte
+		)
+		if keyHash != "" {
+			var err error
+			if salt, digest, err = parseAPIKeyHash(keyHash); err != nil {
+				return nil, fmt.Errorf("users[%d]: %w", i, err)
+			}
+			userID = keyHash
+		}
+		if _, exists := users[userID]; exists {
+			if keyHash != "" {
+				return nil, fmt.Errorf("users[%d]: duplicate user apiKeyHash", i)
+			}
 			return nil, fmt.Errorf("duplicate user apiKey '%s'", apiKey)
 		}
 
@@ -320,6 +637,7 @@ func parse(b []byte) (*resolvedConfig, error) {
 			return nil, fmt.Errorf("users[%d]: services mapping is required", i)
 		}
 
+		hasBudget := u.Budget != nil
 		resolvedServices := make(map[string]*resolvedUserService, len(u.Services))
 		sanitizedServices := make(map[string]UserServiceRoute, len(u.Services))
 		for svcType, route := range u.Services {
@@ -331,6 +649,11 @@ func parse(b []byte) (*resolvedConfig, error) {
 				return nil, fmt.Errorf("users[%d]: duplicate service mapping for '%s'", i, trimmedType)
 			}
 
+			routeHeaders, err := normalizeHeaderPolicy(route.Headers)
+			if err != nil {
+				return nil, fmt.Errorf("users[%d] service '%s': %w", i, trimmedType, err)
+			}
+
 			// Determine whether aggregated candidates provided
 			hasAggregates := len(route.Candidates) > 0 || strings.TrimSpace(route.Strategy) != ""
 			var candidates []*resolvedCandidate
@@ -351,7 +674,7 @@ func parse(b []byte) (*resolvedConfig, error) {
 					if keyName == "" {
 						return nil, fmt.Errorf("users[%d] service '%s' candidates[%d]: providerKeyName is required", i, trimmedType, idx)
 					}
-					keyVal, ok := prov.provider.APIKeys[keyName]
+					keyVal, ok := prov.keys[keyName]
 					if !ok {
 						return nil, fmt.Errorf("users[%d] service '%s' candidates[%d]: provider key '%s' missing for provider '%s'", i, trimmedType, idx, keyName, pName)
 					}
@@ -373,13 +696,28 @@ func parse(b []byte) (*resolvedConfig, error) {
 							tags = append(tags, trimmedTag)
 						}
 					}
+					models, err := normalizeModelPatterns(c.Models)
+					if err != nil {
+						return nil, fmt.Errorf("users[%d] service '%s' candidates[%d]: %w", i, trimmedType, idx, err)
+					}
+					candidateHeaders, err := normalizeHeaderPolicy(c.Headers)
+					if err != nil {
+						return nil, fmt.Errorf("users[%d] service '%s' candidates[%d]: %w", i, trimmedType, idx, err)
+					}
 					candidates = append(candidates, &resolvedCandidate{
+						id:              candidateID(pName, keyName),
 						provider:        prov,
 						providerKeyName: keyName,
 						providerKey:     keyVal,
 						weight:          w,
 						enabled:         enabled,
 						tags:            tags,
+						models:          models,
+						serviceModels:   prov.services[trimmedType].Models,
+						serviceModelMap: prov.services[trimmedType].ModelMap,
+						headers:         mergeHeaderPolicies(prov.services[trimmedType].Headers, routeHeaders, candidateHeaders),
+						health:          health.forKey(prov, keyName, trimmedType),
+						stats:           &candidateStats{},
 					})
 
 					enabledCopy := enabled
@@ -389,6 +727,8 @@ func parse(b []byte) (*resolvedConfig, error) {
 						Weight:          w,
 						Enabled:         &enabledCopy,
 						Tags:            tags,
+						Models:          models,
+						Headers:         candidateHeaders,
 					})
 				}
 				if len(candidates) == 0 {
@@ -401,20 +741,59 @@ func parse(b []byte) (*resolvedConfig, error) {
 				}
 				strategy = strings.ToLower(strategy)
 				switch strategy {
-				case strategyRoundRobin, strategyWeightedRR, strategyAdaptiveRR, strategyStickyHealthy:
+				case strategyRoundRobin, strategyWeightedRR, strategyAdaptiveRR, strategyStickyHealthy,
+					strategyLeastLatency, strategyLeastOutstanding, strategyConsistentHash:
 				default:
 					return nil, fmt.Errorf("users[%d] service '%s': unsupported strategy '%s'", i, trimmedType, strategy)
 				}
+				var consistentHash ConsistentHashConfig
+				switch {
+				case strategy == strategyConsistentHash:
+					if consistentHash, err = resolveConsistentHash(route.ConsistentHash); err != nil {
+						return nil, fmt.Errorf("users[%d] service '%s': %w", i, trimmedType, err)
+					}
+				case route.ConsistentHash != nil:
+					return nil, fmt.Errorf("users[%d] service '%s': consistentHash requires strategy '%s'", i, trimmedType, strategyConsistentHash)
+				}
+
+				failover, err := resolveFailover(route.Failover, len(candidates))
+				if err != nil {
+					return nil, fmt.Errorf("users[%d] service '%s': %w", i, trimmedType, err)
+				}
+				rateLimit, err := resolveRateLimit(route.RateLimit)
+				if err != nil {
+					return nil, fmt.Errorf("users[%d] service '%s': %w", i, trimmedType, err)
+				}
+				if err := validateBudget(route.Budget); err != nil {
+					return nil, fmt.Errorf("users[%d] service '%s': %w", i, trimmedType, err)
+				}
+				modelAliases, err := normalizeModelMap(route.ModelAliases, "modelAliases")
+				if err != nil {
+					return nil, fmt.Errorf("users[%d] service '%s': %w", i, trimmedType, err)
+				}
+				if route.Budget != nil {
+					hasBudget = true
+				}
 
 				resolvedServices[trimmedType] = &resolvedUserService{
-					strategy:    strategy,
-					candidates:  candidates,
-					stickyIndex: -1,
+					strategy:       strategy,
+					candidates:     candidates,
+					stickyIndex:    -1,
+					failover:       failover,
+					rateLimit:      rateLimit,
+					modelAliases:   modelAliases,
+					consistentHash: consistentHash,
 				}
 
 				sanitizedServices[trimmedType] = UserServiceRoute{
-					Strategy:   strategy,
-					Candidates: sanitizedCandidates,
+					Strategy:       strategy,
+					Candidates:     sanitizedCandidates,
+					Failover:       route.Failover,
+					RateLimit:      route.RateLimit,
+					Budget:         route.Budget,
+					ModelAliases:   modelAliases,
+					Headers:        routeHeaders,
+					ConsistentHash: route.ConsistentHash,
 				}
 			} else {
 				// Legacy single route → 1-candidate RR
@@ -430,7 +809,10 @@ func parse(b []byte) (*resolvedConfig, error) {
 				if providerKeyName == "" {
 					return nil, fmt.Errorf("users[%d] service '%s': providerKeyName is required", i, trimmedType)
 				}
-				providerKey, ok := provider.provider.APIKeys[providerKeyName]
+				if route.ConsistentHash != nil {
+					return nil, fmt.Errorf("users[%d] service '%s': consistentHash requires strategy '%s'", i, trimmedType, strategyConsistentHash)
+				}
+				providerKey, ok := provider.keys[providerKeyName]
 				if !ok {
 					return nil, fmt.Errorf("users[%d] service '%s': provider key '%s' missing for provider '%s'", i, trimmedType, providerKeyName, providerName)
 				}
@@ -440,63 +822,202 @@ func parse(b []byte) (*resolvedConfig, error) {
 
 				candidates = []*resolvedCandidate{
 					{
+						id:              candidateID(providerName, providerKeyName),
 						provider:        provider,
 						providerKeyName: providerKeyName,
 						providerKey:     providerKey,
 						weight:          1,
 						enabled:         true,
+						serviceModels:   provider.services[trimmedType].Models,
+						serviceModelMap: provider.services[trimmedType].ModelMap,
+						headers:         mergeHeaderPolicies(provider.services[trimmedType].Headers, routeHeaders),
+						health:          health.forKey(provider, providerKeyName, trimmedType),
+						stats:           &candidateStats{},
 					},
 				}
 
+				failover, err := resolveFailover(route.Failover, len(candidates))
+				if err != nil {
+					return nil, fmt.Errorf("users[%d] service '%s': %w", i, trimmedType, err)
+				}
+				rateLimit, err := resolveRateLimit(route.RateLimit)
+				if err != nil {
+					return nil, fmt.Errorf("users[%d] service '%s': %w", i, trimmedType, err)
+				}
+				if err := validateBudget(route.Budget); err != nil {
+					return nil, fmt.Errorf("users[%d] service '%s': %w", i, trimmedType, err)
+				}
+				modelAliases, err := normalizeModelMap(route.ModelAliases, "modelAliases")
+				if err != nil {
+					return nil, fmt.Errorf("users[%d] service '%s': %w", i, trimmedType, err)
+				}
+				if route.Budget != nil {
+					hasBudget = true
+				}
+
 				resolvedServices[trimmedType] = &resolvedUserService{
-					strategy:    strategyRoundRobin,
-					candidates:  candidates,
-					stickyIndex: -1,
+					strategy:     strategyRoundRobin,
+					candidates:   candidates,
+					stickyIndex:  -1,
+					failover:     failover,
+					rateLimit:    rateLimit,
+					modelAliases: modelAliases,
 				}
 
 				sanitizedServices[trimmedType] = UserServiceRoute{
 					ProviderName:    providerName,
 					ProviderKeyName: providerKeyName,
+					Failover:        route.Failover,
+					RateLimit:       route.RateLimit,
+					Budget:          route.Budget,
+					ModelAliases:    modelAliases,
+					Headers:         routeHeaders,
 				}
 			}
 		}
 
+		userRateLimit, err := resolveRateLimit(u.RateLimit)
+		if err != nil {
+			return nil, fmt.Errorf("users[%d]: %w", i, err)
+		}
+		if err := validateBudget(u.Budget); err != nil {
+			return nil, fmt.Errorf("users[%d]: %w", i, err)
+		}
+		userName := strings.TrimSpace(u.Name)
+		if hasBudget && userName == "" {
+			// Budgets are tracked in the usage ledger by user name.
+			return nil, fmt.Errorf("users[%d]: name is required when a budget is configured", i)
+		}
+		anyBudget = anyBudget || hasBudget
+		if first, exists := userIndexByName[userName]; !exists {
+			userIndexByName[userName] = i
+		} else if duplicateName == nil && userName != "" {
+			duplicateName = fmt.Errorf("users[%d]: name '%s' is already used by users[%d]; names must be unique when a budget is configured", i, userName, first)
+		}
+
 		sanitizedUser := User{
-			Name:     strings.TrimSpace(u.Name),
-			APIKey:   apiKey,
-			Services: sanitizedServices,
+			Name:       userName,
+			APIKey:     apiKey,
+			APIKeyHash: keyHash,
+			Services:   sanitizedServices,
+			RateLimit:  u.RateLimit,
+			Budget:     u.Budget,
 		}
 
-		users[apiKey] = &resolvedUser{
-			user:     sanitizedUser,
-			services: resolvedServices,
+		resolved := &resolvedUser{
+			id:        userID,
+			user:      sanitizedUser,
+			services:  resolvedServices,
+			rateLimit: userRateLimit,
+		}
+		users[userID] = resolved
+		if keyHash != "" {
+			keys.addHashed(salt, digest, resolved)
+		} else {
+			keys.plain[apiKey] = resolved
 		}
 		raw.Users[i] = sanitizedUser
 	}
+	if anyBudget && duplicateName != nil {
+		return nil, duplicateName
+	}
+	// A plaintext key that also matches a hashed user would make lookups ambiguous.
+	for key, user := range keys.plain {
+		if hashed := keys.matchHashed(key); hashed != nil {
+			return nil, fmt.Errorf("user '%s' apiKey matches the apiKeyHash of user '%s'", user.user.Name, hashed.user.Name)
+		}
+	}
+
+	clientAuth, err := resolveClientAuth(raw.ClientAuth)
+	if err != nil {
+		return nil, err
+	}
 
 	return &resolvedConfig{
-		raw:       &raw,
-		providers: providers,
-		users:     users,
+		raw:        &raw,
+		providers:  providers,
+		users:      users,
+		keys:       keys,
+		health:     health,
+		clientAuth: clientAuth,
 	}, nil
 }
 
-// selectCandidate applies the configured strategy to pick a healthy, enabled candidate.
-func selectCandidate(svc *resolvedUserService) *resolvedCandidate {
-	if svc == nil || len(svc.candidates) == 0 {
+// resolveFailover validates a route's failover block and fills in defaults.
+func resolveFailover(cfg *FailoverConfig, candidates int) (FailoverConfig, error) {
+	out := FailoverConfig{}
+	if cfg != nil {
+		if cfg.MaxAttempts < 0 {
+			return out, fmt.Errorf("failover.maxAttempts must not be negative")
+		}
+		out = *cfg
+	}
+	if out.MaxAttempts == 0 {
+		out.MaxAttempts = candidates
+		if out.MaxAttempts > defaultFailoverMaxAttempts {
+			out.MaxAttempts = defaultFailoverMaxAttempts
+		}
+	}
+	if out.MaxAttempts < 1 {
+		out.MaxAttempts = 1
+	}
+	return out, nil
+}
+
+// resolveRateLimit validates a rateLimit block; a nil block disables limiting.
+func resolveRateLimit(cfg *RateLimitConfig) (RateLimitConfig, error) {
+	if cfg == nil {
+		return RateLimitConfig{}, nil
+	}
+	if cfg.RequestsPerMinute < 0 {
+		return RateLimitConfig{}, fmt.Errorf("rateLimit.requestsPerMinute must not be negative")
+	}
+	if cfg.MaxConcurrent < 0 {
+		return RateLimitConfig{}, fmt.Errorf("rateLimit.maxConcurrent must not be negative")
+	}
+	return *cfg, nil
+}
+
+// selectCandidate applies the configured strategy to pick a healthy, enabled
+// candidate whose circuit breaker admits the request, and takes a concurrency slot
+// of its key. A half-open candidate whose trial slots were taken in the meantime,
+// or one whose key filled up, is skipped.
+func selectCandidate(svc *resolvedUserService, opts ResolveOptions) *resolvedCandidate {
+	if svc == nil {
+		return nil
+	}
+	for range svc.candidates {
+		c := pickCandidate(svc, opts)
+		if c == nil {
+			return nil
+		}
+		if slots := c.slots(); slots.tryAcquire() {
+			if c.health.breaker.admit(time.Now()) {
+				return c
+			}
+			slots.release()
+		}
+		opts.Exclude = append(opts.Exclude[:len(opts.Exclude):len(opts.Exclude)], c.id)
+	}
+	return nil
+}
+
+// pickCandidate applies the route's strategy to the candidates that are enabled,
+// available, below their key's concurrency limit and not excluded.
+func pickCandidate(svc *resolvedUserService, opts ResolveOptions) *resolvedCandidate {
+	if len(svc.candidates) == 0 {
 		return nil
 	}
 	// Build eligible list snapshot
-	now := time.Now().UnixNano()
+	now := time.Now()
 	eligible := make([]*resolvedCandidate, 0, len(svc.candidates))
 	origIdx := make([]int, 0, len(svc.candidates))
 
 	for i, c := range svc.candidates {
-		if !c.enabled {
+		if !c.enabled || isExcluded(c.id, opts.Exclude) || !c.supportsModel(opts.Model) {
 			continue
 		}
-		unhealthyUntil := atomic.LoadInt64(&c.unhealthyUntil)
-		if unhealthyUntil > 0 && now < unhealthyUntil {
+		if !c.health.available(now) || !c.slots().available() {
 			continue
 		}
 		eligible = append(eligible, c)
@@ -522,70 +1043,34 @@ func selectCandidate(svc *resolvedUserService) *resolvedCandidate {
 		return chosen
 	}
 
-	// weighted_rr: use integer path for predictable behavior
-	if svc.strategy == strategyWeightedRR {
-		weightsInt := make([]int, 0, len(eligible))
-		totalWeightInt := 0
-		for _, c := range eligible {
-			w := c.weight
+	// weighted_rr and adaptive_rr: smooth weighted round robin, with adaptive_rr
+	// scaling each weight by the candidate's quality.
+	if svc.strategy == strategyWeightedRR || svc.strategy == strategyAdaptiveRR {
+		weights := make([]float64, len(eligible))
+		for i, c := range eligible {
+			w := float64(c.weight)
 			if w <= 0 {
 				w = 1
 			}
-			weightsInt = append(weightsInt, w)
-			totalWeightInt += w
-		}
-		if totalWeightInt > 0 {
-			idx := atomic.AddUint64(&svc.rrCounter, 1) - 1
-			pos := int(idx % uint64(totalWeightInt))
-			acc := 0
-			for i, c := range eligible {
-				acc += weightsInt[i]
-				if pos < acc {
-					return c
+			if svc.strategy == strategyAdaptiveRR {
+				quality := 1 - c.health.smoothedErrorRate()
+				if quality < adaptiveQualityFloor {
+					quality = adaptiveQualityFloor
 				}
+				w = w * quality
 			}
-			// Fallback (should not happen)
-			return eligible[len(eligible)-1]
+			weights[i] = w
 		}
+		return svc.smoothWeighted(eligible, weights)
 	}
 
-	// adaptive_rr: use float path for quality-adjusted weights
-	if svc.strategy == strategyAdaptiveRR {
-		weightsFloat := make([]float64, 0, len(eligible))
-		totalWeightFloat := 0.0
-		for _, c := range eligible {
-			w := float64(c.weight)
-			if w <= 0 {
-				w = 1
-			}
-			errRate := atomicLoadFloat64(&c.adaptiveErrorRate)
-			if errRate < 0 {
-				errRate = 0
-			}
-			if errRate > 1 {
-				errRate = 1
-			}
-			quality := 1 - errRate
-			if quality < adaptiveQualityFloor {
-				quality = adaptiveQualityFloor
-			}
-			w = w * quality
-			weightsFloat = append(weightsFloat, w)
-			totalWeightFloat += w
-		}
-		if totalWeightFloat > 0 {
-			idx := atomic.AddUint64(&svc.rrCounter, 1) - 1
-			pos := math.Mod(float64(idx), totalWeightFloat)
-			acc := 0.0
-			for i, c := range eligible {
-				acc += weightsFloat[i]
-				if pos < acc {
-					return c
-				}
-			}
-			// Fallback (should not happen)
-			return eligible[len(eligible)-1]
-		}
+	switch svc.strategy {
+	case strategyLeastLatency:
+		return pickLeastLatency(svc, eligible)
+	case strategyLeastOutstanding:
+		return pickLeastOutstanding(eligible)
+	case strategyConsistentHash:
+		return pickConsistentHash(eligible, opts.affinity)
 	}
 
 	// Default round_robin
@@ -593,54 +1078,66 @@ func selectCandidate(svc *resolvedUserService) *resolvedCandidate {
 	return eligible[int(idx%uint64(len(eligible)))]
 }
 
-func updateAdaptiveMetrics(c *resolvedCandidate, now time.Time, failure bool) {
-	if adaptiveTauSeconds <= 0 {
-		return
-	}
-	last := atomic.LoadInt64(&c.adaptiveLastUpdate)
-	var failures float64
-	var samples float64
-	if last > 0 {
-		elapsed := float64(now.UnixNano()-last) / 1e9
-		if elapsed < 0 {
-			elapsed = 0
+// smoothWeighted picks one of eligible by smooth weighted round robin, as nginx
+// does: each pick raises the current weight of every eligible candidate by its
+// weight and lowers the chosen one's by their total, so the picks of a heavy
+// candidate are spread between those of lighter ones instead of coming in a burst.
+// Candidates outside the eligible set, such as those in quarantine, keep their
+// current weight until they return, which keeps the rotation fair as the set
+// changes. Integer weights are added exactly, so weighted_rr repeats precisely
+// every total-weight picks.
+func (svc *resolvedUserService) smoothWeighted(eligible []*resolvedCandidate, weights []float64) *resolvedCandidate {
+	svc.swrrMu.Lock()
+	defer svc.swrrMu.Unlock()
+	var (
+		best  *resolvedCandidate
+		total float64
+	)
+	for i, c := range eligible {
+		c.currentWeight += weights[i]
+		total += weights[i]
+		if best == nil || c.currentWeight > best.currentWeight {
+			best = c
 		}
-		decay := math.Exp(-elapsed / adaptiveTauSeconds)
-		failures = atomicLoadFloat64(&c.adaptiveFailures) * decay
-		samples = atomicLoadFloat64(&c.adaptiveSamples) * decay
-	} else {
-		failures = 0
-		samples = 0
 	}
-	if failure {
-		failures += 1
-	}
-	samples += 1
-	atomicStoreFloat64(&c.adaptiveFailures, failures)
-	atomicStoreFloat64(&c.adaptiveSamples, samples)
-	atomic.StoreInt64(&c.adaptiveLastUpdate, now.UnixNano())
-	errRate := 0.0
-	if samples > 0 {
-		errRate = failures / samples
+	best.currentWeight -= total
+	return best
+}
+
+// anyCandidateSupports reports whether some candidate of the route, healthy or not,
+// is configured to serve model.
+func anyCandidateSupports(svc *resolvedUserService, model string) bool {
+	for _, c := range svc.candidates {
+		if c.supportsModel(model) {
+			return true
+		}
 	}
-	if errRate < 0 {
-		errRate = 0
-	} else if errRate > 1 {
-		errRate = 1
+	return false
+}
+
+func isExcluded(id string, exclude []string) bool {
+	for _, ex := range exclude {
+		if ex == id {
+			return true
+		}
 	}
-	atomicStoreFloat64(&c.adaptiveErrorRate, errRate)
+	return false
 }
 
 // ReportResult updates runtime health/telemetry for a candidate.
-// Non-2xx/3xx considered failures for health; 502/503 trigger temporary quarantine.
-func (m *Manager) ReportResult(apiKey, serviceType, providerName, providerKeyName string, status int, err error) {
+// Connection errors and 5xx responses are failures and feed the circuit breaker of
+// the provider key, so other users' routes to the same key stop selecting it as
+// well once it opens. Repeated 401 responses, and 403 responses reported with
+// ErrUpstreamAuth, mark the key invalid until EnableKey is called or its value
+// changes. userID is Route.UserID.
+func (m *Manager) ReportResult(userID, serviceType, providerName, providerKeyName string, status int, err error) {
 	m.mu.RLock()
 	data := m.data
 	m.mu.RUnlock()
 	if data == nil {
 		return
 	}
-	svcUser, ok := data.users[apiKey]
+	svcUser, ok := data.users[userID]
 	if !ok {
 		return
 	}
@@ -651,36 +1148,21 @@ func (m *Manager) ReportResult(apiKey, serviceType, providerName, providerKeyNam
 	now := time.Now()
 	for _, c := range svc.candidates {
 		if c.provider != nil && c.provider.provider.Name == providerName && c.providerKeyName == providerKeyName {
-			atomic.AddUint64(&c.totalRequests, 1)
-			atomic.StoreInt64(&c.lastStatus, int64(status))
-			atomic.StoreInt64(&c.lastUpdated, now.UnixNano())
+			atomic.AddUint64(&c.stats.totalRequests, 1)
+			atomic.StoreInt64(&c.stats.lastStatus, int64(status))
+			atomic.StoreInt64(&c.stats.lastUpdated, now.UnixNano())
 
-			failure := err != nil || status == 0 || status >= 500
+			failure := (err != nil && !errors.Is(err, ErrUpstreamAuth)) || status == 0 || status >= 500
 			if failure {
-				atomic.AddUint64(&c.totalErrors, 1)
+				atomic.AddUint64(&c.stats.totalErrors, 1)
 			}
-
-			updateAdaptiveMetrics(c, now, failure)
-
-			if err != nil {
-				c.lastError.Store(err.Error())
-			} else if status >= 500 {
-				c.lastError.Store(fmt.Sprintf("upstream status %d", status))
-			} else {
-				c.lastError.Store("")
+			if errors.Is(err, ErrUpstreamTimeout) {
+				atomic.AddUint64(&c.stats.totalTimeouts, 1)
 			}
+			c.stats.lastError.Store(describeFailure(status, err))
 
-			if failure {
-				backoff := 30 * time.Second
-				if status == 502 || status == 503 {
-					backoff = 60 * time.Second
-				}
-				until := now.Add(backoff).UnixNano()
-				atomic.StoreInt64(&c.unhealthyUntil, until)
-			} else if status >= 200 && status < 500 {
-				// clear unhealthy flag on success or client error
-				atomic.StoreInt64(&c.unhealthyUntil, 0)
-			}
+			// Health is tracked per provider key so every route sharing it reacts at once.
+			c.health.record(now, status, err, failure)
 
 			metrics.ObserveCandidateResult(serviceType, providerName, providerKeyName, status, err)
 			return
@@ -689,27 +1171,40 @@ func (m *Manager) ReportResult(apiKey, serviceType, providerName, providerKeyNam
 }
 
 // CandidateRuntimeStatus captures runtime statistics for a single upstream candidate.
+// LatencyEWMAMs and InFlight, the inputs of least_latency and least_outstanding,
+// are those of the provider key and shared with every route using it.
 type CandidateRuntimeStatus struct {
-	ProviderName    string     `json:"provider_name"`
-	ProviderKeyName string     `json:"provider_key_name"`
-	Weight          int        `json:"weight"`
-	Enabled         bool       `json:"enabled"`
-	Healthy         bool       `json:"healthy"`
-	UnhealthyUntil  *time.Time `json:"unhealthy_until,omitempty"`
-	TotalRequests   uint64     `json:"total_requests"`
-	TotalErrors     uint64     `json:"total_errors"`
-	ErrorRate       float64    `json:"error_rate"`
-	SmoothedError   float64    `json:"smoothed_error_rate,omitempty"`
-	EffectiveWeight float64    `json:"effective_weight,omitempty"`
-	LastStatus      int        `json:"last_status"`
-	LastError       string     `json:"last_error,omitempty"`
-	LastUpdated     time.Time  `json:"last_updated,omitempty"`
-	Tags            []string   `json:"tags,omitempty"`
-}
-
-// RuntimeStatus returns runtime statistics for a user/service route.
-func (m *Manager) RuntimeStatus(apiKey, serviceType string) ([]CandidateRuntimeStatus, error) {
-	if apiKey == "" {
+	ProviderName    string             `json:"provider_name"`
+	ProviderKeyName string             `json:"provider_key_name"`
+	Weight          int                `json:"weight"`
+	Enabled         bool               `json:"enabled"`
+	Healthy         bool               `json:"healthy"`
+	CircuitState    string             `json:"circuit_state"`
+	Invalid         bool               `json:"invalid"`
+	InvalidSince    *time.Time         `json:"invalid_since,omitempty"`
+	InvalidStatus   int                `json:"invalid_status,omitempty"`
+	UnhealthyUntil  *time.Time         `json:"unhealthy_until,omitempty"`
+	CooldownUntil   *time.Time         `json:"cooldown_until,omitempty"`
+	TotalRequests   uint64             `json:"total_requests"`
+	TotalErrors     uint64             `json:"total_errors"`
+	TotalTimeouts   uint64             `json:"total_timeouts,omitempty"`
+	ErrorRate       float64            `json:"error_rate"`
+	SmoothedError   float64            `json:"smoothed_error_rate,omitempty"`
+	EffectiveWeight float64            `json:"effective_weight,omitempty"`
+	LatencyEWMAMs   float64            `json:"latency_ewma_ms,omitempty"`
+	LatencySamples  uint64             `json:"latency_samples,omitempty"`
+	InFlight        int64              `json:"in_flight"`
+	LastStatus      int                `json:"last_status"`
+	LastError       string             `json:"last_error,omitempty"`
+	LastUpdated     time.Time          `json:"last_updated,omitempty"`
+	Tags            []string           `json:"tags,omitempty"`
+	HealthCheck     *HealthCheckStatus `json:"health_check,omitempty"`
+}
+
+// RuntimeStatus returns runtime statistics for a user/service route. userID is the
+// user's API key, or apiKeyHash for users declared by hash.
+func (m *Manager) RuntimeStatus(userID, serviceType string) ([]CandidateRuntimeStatus, error) {
+	if userID == "" {
 		return nil, ErrAPIKeyRequired
 	}
 	if serviceType == "" {
@@ -724,7 +1219,7 @@ func (m *Manager) RuntimeStatus(apiKey, serviceType string) ([]CandidateRuntimeS
 		return nil, ErrConfigNotLoaded
 	}
 
-	user, ok := data.users[apiKey]
+	user, ok := data.users[userID]
 	if !ok {
 		return nil, ErrUserNotFound
 	}
@@ -734,47 +1229,28 @@ func (m *Manager) RuntimeStatus(apiKey, serviceType string) ([]CandidateRuntimeS
 		return nil, fmt.Errorf("%w for user '%s'", ErrServiceNotFound, user.user.Name)
 	}
 
-	now := time.Now()
 	statuses := make([]CandidateRuntimeStatus, 0, len(svc.candidates))
 	for _, c := range svc.candidates {
-		total := atomic.LoadUint64(&c.totalRequests)
-		errors := atomic.LoadUint64(&c.totalErrors)
-		lastStatus := int(atomic.LoadInt64(&c.lastStatus))
-		lastUpdatedUnix := atomic.LoadInt64(&c.lastUpdated)
-		unhealthyUntilUnix := atomic.LoadInt64(&c.unhealthyUntil)
-
-		healthy := c.enabled
-		var unhealthyUntil *time.Time
-		if unhealthyUntilUnix > 0 {
-			t := time.Unix(0, unhealthyUntilUnix)
-			if now.Before(t) {
-				healthy = false
-			}
-			unhealthyUntil = &t
-		}
+		total := atomic.LoadUint64(&c.stats.totalRequests)
+		errors := atomic.LoadUint64(&c.stats.totalErrors)
+		lastStatus := int(atomic.LoadInt64(&c.stats.lastStatus))
+		lastUpdatedUnix := atomic.LoadInt64(&c.stats.lastUpdated)
+		state, unhealthyUntil := c.health.breaker.snapshot()
+		invalidSince, invalidStatus := c.health.invalid()
+		healthy := c.enabled && state == circuitClosed && invalidSince == nil
 
 		var lastUpdated time.Time
 		if lastUpdatedUnix > 0 {
 			lastUpdated = time.Unix(0, lastUpdatedUnix)
 		}
 
-		var lastError string
-		if v := c.lastError.Load(); v != nil {
-			if s, ok := v.(string); ok {
-				lastError = s
-			}
-		}
+		lastError := loadLastError(&c.stats.lastError)
 
 		errorRate := 0.0
 		if total > 0 {
 			errorRate = float64(errors) / float64(total)
 		}
-		smoothed := atomicLoadFloat64(&c.adaptiveErrorRate)
-		if smoothed < 0 {
-			smoothed = 0
-		} else if smoothed > 1 {
-			smoothed = 1
-		}
+		smoothed := c.health.smoothedErrorRate()
 		effectiveWeight := float64(c.weight)
 		if effectiveWeight <= 0 {
 			effectiveWeight = 1
@@ -793,16 +1269,26 @@ func (m *Manager) RuntimeStatus(apiKey, serviceType string) ([]CandidateRuntimeS
 			Weight:          c.weight,
 			Enabled:         c.enabled,
 			Healthy:         healthy,
+			CircuitState:    state.String(),
+			Invalid:         invalidSince != nil,
+			InvalidSince:    invalidSince,
+			InvalidStatus:   invalidStatus,
 			UnhealthyUntil:  unhealthyUntil,
+			CooldownUntil:   c.health.cooldown(time.Now()),
 			TotalRequests:   total,
 			TotalErrors:     errors,
+			TotalTimeouts:   atomic.LoadUint64(&c.stats.totalTimeouts),
 			ErrorRate:       errorRate,
 			SmoothedError:   smoothed,
 			EffectiveWeight: effectiveWeight,
+			LatencyEWMAMs:   c.health.latency(),
+			LatencySamples:  atomic.LoadUint64(&c.health.latencySamples),
+			InFlight:        c.health.outstanding(),
 			LastStatus:      lastStatus,
 			LastError:       lastError,
 			LastUpdated:     lastUpdated,
 			Tags:            append([]string(nil), c.tags...),
+			HealthCheck:     c.health.healthCheckStatus(),
 		}
 
 		statuses = append(statuses, status)
@@ -3,11 +3,21 @@ package config
 import (
 	"context"
 	"errors"
+	"fmt"
 	"math"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
 	"os"
 	"path/filepath"
+	"reflect"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
+
+	"piapi/internal/metrics"
 )
 
 func TestManagerLoadAndResolve(t *testing.T) {
@@ -234,7 +244,8 @@ users:
 		sequence = append(sequence, route.Provider.Name)
 	}
 
-	expectedCycle := []string{"provider-alpha", "provider-alpha", "provider-alpha", "provider-beta"}
+	// Smooth weighted round robin interleaves the lighter candidate.
+	expectedCycle := []string{"provider-alpha", "provider-alpha", "provider-beta", "provider-alpha"}
 	for i, name := range sequence {
 		if name != expectedCycle[i%len(expectedCycle)] {
 			t.Fatalf("unexpected provider at %d: got %s want %s", i, name, expectedCycle[i%len(expectedCycle)])
@@ -511,8 +522,8 @@ func writeTempConfig(t *testing.T, contents string) string {
 	return path
 }
 
-// TestWeightedRRIntegerPath verifies that weighted_rr uses integer arithmetic
-// for predictable and precise weight distribution, avoiding float precision issues.
+// TestWeightedRRIntegerPath verifies that weighted_rr distributes integer weights
+// exactly, interleaving the candidates rather than sending each one a burst.
 func TestWeightedRRIntegerPath(t *testing.T) {
 	yaml := `
 providers:
@@ -559,7 +570,7 @@ users:
 	}
 
 	// Total weight is 5+3+2=10, so the cycle should repeat every 10 requests
-	// Expected pattern: alpha(5x), beta(3x), gamma(2x)
+	// with alpha picked 5 times, beta 3 times and gamma 2 times.
 	totalWeight := 10
 	iterations := 1000 // Test multiple cycles
 
@@ -599,9 +610,8 @@ users:
 	}
 
 	expectedCycle := []string{
-		"provider-alpha", "provider-alpha", "provider-alpha", "provider-alpha", "provider-alpha",
-		"provider-beta", "provider-beta", "provider-beta",
-		"provider-gamma", "provider-gamma",
+		"provider-alpha", "provider-beta", "provider-gamma", "provider-alpha", "provider-alpha",
+		"provider-beta", "provider-alpha", "provider-gamma", "provider-beta", "provider-alpha",
 	}
 
 	for i := 0; i < totalWeight*2; i++ { // Test 2 full cycles
@@ -616,3 +626,2017 @@ users:
 		}
 	}
 }
+
+func TestResolveWithOptionsExcludesTriedCandidates(t *testing.T) {
+	yaml := `
+providers:
+  - name: provider-alpha
+    apiKeys:
+      primary: key-1
+      secondary: key-2
+      tertiary: key-3
+      spare: key-4
+    services:
+      - type: codex
+        baseUrl: https://alpha.example.com/v1
+users:
+  - name: agg
+    apiKey: agg-key
+    services:
+      codex:
+        strategy: sticky_healthy
+        candidates:
+          - providerName: provider-alpha
+            providerKeyName: primary
+          - providerName: provider-alpha
+            providerKeyName: secondary
+          - providerName: provider-alpha
+            providerKeyName: tertiary
+          - providerName: provider-alpha
+            providerKeyName: spare
+  - name: limited
+    apiKey: limited-key
+    services:
+      codex:
+        strategy: round_robin
+        failover:
+          maxAttempts: 2
+          deadline: 45s
+        candidates:
+          - providerName: provider-alpha
+            providerKeyName: primary
+`
+
+	path := writeTempConfig(t, yaml)
+	manager := NewManager()
+	if err := manager.LoadFromFile(path); err != nil {
+		t.Fatalf("load config: %v", err)
+	}
+
+	first, err := manager.Resolve("agg-key", "codex")
+	if err != nil {
+		t.Fatalf("resolve: %v", err)
+	}
+	if first.Failover.MaxAttempts != defaultFailoverMaxAttempts {
+		t.Fatalf("expected default max attempts %d, got %d", defaultFailoverMaxAttempts, first.Failover.MaxAttempts)
+	}
+
+	next, err := manager.ResolveWithOptions("agg-key", "codex", ResolveOptions{Exclude: []string{first.CandidateID()}})
+	if err != nil {
+		t.Fatalf("resolve excluding: %v", err)
+	}
+	if next.UpstreamKeyName != "secondary" {
+		t.Fatalf("expected secondary after excluding primary, got %s", next.UpstreamKeyName)
+	}
+
+	all := []string{"provider-alpha/primary", "provider-alpha/secondary", "provider-alpha/tertiary", "provider-alpha/spare"}
+	if _, err := manager.ResolveWithOptions("agg-key", "codex", ResolveOptions{Exclude: all}); !errors.Is(err, ErrNoActiveUpstream) {
+		t.Fatalf("expected ErrNoActiveUpstream when all excluded, got %v", err)
+	}
+
+	limited, err := manager.Resolve("limited-key", "codex")
+	if err != nil {
+		t.Fatalf("resolve limited: %v", err)
+	}
+	if limited.Failover.MaxAttempts != 2 || limited.Failover.Deadline.Std() != 45*time.Second {
+		t.Fatalf("unexpected failover policy: %+v", limited.Failover)
+	}
+}
+
+func TestKeyHealthSharedAcrossUsers(t *testing.T) {
+	yaml := `
+providers:
+  - name: provider-alpha
+    apiKeys:
+      main-key: key-1
+      spare-key: key-2
+    services:
+      - type: codex
+        baseUrl: https://alpha.example.com/v1
+      - type: claude_code
+        baseUrl: https://alpha.example.com/claude
+users:
+  - name: alice
+    apiKey: alice-key
+    services:
+      codex:
+        providerName: provider-alpha
+        providerKeyName: main-key
+      claude_code:
+        providerName: provider-alpha
+        providerKeyName: main-key
+  - name: bob
+    apiKey: bob-key
+    services:
+      codex:
+        strategy: round_robin
+        candidates:
+          - providerName: provider-alpha
+            providerKeyName: main-key
+          - providerName: provider-alpha
+            providerKeyName: spare-key
+`
+
+	path := writeTempConfig(t, yaml)
+	manager := NewManager()
+	if err := manager.LoadFromFile(path); err != nil {
+		t.Fatalf("load config: %v", err)
+	}
+
+	// Alice's failure quarantines main-key for codex, so Bob skips it without failing first.
+	manager.ReportResult("alice-key", "codex", "provider-alpha", "main-key", 503, nil)
+
+	for i := 0; i < 4; i++ {
+		route, err := manager.Resolve("bob-key", "codex")
+		if err != nil {
+			t.Fatalf("resolve bob: %v", err)
+		}
+		if route.UpstreamKeyName != "spare-key" {
+			t.Fatalf("expected bob to avoid quarantined key, got %s", route.UpstreamKeyName)
+		}
+	}
+
+	// Health is scoped per service type: claude_code on the same key is unaffected.
+	if _, err := manager.Resolve("alice-key", "claude_code"); err != nil {
+		t.Fatalf("expected claude_code route to stay healthy: %v", err)
+	}
+
+	bobStats, err := manager.RuntimeStatus("bob-key", "codex")
+	if err != nil {
+		t.Fatalf("runtime status: %v", err)
+	}
+	for _, s := range bobStats {
+		if s.ProviderKeyName == "main-key" {
+			if s.Healthy || s.TotalRequests != 0 {
+				t.Fatalf("expected bob's route view to show shared quarantine without own traffic: %+v", s)
+			}
+		}
+	}
+
+	keys, err := manager.KeyHealth()
+	if err != nil {
+		t.Fatalf("key health: %v", err)
+	}
+	if len(keys) != 3 {
+		t.Fatalf("expected 3 key health entries, got %+v", keys)
+	}
+	for _, k := range keys {
+		if k.ProviderKeyName == "main-key" && k.ServiceType == "codex" {
+			if k.Healthy || k.Routes != 2 || k.TotalRequests != 1 {
+				t.Fatalf("unexpected shared key health: %+v", k)
+			}
+		}
+	}
+}
+
+func TestReloadPreservesRuntimeState(t *testing.T) {
+	base := `
+providers:
+  - name: provider-alpha
+    apiKeys:
+      primary: %s
+      secondary: key-2
+    services:
+      - type: codex
+        baseUrl: https://alpha.example.com/v1
+users:
+  - name: %s
+    apiKey: agg-key
+    services:
+      codex:
+        strategy: round_robin
+        candidates:
+          - providerName: provider-alpha
+            providerKeyName: primary
+          - providerName: provider-alpha
+            providerKeyName: secondary
+`
+
+	path := writeTempConfig(t, fmt.Sprintf(base, "key-1", "before"))
+	manager := NewManager()
+	if err := manager.LoadFromFile(path); err != nil {
+		t.Fatalf("load config: %v", err)
+	}
+
+	manager.ReportResult("agg-key", "codex", "provider-alpha", "primary", 503, nil)
+	manager.ReportResult("agg-key", "codex", "provider-alpha", "secondary", 200, nil)
+
+	// Renaming the user must not put the quarantined key back into rotation.
+	if err := os.WriteFile(path, []byte(fmt.Sprintf(base, "key-1", "after")), 0o600); err != nil {
+		t.Fatalf("rewrite config: %v", err)
+	}
+	if err := manager.LoadFromFile(path); err != nil {
+		t.Fatalf("reload config: %v", err)
+	}
+
+	for i := 0; i < 3; i++ {
+		route, err := manager.Resolve("agg-key", "codex")
+		if err != nil {
+			t.Fatalf("resolve after reload: %v", err)
+		}
+		if route.UpstreamKeyName != "secondary" {
+			t.Fatalf("expected quarantine to survive reload, got %s", route.UpstreamKeyName)
+		}
+		if route.User.Name != "after" {
+			t.Fatalf("expected renamed user, got %s", route.User.Name)
+		}
+	}
+
+	stats, err := manager.RuntimeStatus("agg-key", "codex")
+	if err != nil {
+		t.Fatalf("runtime status: %v", err)
+	}
+	for _, s := range stats {
+		if s.TotalRequests != 1 {
+			t.Fatalf("expected counters carried over, got %+v", s)
+		}
+	}
+
+	// Changing the key value is a real change: its state is reset.
+	if err := os.WriteFile(path, []byte(fmt.Sprintf(base, "key-rotated", "after")), 0o600); err != nil {
+		t.Fatalf("rewrite config: %v", err)
+	}
+	if err := manager.LoadFromFile(path); err != nil {
+		t.Fatalf("reload config: %v", err)
+	}
+
+	stats, err = manager.RuntimeStatus("agg-key", "codex")
+	if err != nil {
+		t.Fatalf("runtime status: %v", err)
+	}
+	for _, s := range stats {
+		switch s.ProviderKeyName {
+		case "primary":
+			if !s.Healthy || s.TotalRequests != 0 {
+				t.Fatalf("expected rotated key to start fresh, got %+v", s)
+			}
+		case "secondary":
+			if s.TotalRequests != 1 {
+				t.Fatalf("expected unchanged key to keep counters, got %+v", s)
+			}
+		}
+	}
+}
+
+func TestReloadPreservesStickyCandidate(t *testing.T) {
+	initial := `
+providers:
+  - name: provider-alpha
+    apiKeys:
+      primary: key-1
+      secondary: key-2
+    services:
+      - type: codex
+        baseUrl: https://alpha.example.com/v1
+users:
+  - name: agg
+    apiKey: agg-key
+    services:
+      codex:
+        strategy: sticky_healthy
+        candidates:
+          - providerName: provider-alpha
+            providerKeyName: primary
+          - providerName: provider-alpha
+            providerKeyName: secondary
+`
+	path := writeTempConfig(t, initial)
+	manager := NewManager()
+	if err := manager.LoadFromFile(path); err != nil {
+		t.Fatalf("load config: %v", err)
+	}
+
+	manager.ReportResult("agg-key", "codex", "provider-alpha", "primary", 503, nil)
+	route, err := manager.Resolve("agg-key", "codex")
+	if err != nil || route.UpstreamKeyName != "secondary" {
+		t.Fatalf("expected sticky move to secondary, got %v %v", route, err)
+	}
+
+	// Reorder candidates; the sticky choice follows the candidate, not the index.
+	reordered := strings.Replace(initial, `          - providerName: provider-alpha
+            providerKeyName: primary
+          - providerName: provider-alpha
+            providerKeyName: secondary`, `          - providerName: provider-alpha
+            providerKeyName: secondary
+          - providerName: provider-alpha
+            providerKeyName: primary`, 1)
+	if err := os.WriteFile(path, []byte(reordered), 0o600); err != nil {
+		t.Fatalf("rewrite config: %v", err)
+	}
+	if err := manager.LoadFromFile(path); err != nil {
+		t.Fatalf("reload config: %v", err)
+	}
+
+	route, err = manager.Resolve("agg-key", "codex")
+	if err != nil || route.UpstreamKeyName != "secondary" {
+		t.Fatalf("expected sticky candidate to survive reload, got %v %v", route, err)
+	}
+}
+
+func TestAcquireRateLimitEnforcesLimits(t *testing.T) {
+	yaml := `
+providers:
+  - name: provider-alpha
+    apiKeys:
+      primary: key-1
+    services:
+      - type: codex
+        baseUrl: https://alpha.example.com/v1
+      - type: claude
+        baseUrl: https://alpha.example.com/anthropic
+users:
+  - name: limited
+    apiKey: limited-key
+    rateLimit:
+      requestsPerMinute: 3
+    services:
+      codex:
+        providerName: provider-alpha
+        providerKeyName: primary
+        rateLimit:
+          maxConcurrent: 1
+      claude:
+        providerName: provider-alpha
+        providerKeyName: primary
+`
+
+	path := writeTempConfig(t, yaml)
+	manager := NewManager()
+	if err := manager.LoadFromFile(path); err != nil {
+		t.Fatalf("load config: %v", err)
+	}
+
+	release, err := manager.AcquireRateLimit("limited-key", "codex")
+	if err != nil {
+		t.Fatalf("first acquire: %v", err)
+	}
+
+	// The per-service concurrency limit rejects and refunds the user-wide token.
+	_, err = manager.AcquireRateLimit("limited-key", "codex")
+	var limited *RateLimitError
+	if !errors.As(err, &limited) || !errors.Is(err, ErrRateLimited) {
+		t.Fatalf("expected rate limit error, got %v", err)
+	}
+	if limited.Limit != RateLimitMaxConcurrent || limited.ServiceType != "codex" || limited.User != "limited" {
+		t.Fatalf("unexpected rejection: %+v", limited)
+	}
+	release()
+	release() // releasing twice must not free a second slot
+
+	for i := 0; i < 2; i++ {
+		rel, err := manager.AcquireRateLimit("limited-key", "claude")
+		if err != nil {
+			t.Fatalf("acquire %d within rpm: %v", i, err)
+		}
+		rel()
+	}
+
+	_, err = manager.AcquireRateLimit("limited-key", "claude")
+	if !errors.As(err, &limited) {
+		t.Fatalf("expected requests per minute rejection, got %v", err)
+	}
+	if limited.Limit != RateLimitRequestsPerMinute || limited.ServiceType != "" {
+		t.Fatalf("unexpected rejection: %+v", limited)
+	}
+	if limited.RetryAfter <= 0 || limited.RetryAfter > 20*time.Second {
+		t.Fatalf("expected retry after about 20s, got %v", limited.RetryAfter)
+	}
+
+	statuses, err := manager.RateLimits()
+	if err != nil {
+		t.Fatalf("rate limits: %v", err)
+	}
+	if len(statuses) != 2 {
+		t.Fatalf("expected user and codex limiters, got %+v", statuses)
+	}
+	if statuses[0].ServiceType != "" || statuses[0].Rejected != 1 || statuses[0].InFlight != 0 {
+		t.Fatalf("unexpected user limiter status: %+v", statuses[0])
+	}
+	if statuses[1].ServiceType != "codex" || statuses[1].Rejected != 1 {
+		t.Fatalf("unexpected codex limiter status: %+v", statuses[1])
+	}
+}
+
+func TestRateLimitStateSurvivesReload(t *testing.T) {
+	base := `
+providers:
+  - name: provider-alpha
+    apiKeys:
+      primary: key-1
+    services:
+      - type: codex
+        baseUrl: https://alpha.example.com/v1
+users:
+  - name: limited
+    apiKey: limited-key
+    rateLimit:
+      requestsPerMinute: %d
+      maxConcurrent: 5
+    services:
+      codex:
+        providerName: provider-alpha
+        providerKeyName: primary
+`
+
+	path := writeTempConfig(t, fmt.Sprintf(base, 2))
+	manager := NewManager()
+	if err := manager.LoadFromFile(path); err != nil {
+		t.Fatalf("load config: %v", err)
+	}
+
+	release, err := manager.AcquireRateLimit("limited-key", "codex")
+	if err != nil {
+		t.Fatalf("acquire: %v", err)
+	}
+	if _, err := manager.AcquireRateLimit("limited-key", "codex"); err != nil {
+		t.Fatalf("second acquire: %v", err)
+	}
+
+	if err := os.WriteFile(path, []byte(fmt.Sprintf(base, 3)), 0o600); err != nil {
+		t.Fatalf("rewrite config: %v", err)
+	}
+	if err := manager.LoadFromFile(path); err != nil {
+		t.Fatalf("reload config: %v", err)
+	}
+
+	if _, err := manager.AcquireRateLimit("limited-key", "codex"); !errors.Is(err, ErrRateLimited) {
+		t.Fatalf("expected exhausted bucket to carry over reload, got %v", err)
+	}
+
+	release()
+	statuses, err := manager.RateLimits()
+	if err != nil {
+		t.Fatalf("rate limits: %v", err)
+	}
+	if len(statuses) != 1 || statuses[0].RequestsPerMinute != 3 || statuses[0].InFlight != 1 {
+		t.Fatalf("expected reloaded limit with in-flight state kept, got %+v", statuses)
+	}
+
+	// Lifting the rate limit and imposing it again starts with a full bucket.
+	for _, rpm := range []int{0, 2} {
+		if err := os.WriteFile(path, []byte(fmt.Sprintf(base, rpm)), 0o600); err != nil {
+			t.Fatalf("rewrite config: %v", err)
+		}
+		if err := manager.LoadFromFile(path); err != nil {
+			t.Fatalf("reload config: %v", err)
+		}
+	}
+	for i := 0; i < 2; i++ {
+		if _, err := manager.AcquireRateLimit("limited-key", "codex"); err != nil {
+			t.Fatalf("expected a full bucket after the limit was imposed, acquire %d: %v", i, err)
+		}
+	}
+}
+
+func TestParseValidatesBudgets(t *testing.T) {
+	base := `
+providers:
+  - name: provider-alpha
+    apiKeys:
+      primary: key-1
+    services:
+      - type: codex
+        baseUrl: https://alpha.example.com/v1
+        pricing:
+          prompt: %s
+users:
+  - name: %s
+    apiKey: budget-key
+    budget:
+      daily:
+        tokens: %s
+    services:
+      codex:
+        providerName: provider-alpha
+        providerKeyName: primary
+`
+
+	cases := []struct {
+		name, price, user, tokens, wantErr string
+	}{
+		{"valid", "2.5", "alice", "1000", ""},
+		{"negative price", "-1", "alice", "1000", "pricing must not be negative"},
+		{"negative budget", "2.5", "alice", "-5", "budget.daily must not be negative"},
+		{"unnamed user", "2.5", `""`, "1000", "name is required when a budget is configured"},
+	}
+	for _, tc := range cases {
+		cfg, err := parse([]byte(fmt.Sprintf(base, tc.price, tc.user, tc.tokens)))
+		if tc.wantErr == "" {
+			if err != nil {
+				t.Fatalf("%s: unexpected error: %v", tc.name, err)
+			}
+			user := cfg.users["budget-key"].user
+			if user.Budget == nil || user.Budget.Daily.Tokens != 1000 {
+				t.Fatalf("%s: budget not retained: %+v", tc.name, user.Budget)
+			}
+			continue
+		}
+		if err == nil || !strings.Contains(err.Error(), tc.wantErr) {
+			t.Fatalf("%s: expected error containing %q, got %v", tc.name, tc.wantErr, err)
+		}
+	}
+
+	// Users sharing a name would share a budget in the ledger.
+	shared := `
+providers:
+  - name: provider-alpha
+    apiKeys:
+      primary: key-1
+    services:
+      - type: codex
+        baseUrl: https://alpha.example.com/v1
+users:
+  - name: alice
+    apiKey: first-key
+    services:
+      codex:
+        providerName: provider-alpha
+        providerKeyName: primary
+  - name: alice
+    apiKey: second-key
+%s    services:
+      codex:
+        providerName: provider-alpha
+        providerKeyName: primary
+`
+	if _, err := parse([]byte(fmt.Sprintf(shared, ""))); err != nil {
+		t.Fatalf("expected shared names allowed without budgets: %v", err)
+	}
+	_, err := parse([]byte(fmt.Sprintf(shared, "    budget:\n      daily:\n        tokens: 1000\n")))
+	if err == nil || !strings.Contains(err.Error(), "names must be unique when a budget is configured") {
+		t.Fatalf("expected shared names rejected with a budget, got %v", err)
+	}
+}
+
+func TestResolveFiltersCandidatesByModel(t *testing.T) {
+	yaml := `
+providers:
+  - name: openai
+    apiKeys:
+      main: key-1
+    services:
+      - type: codex
+        baseUrl: https://openai.example.com/v1
+        models: ["gpt-4o*", "o3*"]
+  - name: reasoning
+    apiKeys:
+      main: key-2
+    services:
+      - type: codex
+        baseUrl: https://reasoning.example.com/v1
+users:
+  - name: agg
+    apiKey: agg-key
+    services:
+      codex:
+        strategy: round_robin
+        candidates:
+          - providerName: openai
+            providerKeyName: main
+            models: ["GPT-4O*"]
+          - providerName: reasoning
+            providerKeyName: main
+            models: ["o3", "o4-*"]
+`
+
+	manager := NewManager()
+	if err := manager.LoadFromFile(writeTempConfig(t, yaml)); err != nil {
+		t.Fatalf("load config: %v", err)
+	}
+
+	cases := map[string]string{
+		"gpt-4o":      "openai",
+		"gpt-4o-mini": "openai",
+		"o3":          "reasoning",
+		"o4-mini":     "reasoning",
+	}
+	for model, want := range cases {
+		for i := 0; i < 2; i++ {
+			route, err := manager.ResolveWithOptions("agg-key", "codex", ResolveOptions{Model: model})
+			if err != nil {
+				t.Fatalf("resolve %s: %v", model, err)
+			}
+			if route.Provider.Name != want {
+				t.Fatalf("model %s routed to %s, want %s", model, route.Provider.Name, want)
+			}
+		}
+	}
+
+	// o3-mini passes the openai service patterns but not the candidate's narrower list.
+	if _, err := manager.ResolveWithOptions("agg-key", "codex", ResolveOptions{Model: "o3-mini"}); !errors.Is(err, ErrModelNotSupported) {
+		t.Fatalf("expected ErrModelNotSupported, got %v", err)
+	}
+	if _, err := manager.ResolveWithOptions("agg-key", "codex", ResolveOptions{Model: "o3", Exclude: []string{"reasoning/main"}}); !errors.Is(err, ErrNoActiveUpstream) {
+		t.Fatalf("expected ErrNoActiveUpstream when the only supporting candidate is excluded, got %v", err)
+	}
+	if _, err := manager.Resolve("agg-key", "codex"); err != nil {
+		t.Fatalf("requests without a model must not be filtered: %v", err)
+	}
+}
+
+func TestMatchModel(t *testing.T) {
+	cases := []struct {
+		pattern, model string
+		want           bool
+	}{
+		{"gpt-4o", "gpt-4o", true},
+		{"gpt-4o", "gpt-4o-mini", false},
+		{"gpt-4o*", "gpt-4o-mini", true},
+		{"*", "anything", true},
+		{"*claude*", "anthropic/claude-sonnet-4", true},
+		{"claude-*-4", "claude-sonnet-4", true},
+		{"claude-*-4", "claude-sonnet-4-5", false},
+		{"a*a", "a", false},
+	}
+	for _, tc := range cases {
+		if got := matchModel(tc.pattern, tc.model); got != tc.want {
+			t.Fatalf("matchModel(%q, %q) = %v, want %v", tc.pattern, tc.model, got, tc.want)
+		}
+	}
+}
+
+func TestResolveAppliesModelAliasesAndMap(t *testing.T) {
+	yaml := `
+providers:
+  - name: router
+    apiKeys:
+      main: key-1
+    services:
+      - type: claude_code
+        baseUrl: https://router.example.com/v1
+        models: ["openai/*"]
+        modelMap:
+          claude-sonnet-4: anthropic/claude-sonnet-4
+users:
+  - name: aliased
+    apiKey: alias-key
+    services:
+      claude_code:
+        providerName: router
+        providerKeyName: main
+        modelAliases:
+          smart: claude-sonnet-4
+`
+
+	manager := NewManager()
+	if err := manager.LoadFromFile(writeTempConfig(t, yaml)); err != nil {
+		t.Fatalf("load config: %v", err)
+	}
+
+	route, err := manager.ResolveWithOptions("alias-key", "claude_code", ResolveOptions{Model: "smart"})
+	if err != nil {
+		t.Fatalf("resolve alias: %v", err)
+	}
+	if route.Model != "claude-sonnet-4" || route.UpstreamModel != "anthropic/claude-sonnet-4" {
+		t.Fatalf("unexpected models: %q -> %q", route.Model, route.UpstreamModel)
+	}
+
+	route, err = manager.ResolveWithOptions("alias-key", "claude_code", ResolveOptions{Model: "openai/gpt-4o"})
+	if err != nil {
+		t.Fatalf("resolve unmapped: %v", err)
+	}
+	if route.UpstreamModel != "openai/gpt-4o" {
+		t.Fatalf("expected unmapped model passed through, got %q", route.UpstreamModel)
+	}
+
+	if _, err := manager.ResolveWithOptions("alias-key", "claude_code", ResolveOptions{Model: "fast"}); !errors.Is(err, ErrModelNotSupported) {
+		t.Fatalf("expected unknown alias to be unsupported, got %v", err)
+	}
+
+	route, err = manager.Resolve("alias-key", "claude_code")
+	if err != nil {
+		t.Fatalf("resolve without model: %v", err)
+	}
+	if route.Model != "" || route.UpstreamModel != "" {
+		t.Fatalf("expected no models without a requested model, got %q -> %q", route.Model, route.UpstreamModel)
+	}
+}
+
+func TestClientAuthStyles(t *testing.T) {
+	base := `
+providers:
+  - name: provider-alpha
+    apiKeys:
+      primary: key-1
+    services:
+      - type: gemini
+        baseUrl: https://alpha.example.com
+users:
+  - name: alice
+    apiKey: alice-key
+    services:
+      gemini:
+        providerName: provider-alpha
+        providerKeyName: primary
+clientAuth:
+  gemini:
+    styles: %s
+`
+	manager := NewManager()
+	if err := manager.LoadFromFile(writeTempConfig(t, fmt.Sprintf(base, `[X-Goog-Api-Key, query, query]`))); err != nil {
+		t.Fatalf("load config: %v", err)
+	}
+	if got := manager.ClientAuthStyles("gemini"); !reflect.DeepEqual(got, []string{ClientAuthXGoogAPIKey, ClientAuthQuery}) {
+		t.Fatalf("unexpected gemini styles: %v", got)
+	}
+	if got := manager.ClientAuthStyles("codex"); !reflect.DeepEqual(got, DefaultClientAuthStyles) {
+		t.Fatalf("expected default styles for unlisted service type, got %v", got)
+	}
+
+	for styles, wantErr := range map[string]string{
+		`[]`:       "styles must not be empty",
+		`[cookie]`: "unsupported style 'cookie'",
+	} {
+		if _, err := parse([]byte(fmt.Sprintf(base, styles))); err == nil || !strings.Contains(err.Error(), wantErr) {
+			t.Fatalf("styles %s: expected error containing %q, got %v", styles, wantErr, err)
+		}
+	}
+}
+
+func TestResolveByHashedAPIKey(t *testing.T) {
+	hash, err := HashAPIKey("bob-secret")
+	if err != nil {
+		t.Fatalf("hash key: %v", err)
+	}
+	base := `
+providers:
+  - name: provider-alpha
+    apiKeys:
+      primary: key-1
+    services:
+      - type: codex
+        baseUrl: https://alpha.example.com/v1
+users:
+  - name: alice
+    apiKey: %s
+    services:
+      codex:
+        providerName: provider-alpha
+        providerKeyName: primary
+  - name: bob
+    apiKeyHash: %s
+    services:
+      codex:
+        providerName: provider-alpha
+        providerKeyName: primary
+`
+	manager := NewManager()
+	if err := manager.LoadFromFile(writeTempConfig(t, fmt.Sprintf(base, "alice-secret", hash))); err != nil {
+		t.Fatalf("load config: %v", err)
+	}
+
+	for i := 0; i < 2; i++ {
+		route, err := manager.Resolve("bob-secret", "codex")
+		if err != nil {
+			t.Fatalf("resolve by hashed key: %v", err)
+		}
+		if route.User.Name != "bob" || route.UserID != hash || route.User.APIKey != "" {
+			t.Fatalf("unexpected route user: %+v (id %q)", route.User, route.UserID)
+		}
+	}
+	if _, err := manager.RuntimeStatus(hash, "codex"); err != nil {
+		t.Fatalf("runtime status by hash: %v", err)
+	}
+	for _, key := range []string{hash, "bob-secret2", ""} {
+		if _, err := manager.Resolve(key, "codex"); err == nil {
+			t.Fatalf("expected key %q to be rejected", key)
+		}
+	}
+
+	for name, tc := range map[string]struct{ aliceKey, bobHash, wantErr string }{
+		"malformed hash":    {"alice-secret", "md5:abc:def", "apiKeyHash must have the form"},
+		"short digest":      {"alice-secret", "sha256:salt:abcd", "digest must be 64 hex characters"},
+		"plaintext matches": {"bob-secret", hash, "matches the apiKeyHash of user 'bob'"},
+	} {
+		if _, err := parse([]byte(fmt.Sprintf(base, tc.aliceKey, tc.bobHash))); err == nil || !strings.Contains(err.Error(), tc.wantErr) {
+			t.Fatalf("%s: expected error containing %q, got %v", name, tc.wantErr, err)
+		}
+	}
+	both := strings.Replace(fmt.Sprintf(base, "alice-secret", hash), "    apiKeyHash:", "    apiKey: bob-plain\n    apiKeyHash:", 1)
+	if _, err := parse([]byte(both)); err == nil || !strings.Contains(err.Error(), "mutually exclusive") {
+		t.Fatalf("expected apiKey and apiKeyHash to be mutually exclusive, got %v", err)
+	}
+}
+
+func TestResolveSecretReferences(t *testing.T) {
+	t.Setenv(MasterKeyEnv, "MDEyMzQ1Njc4OWFiY2RlZjAxMjM0NTY3ODlhYmNkZWY=")
+	t.Setenv("PIAPI_TEST_PROVIDER_KEY", "env-secret")
+	secretFile := filepath.Join(t.TempDir(), "provider.key")
+	if err := os.WriteFile(secretFile, []byte("file-secret\n"), 0o600); err != nil {
+		t.Fatalf("write secret file: %v", err)
+	}
+	encrypted, err := EncryptSecret("enc-secret")
+	if err != nil {
+		t.Fatalf("encrypt secret: %v", err)
+	}
+	base := `
+providers:
+  - name: provider-alpha
+    apiKeys:
+      env: ${env:PIAPI_TEST_PROVIDER_KEY}
+      file: file:%s
+      enc: %s
+      plain: plain-secret
+    services:
+      - type: codex
+        baseUrl: https://alpha.example.com/v1
+users:
+  - name: alice
+    apiKey: alice-secret
+    services:
+      codex:
+        providerName: provider-alpha
+        providerKeyName: %s
+`
+	manager := NewManager()
+	for keyName, want := range map[string]string{"env": "env-secret", "file": "file-secret", "enc": "enc-secret", "plain": "plain-secret"} {
+		if err := manager.LoadFromFile(writeTempConfig(t, fmt.Sprintf(base, secretFile, encrypted, keyName))); err != nil {
+			t.Fatalf("load config: %v", err)
+		}
+		route, err := manager.Resolve("alice-secret", "codex")
+		if err != nil {
+			t.Fatalf("resolve: %v", err)
+		}
+		if route.UpstreamKeyValue != want {
+			t.Fatalf("key %s: expected %q, got %q", keyName, want, route.UpstreamKeyValue)
+		}
+	}
+	current := manager.Current()
+	if got := current.Providers[0].APIKeys["env"]; got != "${env:PIAPI_TEST_PROVIDER_KEY}" {
+		t.Fatalf("expected Current to keep the secret reference, got %q", got)
+	}
+
+	t.Setenv("PIAPI_TEST_PROVIDER_KEY", "rotated-secret")
+	if err := manager.LoadFromFile(writeTempConfig(t, fmt.Sprintf(base, secretFile, encrypted, "env"))); err != nil {
+		t.Fatalf("reload config: %v", err)
+	}
+	if route, err := manager.Resolve("alice-secret", "codex"); err != nil || route.UpstreamKeyValue != "rotated-secret" {
+		t.Fatalf("expected reload to re-read the env secret, got %+v, %v", route, err)
+	}
+
+	for name, tc := range map[string]struct {
+		env, file, enc string
+		wantErr        string
+	}{
+		"missing env":  {env: "PIAPI_TEST_MISSING_KEY", file: secretFile, enc: encrypted, wantErr: "environment variable PIAPI_TEST_MISSING_KEY is not set"},
+		"missing file": {env: "PIAPI_TEST_PROVIDER_KEY", file: secretFile + ".missing", enc: encrypted, wantErr: "read secret file"},
+		"bad cipher":   {env: "PIAPI_TEST_PROVIDER_KEY", file: secretFile, enc: "enc:bm90LWEtdmFsaWQtY2lwaGVydGV4dA==", wantErr: "wrong master key"},
+	} {
+		yaml := strings.Replace(fmt.Sprintf(base, tc.file, tc.enc, "plain"), "PIAPI_TEST_PROVIDER_KEY", tc.env, 1)
+		_, err := parse([]byte(yaml))
+		if err == nil || !strings.Contains(err.Error(), tc.wantErr) {
+			t.Fatalf("%s: expected error containing %q, got %v", name, tc.wantErr, err)
+		}
+	}
+
+	t.Setenv(MasterKeyEnv, "")
+	if _, err := parse([]byte(fmt.Sprintf(base, secretFile, encrypted, "plain"))); err == nil || !strings.Contains(err.Error(), MasterKeyEnv+" is not set") {
+		t.Fatalf("expected missing master key error, got %v", err)
+	}
+}
+
+func TestResolveMergesHeaderPolicies(t *testing.T) {
+	base := `
+providers:
+  - name: provider-alpha
+    apiKeys:
+      primary: key-1
+      secondary: key-2
+    services:
+      - type: claude
+        baseUrl: https://alpha.example.com/v1
+        headers:
+          request:
+            set:
+              anthropic-version: "2023-06-01"
+              x-team: platform
+            add:
+              anthropic-beta: tools-2024
+            remove: [cookie]
+          response:
+            remove: [server]
+users:
+  - name: alice
+    apiKey: alice-key
+    services:
+      claude:
+        strategy: round_robin
+        headers:
+          request:
+            set:
+              X-End-User: "{{user}}/{{request_id}}"
+            remove: [x-team]
+        candidates:
+          - providerName: provider-alpha
+            providerKeyName: primary
+            headers:
+              request:
+                add:
+                  anthropic-beta: prompt-caching
+          - providerName: provider-alpha
+            providerKeyName: secondary
+%s
+`
+	manager := NewManager()
+	if err := manager.LoadFromFile(writeTempConfig(t, fmt.Sprintf(base, ""))); err != nil {
+		t.Fatalf("load config: %v", err)
+	}
+
+	want := map[string]*HeaderRules{
+		"primary": {
+			Set:    map[string]string{"Anthropic-Version": "2023-06-01", "X-End-User": "{{user}}/{{request_id}}"},
+			Add:    map[string]string{"Anthropic-Beta": "prompt-caching"},
+			Remove: []string{"Cookie", "X-Team"},
+		},
+		"secondary": {
+			Set:    map[string]string{"Anthropic-Version": "2023-06-01", "X-End-User": "{{user}}/{{request_id}}"},
+			Add:    map[string]string{"Anthropic-Beta": "tools-2024"},
+			Remove: []string{"Cookie", "X-Team"},
+		},
+	}
+	for i := 0; i < 2; i++ {
+		route, err := manager.Resolve("alice-key", "claude")
+		if err != nil {
+			t.Fatalf("resolve: %v", err)
+		}
+		if route.Headers == nil || !reflect.DeepEqual(route.Headers.Request, want[route.UpstreamKeyName]) {
+			t.Fatalf("unexpected request rules for %s: %+v", route.UpstreamKeyName, route.Headers)
+		}
+		if !reflect.DeepEqual(route.Headers.Response, &HeaderRules{Remove: []string{"Server"}}) {
+			t.Fatalf("unexpected response rules: %+v", route.Headers.Response)
+		}
+	}
+
+	h := http.Header{"Cookie": {"session=1"}, "X-Team": {"client"}, "Anthropic-Beta": {"client-beta"}}
+	want["primary"].Apply(h, map[string]string{"user": "alice\r\nX-Injected: 1", "request_id": "req-1"})
+	if got := h.Get("X-End-User"); got != "aliceX-Injected: 1/req-1" {
+		t.Fatalf("unexpected templated header %q", got)
+	}
+	if h.Get("Cookie") != "" || h.Get("X-Team") != "" || !reflect.DeepEqual(h["Anthropic-Beta"], []string{"client-beta", "prompt-caching"}) {
+		t.Fatalf("unexpected headers after apply: %v", h)
+	}
+
+	for name, tc := range map[string]struct{ extra, wantErr string }{
+		"unknown placeholder": {"            headers:\n              request:\n                set:\n                  X-A: \"{{secret}}\"", "unknown placeholder '{{secret}}'"},
+		"invalid name":        {"            headers:\n              request:\n                set:\n                  \"bad header\": x", "invalid header name 'bad header'"},
+		"protected header":    {"            headers:\n              response:\n                remove: [content-length]", "header 'Content-Length' cannot be changed"},
+	} {
+		_, err := parse([]byte(fmt.Sprintf(base, tc.extra)))
+		if err == nil || !strings.Contains(err.Error(), tc.wantErr) {
+			t.Fatalf("%s: expected error containing %q, got %v", name, tc.wantErr, err)
+		}
+	}
+}
+
+func TestParseServiceTimeouts(t *testing.T) {
+	base := `
+providers:
+  - name: provider-alpha
+    apiKeys:
+      primary: key-1
+    services:
+      - type: codex
+        baseUrl: https://alpha.example.com
+        timeouts: %s
+users:
+  - name: alice
+    apiKey: alice-key
+    services:
+      codex:
+        providerName: provider-alpha
+        providerKeyName: primary
+`
+	rc, err := parse([]byte(fmt.Sprintf(base, `{connect: 2s, responseHeader: 30, total: 10m, streamIdle: 1m}`)))
+	if err != nil {
+		t.Fatalf("parse: %v", err)
+	}
+	got := rc.raw.Providers[0].Services[0].Timeouts
+	want := &TimeoutConfig{
+		Connect:        Duration(2 * time.Second),
+		ResponseHeader: Duration(30 * time.Second),
+		Total:          Duration(10 * time.Minute),
+		StreamIdle:     Duration(time.Minute),
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Fatalf("unexpected timeouts: %+v", got)
+	}
+
+	rc, err = parse([]byte(fmt.Sprintf(base, `{}`)))
+	if err != nil {
+		t.Fatalf("parse: %v", err)
+	}
+	if got := rc.raw.Providers[0].Services[0].Timeouts; got != nil {
+		t.Fatalf("expected empty timeouts dropped, got %+v", got)
+	}
+
+	for timeouts, wantErr := range map[string]string{
+		`{connect: -1s}`:              "must not be negative",
+		`{streamIdle: 2m, total: 1m}`: "timeouts.streamIdle (2m0s) exceeds timeouts.total (1m0s)",
+		`{responseHeader: soon}`:      "invalid duration",
+	} {
+		if _, err := parse([]byte(fmt.Sprintf(base, timeouts))); err == nil || !strings.Contains(err.Error(), wantErr) {
+			t.Fatalf("timeouts %s: expected error containing %q, got %v", timeouts, wantErr, err)
+		}
+	}
+}
+
+func TestProviderTransportSettings(t *testing.T) {
+	base := `
+providers:
+  - name: provider-alpha
+    apiKeys:
+      primary: key-1
+    transport: %s
+    services:
+      - type: codex
+        baseUrl: https://alpha.example.com
+users:
+  - name: alice
+    apiKey: alice-key
+    services:
+      codex:
+        providerName: provider-alpha
+        providerKeyName: primary
+`
+	path := writeTempConfig(t, fmt.Sprintf(base, `{proxy: "http://proxy.internal:3128", http2: false}`))
+	manager := NewManager()
+	if err := manager.LoadFromFile(path); err != nil {
+		t.Fatalf("load config: %v", err)
+	}
+	route, err := manager.Resolve("alice-key", "codex")
+	if err != nil {
+		t.Fatalf("resolve: %v", err)
+	}
+	transport, ok := route.Transport.(*http.Transport)
+	if !ok {
+		t.Fatalf("expected a provider transport, got %T", route.Transport)
+	}
+	proxyURL, err := transport.Proxy(&http.Request{URL: &url.URL{Scheme: "https", Host: "alpha.example.com"}})
+	if err != nil || proxyURL == nil || proxyURL.Host != "proxy.internal:3128" {
+		t.Fatalf("unexpected proxy %v (%v)", proxyURL, err)
+	}
+	if transport.TLSNextProto == nil || transport.ForceAttemptHTTP2 {
+		t.Fatalf("expected HTTP/2 disabled")
+	}
+
+	// An unchanged reload keeps the transport and its connection pool.
+	if err := manager.LoadFromFile(path); err != nil {
+		t.Fatalf("reload config: %v", err)
+	}
+	if route, _ := manager.Resolve("alice-key", "codex"); route.Transport != transport {
+		t.Fatalf("expected transport kept across an unchanged reload")
+	}
+	if err := os.WriteFile(path, []byte(fmt.Sprintf(base, `{proxy: direct}`)), 0o600); err != nil {
+		t.Fatalf("rewrite config: %v", err)
+	}
+	if err := manager.LoadFromFile(path); err != nil {
+		t.Fatalf("reload config: %v", err)
+	}
+	route, _ = manager.Resolve("alice-key", "codex")
+	if route.Transport == transport || route.Transport.(*http.Transport).Proxy != nil {
+		t.Fatalf("expected a rebuilt direct transport, got %+v", route.Transport)
+	}
+
+	for transport, wantErr := range map[string]string{
+		`{proxy: "ftp://proxy.internal"}`: "unsupported scheme 'ftp'",
+		`{proxy: "http://"}`:              "host is required",
+		`{certFile: client.pem}`:          "certFile and keyFile must be set together",
+		`{caFile: /nonexistent/ca.pem}`:   "transport.caFile",
+		`{caFile: ` + path + `}`:          "no certificates found",
+	} {
+		if _, err := parse([]byte(fmt.Sprintf(base, transport))); err == nil || !strings.Contains(err.Error(), wantErr) {
+			t.Fatalf("transport %s: expected error containing %q, got %v", transport, wantErr, err)
+		}
+	}
+}
+
+func TestCircuitBreakerTransitions(t *testing.T) {
+	settings, err := resolveCircuitBreaker(&CircuitBreakerConfig{
+		FailureThreshold: 3,
+		Window:           Duration(10 * time.Second),
+		OpenTimeout:      Duration(10 * time.Second),
+		MaxOpenTimeout:   Duration(25 * time.Second),
+		HalfOpenRequests: 2,
+	})
+	if err != nil {
+		t.Fatalf("resolve: %v", err)
+	}
+	b := &circuitBreaker{settings: settings}
+	start := time.Unix(1_700_000_000, 0)
+	at := func(seconds float64) time.Time { return start.Add(time.Duration(seconds * float64(time.Second))) }
+
+	// Failures outside the window do not add up.
+	b.record(at(0), true)
+	b.record(at(11), true)
+	b.record(at(12), true)
+	if state, _ := b.snapshot(); state != circuitClosed {
+		t.Fatalf("expected closed with two failures in the window, got %s", state)
+	}
+	b.record(at(13), true)
+	state, until := b.snapshot()
+	if state != circuitOpen || until == nil {
+		t.Fatalf("expected open after three failures in the window, got %s", state)
+	}
+	if d := until.Sub(at(13)); d < 8*time.Second || d > 12*time.Second {
+		t.Fatalf("open duration %s outside the jittered open timeout", d)
+	}
+	if b.available(at(13)) || b.admit(at(13)) {
+		t.Fatalf("expected an open circuit to reject requests")
+	}
+
+	// Half-open admits two trials; a failed trial reopens with a doubled timeout.
+	if !b.admit(*until) || !b.admit(*until) || b.admit(*until) {
+		t.Fatalf("expected exactly two trial requests admitted")
+	}
+	b.record(until.Add(time.Second), true)
+	reopenedAt := until.Add(time.Second)
+	state, until = b.snapshot()
+	if d := until.Sub(reopenedAt); state != circuitOpen || d < 16*time.Second || d > 24*time.Second {
+		t.Fatalf("expected reopened for about 20s, got %s for %s", state, d)
+	}
+
+	// Trials that never report give their slots back after the open timeout.
+	if !b.admit(*until) || !b.admit(*until) || b.admit(until.Add(time.Second)) {
+		t.Fatalf("expected two trial slots")
+	}
+	if !b.admit(until.Add(10 * time.Second)) {
+		t.Fatalf("expected stale trial slots released")
+	}
+	b.record(until.Add(11*time.Second), false)
+	if state, _ := b.snapshot(); state != circuitHalfOpen {
+		t.Fatalf("expected half-open until every trial succeeded, got %s", state)
+	}
+	// A trial answered with 429 proves nothing; it frees its slot without closing.
+	b.admit(until.Add(11 * time.Second))
+	b.release()
+	if state, _ := b.snapshot(); state != circuitHalfOpen || !b.available(until.Add(11*time.Second)) {
+		t.Fatalf("expected a released trial to leave the circuit half-open, got %s", state)
+	}
+	b.admit(until.Add(11 * time.Second))
+	b.record(until.Add(12*time.Second), false)
+	if state, _ := b.snapshot(); state != circuitClosed || b.reopens != 0 {
+		t.Fatalf("expected closed after successful trials, got %s", state)
+	}
+
+	for cfg, wantErr := range map[string]string{
+		`{failureThreshold: -1}`:                 "failureThreshold must not be negative",
+		`{openTimeout: 1m, maxOpenTimeout: 30s}`: "maxOpenTimeout must not be shorter than openTimeout",
+	} {
+		yaml := fmt.Sprintf(`
+providers:
+  - name: provider-alpha
+    apiKeys:
+      main: key-1
+    services:
+      - type: codex
+        baseUrl: https://alpha.example.com/v1
+        circuitBreaker: %s
+users:
+  - name: alice
+    apiKey: alice-key
+    services:
+      codex:
+        providerName: provider-alpha
+        providerKeyName: main
+`, cfg)
+		if _, err := parse([]byte(yaml)); err == nil || !strings.Contains(err.Error(), wantErr) {
+			t.Fatalf("circuitBreaker %s: expected error containing %q, got %v", cfg, wantErr, err)
+		}
+	}
+}
+
+func TestCircuitBreakerThresholdFromConfig(t *testing.T) {
+	yaml := `
+providers:
+  - name: provider-alpha
+    apiKeys:
+      main: key-1
+    services:
+      - type: codex
+        baseUrl: https://alpha.example.com/v1
+        circuitBreaker:
+          failureThreshold: 2
+users:
+  - name: alice
+    apiKey: alice-key
+    services:
+      codex:
+        providerName: provider-alpha
+        providerKeyName: main
+`
+	manager := NewManager()
+	if err := manager.LoadFromFile(writeTempConfig(t, yaml)); err != nil {
+		t.Fatalf("load config: %v", err)
+	}
+
+	manager.ReportResult("alice-key", "codex", "provider-alpha", "main", 503, nil)
+	if _, err := manager.Resolve("alice-key", "codex"); err != nil {
+		t.Fatalf("expected the key still selected below the threshold: %v", err)
+	}
+	manager.ReportResult("alice-key", "codex", "provider-alpha", "main", 0, errors.New("connection refused"))
+	if _, err := manager.Resolve("alice-key", "codex"); !errors.Is(err, ErrNoActiveUpstream) {
+		t.Fatalf("expected ErrNoActiveUpstream once the circuit opened, got %v", err)
+	}
+
+	stats, err := manager.RuntimeStatus("alice-key", "codex")
+	if err != nil {
+		t.Fatalf("runtime status: %v", err)
+	}
+	if stats[0].Healthy || stats[0].CircuitState != "open" || stats[0].UnhealthyUntil == nil {
+		t.Fatalf("expected open circuit in runtime status, got %+v", stats[0])
+	}
+
+	rr := httptest.NewRecorder()
+	metrics.Handler().ServeHTTP(rr, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+	// Per-key series are opt-in through metrics.Config.EnableCandidateKeyLabels.
+	if strings.Contains(rr.Body.String(), "piapi_circuit_state") {
+		t.Fatalf("expected no per-key circuit gauge without key labels enabled")
+	}
+}
+
+func TestHealthChecksDriveCircuitBreaker(t *testing.T) {
+	var healthy atomic.Bool
+	var mu sync.Mutex
+	paths := make(map[string]int)
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		paths[r.URL.Path]++
+		mu.Unlock()
+		if r.URL.Query().Get("key") != "key-1" || r.Header.Get("X-Probe") != "provider-alpha/main" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		if !healthy.Load() {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	defer upstream.Close()
+
+	base := `
+providers:
+  - name: provider-alpha
+    apiKeys:
+      main: key-1
+    services:
+      - type: codex
+        baseUrl: %s/v1
+        auth:
+          mode: query
+          name: key
+        headers:
+          request:
+            set:
+              X-Probe: "{{provider}}/{{provider_key}}"
+        healthCheck:
+          path: %s
+          expectedStatus: 204
+          interval: 20ms
+users:
+  - name: alice
+    apiKey: alice-key
+    services:
+      codex:
+        providerName: provider-alpha
+        providerKeyName: main
+`
+	path := writeTempConfig(t, fmt.Sprintf(base, upstream.URL, "/health"))
+	manager := NewManager()
+	if err := manager.LoadFromFile(path); err != nil {
+		t.Fatalf("load config: %v", err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	manager.StartHealthChecks(ctx, nil)
+
+	waitFor := func(what string, cond func(CandidateRuntimeStatus) bool) {
+		t.Helper()
+		deadline := time.Now().Add(2 * time.Second)
+		for time.Now().Before(deadline) {
+			stats, err := manager.RuntimeStatus("alice-key", "codex")
+			if err != nil {
+				t.Fatalf("runtime status: %v", err)
+			}
+			if cond(stats[0]) {
+				return
+			}
+			time.Sleep(5 * time.Millisecond)
+		}
+		t.Fatalf("timed out waiting for %s", what)
+	}
+
+	waitFor("a failing health check to open the circuit", func(s CandidateRuntimeStatus) bool {
+		return s.CircuitState == "open" && s.HealthCheck != nil && !s.HealthCheck.Healthy
+	})
+	if _, err := manager.Resolve("alice-key", "codex"); !errors.Is(err, ErrNoActiveUpstream) {
+		t.Fatalf("expected ErrNoActiveUpstream while the health check fails, got %v", err)
+	}
+	stats, _ := manager.RuntimeStatus("alice-key", "codex")
+	if stats[0].HealthCheck.Status != http.StatusServiceUnavailable || stats[0].TotalRequests != 0 {
+		t.Fatalf("unexpected health check status: %+v", stats[0])
+	}
+
+	healthy.Store(true)
+	waitFor("a passing health check to close the circuit", func(s CandidateRuntimeStatus) bool {
+		return s.CircuitState == "closed" && s.HealthCheck != nil && s.HealthCheck.Healthy
+	})
+	if _, err := manager.Resolve("alice-key", "codex"); err != nil {
+		t.Fatalf("expected the key selected again: %v", err)
+	}
+
+	rr := httptest.NewRecorder()
+	metrics.Handler().ServeHTTP(rr, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+	if !strings.Contains(rr.Body.String(), `piapi_health_checks_total{provider="provider-alpha",result="success",service_type="codex"}`) {
+		t.Fatalf("expected passing health checks counted in metrics output")
+	}
+	// The per-key gauge is opt-in through metrics.Config.EnableCandidateKeyLabels.
+	if strings.Contains(rr.Body.String(), "piapi_health_check_up") {
+		t.Fatalf("expected no per-key health check gauge without key labels enabled")
+	}
+
+	// A reload replaces the probes: only the new path is checked afterwards.
+	if err := os.WriteFile(path, []byte(fmt.Sprintf(base, upstream.URL, "/ready")), 0o600); err != nil {
+		t.Fatalf("rewrite config: %v", err)
+	}
+	if err := manager.LoadFromFile(path); err != nil {
+		t.Fatalf("reload config: %v", err)
+	}
+	mu.Lock()
+	before := paths["/v1/health"]
+	mu.Unlock()
+	time.Sleep(100 * time.Millisecond)
+	mu.Lock()
+	after, ready := paths["/v1/health"], paths["/v1/ready"]
+	mu.Unlock()
+	if after != before || ready == 0 {
+		t.Fatalf("expected probes to move to the new path, got %d more /health and %d /ready", after-before, ready)
+	}
+
+	cancel()
+	manager.mu.Lock()
+	manager.probes.wg.Wait()
+	manager.mu.Unlock()
+}
+
+func TestParseHealthCheckValidation(t *testing.T) {
+	base := `
+providers:
+  - name: provider-alpha
+    apiKeys:
+      main: key-1
+    services:
+      - type: codex
+        baseUrl: https://alpha.example.com/v1
+        healthCheck: %s
+users:
+  - name: alice
+    apiKey: alice-key
+    services:
+      codex:
+        providerName: provider-alpha
+        providerKeyName: main
+`
+	rc, err := parse([]byte(fmt.Sprintf(base, `{path: /models}`)))
+	if err != nil {
+		t.Fatalf("parse: %v", err)
+	}
+	check := rc.providers["provider-alpha"].healthChecks["codex"]
+	if check == nil || check.Method != http.MethodGet || check.Interval.Std() != 30*time.Second || check.Timeout.Std() != 10*time.Second {
+		t.Fatalf("unexpected health check defaults: %+v", check)
+	}
+	if got := rc.raw.Providers[0].Services[0].HealthCheck; got == nil || got.Method != "" {
+		t.Fatalf("expected the health check kept as written, got %+v", got)
+	}
+
+	cases := map[string]string{
+		`{path: models}`:                             "healthCheck.path must start with '/'",
+		`{path: /models, method: "GE T"}`:            "healthCheck.method",
+		`{path: /models, expectedStatus: 42}`:        "is not an HTTP status",
+		`{path: /models, interval: -1s}`:             "must not be negative",
+		`{path: /models, interval: 1s, timeout: 2s}`: "must not exceed healthCheck.interval",
+	}
+	for fragment, wantErr := range cases {
+		if _, err := parse([]byte(fmt.Sprintf(base, fragment))); err == nil || !strings.Contains(err.Error(), wantErr) {
+			t.Errorf("%s: expected error containing %q, got %v", fragment, wantErr, err)
+		}
+	}
+}
+
+func TestRateLimitCooldown(t *testing.T) {
+	now := time.Date(2025, 1, 2, 3, 4, 5, 0, time.UTC)
+	settings, err := resolveUpstreamRateLimit(&UpstreamRateLimitConfig{MinRemainingTokens: 1000})
+	if err != nil {
+		t.Fatalf("resolve: %v", err)
+	}
+	cases := []struct {
+		name       string
+		status     int
+		header     map[string]string
+		wantAfter  time.Duration
+		wantReason string
+	}{
+		{name: "429 without hints", status: 429, wantAfter: 30 * time.Second, wantReason: cooldownRateLimited},
+		{name: "retry-after seconds", status: 429, header: map[string]string{"Retry-After": "7"}, wantAfter: 7 * time.Second, wantReason: cooldownRateLimited},
+		{name: "retry-after date", status: 429, header: map[string]string{"Retry-After": now.Add(time.Minute).Format(http.TimeFormat)}, wantAfter: time.Minute, wantReason: cooldownRateLimited},
+		{name: "retry-after-ms", status: 429, header: map[string]string{"Retry-After-Ms": "1500", "Retry-After": "9"}, wantAfter: 1500 * time.Millisecond, wantReason: cooldownRateLimited},
+		{name: "429 with exhausted openai quota", status: 429, header: map[string]string{"X-Ratelimit-Remaining-Requests": "0", "X-Ratelimit-Reset-Requests": "6m0s"}, wantAfter: 6 * time.Minute, wantReason: cooldownRateLimited},
+		{name: "capped", status: 429, header: map[string]string{"Retry-After": "3600"}, wantAfter: 10 * time.Minute, wantReason: cooldownRateLimited},
+		{name: "requests exhausted", status: 200, header: map[string]string{"X-Ratelimit-Remaining-Requests": "0", "X-Ratelimit-Reset-Requests": "2s"}, wantAfter: 2 * time.Second, wantReason: cooldownLowQuota},
+		{name: "requests left", status: 200, header: map[string]string{"X-Ratelimit-Remaining-Requests": "3", "X-Ratelimit-Reset-Requests": "2s"}},
+		{name: "anthropic tokens low", status: 200, header: map[string]string{"Anthropic-Ratelimit-Output-Tokens-Remaining": "800", "Anthropic-Ratelimit-Output-Tokens-Reset": now.Add(20 * time.Second).Format(time.RFC3339)}, wantAfter: 20 * time.Second, wantReason: cooldownLowQuota},
+		{name: "anthropic tokens left", status: 200, header: map[string]string{"Anthropic-Ratelimit-Tokens-Remaining": "5000", "Anthropic-Ratelimit-Tokens-Reset": now.Add(20 * time.Second).Format(time.RFC3339)}},
+		{name: "server error", status: 503, header: map[string]string{"Retry-After": "5"}},
+	}
+	for _, tc := range cases {
+		header := make(http.Header)
+		for name, value := range tc.header {
+			header.Set(name, value)
+		}
+		until, reason := rateLimitCooldown(now, tc.status, header, settings)
+		if tc.wantAfter == 0 {
+			if !until.IsZero() {
+				t.Errorf("%s: expected no cooldown, got until %s (%s)", tc.name, until, reason)
+			}
+			continue
+		}
+		if got := until.Sub(now); got != tc.wantAfter || reason != tc.wantReason {
+			t.Errorf("%s: got cooldown %s (%s), want %s (%s)", tc.name, got, reason, tc.wantAfter, tc.wantReason)
+		}
+	}
+
+	// A 429 is neither a breaker success nor ignored by adaptive_rr.
+	h := &keyHealth{}
+	h.breaker.settings, _ = resolveCircuitBreaker(nil)
+	h.breaker.state, h.breaker.trials = circuitHalfOpen, 1
+	h.record(now, http.StatusTooManyRequests, nil, false)
+	if state, _ := h.breaker.snapshot(); state != circuitHalfOpen || h.smoothedErrorRate() != 1 {
+		t.Fatalf("expected a 429 to keep the breaker half-open and count as an error, got %s at rate %v", state, h.smoothedErrorRate())
+	}
+
+	for fragment, wantErr := range map[string]string{
+		`{defaultCooldown: -1s}`:                 "must not be negative",
+		`{minRemainingTokens: -1}`:               "must not be negative",
+		`{defaultCooldown: 2m, maxCooldown: 1m}`: "maxCooldown must not be shorter",
+	} {
+		yaml := fmt.Sprintf(`
+providers:
+  - name: provider-alpha
+    apiKeys:
+      main: key-1
+    services:
+      - type: codex
+        baseUrl: https://alpha.example.com/v1
+        upstreamRateLimit: %s
+users:
+  - name: alice
+    apiKey: alice-key
+    services:
+      codex:
+        providerName: provider-alpha
+        providerKeyName: main
+`, fragment)
+		if _, err := parse([]byte(yaml)); err == nil || !strings.Contains(err.Error(), wantErr) {
+			t.Errorf("%s: expected error containing %q, got %v", fragment, wantErr, err)
+		}
+	}
+}
+
+func TestRepeatedAuthFailuresInvalidateKey(t *testing.T) {
+	base := `
+providers:
+  - name: provider-alpha
+    apiKeys:
+      main: %s
+    services:
+      - type: codex
+        baseUrl: %s
+users:
+  - name: alice
+    apiKey: alice-key
+    services:
+      codex:
+        providerName: provider-alpha
+        providerKeyName: main
+  - name: bob
+    apiKey: bob-key
+    services:
+      codex:
+        providerName: provider-alpha
+        providerKeyName: main
+`
+	path := writeTempConfig(t, fmt.Sprintf(base, "key-1", "https://alpha.example.com/v1"))
+	manager := NewManager()
+	if err := manager.LoadFromFile(path); err != nil {
+		t.Fatalf("load config: %v", err)
+	}
+
+	// A run of auth failures broken by any other response does not count.
+	manager.ReportResult("alice-key", "codex", "provider-alpha", "main", 401, nil)
+	manager.ReportResult("alice-key", "codex", "provider-alpha", "main", 401, nil)
+	manager.ReportResult("alice-key", "codex", "provider-alpha", "main", 400, nil)
+	manager.ReportResult("alice-key", "codex", "provider-alpha", "main", 401, nil)
+	if _, err := manager.Resolve("bob-key", "codex"); err != nil {
+		t.Fatalf("expected the key still valid: %v", err)
+	}
+	// A 403 refusing the request, such as a model the account cannot use, does not
+	// count either.
+	for i := 0; i < invalidKeyThreshold; i++ {
+		manager.ReportResult("alice-key", "codex", "provider-alpha", "main", 403, nil)
+	}
+	if _, err := manager.Resolve("bob-key", "codex"); err != nil {
+		t.Fatalf("expected the key valid after model access 403s: %v", err)
+	}
+	for i := 0; i < invalidKeyThreshold; i++ {
+		manager.ReportResult("alice-key", "codex", "provider-alpha", "main", 403, ErrUpstreamAuth)
+	}
+	if _, err := manager.Resolve("bob-key", "codex"); !errors.Is(err, ErrNoActiveUpstream) {
+		t.Fatalf("expected the invalid key skipped for every route, got %v", err)
+	}
+
+	keys, err := manager.KeyHealth()
+	if err != nil {
+		t.Fatalf("key health: %v", err)
+	}
+	if !keys[0].Invalid || keys[0].InvalidStatus != 403 || keys[0].InvalidSince == nil || keys[0].Healthy {
+		t.Fatalf("expected the key reported invalid, got %+v", keys[0])
+	}
+
+	// Reloading the same key value keeps it invalid; the admin action clears it.
+	if err := manager.LoadFromFile(path); err != nil {
+		t.Fatalf("reload config: %v", err)
+	}
+	if _, err := manager.Resolve("alice-key", "codex"); !errors.Is(err, ErrNoActiveUpstream) {
+		t.Fatalf("expected the key still invalid after an unrelated reload, got %v", err)
+	}
+	// Neither does moving the key to another endpoint.
+	if err := os.WriteFile(path, []byte(fmt.Sprintf(base, "key-1", "https://beta.example.com/v1")), 0o600); err != nil {
+		t.Fatalf("rewrite config: %v", err)
+	}
+	if err := manager.LoadFromFile(path); err != nil {
+		t.Fatalf("reload config: %v", err)
+	}
+	if _, err := manager.Resolve("alice-key", "codex"); !errors.Is(err, ErrNoActiveUpstream) {
+		t.Fatalf("expected the key still invalid after its base URL changed, got %v", err)
+	}
+	enabled, err := manager.EnableKey("provider-alpha", "main")
+	if err != nil {
+		t.Fatalf("enable key: %v", err)
+	}
+	if len(enabled) != 1 || enabled[0].Invalid || !enabled[0].Healthy {
+		t.Fatalf("expected the key enabled, got %+v", enabled)
+	}
+	if _, err := manager.Resolve("alice-key", "codex"); err != nil {
+		t.Fatalf("expected the key selected after enabling: %v", err)
+	}
+	if _, err := manager.EnableKey("provider-alpha", "missing"); !errors.Is(err, ErrProviderKeyNotFound) {
+		t.Fatalf("expected ErrProviderKeyNotFound, got %v", err)
+	}
+
+	// Replacing the key value starts the new key out valid.
+	for i := 0; i < invalidKeyThreshold; i++ {
+		manager.ReportResult("alice-key", "codex", "provider-alpha", "main", 401, nil)
+	}
+	if err := os.WriteFile(path, []byte(fmt.Sprintf(base, "key-2", "https://beta.example.com/v1")), 0o600); err != nil {
+		t.Fatalf("rewrite config: %v", err)
+	}
+	if err := manager.LoadFromFile(path); err != nil {
+		t.Fatalf("reload config: %v", err)
+	}
+	if _, err := manager.Resolve("alice-key", "codex"); err != nil {
+		t.Fatalf("expected the replaced key selected: %v", err)
+	}
+}
+
+func TestKeyLimitsQueueSaturatedKeys(t *testing.T) {
+	yaml := `
+providers:
+  - name: provider-alpha
+    apiKeys:
+      first: key-1
+      second: key-2
+    keyLimits:
+      first:
+        maxConcurrent: 1
+        maxQueue: 1
+        queueTimeout: 50ms
+    services:
+      - type: codex
+        baseUrl: https://alpha.example.com/v1
+users:
+  - name: alice
+    apiKey: alice-key
+    services:
+      codex:
+        strategy: sticky_healthy
+        candidates:
+          - providerName: provider-alpha
+            providerKeyName: first
+          - providerName: provider-alpha
+            providerKeyName: second
+  - name: bob
+    apiKey: bob-key
+    services:
+      codex:
+        providerName: provider-alpha
+        providerKeyName: first
+`
+	path := writeTempConfig(t, yaml)
+	manager := NewManager()
+	if err := manager.LoadFromFile(path); err != nil {
+		t.Fatalf("load config: %v", err)
+	}
+
+	held, err := manager.Resolve("alice-key", "codex")
+	if err != nil || held.UpstreamKeyName != "first" {
+		t.Fatalf("expected the first key, got %+v, %v", held, err)
+	}
+	// The saturated key is skipped while another candidate is free.
+	other, err := manager.Resolve("alice-key", "codex")
+	if err != nil || other.UpstreamKeyName != "second" {
+		t.Fatalf("expected the saturated key skipped, got %+v, %v", other, err)
+	}
+	other.Release()
+
+	// Reloading keeps the request in flight.
+	if err := manager.LoadFromFile(path); err != nil {
+		t.Fatalf("reload config: %v", err)
+	}
+	start := time.Now()
+	if _, err := manager.Resolve("bob-key", "codex"); !errors.Is(err, ErrUpstreamBusy) {
+		t.Fatalf("expected ErrUpstreamBusy after the queue timeout, got %v", err)
+	}
+	if waited := time.Since(start); waited < 50*time.Millisecond {
+		t.Fatalf("expected the request queued for the timeout, returned after %s", waited)
+	}
+
+	// A queued request gets the slot as soon as it is released, and the queue is bounded.
+	if err := os.WriteFile(path, []byte(strings.Replace(yaml, "queueTimeout: 50ms", "queueTimeout: 5s", 1)), 0o600); err != nil {
+		t.Fatalf("rewrite config: %v", err)
+	}
+	if err := manager.LoadFromFile(path); err != nil {
+		t.Fatalf("reload config: %v", err)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	queued := make(chan *Route, 1)
+	slots := manager.data.providers["provider-alpha"].slots["first"]
+	go func() {
+		route, err := manager.ResolveWithOptions("bob-key", "codex", ResolveOptions{Context: ctx})
+		if err != nil {
+			t.Errorf("queued resolve: %v", err)
+		}
+		queued <- route
+	}()
+	for slots.queued() == 0 {
+		time.Sleep(time.Millisecond)
+	}
+	if _, err := manager.Resolve("bob-key", "codex"); !errors.Is(err, ErrUpstreamBusy) {
+		t.Fatalf("expected a full queue rejected, got %v", err)
+	}
+	held.Release()
+	held.Release()
+	route := <-queued
+	if route == nil || route.UpstreamKeyName != "first" {
+		t.Fatalf("expected the queued request routed to the first key, got %+v", route)
+	}
+	slots.mu.Lock()
+	inFlight := slots.inFlight
+	slots.mu.Unlock()
+	if inFlight != 1 {
+		t.Fatalf("expected one request in flight, got %d", inFlight)
+	}
+	route.Release()
+	if !slots.available() {
+		t.Fatal("expected the slot free after release")
+	}
+
+	for fragment, wantErr := range map[string]string{
+		"first: {maxConcurrent: 0}":               "maxConcurrent must be positive",
+		"first: {maxConcurrent: 1, maxQueue: -1}": "maxQueue must not be negative",
+		"third: {maxConcurrent: 1}":               "keyLimits names unknown apiKey 'third'",
+	} {
+		cfg := strings.Replace(yaml, `first:
+        maxConcurrent: 1
+        maxQueue: 1
+        queueTimeout: 50ms`, fragment, 1)
+		if _, err := parse([]byte(cfg)); err == nil || !strings.Contains(err.Error(), wantErr) {
+			t.Errorf("%s: expected error containing %q, got %v", fragment, wantErr, err)
+		}
+	}
+}
+
+func TestWeightedRRStaysSmoothAsCandidatesLeave(t *testing.T) {
+	yaml := `
+providers:
+  - name: provider-alpha
+    apiKeys:
+      a: key-a
+      b: key-b
+      c: key-c
+    services:
+      - type: codex
+        baseUrl: https://alpha.example.com/v1
+users:
+  - name: test-user
+    apiKey: test-key
+    services:
+      codex:
+        strategy: weighted_rr
+        candidates:
+          - providerName: provider-alpha
+            providerKeyName: a
+            weight: 5
+          - providerName: provider-alpha
+            providerKeyName: b
+            weight: 3
+          - providerName: provider-alpha
+            providerKeyName: c
+            weight: 2
+`
+	path := writeTempConfig(t, yaml)
+	manager := NewManager()
+	if err := manager.LoadFromFile(path); err != nil {
+		t.Fatalf("load config: %v", err)
+	}
+	picks := func(n int) string {
+		var out strings.Builder
+		for i := 0; i < n; i++ {
+			route, err := manager.Resolve("test-key", "codex")
+			if err != nil {
+				t.Fatalf("resolve %d: %v", i, err)
+			}
+			out.WriteString(route.UpstreamKeyName)
+		}
+		return out.String()
+	}
+
+	if got := picks(4); got != "abca" {
+		t.Fatalf("unexpected picks before b leaves: %s", got)
+	}
+	for i := 0; i < invalidKeyThreshold; i++ {
+		manager.ReportResult("test-key", "codex", "provider-alpha", "b", 401, nil)
+	}
+	if got := picks(7); got != "aacaaca" {
+		t.Fatalf("expected the remaining candidates interleaved 5:2, got %s", got)
+	}
+
+	if _, err := manager.EnableKey("provider-alpha", "b"); err != nil {
+		t.Fatalf("enable key: %v", err)
+	}
+	got := picks(100)
+	if strings.Contains(got, "aaa") {
+		t.Fatalf("expected no burst after b returns, got %s", got)
+	}
+	for key, want := range map[string]int{"a": 50, "b": 30, "c": 20} {
+		if n := strings.Count(got, key); n != want {
+			t.Fatalf("expected %d picks of %s after b returns, got %d in %s", want, key, n, got)
+		}
+	}
+}
+
+func TestLeastLatencyAndLeastOutstandingStrategies(t *testing.T) {
+	base := `
+providers:
+  - name: provider-alpha
+    apiKeys:
+      a: key-a
+      b: key-b
+      c: key-c
+    services:
+      - type: codex
+        baseUrl: https://alpha.example.com/v1
+users:
+  - name: test-user
+    apiKey: test-key
+    services:
+      codex:
+        strategy: %s
+        candidates:
+          - providerName: provider-alpha
+            providerKeyName: a
+          - providerName: provider-alpha
+            providerKeyName: b
+          - providerName: provider-alpha
+            providerKeyName: c
+`
+	load := func(strategy string) *Manager {
+		manager := NewManager()
+		if err := manager.LoadFromFile(writeTempConfig(t, fmt.Sprintf(base, strategy))); err != nil {
+			t.Fatalf("load %s config: %v", strategy, err)
+		}
+		return manager
+	}
+	pick := func(manager *Manager) *Route {
+		route, err := manager.Resolve("test-key", "codex")
+		if err != nil {
+			t.Fatalf("resolve: %v", err)
+		}
+		return route
+	}
+
+	t.Run("least_latency", func(t *testing.T) {
+		manager := load(strategyLeastLatency)
+		manager.ReportLatency("codex", "provider-alpha", "a", 100*time.Millisecond)
+		manager.ReportLatency("codex", "provider-alpha", "b", 20*time.Millisecond)
+		if route := pick(manager); route.UpstreamKeyName != "c" {
+			t.Fatalf("expected the unmeasured key tried first, got %s", route.UpstreamKeyName)
+		}
+		manager.ReportLatency("codex", "provider-alpha", "c", 500*time.Millisecond)
+		for i := 0; i < 3; i++ {
+			if route := pick(manager); route.UpstreamKeyName != "b" {
+				t.Fatalf("expected the fastest key, got %s", route.UpstreamKeyName)
+			}
+		}
+		// b slows down: 20 -> 116 -> 192.8 ms.
+		manager.ReportLatency("codex", "provider-alpha", "b", 500*time.Millisecond)
+		manager.ReportLatency("codex", "provider-alpha", "b", 500*time.Millisecond)
+		if route := pick(manager); route.UpstreamKeyName != "a" {
+			t.Fatalf("expected the key that is now fastest, got %s", route.UpstreamKeyName)
+		}
+
+		stats, err := manager.RuntimeStatus("test-key", "codex")
+		if err != nil {
+			t.Fatalf("runtime status: %v", err)
+		}
+		if b := stats[1]; math.Abs(b.LatencyEWMAMs-192.8) > 1e-6 || b.LatencySamples != 3 {
+			t.Fatalf("expected b's average latency reported, got %+v", b)
+		}
+	})
+
+	t.Run("least_latency re-samples slow keys", func(t *testing.T) {
+		manager := load(strategyLeastLatency)
+		manager.ReportLatency("codex", "provider-alpha", "a", 500*time.Millisecond)
+		manager.ReportLatency("codex", "provider-alpha", "b", 50*time.Millisecond)
+		manager.ReportLatency("codex", "provider-alpha", "c", 500*time.Millisecond)
+		// a has recovered, but only the picks spent exploring measure it again.
+		latencies := map[string]time.Duration{"a": 10 * time.Millisecond, "b": 50 * time.Millisecond, "c": 500 * time.Millisecond}
+		picked := make(map[string]int)
+		for i := 0; i < 50*latencyExploreInterval; i++ {
+			route := pick(manager)
+			if i >= 49*latencyExploreInterval {
+				picked[route.UpstreamKeyName]++
+			}
+			manager.ReportLatency("codex", "provider-alpha", route.UpstreamKeyName, latencies[route.UpstreamKeyName])
+		}
+		if picked["a"] < latencyExploreInterval-1 {
+			t.Fatalf("expected the recovered key to win again, got %v", picked)
+		}
+	})
+
+	t.Run("least_outstanding", func(t *testing.T) {
+		manager := load(strategyLeastOutstanding)
+		// Of any two keys sampled, at least one is idle, so the busy key is never picked.
+		busy := pick(manager)
+		for i := 0; i < 60; i++ {
+			route := pick(manager)
+			if route.UpstreamKeyName == busy.UpstreamKeyName {
+				t.Fatalf("expected the busy key %s skipped at %d", busy.UpstreamKeyName, i)
+			}
+			route.Release()
+		}
+
+		stats, err := manager.RuntimeStatus("test-key", "codex")
+		if err != nil {
+			t.Fatalf("runtime status: %v", err)
+		}
+		for _, s := range stats {
+			want := int64(0)
+			if s.ProviderKeyName == busy.UpstreamKeyName {
+				want = 1
+			}
+			if s.InFlight != want {
+				t.Fatalf("expected %d in flight on %s, got %d", want, s.ProviderKeyName, s.InFlight)
+			}
+		}
+		busy.Release()
+		busy.Release()
+		if keys, _ := manager.KeyHealth(); keys[0].InFlight+keys[1].InFlight+keys[2].InFlight != 0 {
+			t.Fatalf("expected nothing in flight after release, got %+v", keys)
+		}
+	})
+}
+
+func TestConsistentHashStrategy(t *testing.T) {
+	base := `
+providers:
+  - name: provider-alpha
+    apiKeys:
+      a: key-a
+      b: key-b
+      c: key-c
+      d: key-d
+    services:
+      - type: claude
+        baseUrl: https://alpha.example.com/v1
+users:
+  - name: test-user
+    apiKey: test-key
+    services:
+      claude:
+        strategy: consistent_hash
+%s
+        candidates:
+          - providerName: provider-alpha
+            providerKeyName: a
+          - providerName: provider-alpha
+            providerKeyName: b
+          - providerName: provider-alpha
+            providerKeyName: c
+          - providerName: provider-alpha
+            providerKeyName: d
+`
+	manager := NewManager()
+	if err := manager.LoadFromFile(writeTempConfig(t, fmt.Sprintf(base, ""))); err != nil {
+		t.Fatalf("load config: %v", err)
+	}
+	resolve := func(manager *Manager, opts ResolveOptions) string {
+		route, err := manager.ResolveWithOptions("test-key", "claude", opts)
+		if err != nil {
+			t.Fatalf("resolve: %v", err)
+		}
+		route.Release()
+		return route.UpstreamKeyName
+	}
+	session := func(id string) ResolveOptions {
+		return ResolveOptions{Header: http.Header{"X-Session-Id": []string{id}}}
+	}
+
+	placement := make(map[string]string)
+	used := make(map[string]int)
+	for i := 0; i < 200; i++ {
+		id := fmt.Sprintf("session-%d", i)
+		placement[id] = resolve(manager, session(id))
+		used[placement[id]]++
+		if again := resolve(manager, session(id)); again != placement[id] {
+			t.Fatalf("session %s moved from %s to %s", id, placement[id], again)
+		}
+	}
+	for _, key := range []string{"a", "b", "c", "d"} {
+		if used[key] < 20 {
+			t.Fatalf("expected sessions spread over every key, got %v", used)
+		}
+	}
+
+	// Only the sessions of a key that leaves move, and they come back with it.
+	for i := 0; i < invalidKeyThreshold; i++ {
+		manager.ReportResult("test-key", "claude", "provider-alpha", "b", 401, nil)
+	}
+	for id, key := range placement {
+		got := resolve(manager, session(id))
+		if key != "b" && got != key {
+			t.Fatalf("session %s moved from healthy key %s to %s", id, key, got)
+		}
+		if key == "b" && got == "b" {
+			t.Fatalf("session %s stayed on the invalid key", id)
+		}
+	}
+	if _, err := manager.EnableKey("provider-alpha", "b"); err != nil {
+		t.Fatalf("enable key: %v", err)
+	}
+	for id, key := range placement {
+		if got := resolve(manager, session(id)); got != key {
+			t.Fatalf("session %s did not return to %s, got %s", id, key, got)
+		}
+	}
+
+	// Without the header, requests are hashed by user.
+	byUser := resolve(manager, ResolveOptions{})
+	for i := 0; i < 5; i++ {
+		if got := resolve(manager, ResolveOptions{}); got != byUser {
+			t.Fatalf("expected requests without a session kept on %s, got %s", byUser, got)
+		}
+	}
+
+	prompt := NewManager()
+	if err := prompt.LoadFromFile(writeTempConfig(t, fmt.Sprintf(base, "        consistentHash: {source: prompt, promptPrefix: 64}"))); err != nil {
+		t.Fatalf("load prompt config: %v", err)
+	}
+	promptUsed := make(map[string]bool)
+	for i := 0; i < 40; i++ {
+		first := fmt.Sprintf(`{"model":"claude","system":"Be brief.","messages":[{"role":"user","content":"task %d"}]}`, i)
+		turn := fmt.Sprintf(`{"max_tokens":%d,"system":"Be brief.","messages":[{"role":"user","content":"task %d"},{"role":"assistant","content":"done"}]}`, i, i)
+		a, b := resolve(prompt, ResolveOptions{Body: []byte(first)}), resolve(prompt, ResolveOptions{Body: []byte(turn)})
+		if a != b {
+			t.Fatalf("conversation %d moved from %s to %s between turns", i, a, b)
+		}
+		promptUsed[a] = true
+	}
+	if len(promptUsed) < 2 {
+		t.Fatalf("expected conversations spread by their first message, got %v", promptUsed)
+	}
+
+	for fragment, wantErr := range map[string]string{
+		"        consistentHash: {source: cookie}":       "consistentHash.source 'cookie' is not header, user or prompt",
+		"        consistentHash: {header: 'bad header'}": "consistentHash.header 'bad header' is not a valid header name",
+		"        consistentHash: {promptPrefix: -1}":     "consistentHash.promptPrefix must not be negative",
+	} {
+		if _, err := parse([]byte(fmt.Sprintf(base, fragment))); err == nil || !strings.Contains(err.Error(), wantErr) {
+			t.Errorf("%s: expected error containing %q, got %v", fragment, wantErr, err)
+		}
+	}
+	roundRobin := strings.Replace(fmt.Sprintf(base, "        consistentHash: {source: user}"), "strategy: consistent_hash", "strategy: round_robin", 1)
+	if _, err := parse([]byte(roundRobin)); err == nil || !strings.Contains(err.Error(), "consistentHash requires strategy 'consistent_hash'") {
+		t.Errorf("expected consistentHash rejected with another strategy, got %v", err)
+	}
+}
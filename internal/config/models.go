@@ -0,0 +1,117 @@
+package config
+
+import (
+	"fmt"
+	"strings"
+)
+
+// ModelNotSupportedError reports that no candidate of a user's route is configured
+// to serve the requested model.
+type ModelNotSupportedError struct {
+	User        string
+	ServiceType string
+	Model       string
+}
+
+func (e *ModelNotSupportedError) Error() string {
+	return fmt.Sprintf("%s: '%s' is not served by any upstream of service '%s' for user '%s'", ErrModelNotSupported, e.Model, e.ServiceType, e.User)
+}
+
+func (e *ModelNotSupportedError) Unwrap() error {
+	return ErrModelNotSupported
+}
+
+// normalizeModelPatterns trims patterns and rejects blank ones.
+func normalizeModelPatterns(patterns []string) ([]string, error) {
+	if len(patterns) == 0 {
+		return nil, nil
+	}
+	out := make([]string, 0, len(patterns))
+	for _, p := range patterns {
+		trimmed := strings.TrimSpace(p)
+		if trimmed == "" {
+			return nil, fmt.Errorf("models must not contain empty patterns")
+		}
+		out = append(out, trimmed)
+	}
+	return out, nil
+}
+
+// normalizeModelMap trims model names in a modelMap or modelAliases block.
+func normalizeModelMap(m map[string]string, field string) (map[string]string, error) {
+	if len(m) == 0 {
+		return nil, nil
+	}
+	out := make(map[string]string, len(m))
+	for from, to := range m {
+		from, to = strings.TrimSpace(from), strings.TrimSpace(to)
+		if from == "" || to == "" {
+			return nil, fmt.Errorf("%s must not contain empty model names", field)
+		}
+		if _, exists := out[from]; exists {
+			return nil, fmt.Errorf("%s: duplicate model '%s'", field, from)
+		}
+		out[from] = to
+	}
+	return out, nil
+}
+
+// mapModel returns the model m maps model to, or model itself when unmapped.
+func mapModel(m map[string]string, model string) string {
+	if mapped, ok := m[model]; ok {
+		return mapped
+	}
+	return model
+}
+
+// matchModelPatterns reports whether model matches any pattern. An empty pattern
+// list accepts every model.
+func matchModelPatterns(patterns []string, model string) bool {
+	if len(patterns) == 0 {
+		return true
+	}
+	for _, p := range patterns {
+		if matchModel(p, model) {
+			return true
+		}
+	}
+	return false
+}
+
+// matchModel compares a model name against a pattern case-insensitively. "*" in the
+// pattern matches any run of characters, including "/" so that "*claude*" also
+// covers vendor-prefixed names.
+func matchModel(pattern, model string) bool {
+	pattern = strings.ToLower(pattern)
+	model = strings.ToLower(model)
+	parts := strings.Split(pattern, "*")
+	if len(parts) == 1 {
+		return pattern == model
+	}
+	if !strings.HasPrefix(model, parts[0]) {
+		return false
+	}
+	model = model[len(parts[0]):]
+	last := parts[len(parts)-1]
+	for _, part := range parts[1 : len(parts)-1] {
+		idx := strings.Index(model, part)
+		if idx < 0 {
+			return false
+		}
+		model = model[idx+len(part):]
+	}
+	return len(model) >= len(last) && strings.HasSuffix(model, last)
+}
+
+// supportsModel reports whether the candidate may serve model. Both the provider
+// service and the candidate must accept it; an empty model is always accepted.
+func (c *resolvedCandidate) supportsModel(model string) bool {
+	if model == "" {
+		return true
+	}
+	_, mapped := c.serviceModelMap[model]
+	if !mapped && !matchModelPatterns(c.serviceModels, model) {
+		return false
+	}
+	return matchModelPatterns(c.models, model)
+}
@@ -0,0 +1,336 @@
+package config
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"piapi/internal/metrics"
+)
+
+const (
+	defaultHealthCheckInterval = 30 * time.Second
+	defaultHealthCheckTimeout  = 10 * time.Second
+
+	// maxProbeBodyDrain bounds how much of a probe response is read before the
+	// connection is returned to the pool.
+	maxProbeBodyDrain = 64 << 10
+)
+
+// HealthCheckStatus is the outcome of the latest active probe of a provider key.
+type HealthCheckStatus struct {
+	Healthy             bool      `json:"healthy"`
+	Status              int       `json:"status,omitempty"`
+	Error               string    `json:"error,omitempty"`
+	LatencyMs           int64     `json:"latency_ms"`
+	CheckedAt           time.Time `json:"checked_at"`
+	ConsecutiveFailures int       `json:"consecutive_failures,omitempty"`
+}
+
+// resolveHealthCheck validates a healthCheck block and fills in defaults. It
+// returns nil when cfg is nil.
+func resolveHealthCheck(cfg *HealthCheckConfig) (*HealthCheckConfig, error) {
+	if cfg == nil {
+		return nil, nil
+	}
+	out := *cfg
+	out.Path = strings.TrimSpace(out.Path)
+	if !strings.HasPrefix(out.Path, "/") {
+		return nil, errors.New("healthCheck.path must start with '/'")
+	}
+	if _, err := url.Parse(out.Path); err != nil {
+		return nil, fmt.Errorf("healthCheck.path: %w", err)
+	}
+	out.Method = strings.ToUpper(strings.TrimSpace(out.Method))
+	if out.Method == "" {
+		out.Method = http.MethodGet
+	}
+	if !validHeaderName(out.Method) {
+		return nil, fmt.Errorf("healthCheck.method '%s' is invalid", cfg.Method)
+	}
+	if out.ExpectedStatus != 0 && (out.ExpectedStatus < 100 || out.ExpectedStatus > 599) {
+		return nil, fmt.Errorf("healthCheck.expectedStatus %d is not an HTTP status", out.ExpectedStatus)
+	}
+	if out.Interval < 0 || out.Timeout < 0 {
+		return nil, errors.New("healthCheck durations must not be negative")
+	}
+	if out.Interval == 0 {
+		out.Interval = Duration(defaultHealthCheckInterval)
+	}
+	if out.Timeout == 0 {
+		out.Timeout = Duration(defaultHealthCheckTimeout)
+		if out.Timeout > out.Interval {
+			out.Timeout = out.Interval
+		}
+	}
+	if out.Timeout > out.Interval {
+		return nil, errors.New("healthCheck.timeout must not exceed healthCheck.interval")
+	}
+	return &out, nil
+}
+
+// healthProber runs the active health checks of the published configuration. It
+// is idle until StartHealthChecks supplies the context the probes live in.
+type healthProber struct {
+	parent context.Context
+	logf   func(string, ...interface{})
+	cancel context.CancelFunc
+	wg     sync.WaitGroup
+	// probed lists the keys checked by the running probes, so that the metrics of
+	// keys no longer checked can be dropped.
+	probed map[keyHealthID]struct{}
+}
+
+// StartHealthChecks starts probing the provider keys whose service has a
+// healthCheck block. The probes are rebuilt on every successful reload and stop
+// when ctx is done. logf, when set, is told when a key starts or stops passing.
+func (m *Manager) StartHealthChecks(ctx context.Context, logf func(string, ...interface{})) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.probes.parent = ctx
+	m.probes.logf = logf
+	m.probes.restart(m.data)
+}
+
+// restart stops the running probes, waiting for them to exit, and starts the
+// probes of cfg. It is called with the manager's lock held.
+func (p *healthProber) restart(cfg *resolvedConfig) {
+	if p.parent == nil {
+		return
+	}
+	if p.cancel != nil {
+		p.cancel()
+		p.wg.Wait()
+	}
+	ctx, cancel := context.WithCancel(p.parent)
+	p.cancel = cancel
+
+	probed := make(map[keyHealthID]struct{})
+	if cfg != nil {
+		for id, h := range cfg.health {
+			target := cfg.probeTarget(h)
+			if target == nil {
+				continue
+			}
+			probed[id] = struct{}{}
+			p.wg.Add(1)
+			go func() {
+				defer p.wg.Done()
+				target.run(ctx, p.logf)
+			}()
+		}
+	}
+	for id := range p.probed {
+		if _, ok := probed[id]; !ok {
+			metrics.ForgetHealthCheck(id.serviceType, id.provider, id.keyName)
+		}
+	}
+	p.probed = probed
+}
+
+// probeTarget is everything one probe loop needs, captured when the probes start
+// so that it does not depend on the configuration published later.
+type probeTarget struct {
+	health   *keyHealth
+	check    HealthCheckConfig
+	url      *url.URL
+	auth     AuthConfig
+	key      string
+	headers  *HeaderRules
+	vars     map[string]string
+	client   *http.Client
+	interval time.Duration
+}
+
+// probeTarget returns the probe of h, or nil when its service has no health check.
+func (c *resolvedConfig) probeTarget(h *keyHealth) *probeTarget {
+	provider, ok := c.providers[h.id.provider]
+	if !ok {
+		return nil
+	}
+	check := provider.healthChecks[h.id.serviceType]
+	svc, ok := provider.services[h.id.serviceType]
+	if check == nil || !ok {
+		return nil
+	}
+	base, err := url.Parse(svc.BaseURL)
+	if err != nil {
+		return nil
+	}
+	ref, _ := url.Parse(check.Path)
+	target := *base
+	target.Path = strings.TrimSuffix(base.Path, "/") + ref.Path
+	target.RawPath = ""
+	query := base.Query()
+	for name, values := range ref.Query() {
+		query[name] = values
+	}
+	target.RawQuery = query.Encode()
+
+	transport := provider.transports.forService(svc.Timeouts)
+	if transport == nil {
+		transport = http.DefaultTransport
+	}
+	t := &probeTarget{
+		health:   h,
+		check:    *check,
+		url:      &target,
+		key:      provider.keys[h.id.keyName],
+		interval: check.Interval.Std(),
+		vars: map[string]string{
+			"service":      h.id.serviceType,
+			"provider":     h.id.provider,
+			"provider_key": h.id.keyName,
+		},
+		client: &http.Client{
+			Transport: transport,
+			// A redirect is reported as the probe's status, as the gateway would
+			// pass it on.
+			CheckRedirect: func(*http.Request, []*http.Request) error { return http.ErrUseLastResponse },
+		},
+	}
+	if svc.Auth != nil {
+		t.auth = *svc.Auth
+	}
+	if svc.Headers != nil {
+		t.headers = svc.Headers.Request
+	}
+	return t
+}
+
+func (t *probeTarget) run(ctx context.Context, logf func(string, ...interface{})) {
+	ticker := time.NewTicker(t.interval)
+	defer ticker.Stop()
+	for {
+		t.probeOnce(ctx, logf)
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+func (t *probeTarget) probeOnce(ctx context.Context, logf func(string, ...interface{})) {
+	start := time.Now()
+	status, err := t.probe(ctx)
+	if ctx.Err() != nil {
+		// Stopped by a reload or shutdown; the outcome says nothing about the key.
+		return
+	}
+	result := HealthCheckStatus{
+		Status:    status,
+		LatencyMs: time.Since(start).Milliseconds(),
+		CheckedAt: start,
+	}
+	switch {
+	case err != nil:
+		result.Error = err.Error()
+	case t.check.ExpectedStatus == 0 && (status < 200 || status > 299):
+		result.Error = fmt.Sprintf("unexpected status %d", status)
+	case t.check.ExpectedStatus != 0 && status != t.check.ExpectedStatus:
+		result.Error = fmt.Sprintf("unexpected status %d, want %d", status, t.check.ExpectedStatus)
+	default:
+		result.Healthy = true
+	}
+
+	prev := t.health.recordProbe(time.Now(), result)
+	if logf == nil {
+		return
+	}
+	id := t.health.id
+	switch {
+	case !result.Healthy && (prev == nil || prev.Healthy):
+		logf("health check of %s/%s (%s) failing: %s", id.provider, id.keyName, id.serviceType, result.Error)
+	case result.Healthy && prev != nil && !prev.Healthy:
+		logf("health check of %s/%s (%s) passing again", id.provider, id.keyName, id.serviceType)
+	}
+}
+
+// probe sends one probe request authenticated with the key under test.
+func (t *probeTarget) probe(ctx context.Context) (int, error) {
+	ctx, cancel := context.WithTimeout(ctx, t.check.Timeout.Std())
+	defer cancel()
+
+	target := *t.url
+	if t.auth.Mode == AuthModeQuery {
+		query := target.Query()
+		query.Set(t.auth.Name, t.key)
+		target.RawQuery = query.Encode()
+	}
+	var body io.Reader
+	if t.check.Body != "" {
+		body = strings.NewReader(t.check.Body)
+	}
+	req, err := http.NewRequestWithContext(ctx, t.check.Method, target.String(), body)
+	if err != nil {
+		return 0, err
+	}
+	if t.check.Body != "" {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	// As for proxied requests, the header policy cannot touch the credential.
+	t.headers.Apply(req.Header, t.vars)
+	switch t.auth.Mode {
+	case AuthModeQuery:
+	case AuthModeHeader:
+		req.Header.Set(t.auth.Name, t.auth.Prefix+t.key)
+	default:
+		req.Header.Set("Authorization", "Bearer "+t.key)
+	}
+
+	res, err := t.client.Do(req)
+	if err != nil {
+		// url.Error quotes the URL, which carries the key in query auth mode.
+		var urlErr *url.Error
+		if errors.As(err, &urlErr) {
+			err = urlErr.Err
+		}
+		if errors.Is(err, context.DeadlineExceeded) {
+			err = fmt.Errorf("timed out after %s", t.check.Timeout.Std())
+		}
+		return 0, err
+	}
+	_, _ = io.Copy(io.Discard, io.LimitReader(res.Body, maxProbeBodyDrain))
+	res.Body.Close()
+	return res.StatusCode, nil
+}
+
+// recordProbe stores the outcome of a probe and applies it to the circuit breaker:
+// a failed probe counts as a failed request, and a passing one closes the circuit.
+// It returns the previous outcome.
+func (h *keyHealth) recordProbe(now time.Time, result HealthCheckStatus) *HealthCheckStatus {
+	prev := h.probe.Load()
+	if !result.Healthy {
+		result.ConsecutiveFailures = 1
+		if prev != nil {
+			result.ConsecutiveFailures = prev.ConsecutiveFailures + 1
+		}
+	}
+	h.probe.Store(&result)
+	// Probe bodies are not inspected, so only a 401 counts as an auth failure.
+	h.recordAuth(now, result.Status, nil)
+	if result.Healthy {
+		h.breaker.reset()
+	} else {
+		h.breaker.record(now, true)
+	}
+	metrics.ObserveHealthCheck(h.id.serviceType, h.id.provider, h.id.keyName, result.Healthy)
+	return prev
+}
+
+// healthCheckStatus returns a copy of the latest probe outcome, or nil when the key
+// has not been probed.
+func (h *keyHealth) healthCheckStatus() *HealthCheckStatus {
+	if result := h.probe.Load(); result != nil {
+		out := *result
+		return &out
+	}
+	return nil
+}
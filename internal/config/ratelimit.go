@@ -0,0 +1,288 @@
+package config
+
+import (
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+)
+
+// Rate limit names reported in RateLimitError and RateLimitStatus.
+const (
+	RateLimitRequestsPerMinute = "requests_per_minute"
+	RateLimitMaxConcurrent     = "max_concurrent"
+)
+
+// concurrencyRetryAfter is advertised when a request is rejected for concurrency;
+// slots free up as soon as any in-flight request finishes.
+const concurrencyRetryAfter = time.Second
+
+// RateLimitError reports which limit rejected a request and when to retry.
+type RateLimitError struct {
+	User        string
+	ServiceType string // empty for the user-wide limit
+	Limit       string
+	RetryAfter  time.Duration
+}
+
+func (e *RateLimitError) Error() string {
+	scope := "user '" + e.User + "'"
+	if e.ServiceType != "" {
+		scope += " service '" + e.ServiceType + "'"
+	}
+	return fmt.Sprintf("%s for %s (%s)", ErrRateLimited, scope, e.Limit)
+}
+
+func (e *RateLimitError) Unwrap() error {
+	return ErrRateLimited
+}
+
+// rateLimitID keys a limiter by user and, for per-service limits, service type.
+type rateLimitID struct {
+	userID      string
+	serviceType string
+}
+
+// rateLimiter combines a token bucket for request rate with an in-flight counter.
+type rateLimiter struct {
+	mu       sync.Mutex
+	user     string
+	cfg      RateLimitConfig
+	tokens   float64
+	last     time.Time
+	inFlight int
+
+	rejected     uint64
+	lastRejected time.Time
+}
+
+func newRateLimiter(user string, cfg RateLimitConfig, now time.Time) *rateLimiter {
+	return &rateLimiter{user: user, cfg: cfg, tokens: float64(cfg.RequestsPerMinute), last: now}
+}
+
+// reconfigure applies a reloaded limit while keeping accumulated state.
+func (l *rateLimiter) reconfigure(user string, cfg RateLimitConfig, now time.Time) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.refill(now)
+	wasUnlimited := l.cfg.RequestsPerMinute <= 0
+	l.user = user
+	l.cfg = cfg
+	capacity := float64(cfg.RequestsPerMinute)
+	// An unlimited bucket holds no tokens; a newly imposed limit starts full, as a
+	// new limiter does.
+	if wasUnlimited || l.tokens > capacity {
+		l.tokens = capacity
+	}
+}
+
+// refill must be called with l.mu held.
+func (l *rateLimiter) refill(now time.Time) {
+	if elapsed := now.Sub(l.last); elapsed > 0 {
+		capacity := float64(l.cfg.RequestsPerMinute)
+		l.tokens += elapsed.Minutes() * capacity
+		if l.tokens > capacity {
+			l.tokens = capacity
+		}
+	}
+	l.last = now
+}
+
+// acquire takes a token and an in-flight slot. On rejection it returns the limit
+// that was hit and how long until a retry could succeed.
+func (l *rateLimiter) acquire(now time.Time) (limit string, retryAfter time.Duration, ok bool) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	rpm := l.cfg.RequestsPerMinute
+	if rpm > 0 {
+		l.refill(now)
+		if l.tokens < 1 {
+			l.rejected++
+			l.lastRejected = now
+			wait := time.Duration((1 - l.tokens) / float64(rpm) * float64(time.Minute))
+			return RateLimitRequestsPerMinute, wait, false
+		}
+	}
+	if maxConcurrent := l.cfg.MaxConcurrent; maxConcurrent > 0 && l.inFlight >= maxConcurrent {
+		l.rejected++
+		l.lastRejected = now
+		return RateLimitMaxConcurrent, concurrencyRetryAfter, false
+	}
+	if rpm > 0 {
+		l.tokens--
+	}
+	l.inFlight++
+	return "", 0, true
+}
+
+// release frees the in-flight slot taken by acquire. When refund is set the token
+// is returned as well, used when a later limiter rejected the same request.
+func (l *rateLimiter) release(refund bool) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.inFlight > 0 {
+		l.inFlight--
+	}
+	if refund && l.cfg.RequestsPerMinute > 0 {
+		l.tokens++
+		if capacity := float64(l.cfg.RequestsPerMinute); l.tokens > capacity {
+			l.tokens = capacity
+		}
+	}
+}
+
+// rateLimiterRegistry holds limiters across configuration reloads.
+type rateLimiterRegistry struct {
+	mu       sync.RWMutex
+	limiters map[rateLimitID]*rateLimiter
+}
+
+// sync creates, updates or drops limiters so they match cfg. Limiters whose user
+// and scope still exist keep their tokens and in-flight count.
+func (r *rateLimiterRegistry) sync(cfg *resolvedConfig) {
+	now := time.Now()
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	next := make(map[rateLimitID]*rateLimiter)
+	keep := func(id rateLimitID, user string, limit RateLimitConfig) {
+		if limit == (RateLimitConfig{}) {
+			return
+		}
+		if l, ok := r.limiters[id]; ok {
+			l.reconfigure(user, limit, now)
+			next[id] = l
+			return
+		}
+		next[id] = newRateLimiter(user, limit, now)
+	}
+	for userID, user := range cfg.users {
+		keep(rateLimitID{userID: userID}, user.user.Name, user.rateLimit)
+		for svcType, svc := range user.services {
+			keep(rateLimitID{userID: userID, serviceType: svcType}, user.user.Name, svc.rateLimit)
+		}
+	}
+	r.limiters = next
+}
+
+func (r *rateLimiterRegistry) get(id rateLimitID) *rateLimiter {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return r.limiters[id]
+}
+
+// AcquireRateLimit admits one request for the user and service type against the
+// user-wide and per-service limits. On success the returned release func must be
+// called once the request completes. A rejection is reported as a *RateLimitError.
+func (m *Manager) AcquireRateLimit(apiKey, serviceType string) (release func(), err error) {
+	if apiKey == "" {
+		return nil, ErrAPIKeyRequired
+	}
+	if serviceType == "" {
+		return nil, ErrServiceTypeRequired
+	}
+
+	m.mu.RLock()
+	data := m.data
+	m.mu.RUnlock()
+
+	if data == nil {
+		return nil, ErrConfigNotLoaded
+	}
+	user, ok := data.keys.lookup(apiKey)
+	if !ok {
+		return nil, ErrUserNotFound
+	}
+	if _, ok := user.services[serviceType]; !ok {
+		return nil, fmt.Errorf("%w for user '%s'", ErrServiceNotFound, user.user.Name)
+	}
+
+	now := time.Now()
+	scopes := []rateLimitID{{userID: user.id}, {userID: user.id, serviceType: serviceType}}
+	acquired := make([]*rateLimiter, 0, len(scopes))
+	for _, id := range scopes {
+		l := m.limiters.get(id)
+		if l == nil {
+			continue
+		}
+		limit, retryAfter, ok := l.acquire(now)
+		if !ok {
+			for _, prev := range acquired {
+				prev.release(true)
+			}
+			return nil, &RateLimitError{
+				User:        user.user.Name,
+				ServiceType: id.serviceType,
+				Limit:       limit,
+				RetryAfter:  retryAfter,
+			}
+		}
+		acquired = append(acquired, l)
+	}
+
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			for _, l := range acquired {
+				l.release(false)
+			}
+		})
+	}, nil
+}
+
+// RateLimitStatus is a snapshot of one configured limiter.
+type RateLimitStatus struct {
+	User              string     `json:"user"`
+	ServiceType       string     `json:"service_type,omitempty"`
+	RequestsPerMinute int        `json:"requests_per_minute,omitempty"`
+	MaxConcurrent     int        `json:"max_concurrent,omitempty"`
+	AvailableRequests float64    `json:"available_requests,omitempty"`
+	InFlight          int        `json:"in_flight"`
+	Rejected          uint64     `json:"rejected"`
+	LastRejected      *time.Time `json:"last_rejected,omitempty"`
+}
+
+// RateLimits returns the state of every configured limiter, ordered by user name and
+// service type, with user-wide limits first.
+func (m *Manager) RateLimits() ([]RateLimitStatus, error) {
+	m.mu.RLock()
+	loaded := m.data != nil
+	m.mu.RUnlock()
+	if !loaded {
+		return nil, ErrConfigNotLoaded
+	}
+
+	now := time.Now()
+	m.limiters.mu.RLock()
+	statuses := make([]RateLimitStatus, 0, len(m.limiters.limiters))
+	for id, l := range m.limiters.limiters {
+		l.mu.Lock()
+		l.refill(now)
+		status := RateLimitStatus{
+			User:              l.user,
+			ServiceType:       id.serviceType,
+			RequestsPerMinute: l.cfg.RequestsPerMinute,
+			MaxConcurrent:     l.cfg.MaxConcurrent,
+			AvailableRequests: l.tokens,
+			InFlight:          l.inFlight,
+			Rejected:          l.rejected,
+		}
+		if !l.lastRejected.IsZero() {
+			t := l.lastRejected
+			status.LastRejected = &t
+		}
+		l.mu.Unlock()
+		statuses = append(statuses, status)
+	}
+	m.limiters.mu.RUnlock()
+
+	sort.Slice(statuses, func(i, j int) bool {
+		a, b := statuses[i], statuses[j]
+		if a.User != b.User {
+			return a.User < b.User
+		}
+		return a.ServiceType < b.ServiceType
+	})
+	return statuses, nil
+}
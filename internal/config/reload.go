@@ -0,0 +1,124 @@
+package config
+
+import "sync/atomic"
+
+// inherit carries runtime routing state from the previously published configuration
+// into next, which has not been published yet.
+//
+// Provider transports, and with them their connection pools, are kept while the
+// provider's transport settings are unchanged; replaced ones have their idle
+// connections closed. The concurrency limits of provider keys that keep a keyLimits
+// entry keep their in-flight requests and queue. Shared key health (circuit
+// breaker, rate-limit cooldown, adaptive error rate, latest health check) is kept
+// when the provider key still points at the same key value and base URL; the
+// invalid mark of a key is kept for every entry that uses the same key value.
+// Route-level counters are kept for candidates that keep the same
+// user/service/provider/key identity, and round-robin and sticky positions are kept
+// for user services that still exist. Anything whose identity changed starts from a
+// clean slate.
+func (next *resolvedConfig) inherit(prev *resolvedConfig) {
+	if next == nil || prev == nil {
+		return
+	}
+
+	for name, old := range prev.providers {
+		if p, ok := next.providers[name]; ok && p.transports.fingerprint == old.transports.fingerprint {
+			p.transports = old.transports
+			continue
+		}
+		old.transports.closeIdleConnections()
+	}
+
+	for name, p := range next.providers {
+		old, ok := prev.providers[name]
+		if !ok {
+			continue
+		}
+		for keyName, slots := range p.slots {
+			if prevSlots, ok := old.slots[keyName]; ok {
+				prevSlots.setSettings(slots.settings)
+				p.slots[keyName] = prevSlots
+			}
+		}
+	}
+
+	revoked := make(map[string]*keyHealth)
+	for _, old := range prev.health {
+		if atomic.LoadInt64(&old.invalidSince) != 0 {
+			revoked[old.secret] = old
+		}
+	}
+	replaced := make(map[*keyHealth]*keyHealth, len(next.health))
+	for id, h := range next.health {
+		old, ok := prev.health[id]
+		if !ok || old.fingerprint != h.fingerprint {
+			if r, ok := revoked[h.secret]; ok {
+				atomic.StoreInt64(&h.invalidStatus, atomic.LoadInt64(&r.invalidStatus))
+				atomic.StoreInt64(&h.invalidSince, atomic.LoadInt64(&r.invalidSince))
+			}
+			continue
+		}
+		old.breaker.setSettings(h.breaker.settings)
+		old.rateLimit.Store(h.rateLimit.Load())
+		replaced[h] = old
+		next.health[id] = old
+	}
+
+	for userKey, user := range next.users {
+		prevUser := prev.users[userKey]
+		for svcType, svc := range user.services {
+			var prevSvc *resolvedUserService
+			if prevUser != nil {
+				prevSvc = prevUser.services[svcType]
+			}
+
+			prevCandidates := make(map[string]*resolvedCandidate)
+			if prevSvc != nil {
+				for _, c := range prevSvc.candidates {
+					prevCandidates[c.id] = c
+				}
+			}
+
+			for _, c := range svc.candidates {
+				if old, ok := replaced[c.health]; ok {
+					c.health = old
+				}
+				if old, ok := prevCandidates[c.id]; ok && old.health == c.health {
+					c.stats = old.stats
+				}
+			}
+
+			if prevSvc != nil {
+				svc.inheritPosition(prevSvc)
+			}
+		}
+	}
+}
+
+// inheritPosition keeps the rotation counter, the smooth weighted round robin
+// state and the sticky candidate of a user service.
+func (svc *resolvedUserService) inheritPosition(prev *resolvedUserService) {
+	atomic.StoreUint64(&svc.rrCounter, atomic.LoadUint64(&prev.rrCounter))
+
+	prev.swrrMu.Lock()
+	currentWeights := make(map[string]float64, len(prev.candidates))
+	for _, c := range prev.candidates {
+		currentWeights[c.id] = c.currentWeight
+	}
+	prev.swrrMu.Unlock()
+	for _, c := range svc.candidates {
+		c.currentWeight = currentWeights[c.id]
+	}
+
+	sticky := int(atomic.LoadInt32(&prev.stickyIndex))
+	if sticky < 0 || sticky >= len(prev.candidates) {
+		return
+	}
+	stickyID := prev.candidates[sticky].id
+	for i, c := range svc.candidates {
+		if c.id == stickyID {
+			atomic.StoreInt32(&svc.stickyIndex, int32(i))
+			return
+		}
+	}
+}
@@ -0,0 +1,124 @@
+package config
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+)
+
+// MasterKeyEnv names the environment variable holding the base64-encoded 32-byte
+// key that decrypts "enc:" secrets.
+const MasterKeyEnv = "PIAPI_MASTER_KEY"
+
+// Secret reference prefixes accepted in provider key values.
+const (
+	secretEnvPrefix  = "${env:"
+	secretFilePrefix = "file:"
+	secretEncPrefix  = "enc:"
+)
+
+var errMasterKeyMissing = errors.New(MasterKeyEnv + " is not set")
+
+// IsSecretReference reports whether a provider key value refers to a secret held
+// elsewhere rather than being the secret itself.
+func IsSecretReference(value string) bool {
+	return (strings.HasPrefix(value, secretEnvPrefix) && strings.HasSuffix(value, "}")) ||
+		strings.HasPrefix(value, secretFilePrefix) ||
+		strings.HasPrefix(value, secretEncPrefix)
+}
+
+// resolveSecret returns the secret a provider key value refers to. Supported forms
+// are "${env:NAME}", "file:/path" (surrounding whitespace is trimmed) and
+// "enc:<base64>" (AES-256-GCM under the master key); any other value is the
+// secret itself. Errors never include secret material.
+func resolveSecret(value string) (string, error) {
+	var (
+		secret string
+		err    error
+	)
+	switch {
+	case strings.HasPrefix(value, secretEnvPrefix) && strings.HasSuffix(value, "}"):
+		name := strings.TrimSpace(value[len(secretEnvPrefix) : len(value)-1])
+		if name == "" {
+			return "", errors.New("environment variable name is empty")
+		}
+		secret = os.Getenv(name)
+		if strings.TrimSpace(secret) == "" {
+			return "", fmt.Errorf("environment variable %s is not set", name)
+		}
+	case strings.HasPrefix(value, secretFilePrefix):
+		path := strings.TrimSpace(strings.TrimPrefix(value, secretFilePrefix))
+		data, readErr := os.ReadFile(path)
+		if readErr != nil {
+			return "", fmt.Errorf("read secret file: %w", readErr)
+		}
+		secret = string(data)
+	case strings.HasPrefix(value, secretEncPrefix):
+		secret, err = decryptSecret(strings.TrimPrefix(value, secretEncPrefix))
+		if err != nil {
+			return "", err
+		}
+	default:
+		return value, nil
+	}
+	secret = strings.TrimSpace(secret)
+	if secret == "" {
+		return "", errors.New("secret is empty")
+	}
+	return secret, nil
+}
+
+// EncryptSecret returns the "enc:" value of plaintext under the master key taken
+// from MasterKeyEnv.
+func EncryptSecret(plaintext string) (string, error) {
+	aead, err := masterAEAD()
+	if err != nil {
+		return "", err
+	}
+	nonce := make([]byte, aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return "", fmt.Errorf("generate nonce: %w", err)
+	}
+	sealed := aead.Seal(nonce, nonce, []byte(plaintext), nil)
+	return secretEncPrefix + base64.StdEncoding.EncodeToString(sealed), nil
+}
+
+func decryptSecret(encoded string) (string, error) {
+	aead, err := masterAEAD()
+	if err != nil {
+		return "", err
+	}
+	data, err := base64.StdEncoding.DecodeString(strings.TrimSpace(encoded))
+	if err != nil {
+		return "", errors.New("encrypted secret is not valid base64")
+	}
+	if len(data) < aead.NonceSize() {
+		return "", errors.New("encrypted secret is too short")
+	}
+	plain, err := aead.Open(nil, data[:aead.NonceSize()], data[aead.NonceSize():], nil)
+	if err != nil {
+		return "", errors.New("decrypt secret: wrong master key or corrupted value")
+	}
+	return string(plain), nil
+}
+
+func masterAEAD() (cipher.AEAD, error) {
+	encoded := strings.TrimSpace(os.Getenv(MasterKeyEnv))
+	if encoded == "" {
+		return nil, errMasterKeyMissing
+	}
+	key, err := base64.StdEncoding.DecodeString(encoded)
+	if err != nil || len(key) != 32 {
+		return nil, fmt.Errorf("%s must be 32 bytes encoded as base64", MasterKeyEnv)
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
@@ -0,0 +1,25 @@
+package config
+
+import "fmt"
+
+// normalizeTimeouts validates t and returns a copy of it, or nil when no timeout is
+// set. Negative values are already rejected when the durations are decoded.
+func normalizeTimeouts(t *TimeoutConfig) (*TimeoutConfig, error) {
+	if t == nil || *t == (TimeoutConfig{}) {
+		return nil, nil
+	}
+	if t.Total > 0 {
+		for name, d := range map[string]Duration{
+			"connect":        t.Connect,
+			"tlsHandshake":   t.TLSHandshake,
+			"responseHeader": t.ResponseHeader,
+			"streamIdle":     t.StreamIdle,
+		} {
+			if d > t.Total {
+				return nil, fmt.Errorf("timeouts.%s (%s) exceeds timeouts.total (%s)", name, d, t.Total)
+			}
+		}
+	}
+	out := *t
+	return &out, nil
+}
@@ -0,0 +1,209 @@
+package config
+
+import (
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ProxyDirect disables the proxy taken from the environment for a provider.
+const ProxyDirect = "direct"
+
+// defaultDialKeepAlive matches the dialer of http.DefaultTransport.
+const defaultDialKeepAlive = 30 * time.Second
+
+// providerTransports holds the HTTP transports of one provider: base, built from its
+// transport settings, and clones of it that carry service connection timeouts. They
+// are kept across reloads while the settings and the files they name are unchanged,
+// so connection pools survive.
+type providerTransports struct {
+	fingerprint string
+	// base is nil when the provider has no transport settings.
+	base *http.Transport
+
+	mu         sync.Mutex
+	byTimeouts map[transportTimeouts]*http.Transport
+}
+
+// transportTimeouts are the service timeouts enforced by the transport itself.
+type transportTimeouts struct {
+	connect        time.Duration
+	tlsHandshake   time.Duration
+	responseHeader time.Duration
+}
+
+// normalizeTransport validates t, returning a trimmed copy, or nil when no setting
+// is made.
+func normalizeTransport(t *TransportConfig) (*TransportConfig, error) {
+	if t == nil {
+		return nil, nil
+	}
+	out := TransportConfig{
+		Proxy:      strings.TrimSpace(t.Proxy),
+		CAFile:     strings.TrimSpace(t.CAFile),
+		CertFile:   strings.TrimSpace(t.CertFile),
+		KeyFile:    strings.TrimSpace(t.KeyFile),
+		ServerName: strings.TrimSpace(t.ServerName),
+		HTTP2:      t.HTTP2,
+	}
+	if out == (TransportConfig{}) {
+		return nil, nil
+	}
+	if out.Proxy != "" && out.Proxy != ProxyDirect {
+		u, err := url.Parse(out.Proxy)
+		if err != nil {
+			return nil, fmt.Errorf("transport.proxy: %w", err)
+		}
+		switch u.Scheme {
+		case "http", "https", "socks5":
+		default:
+			return nil, fmt.Errorf("transport.proxy: unsupported scheme '%s'", u.Scheme)
+		}
+		if u.Host == "" {
+			return nil, errors.New("transport.proxy: host is required")
+		}
+	}
+	if (out.CertFile == "") != (out.KeyFile == "") {
+		return nil, errors.New("transport: certFile and keyFile must be set together")
+	}
+	return &out, nil
+}
+
+// newProviderTransports builds the base transport for t, reading the files it
+// names. A nil t yields transports without a base.
+func newProviderTransports(t *TransportConfig) (*providerTransports, error) {
+	p := &providerTransports{byTimeouts: make(map[transportTimeouts]*http.Transport)}
+	if t == nil {
+		return p, nil
+	}
+
+	hash := sha256.New()
+	fmt.Fprintf(hash, "%s\x00%s\x00%s\x00%s\x00%s\x00", t.Proxy, t.CAFile, t.CertFile, t.KeyFile, t.ServerName)
+	if t.HTTP2 != nil {
+		hash.Write([]byte(strconv.FormatBool(*t.HTTP2)))
+	}
+
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	switch t.Proxy {
+	case "":
+	case ProxyDirect:
+		transport.Proxy = nil
+	default:
+		proxyURL, _ := url.Parse(t.Proxy)
+		transport.Proxy = http.ProxyURL(proxyURL)
+	}
+
+	if t.CAFile != "" || t.CertFile != "" || t.ServerName != "" {
+		tlsConfig := &tls.Config{ServerName: t.ServerName}
+		if t.CAFile != "" {
+			pem, err := os.ReadFile(t.CAFile)
+			if err != nil {
+				return nil, fmt.Errorf("transport.caFile: %w", err)
+			}
+			pool, err := x509.SystemCertPool()
+			if err != nil {
+				pool = x509.NewCertPool()
+			}
+			if !pool.AppendCertsFromPEM(pem) {
+				return nil, fmt.Errorf("transport.caFile: no certificates found in %s", t.CAFile)
+			}
+			tlsConfig.RootCAs = pool
+			hash.Write(pem)
+		}
+		if t.CertFile != "" {
+			certPEM, err := os.ReadFile(t.CertFile)
+			if err != nil {
+				return nil, fmt.Errorf("transport.certFile: %w", err)
+			}
+			keyPEM, err := os.ReadFile(t.KeyFile)
+			if err != nil {
+				return nil, fmt.Errorf("transport.keyFile: %w", err)
+			}
+			cert, err := tls.X509KeyPair(certPEM, keyPEM)
+			if err != nil {
+				return nil, fmt.Errorf("transport: load client certificate: %w", err)
+			}
+			tlsConfig.Certificates = []tls.Certificate{cert}
+			hash.Write(certPEM)
+			hash.Write(keyPEM)
+		}
+		transport.TLSClientConfig = tlsConfig
+	}
+
+	if t.HTTP2 != nil && !*t.HTTP2 {
+		// A non-nil, empty TLSNextProto disables HTTP/2.
+		transport.ForceAttemptHTTP2 = false
+		transport.TLSNextProto = make(map[string]func(string, *tls.Conn) http.RoundTripper)
+	}
+
+	p.base = transport
+	p.fingerprint = hex.EncodeToString(hash.Sum(nil))
+	return p, nil
+}
+
+// forService returns the round tripper for a service of the provider, or nil when
+// neither the provider's settings nor the service's timeouts call for a dedicated
+// transport.
+func (p *providerTransports) forService(timeouts *TimeoutConfig) http.RoundTripper {
+	var key transportTimeouts
+	if timeouts != nil {
+		key = transportTimeouts{
+			connect:        timeouts.Connect.Std(),
+			tlsHandshake:   timeouts.TLSHandshake.Std(),
+			responseHeader: timeouts.ResponseHeader.Std(),
+		}
+	}
+	if key == (transportTimeouts{}) {
+		if p.base == nil {
+			return nil
+		}
+		return p.base
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if transport, ok := p.byTimeouts[key]; ok {
+		return transport
+	}
+	base := p.base
+	if base == nil {
+		base = http.DefaultTransport.(*http.Transport)
+	}
+	transport := base.Clone()
+	if key.connect > 0 {
+		dialer := &net.Dialer{Timeout: key.connect, KeepAlive: defaultDialKeepAlive}
+		transport.DialContext = dialer.DialContext
+	}
+	if key.tlsHandshake > 0 {
+		transport.TLSHandshakeTimeout = key.tlsHandshake
+	}
+	if key.responseHeader > 0 {
+		transport.ResponseHeaderTimeout = key.responseHeader
+	}
+	p.byTimeouts[key] = transport
+	return transport
+}
+
+// closeIdleConnections releases the pooled connections of transports that are no
+// longer used. Requests in flight are not affected.
+func (p *providerTransports) closeIdleConnections() {
+	if p.base != nil {
+		p.base.CloseIdleConnections()
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	for _, transport := range p.byTimeouts {
+		transport.CloseIdleConnections()
+	}
+}
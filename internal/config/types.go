@@ -6,10 +6,26 @@ const (
 	AuthModeQuery  = "query"
 )
 
+// Client credential styles accepted from callers of the gateway.
+const (
+	// ClientAuthBearer reads "Authorization: Bearer <key>".
+	ClientAuthBearer = "bearer"
+	// ClientAuthXAPIKey reads the x-api-key header sent by Anthropic SDKs.
+	ClientAuthXAPIKey = "x-api-key"
+	// ClientAuthXGoogAPIKey reads the x-goog-api-key header sent by Gemini SDKs.
+	ClientAuthXGoogAPIKey = "x-goog-api-key"
+	// ClientAuthQuery reads the "key" query parameter. Keys in URLs tend to end up in
+	// access logs, so this style is never enabled by default.
+	ClientAuthQuery = "query"
+)
+
 // Config represents the full piapi configuration surface.
 type Config struct {
 	Providers []Provider `yaml:"providers" json:"providers"`
 	Users     []User     `yaml:"users" json:"users"`
+	// ClientAuth selects, per service type, how clients present their piapi key.
+	// Service types not listed accept DefaultClientAuthStyles.
+	ClientAuth map[string]ClientAuthConfig `yaml:"clientAuth" json:"client_auth,omitempty"`
 }
 
 // Provider describes an upstream vendor and its available services and keys.
@@ -17,6 +33,41 @@ type Provider struct {
 	Name     string            `yaml:"name" json:"name"`
 	APIKeys  map[string]string `yaml:"apiKeys" json:"api_keys"`
 	Services []Service         `yaml:"services" json:"services"`
+	// Transport configures how connections to this provider are made.
+	Transport *TransportConfig `yaml:"transport" json:"transport,omitempty"`
+	// KeyLimits caps the concurrency of API keys, by key name.
+	KeyLimits map[string]KeyLimitConfig `yaml:"keyLimits" json:"key_limits,omitempty"`
+}
+
+// KeyLimitConfig bounds the requests in flight on one provider key, across every
+// service type and user routed to it. A saturated key is skipped by candidate
+// selection; when every candidate of a route is saturated, the request waits for a
+// slot in the key's queue.
+type KeyLimitConfig struct {
+	// MaxConcurrent caps the requests in flight on the key.
+	MaxConcurrent int `yaml:"maxConcurrent" json:"max_concurrent"`
+	// MaxQueue caps the requests waiting for a slot; it defaults to 100.
+	MaxQueue int `yaml:"maxQueue" json:"max_queue,omitempty"`
+	// QueueTimeout is how long a request waits for a slot; it defaults to 10s.
+	QueueTimeout Duration `yaml:"queueTimeout" json:"queue_timeout,omitempty"`
+}
+
+// TransportConfig holds the egress proxy and TLS settings of a provider. Files are
+// read when the config is loaded.
+type TransportConfig struct {
+	// Proxy is the URL of an http, https or socks5 proxy, or "direct" to ignore the
+	// HTTP_PROXY/HTTPS_PROXY environment variables. Empty follows the environment.
+	Proxy string `yaml:"proxy" json:"proxy,omitempty"`
+	// CAFile is a PEM bundle of certificate authorities trusted in addition to the
+	// system roots.
+	CAFile string `yaml:"caFile" json:"ca_file,omitempty"`
+	// CertFile and KeyFile hold a PEM client certificate and key presented for mTLS.
+	CertFile string `yaml:"certFile" json:"cert_file,omitempty"`
+	KeyFile  string `yaml:"keyFile" json:"key_file,omitempty"`
+	// ServerName overrides the host name used to verify the upstream certificate.
+	ServerName string `yaml:"serverName" json:"server_name,omitempty"`
+	// HTTP2 set to false limits connections to HTTP/1.1. HTTP/2 is used by default.
+	HTTP2 *bool `yaml:"http2" json:"http2,omitempty"`
 }
 
 // Service captures routing metadata for a particular upstream capability.
@@ -24,6 +75,135 @@ type Service struct {
 	Type    string      `yaml:"type" json:"type"`
 	BaseURL string      `yaml:"baseUrl" json:"base_url"`
 	Auth    *AuthConfig `yaml:"auth" json:"auth,omitempty"`
+	// Pricing estimates the cost of requests for currency budgets.
+	Pricing *PricingConfig `yaml:"pricing" json:"pricing,omitempty"`
+	// Models lists the model patterns this service accepts, where "*" matches any
+	// run of characters. Empty accepts every model.
+	Models []string `yaml:"models" json:"models,omitempty"`
+	// ModelMap renames models for this provider before the request is proxied, e.g.
+	// "claude-sonnet-4" to "anthropic/claude-sonnet-4". Mapped models count as
+	// supported even when Models does not list them.
+	ModelMap map[string]string `yaml:"modelMap" json:"model_map,omitempty"`
+	// Protocol declares the API the upstream speaks: "anthropic" (Messages),
+	// "openai" (Chat Completions) or "responses". When set and a client calls
+	// another API's generation endpoint, the gateway translates the request and
+	// response. Empty proxies every request as is.
+	Protocol string `yaml:"protocol" json:"protocol,omitempty"`
+	// ChatOnly marks an OpenAI upstream that lacks the Responses API, so Responses
+	// clients are translated to Chat Completions. It implies protocol "openai".
+	ChatOnly bool `yaml:"chatOnly" json:"chat_only,omitempty"`
+	// Headers rewrites headers of requests sent to and responses received from this
+	// service. Routes and candidates may extend it.
+	Headers *HeaderPolicy `yaml:"headers" json:"headers,omitempty"`
+	// Timeouts bounds calls to this service.
+	Timeouts *TimeoutConfig `yaml:"timeouts" json:"timeouts,omitempty"`
+	// CircuitBreaker tunes the breaker kept for each provider key used by this service.
+	CircuitBreaker *CircuitBreakerConfig `yaml:"circuitBreaker" json:"circuit_breaker,omitempty"`
+	// UpstreamRateLimit tunes how the rate-limit signals of upstream responses cool
+	// a provider key down.
+	UpstreamRateLimit *UpstreamRateLimitConfig `yaml:"upstreamRateLimit" json:"upstream_rate_limit,omitempty"`
+	// HealthCheck, when set, probes each provider key routed to this service.
+	HealthCheck *HealthCheckConfig `yaml:"healthCheck" json:"health_check,omitempty"`
+}
+
+// HealthCheckConfig describes an active probe. Probes are sent to the service with
+// the key under test, authenticated and with the service's request header policy
+// like proxied requests. A failed probe counts as a failure for the key's circuit
+// breaker; a passing probe closes it.
+type HealthCheckConfig struct {
+	// Path is appended to the service's baseUrl.
+	Path string `yaml:"path" json:"path"`
+	// Method defaults to GET.
+	Method string `yaml:"method" json:"method,omitempty"`
+	// Body is sent as application/json when set.
+	Body string `yaml:"body" json:"body,omitempty"`
+	// ExpectedStatus is the status a healthy upstream answers with. Zero accepts
+	// any 2xx status.
+	ExpectedStatus int `yaml:"expectedStatus" json:"expected_status,omitempty"`
+	// Interval defaults to 30s.
+	Interval Duration `yaml:"interval" json:"interval,omitempty"`
+	// Timeout bounds each probe. It defaults to 10s, or Interval if shorter.
+	Timeout Duration `yaml:"timeout" json:"timeout,omitempty"`
+}
+
+// CircuitBreakerConfig tunes a circuit breaker. The circuit opens once
+// FailureThreshold failures fall within Window. While open, the key is not selected;
+// after OpenTimeout the circuit turns half-open and lets HalfOpenRequests trial
+// requests through. If they all succeed it closes; a failed trial reopens it for
+// twice as long as before, up to MaxOpenTimeout. Open durations vary by ±20%.
+type CircuitBreakerConfig struct {
+	// FailureThreshold defaults to 1, so a single failure opens the circuit.
+	FailureThreshold int `yaml:"failureThreshold" json:"failure_threshold,omitempty"`
+	// Window defaults to 60s.
+	Window Duration `yaml:"window" json:"window,omitempty"`
+	// OpenTimeout defaults to 30s.
+	OpenTimeout Duration `yaml:"openTimeout" json:"open_timeout,omitempty"`
+	// MaxOpenTimeout defaults to 10m.
+	MaxOpenTimeout Duration `yaml:"maxOpenTimeout" json:"max_open_timeout,omitempty"`
+	// HalfOpenRequests defaults to 1.
+	HalfOpenRequests int `yaml:"halfOpenRequests" json:"half_open_requests,omitempty"`
+}
+
+// UpstreamRateLimitConfig controls the cooldown of provider keys the upstream rate
+// limits. A key answered with 429 is not selected until the time given by
+// Retry-After or the provider's rate-limit reset headers, or for DefaultCooldown
+// when the response carries neither. A key whose remaining request or token quota
+// falls to MinRemainingRequests or MinRemainingTokens is cooled down until the
+// quota resets. Cooldowns never exceed MaxCooldown.
+type UpstreamRateLimitConfig struct {
+	// DefaultCooldown defaults to 30s.
+	DefaultCooldown Duration `yaml:"defaultCooldown" json:"default_cooldown,omitempty"`
+	// MaxCooldown defaults to 10m.
+	MaxCooldown Duration `yaml:"maxCooldown" json:"max_cooldown,omitempty"`
+	// MinRemainingRequests defaults to 0: the key is skipped once no requests remain.
+	MinRemainingRequests int64 `yaml:"minRemainingRequests" json:"min_remaining_requests,omitempty"`
+	// MinRemainingTokens defaults to 0: the key is skipped once no tokens remain.
+	MinRemainingTokens int64 `yaml:"minRemainingTokens" json:"min_remaining_tokens,omitempty"`
+}
+
+// TimeoutConfig bounds the phases of an upstream call. Zero leaves a phase
+// unbounded, except Connect and TLSHandshake, which then keep the defaults of Go's
+// HTTP transport (30s and 10s).
+type TimeoutConfig struct {
+	// Connect bounds establishing the TCP connection.
+	Connect Duration `yaml:"connect" json:"connect,omitempty"`
+	// TLSHandshake bounds the TLS handshake.
+	TLSHandshake Duration `yaml:"tlsHandshake" json:"tls_handshake,omitempty"`
+	// ResponseHeader bounds the wait for response headers once the request is sent.
+	ResponseHeader Duration `yaml:"responseHeader" json:"response_header,omitempty"`
+	// Total bounds the whole attempt, including reading the response body.
+	Total Duration `yaml:"total" json:"total,omitempty"`
+	// StreamIdle bounds the gap between two reads of the response body, so a stalled
+	// stream is cut off without limiting how long a live one may run.
+	StreamIdle Duration `yaml:"streamIdle" json:"stream_idle,omitempty"`
+}
+
+// HeaderPolicy rewrites the headers of proxied requests and responses.
+type HeaderPolicy struct {
+	Request  *HeaderRules `yaml:"request" json:"request,omitempty"`
+	Response *HeaderRules `yaml:"response" json:"response,omitempty"`
+}
+
+// HeaderRules are applied in order: Remove, then Set, then Add. Values may contain
+// the placeholders listed in HeaderTemplateVars, such as "{{user}}".
+type HeaderRules struct {
+	// Set replaces any existing values of a header.
+	Set map[string]string `yaml:"set" json:"set,omitempty"`
+	// Add appends a value, keeping existing ones.
+	Add map[string]string `yaml:"add" json:"add,omitempty"`
+	// Remove deletes headers.
+	Remove []string `yaml:"remove" json:"remove,omitempty"`
+}
+
+// PricingConfig lists prices per one million tokens, in whatever currency budgets use.
+// Cache prices apply to the cache token counts reported by the upstream, on top of
+// the prompt price; leave them unset for APIs whose prompt count already includes
+// cached tokens.
+type PricingConfig struct {
+	Prompt     float64 `yaml:"prompt" json:"prompt,omitempty"`
+	Completion float64 `yaml:"completion" json:"completion,omitempty"`
+	CacheRead  float64 `yaml:"cacheRead" json:"cache_read,omitempty"`
+	CacheWrite float64 `yaml:"cacheWrite" json:"cache_write,omitempty"`
 }
 
 // AuthConfig parameterizes how to inject upstream credentials per service.
@@ -35,9 +215,16 @@ type AuthConfig struct {
 
 // User defines the mapping between a piapi API key and an upstream route.
 type User struct {
-	Name     string                      `yaml:"name" json:"name"`
-	APIKey   string                      `yaml:"apiKey" json:"api_key"`
-	Services map[string]UserServiceRoute `yaml:"services" json:"services"`
+	Name   string `yaml:"name" json:"name"`
+	APIKey string `yaml:"apiKey" json:"api_key"`
+	// APIKeyHash declares the user by a salted hash of their key instead of APIKey,
+	// in the form "sha256:<salt>:<hex digest of salt+key>".
+	APIKeyHash string                      `yaml:"apiKeyHash" json:"api_key_hash,omitempty"`
+	Services   map[string]UserServiceRoute `yaml:"services" json:"services"`
+	// RateLimit applies to all of the user's traffic, across every service type.
+	RateLimit *RateLimitConfig `yaml:"rateLimit" json:"rate_limit,omitempty"`
+	// Budget caps the user's token usage and estimated cost across every service type.
+	Budget *BudgetConfig `yaml:"budget" json:"budget,omitempty"`
 }
 
 // UserServiceRoute defines the upstream selection for a specific service type.
@@ -51,8 +238,86 @@ type UserServiceRoute struct {
 	//   - weighted_rr（静态加权轮询）
 	//   - adaptive_rr（基于运行时质量的自动加权）
 	//   - sticky_healthy（粘住最近健康候选，失败后切换）
+	//   - least_latency（首字节时间滑动平均最低的候选优先）
+	//   - least_outstanding（随机抽取两个候选，取在途请求较少者）
+	//   - consistent_hash（按会话等请求属性一致性哈希，保持提示缓存命中）
 	Strategy   string                 `yaml:"strategy" json:"strategy,omitempty"`
 	Candidates []UserServiceCandidate `yaml:"candidates" json:"candidates,omitempty"`
+
+	// Failover bounds transparent retries on the next candidate when an upstream
+	// fails before any response bytes reach the client.
+	Failover *FailoverConfig `yaml:"failover" json:"failover,omitempty"`
+
+	// RateLimit applies to the user's traffic for this service type only, on top of
+	// the user-wide limit.
+	RateLimit *RateLimitConfig `yaml:"rateLimit" json:"rate_limit,omitempty"`
+
+	// Budget caps the user's usage of this service type only, on top of the user budget.
+	Budget *BudgetConfig `yaml:"budget" json:"budget,omitempty"`
+
+	// ModelAliases lets clients of this route request models by short names such as
+	// "fast" or "smart"; the alias is replaced before candidates are selected.
+	ModelAliases map[string]string `yaml:"modelAliases" json:"model_aliases,omitempty"`
+
+	// Headers extends the header policy of the route's services.
+	Headers *HeaderPolicy `yaml:"headers" json:"headers,omitempty"`
+
+	// ConsistentHash selects what the consistent_hash strategy hashes; it is only
+	// valid with that strategy.
+	ConsistentHash *ConsistentHashConfig `yaml:"consistentHash" json:"consistent_hash,omitempty"`
+}
+
+// ConsistentHashConfig selects the request attribute that the consistent_hash
+// strategy maps onto candidates, so that requests sharing it keep reaching the same
+// provider key and its prompt cache. Requests without the attribute are hashed by
+// user.
+type ConsistentHashConfig struct {
+	// Source is "header" (the default), "user" or "prompt".
+	Source string `yaml:"source" json:"source,omitempty"`
+	// Header names the header hashed by the header source; it defaults to
+	// X-Session-Id.
+	Header string `yaml:"header" json:"header,omitempty"`
+	// PromptPrefix is how many bytes of the system prompt and first message the
+	// prompt source hashes; it defaults to 1024.
+	PromptPrefix int `yaml:"promptPrefix" json:"prompt_prefix,omitempty"`
+}
+
+// BudgetConfig limits usage per calendar day and month (local time).
+type BudgetConfig struct {
+	Daily   *BudgetLimit `yaml:"daily" json:"daily,omitempty"`
+	Monthly *BudgetLimit `yaml:"monthly" json:"monthly,omitempty"`
+}
+
+// BudgetLimit caps tokens (prompt plus completion) and/or estimated cost as priced by
+// the service's pricing block. Zero disables a cap.
+type BudgetLimit struct {
+	Tokens int64   `yaml:"tokens" json:"tokens,omitempty"`
+	Cost   float64 `yaml:"cost" json:"cost,omitempty"`
+}
+
+// ClientAuthConfig lists the credential styles a service type accepts, in the order
+// they are checked.
+type ClientAuthConfig struct {
+	Styles []string `yaml:"styles" json:"styles"`
+}
+
+// RateLimitConfig bounds how much traffic a user may send. Zero disables a limit.
+type RateLimitConfig struct {
+	// RequestsPerMinute is enforced as a token bucket that refills continuously and
+	// holds at most one minute's worth of requests.
+	RequestsPerMinute int `yaml:"requestsPerMinute" json:"requests_per_minute,omitempty"`
+	// MaxConcurrent caps requests in flight at the same time.
+	MaxConcurrent int `yaml:"maxConcurrent" json:"max_concurrent,omitempty"`
+}
+
+// FailoverConfig controls in-request failover across the candidates of a route.
+type FailoverConfig struct {
+	// MaxAttempts caps upstream attempts per request, including the first one.
+	// Defaults to the number of candidates, at most 3.
+	MaxAttempts int `yaml:"maxAttempts" json:"max_attempts,omitempty"`
+	// Deadline stops starting new attempts once the request has been running this long.
+	// Zero means no overall deadline.
+	Deadline Duration `yaml:"deadline" json:"deadline,omitempty"`
 }
 
 // UserServiceCandidate describes one upstream candidate in an aggregated route.
@@ -62,4 +327,9 @@ type UserServiceCandidate struct {
 	Weight          int      `yaml:"weight" json:"weight,omitempty"`
 	Enabled         *bool    `yaml:"enabled" json:"enabled,omitempty"`
 	Tags            []string `yaml:"tags" json:"tags,omitempty"`
+	// Models further restricts which requested models are sent to this candidate,
+	// using the same patterns as Service.Models. Empty defers to the service.
+	Models []string `yaml:"models" json:"models,omitempty"`
+	// Headers extends the header policy of the service and route for this candidate.
+	Headers *HeaderPolicy `yaml:"headers" json:"headers,omitempty"`
 }
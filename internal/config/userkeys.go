@@ -0,0 +1,112 @@
+package config
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"fmt"
+	"strings"
+	"sync"
+)
+
+// apiKeyHashScheme prefixes apiKeyHash values: "sha256:<salt>:<hex digest>", where
+// the digest is SHA-256 over the salt followed by the key.
+const apiKeyHashScheme = "sha256"
+
+// generatedKeyPrefix marks keys created by GenerateAPIKey.
+const generatedKeyPrefix = "piapi-"
+
+// GenerateAPIKey returns a new random user API key.
+func GenerateAPIKey() (string, error) {
+	buf := make([]byte, 24)
+	if _, err := rand.Read(buf); err != nil {
+		return "", fmt.Errorf("generate api key: %w", err)
+	}
+	return generatedKeyPrefix + hex.EncodeToString(buf), nil
+}
+
+// HashAPIKey returns the apiKeyHash value of key under a fresh random salt.
+func HashAPIKey(key string) (string, error) {
+	buf := make([]byte, 16)
+	if _, err := rand.Read(buf); err != nil {
+		return "", fmt.Errorf("generate salt: %w", err)
+	}
+	salt := hex.EncodeToString(buf)
+	return apiKeyHashScheme + ":" + salt + ":" + hex.EncodeToString(saltedDigest(salt, key)), nil
+}
+
+func saltedDigest(salt, key string) []byte {
+	sum := sha256.Sum256([]byte(salt + key))
+	return sum[:]
+}
+
+// parseAPIKeyHash splits an apiKeyHash value into its salt and digest.
+func parseAPIKeyHash(value string) (salt string, digest []byte, err error) {
+	parts := strings.Split(value, ":")
+	if len(parts) != 3 || parts[0] != apiKeyHashScheme {
+		return "", nil, fmt.Errorf("apiKeyHash must have the form '%s:<salt>:<hex digest>'", apiKeyHashScheme)
+	}
+	if parts[1] == "" {
+		return "", nil, fmt.Errorf("apiKeyHash salt must not be empty")
+	}
+	digest, err = hex.DecodeString(parts[2])
+	if err != nil || len(digest) != sha256.Size {
+		return "", nil, fmt.Errorf("apiKeyHash digest must be %d hex characters", sha256.Size*2)
+	}
+	return parts[1], digest, nil
+}
+
+// userKeyIndex finds the user a presented API key belongs to. Plaintext keys are a
+// map lookup. Hashed keys cost one SHA-256 per distinct salt on first use; matches
+// are then cached under the unsalted digest of the key, so steady-state lookups
+// are a single hash and a map read.
+type userKeyIndex struct {
+	plain  map[string]*resolvedUser
+	hashed []hashedUser
+	cache  sync.Map // unsalted hex digest -> *resolvedUser
+}
+
+type hashedUser struct {
+	salt   string
+	digest []byte
+	user   *resolvedUser
+}
+
+func newUserKeyIndex() *userKeyIndex {
+	return &userKeyIndex{plain: make(map[string]*resolvedUser)}
+}
+
+func (idx *userKeyIndex) addHashed(salt string, digest []byte, user *resolvedUser) {
+	idx.hashed = append(idx.hashed, hashedUser{salt: salt, digest: digest, user: user})
+}
+
+func (idx *userKeyIndex) lookup(key string) (*resolvedUser, bool) {
+	if user, ok := idx.plain[key]; ok {
+		return user, true
+	}
+	if len(idx.hashed) == 0 || key == "" {
+		return nil, false
+	}
+	sum := sha256.Sum256([]byte(key))
+	cacheKey := hex.EncodeToString(sum[:])
+	if cached, ok := idx.cache.Load(cacheKey); ok {
+		return cached.(*resolvedUser), true
+	}
+	user := idx.matchHashed(key)
+	if user == nil {
+		return nil, false
+	}
+	// Only matches are cached, so the cache is bounded by the number of users.
+	idx.cache.Store(cacheKey, user)
+	return user, true
+}
+
+func (idx *userKeyIndex) matchHashed(key string) *resolvedUser {
+	for _, h := range idx.hashed {
+		if subtle.ConstantTimeCompare(saltedDigest(h.salt, key), h.digest) == 1 {
+			return h.user
+		}
+	}
+	return nil
+}
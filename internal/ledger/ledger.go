@@ -0,0 +1,377 @@
+// Package ledger persists per-user token and cost usage so that budgets survive
+// restarts. Usage is tracked for the current day and month in local time.
+package ledger
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+)
+
+// Period identifies a budget window.
+type Period string
+
+const (
+	Daily   Period = "daily"
+	Monthly Period = "monthly"
+)
+
+// ParsePeriod validates a period name.
+func ParsePeriod(s string) (Period, error) {
+	switch p := Period(s); p {
+	case Daily, Monthly:
+		return p, nil
+	default:
+		return "", fmt.Errorf("unknown budget period %q", s)
+	}
+}
+
+// DefaultFlushInterval is how often Run writes pending usage to disk.
+const DefaultFlushInterval = 10 * time.Second
+
+const fileVersion = 1
+
+// Usage is an amount of tokens and estimated cost.
+type Usage struct {
+	Tokens int64   `json:"tokens"`
+	Cost   float64 `json:"cost"`
+}
+
+func (u Usage) add(o Usage) Usage {
+	return Usage{Tokens: u.Tokens + o.Tokens, Cost: u.Cost + o.Cost}
+}
+
+// Limit caps usage within a period. Zero fields are unlimited.
+type Limit struct {
+	Tokens int64
+	Cost   float64
+}
+
+// IsZero reports whether the limit caps nothing.
+func (l Limit) IsZero() bool {
+	return l.Tokens <= 0 && l.Cost <= 0
+}
+
+// Balance is the usage of one user (or user and service) within the current period.
+type Balance struct {
+	Period  Period    `json:"period"`
+	Start   time.Time `json:"start"`
+	ResetAt time.Time `json:"reset_at"`
+	Used    Usage     `json:"used"`
+	// Credit is extra allowance granted by a top-up; it expires with the period.
+	Credit Usage `json:"credit"`
+}
+
+// Exhausted reports whether any capped dimension of limit has been used up.
+func (b Balance) Exhausted(limit Limit) bool {
+	if limit.Tokens > 0 && b.Used.Tokens >= limit.Tokens+b.Credit.Tokens {
+		return true
+	}
+	if limit.Cost > 0 && b.Used.Cost >= limit.Cost+b.Credit.Cost {
+		return true
+	}
+	return false
+}
+
+// Remaining returns what is left of limit, including credit. Uncapped dimensions are zero.
+func (b Balance) Remaining(limit Limit) Usage {
+	var out Usage
+	if limit.Tokens > 0 {
+		out.Tokens = limit.Tokens + b.Credit.Tokens - b.Used.Tokens
+		if out.Tokens < 0 {
+			out.Tokens = 0
+		}
+	}
+	if limit.Cost > 0 {
+		out.Cost = limit.Cost + b.Credit.Cost - b.Used.Cost
+		if out.Cost < 0 {
+			out.Cost = 0
+		}
+	}
+	return out
+}
+
+type entryKey struct {
+	user        string
+	serviceType string
+}
+
+// entry is the persisted usage of one user, or one user and service type.
+type entry struct {
+	User          string `json:"user"`
+	ServiceType   string `json:"service_type,omitempty"`
+	Day           string `json:"day"`
+	Daily         Usage  `json:"daily"`
+	DailyCredit   Usage  `json:"daily_credit"`
+	Month         string `json:"month"`
+	Monthly       Usage  `json:"monthly"`
+	MonthlyCredit Usage  `json:"monthly_credit"`
+}
+
+// roll clears counters of periods that ended before now.
+func (e *entry) roll(now time.Time) bool {
+	changed := false
+	if day := now.Format("2006-01-02"); e.Day != day {
+		e.Day, e.Daily, e.DailyCredit = day, Usage{}, Usage{}
+		changed = true
+	}
+	if month := now.Format("2006-01"); e.Month != month {
+		e.Month, e.Monthly, e.MonthlyCredit = month, Usage{}, Usage{}
+		changed = true
+	}
+	return changed
+}
+
+type fileFormat struct {
+	Version int      `json:"version"`
+	Entries []*entry `json:"entries"`
+}
+
+// Ledger accumulates usage in memory and writes it to a JSON file.
+type Ledger struct {
+	path string
+	now  func() time.Time
+	// flushMu serialises writers so an older snapshot never replaces a newer one.
+	flushMu sync.Mutex
+
+	mu      sync.Mutex
+	entries map[entryKey]*entry
+	dirty   bool
+}
+
+// Open loads the ledger at path, starting empty if the file does not exist yet.
+func Open(path string) (*Ledger, error) {
+	l := &Ledger{
+		path:    path,
+		now:     time.Now,
+		entries: make(map[entryKey]*entry),
+	}
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return l, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("read ledger: %w", err)
+	}
+	var file fileFormat
+	if err := json.Unmarshal(data, &file); err != nil {
+		return nil, fmt.Errorf("parse ledger %s: %w", path, err)
+	}
+	if file.Version != fileVersion {
+		return nil, fmt.Errorf("parse ledger %s: unsupported version %d", path, file.Version)
+	}
+	for _, e := range file.Entries {
+		if e == nil || e.User == "" {
+			continue
+		}
+		l.entries[entryKey{user: e.User, serviceType: e.ServiceType}] = e
+	}
+	return l, nil
+}
+
+// Path returns the file backing the ledger.
+func (l *Ledger) Path() string {
+	return l.path
+}
+
+// entryFor must be called with l.mu held.
+func (l *Ledger) entryFor(user, serviceType string, now time.Time, create bool) *entry {
+	key := entryKey{user: user, serviceType: serviceType}
+	e, ok := l.entries[key]
+	if !ok {
+		if !create {
+			return nil
+		}
+		e = &entry{User: user, ServiceType: serviceType}
+		l.entries[key] = e
+	}
+	if e.roll(now) {
+		l.dirty = true
+	}
+	return e
+}
+
+// Record adds usage to the user's total and to the user's service type.
+func (l *Ledger) Record(user, serviceType string, u Usage) {
+	if user == "" || (u.Tokens == 0 && u.Cost == 0) {
+		return
+	}
+	now := l.now()
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	for _, svc := range []string{"", serviceType} {
+		e := l.entryFor(user, svc, now, true)
+		e.Daily = e.Daily.add(u)
+		e.Monthly = e.Monthly.add(u)
+		if serviceType == "" {
+			break
+		}
+	}
+	l.dirty = true
+}
+
+// Balance returns current usage of the user, or of one service type of the user when
+// serviceType is non-empty.
+func (l *Ledger) Balance(user, serviceType string, period Period) Balance {
+	now := l.now()
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	start, reset := periodBounds(now, period)
+	b := Balance{Period: period, Start: start, ResetAt: reset}
+	e := l.entryFor(user, serviceType, now, false)
+	if e == nil {
+		return b
+	}
+	switch period {
+	case Daily:
+		b.Used, b.Credit = e.Daily, e.DailyCredit
+	case Monthly:
+		b.Used, b.Credit = e.Monthly, e.MonthlyCredit
+	}
+	return b
+}
+
+// Reset clears usage and credit for the period.
+func (l *Ledger) Reset(user, serviceType string, period Period) {
+	now := l.now()
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	e := l.entryFor(user, serviceType, now, false)
+	if e == nil {
+		return
+	}
+	switch period {
+	case Daily:
+		e.Daily, e.DailyCredit = Usage{}, Usage{}
+	case Monthly:
+		e.Monthly, e.MonthlyCredit = Usage{}, Usage{}
+	}
+	l.dirty = true
+}
+
+// TopUp grants extra allowance for the rest of the period.
+func (l *Ledger) TopUp(user, serviceType string, period Period, credit Usage) {
+	now := l.now()
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	e := l.entryFor(user, serviceType, now, true)
+	switch period {
+	case Daily:
+		e.DailyCredit = e.DailyCredit.add(credit)
+	case Monthly:
+		e.MonthlyCredit = e.MonthlyCredit.add(credit)
+	}
+	l.dirty = true
+}
+
+// Flush writes the ledger to disk if it changed since the last flush. The file is
+// replaced atomically so a crash never leaves a truncated ledger behind.
+func (l *Ledger) Flush() error {
+	l.flushMu.Lock()
+	defer l.flushMu.Unlock()
+
+	l.mu.Lock()
+	if !l.dirty {
+		l.mu.Unlock()
+		return nil
+	}
+	file := fileFormat{Version: fileVersion, Entries: make([]*entry, 0, len(l.entries))}
+	for _, e := range l.entries {
+		copied := *e
+		file.Entries = append(file.Entries, &copied)
+	}
+	l.dirty = false
+	l.mu.Unlock()
+
+	sort.Slice(file.Entries, func(i, j int) bool {
+		a, b := file.Entries[i], file.Entries[j]
+		if a.User != b.User {
+			return a.User < b.User
+		}
+		return a.ServiceType < b.ServiceType
+	})
+
+	if err := writeFileAtomic(l.path, file); err != nil {
+		l.mu.Lock()
+		l.dirty = true
+		l.mu.Unlock()
+		return err
+	}
+	return nil
+}
+
+// Run flushes the ledger every interval until ctx is cancelled, then flushes once more.
+func (l *Ledger) Run(ctx context.Context, interval time.Duration, onError func(error)) {
+	if interval <= 0 {
+		interval = DefaultFlushInterval
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	flush := func() {
+		if err := l.Flush(); err != nil && onError != nil {
+			onError(err)
+		}
+	}
+	for {
+		select {
+		case <-ctx.Done():
+			flush()
+			return
+		case <-ticker.C:
+			flush()
+		}
+	}
+}
+
+func writeFileAtomic(path string, file fileFormat) error {
+	data, err := json.MarshalIndent(file, "", "  ")
+	if err != nil {
+		return fmt.Errorf("marshal ledger: %w", err)
+	}
+	dir := filepath.Dir(path)
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return fmt.Errorf("create ledger dir: %w", err)
+	}
+	tmp, err := os.CreateTemp(dir, filepath.Base(path)+".tmp-*")
+	if err != nil {
+		return fmt.Errorf("create ledger temp file: %w", err)
+	}
+	tmpName := tmp.Name()
+	defer func() {
+		_ = os.Remove(tmpName)
+	}()
+	if _, err := tmp.Write(data); err != nil {
+		_ = tmp.Close()
+		return fmt.Errorf("write ledger: %w", err)
+	}
+	if err := tmp.Sync(); err != nil {
+		_ = tmp.Close()
+		return fmt.Errorf("sync ledger: %w", err)
+	}
+	if err := tmp.Close(); err != nil {
+		return fmt.Errorf("close ledger: %w", err)
+	}
+	if err := os.Rename(tmpName, path); err != nil {
+		return fmt.Errorf("replace ledger: %w", err)
+	}
+	return nil
+}
+
+// periodBounds returns the start of the period containing now and the start of the next one.
+func periodBounds(now time.Time, period Period) (start, next time.Time) {
+	y, m, d := now.Date()
+	loc := now.Location()
+	if period == Monthly {
+		start = time.Date(y, m, 1, 0, 0, 0, 0, loc)
+		return start, start.AddDate(0, 1, 0)
+	}
+	start = time.Date(y, m, d, 0, 0, 0, 0, loc)
+	return start, start.AddDate(0, 0, 1)
+}
@@ -0,0 +1,108 @@
+package ledger
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func newTestLedger(t *testing.T, path string, now *time.Time) *Ledger {
+	t.Helper()
+	l, err := Open(path)
+	if err != nil {
+		t.Fatalf("open ledger: %v", err)
+	}
+	l.now = func() time.Time { return *now }
+	return l
+}
+
+func TestLedgerRecordsAndPersistsUsage(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "ledger.json")
+	now := time.Date(2025, 3, 14, 10, 0, 0, 0, time.Local)
+
+	l := newTestLedger(t, path, &now)
+	l.Record("alice", "codex", Usage{Tokens: 100, Cost: 0.5})
+	l.Record("alice", "claude", Usage{Tokens: 50, Cost: 0.25})
+	if err := l.Flush(); err != nil {
+		t.Fatalf("flush: %v", err)
+	}
+
+	reopened := newTestLedger(t, path, &now)
+	total := reopened.Balance("alice", "", Daily)
+	if total.Used.Tokens != 150 || total.Used.Cost != 0.75 {
+		t.Fatalf("unexpected user total after reopen: %+v", total.Used)
+	}
+	codex := reopened.Balance("alice", "codex", Monthly)
+	if codex.Used.Tokens != 100 {
+		t.Fatalf("unexpected service usage after reopen: %+v", codex.Used)
+	}
+	wantReset := time.Date(2025, 3, 15, 0, 0, 0, 0, time.Local)
+	if !total.ResetAt.Equal(wantReset) {
+		t.Fatalf("expected daily reset at %v, got %v", wantReset, total.ResetAt)
+	}
+
+	matches, _ := filepath.Glob(path + ".tmp-*")
+	if len(matches) != 0 {
+		t.Fatalf("temporary files left behind: %v", matches)
+	}
+}
+
+func TestLedgerRollsOverPeriods(t *testing.T) {
+	now := time.Date(2025, 3, 31, 23, 0, 0, 0, time.Local)
+	l := newTestLedger(t, filepath.Join(t.TempDir(), "ledger.json"), &now)
+
+	l.Record("bob", "codex", Usage{Tokens: 10})
+	l.TopUp("bob", "", Daily, Usage{Tokens: 5})
+
+	now = now.Add(2 * time.Hour) // 2025-04-01 01:00
+	daily := l.Balance("bob", "", Daily)
+	if daily.Used.Tokens != 0 || daily.Credit.Tokens != 0 {
+		t.Fatalf("expected daily usage and credit to roll over, got %+v", daily)
+	}
+	monthly := l.Balance("bob", "", Monthly)
+	if monthly.Used.Tokens != 0 {
+		t.Fatalf("expected monthly usage to roll over, got %+v", monthly)
+	}
+	if want := time.Date(2025, 5, 1, 0, 0, 0, 0, time.Local); !monthly.ResetAt.Equal(want) {
+		t.Fatalf("expected monthly reset at %v, got %v", want, monthly.ResetAt)
+	}
+}
+
+func TestLedgerBudgetAdjustments(t *testing.T) {
+	now := time.Date(2025, 6, 1, 12, 0, 0, 0, time.Local)
+	l := newTestLedger(t, filepath.Join(t.TempDir(), "ledger.json"), &now)
+	limit := Limit{Tokens: 100}
+
+	l.Record("carol", "codex", Usage{Tokens: 100})
+	if !l.Balance("carol", "", Daily).Exhausted(limit) {
+		t.Fatalf("expected budget to be exhausted")
+	}
+
+	l.TopUp("carol", "", Daily, Usage{Tokens: 50})
+	b := l.Balance("carol", "", Daily)
+	if b.Exhausted(limit) || b.Remaining(limit).Tokens != 50 {
+		t.Fatalf("expected top-up to restore 50 tokens, got %+v", b)
+	}
+	if !l.Balance("carol", "", Monthly).Exhausted(limit) {
+		t.Fatalf("daily top-up must not affect the monthly budget")
+	}
+
+	l.Reset("carol", "", Monthly)
+	if got := l.Balance("carol", "", Monthly); got.Used.Tokens != 0 {
+		t.Fatalf("expected monthly usage reset, got %+v", got)
+	}
+	if got := l.Balance("carol", "codex", Monthly); got.Used.Tokens != 100 {
+		t.Fatalf("resetting the user total must not reset services, got %+v", got)
+	}
+}
+
+func TestOpenRejectsCorruptLedger(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "ledger.json")
+	if err := os.WriteFile(path, []byte("{not json"), 0o600); err != nil {
+		t.Fatalf("write ledger: %v", err)
+	}
+	if _, err := Open(path); err == nil {
+		t.Fatalf("expected corrupt ledger to be rejected")
+	}
+}
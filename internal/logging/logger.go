@@ -5,6 +5,7 @@ import (
 	"strconv"
 
 	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
 )
 
 var (
@@ -24,10 +25,13 @@ func init() {
 }
 
 // NewLogger creates a structured logger configured for production-style JSON output.
+// Known secrets are masked in every entry; see GlobalRedactor.
 func NewLogger() (*zap.Logger, error) {
 	cfg := zap.NewProductionConfig()
 	cfg.EncoderConfig.TimeKey = "timestamp"
 	cfg.EncoderConfig.MessageKey = "message"
 	cfg.EncoderConfig.CallerKey = "caller"
-	return cfg.Build()
+	return cfg.Build(zap.WrapCore(func(core zapcore.Core) zapcore.Core {
+		return NewRedactingCore(core, GlobalRedactor)
+	}))
 }
@@ -0,0 +1,205 @@
+package logging
+
+import (
+	"fmt"
+	"net/url"
+	"sort"
+	"strings"
+	"sync"
+
+	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
+)
+
+// minRedactLength is the shortest secret replaced by substring matching. Shorter
+// values would mangle unrelated log text.
+const minRedactLength = 8
+
+// GlobalRedactor masks the secrets of the loaded configuration. The config manager
+// refreshes it on every load; loggers built by NewLogger and the request log store
+// pass their output through it.
+var GlobalRedactor = NewRedactor()
+
+// MaskSecret returns a display form of secret that keeps at most its first three
+// and last four characters.
+func MaskSecret(secret string) string {
+	if len(secret) < 16 {
+		return "****"
+	}
+	return secret[:3] + "****" + secret[len(secret)-4:]
+}
+
+// Redactor replaces known secret values in strings with their masked form.
+type Redactor struct {
+	mu       sync.RWMutex
+	replacer *strings.Replacer
+}
+
+// NewRedactor constructs a redactor with no secrets.
+func NewRedactor() *Redactor {
+	return &Redactor{}
+}
+
+// SetSecrets replaces the set of secrets to mask. Both the literal and the
+// URL-query-escaped form of each secret are matched.
+func (r *Redactor) SetSecrets(secrets []string) {
+	seen := make(map[string]struct{}, len(secrets))
+	unique := make([]string, 0, len(secrets))
+	for _, secret := range secrets {
+		if len(secret) < minRedactLength {
+			continue
+		}
+		if _, ok := seen[secret]; ok {
+			continue
+		}
+		seen[secret] = struct{}{}
+		unique = append(unique, secret)
+	}
+	// Longer secrets first, so that a secret containing another is masked whole.
+	sort.Slice(unique, func(i, j int) bool { return len(unique[i]) > len(unique[j]) })
+
+	var replacer *strings.Replacer
+	if len(unique) > 0 {
+		pairs := make([]string, 0, len(unique)*4)
+		for _, secret := range unique {
+			masked := MaskSecret(secret)
+			pairs = append(pairs, secret, masked)
+			if escaped := url.QueryEscape(secret); escaped != secret {
+				pairs = append(pairs, escaped, masked)
+			}
+		}
+		replacer = strings.NewReplacer(pairs...)
+	}
+
+	r.mu.Lock()
+	r.replacer = replacer
+	r.mu.Unlock()
+}
+
+// Redact returns s with every known secret masked.
+func (r *Redactor) Redact(s string) string {
+	if r == nil || s == "" {
+		return s
+	}
+	r.mu.RLock()
+	replacer := r.replacer
+	r.mu.RUnlock()
+	if replacer == nil {
+		return s
+	}
+	return replacer.Replace(s)
+}
+
+// RedactURL masks the values of the given query parameters in rawURL, then any
+// known secret left in it.
+func (r *Redactor) RedactURL(rawURL string, params ...string) string {
+	if len(params) > 0 {
+		if u, err := url.Parse(rawURL); err == nil && u.RawQuery != "" {
+			u.RawQuery = maskQueryParams(u.RawQuery, params)
+			rawURL = u.String()
+		}
+	}
+	return r.Redact(rawURL)
+}
+
+// maskQueryParams masks the values of the named parameters, leaving the rest of
+// the query as encoded.
+func maskQueryParams(rawQuery string, params []string) string {
+	pairs := strings.Split(rawQuery, "&")
+	for i, pair := range pairs {
+		key, value, ok := strings.Cut(pair, "=")
+		if !ok {
+			continue
+		}
+		name, err := url.QueryUnescape(key)
+		if err != nil {
+			continue
+		}
+		for _, param := range params {
+			if name == param {
+				if unescaped, err := url.QueryUnescape(value); err == nil {
+					value = unescaped
+				}
+				pairs[i] = key + "=" + MaskSecret(value)
+				break
+			}
+		}
+	}
+	return strings.Join(pairs, "&")
+}
+
+func (r *Redactor) redactEntry(entry *RequestLogEntry) {
+	entry.Path = r.Redact(entry.Path)
+	entry.UpstreamURL = r.Redact(entry.UpstreamURL)
+	entry.Error = r.Redact(entry.Error)
+	if len(entry.Attempts) > 0 {
+		attempts := make([]UpstreamAttempt, len(entry.Attempts))
+		for i, attempt := range entry.Attempts {
+			attempt.Error = r.Redact(attempt.Error)
+			attempts[i] = attempt
+		}
+		entry.Attempts = attempts
+	}
+}
+
+// NewRedactingCore wraps core so that the message and string-like fields of every
+// entry are passed through redactor.
+func NewRedactingCore(core zapcore.Core, redactor *Redactor) zapcore.Core {
+	return &redactingCore{Core: core, redactor: redactor}
+}
+
+type redactingCore struct {
+	zapcore.Core
+	redactor *Redactor
+}
+
+func (c *redactingCore) With(fields []zapcore.Field) zapcore.Core {
+	return &redactingCore{Core: c.Core.With(c.redactFields(fields)), redactor: c.redactor}
+}
+
+func (c *redactingCore) Check(entry zapcore.Entry, checked *zapcore.CheckedEntry) *zapcore.CheckedEntry {
+	if c.Enabled(entry.Level) {
+		return checked.AddCore(entry, c)
+	}
+	return checked
+}
+
+func (c *redactingCore) Write(entry zapcore.Entry, fields []zapcore.Field) error {
+	entry.Message = c.redactor.Redact(entry.Message)
+	return c.Core.Write(entry, c.redactFields(fields))
+}
+
+func (c *redactingCore) redactFields(fields []zapcore.Field) []zapcore.Field {
+	out := make([]zapcore.Field, len(fields))
+	for i, field := range fields {
+		switch field.Type {
+		case zapcore.StringType:
+			field.String = c.redactor.Redact(field.String)
+		case zapcore.ByteStringType:
+			if b, ok := field.Interface.([]byte); ok {
+				field.Interface = []byte(c.redactor.Redact(string(b)))
+			}
+		case zapcore.ErrorType:
+			if err, ok := field.Interface.(error); ok {
+				field.Interface = redactedError{msg: c.redactor.Redact(err.Error()), err: err}
+			}
+		case zapcore.StringerType:
+			if s, ok := field.Interface.(fmt.Stringer); ok {
+				field = zap.String(field.Key, c.redactor.Redact(s.String()))
+			}
+		}
+		out[i] = field
+	}
+	return out
+}
+
+// redactedError keeps the wrapped error reachable for errors.Is while reporting
+// the redacted message.
+type redactedError struct {
+	msg string
+	err error
+}
+
+func (e redactedError) Error() string { return e.msg }
+
+func (e redactedError) Unwrap() error { return e.err }
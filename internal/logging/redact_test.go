@@ -0,0 +1,90 @@
+package logging
+
+import (
+	"errors"
+	"strings"
+	"testing"
+
+	"go.uber.org/zap"
+	"go.uber.org/zap/zaptest/observer"
+)
+
+func TestMaskSecret(t *testing.T) {
+	cases := map[string]string{
+		"":                     "****",
+		"short":                "****",
+		"sk-0123456789abcdef":  "sk-****cdef",
+		"piapi-user-alice-key": "pia****-key",
+	}
+	for in, want := range cases {
+		if got := MaskSecret(in); got != want {
+			t.Fatalf("MaskSecret(%q) = %q, want %q", in, got, want)
+		}
+	}
+}
+
+func TestRedactorMasksSecrets(t *testing.T) {
+	r := NewRedactor()
+	if got := r.Redact("nothing to hide"); got != "nothing to hide" {
+		t.Fatalf("unexpected redaction without secrets: %q", got)
+	}
+	r.SetSecrets([]string{"sk-0123456789abcdef", "sk-0123456789abcdef/extra", "tiny"})
+
+	got := r.Redact("key sk-0123456789abcdef/extra and sk-0123456789abcdef and tiny")
+	if want := "key sk-****xtra and sk-****cdef and tiny"; got != want {
+		t.Fatalf("Redact = %q, want %q", got, want)
+	}
+	if got := r.Redact("https://up.example.com/v1?k=sk-0123456789abcdef%2Fextra"); strings.Contains(got, "0123456789") {
+		t.Fatalf("expected escaped secret to be masked, got %q", got)
+	}
+	if got := r.RedactURL("https://up.example.com/v1?model=a+b&api_key=short&api_key=other", "api_key"); got != "https://up.example.com/v1?model=a+b&api_key=****&api_key=****" {
+		t.Fatalf("RedactURL = %q", got)
+	}
+
+	r.SetSecrets(nil)
+	if got := r.Redact("sk-0123456789abcdef"); got != "sk-0123456789abcdef" {
+		t.Fatalf("expected secrets to be replaced, got %q", got)
+	}
+}
+
+func TestRedactingCoreAndRequestLogStore(t *testing.T) {
+	secret := "sk-0123456789abcdef"
+	redactor := NewRedactor()
+	redactor.SetSecrets([]string{secret})
+
+	core, logs := observer.New(zap.InfoLevel)
+	logger := zap.New(NewRedactingCore(core, redactor)).With(zap.String("ctx", "with "+secret))
+	logger.Info("message "+secret,
+		zap.String("url", "https://up.example.com?key="+secret),
+		zap.Error(errors.New("dial "+secret)),
+		zap.Int("status", 502),
+	)
+	entries := logs.All()
+	if len(entries) != 1 {
+		t.Fatalf("expected one entry, got %d", len(entries))
+	}
+	if strings.Contains(entries[0].Message, secret) {
+		t.Fatalf("secret in message: %q", entries[0].Message)
+	}
+	for key, value := range entries[0].ContextMap() {
+		if s, ok := value.(string); ok && strings.Contains(s, secret) {
+			t.Fatalf("secret in field %s: %q", key, s)
+		}
+	}
+	if got := entries[0].ContextMap()["error"]; got != "dial sk-****cdef" {
+		t.Fatalf("unexpected error field: %v", got)
+	}
+
+	GlobalRedactor.SetSecrets([]string{secret})
+	defer GlobalRedactor.SetSecrets(nil)
+	store := NewRequestLogStore(2)
+	attempts := []UpstreamAttempt{{Error: "proxy error: " + secret}}
+	store.Add(RequestLogEntry{UpstreamURL: "https://up.example.com?key=" + secret, Error: secret, Attempts: attempts})
+	got := store.Query(QueryOptions{})[0]
+	if strings.Contains(got.UpstreamURL+got.Error+got.Attempts[0].Error, secret) {
+		t.Fatalf("secret in stored entry: %+v", got)
+	}
+	if attempts[0].Error != "proxy error: "+secret {
+		t.Fatalf("redaction must not modify the caller's attempts")
+	}
+}
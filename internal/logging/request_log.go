@@ -7,18 +7,46 @@ import (
 
 // RequestLogEntry represents a single request log entry
 type RequestLogEntry struct {
-	Timestamp        time.Time `json:"timestamp"`
-	RequestID        string    `json:"request_id"`
-	User             string    `json:"user"`
-	ServiceType      string    `json:"service_type"`
-	Provider         string    `json:"provider"`
-	ProviderKey      string    `json:"provider_key"`
-	Method           string    `json:"method"`
-	Path             string    `json:"path"`
-	UpstreamURL      string    `json:"upstream_url"`
-	StatusCode       int       `json:"status_code"`
-	LatencyMs        int64     `json:"latency_ms"`
-	Error            string    `json:"error,omitempty"`
+	Timestamp     time.Time `json:"timestamp"`
+	RequestID     string    `json:"request_id"`
+	User          string    `json:"user"`
+	ServiceType   string    `json:"service_type"`
+	Provider      string    `json:"provider"`
+	ProviderKey   string    `json:"provider_key"`
+	Model         string    `json:"model,omitempty"`
+	UpstreamModel string    `json:"upstream_model,omitempty"`
+	Method        string    `json:"method"`
+	Path          string    `json:"path"`
+	UpstreamURL   string    `json:"upstream_url"`
+	StatusCode    int       `json:"status_code"`
+	LatencyMs     int64     `json:"latency_ms"`
+	Error         string    `json:"error,omitempty"`
+	// Attempts lists every upstream call made for this request, in order.
+	// More than one entry means the request failed over to another candidate.
+	Attempts []UpstreamAttempt `json:"attempts,omitempty"`
+	// Usage holds the token counts reported by the upstream, if any.
+	Usage *TokenUsage `json:"usage,omitempty"`
+	// Cost is the usage priced by the upstream service's pricing, if configured.
+	Cost float64 `json:"cost,omitempty"`
+}
+
+// TokenUsage is the token accounting of a single request, normalised across
+// OpenAI-style and Anthropic-style responses.
+type TokenUsage struct {
+	PromptTokens     int64 `json:"prompt_tokens"`
+	CompletionTokens int64 `json:"completion_tokens"`
+	CacheReadTokens  int64 `json:"cache_read_tokens,omitempty"`
+	CacheWriteTokens int64 `json:"cache_write_tokens,omitempty"`
+}
+
+// UpstreamAttempt records the outcome of a single upstream call within a request.
+type UpstreamAttempt struct {
+	Provider    string `json:"provider"`
+	ProviderKey string `json:"provider_key"`
+	Model       string `json:"model,omitempty"`
+	StatusCode  int    `json:"status_code"`
+	LatencyMs   int64  `json:"latency_ms"`
+	Error       string `json:"error,omitempty"`
 }
 
 // RequestLogStore is a thread-safe circular buffer for storing request logs
@@ -43,8 +71,11 @@ func NewRequestLogStore(capacity int) *RequestLogStore {
 	}
 }
 
-// Add appends a new log entry to the store
+// Add appends a new log entry to the store. Known secrets are masked in the
+// entry's URLs and error messages before it is stored.
 func (s *RequestLogStore) Add(entry RequestLogEntry) {
+	GlobalRedactor.redactEntry(&entry)
+
 	s.mu.Lock()
 	defer s.mu.Unlock()
 
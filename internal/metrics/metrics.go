@@ -23,6 +23,14 @@ var (
 	candidateErrorCounter      *prometheus.CounterVec
 	candidateRequestKeyCounter *prometheus.CounterVec
 	candidateErrorKeyCounter   *prometheus.CounterVec
+	tokenCounter               *prometheus.CounterVec
+	rateLimitedCounter         *prometheus.CounterVec
+	circuitStateGauge          *prometheus.GaugeVec
+	healthCheckGauge           *prometheus.GaugeVec
+	healthCheckCounter         *prometheus.CounterVec
+	keyCooldownCounter         *prometheus.CounterVec
+	keyInFlightGauge           *prometheus.GaugeVec
+	keyQueueDepthGauge         *prometheus.GaugeVec
 )
 
 // Config controls optional behaviours of the metrics package.
@@ -76,7 +84,31 @@ func ensureRegistered() {
 			Help:      "Total number of upstream candidate errors partitioned by service type and provider.",
 		}, []string{"service_type", "provider"})
 
-		collectors := []prometheus.Collector{requestCounter, requestDuration, configReloadCounters, candidateRequestCounter, candidateErrorCounter}
+		tokenCounter = prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: "piapi",
+			Name:      "tokens_total",
+			Help:      "Total tokens reported by upstream responses partitioned by service type, provider, and token type (prompt/completion/cache_read/cache_write).",
+		}, []string{"service_type", "provider", "type"})
+
+		rateLimitedCounter = prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: "piapi",
+			Name:      "rate_limited_total",
+			Help:      "Total number of requests rejected by per-user rate limits partitioned by service type and limit.",
+		}, []string{"service_type", "limit"})
+
+		healthCheckCounter = prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: "piapi",
+			Name:      "health_checks_total",
+			Help:      "Total number of active health checks partitioned by service type, provider, and result (success/failure).",
+		}, []string{"service_type", "provider", "result"})
+
+		keyCooldownCounter = prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: "piapi",
+			Name:      "key_cooldowns_total",
+			Help:      "Total number of provider keys cooled down by upstream rate-limit signals partitioned by service type, provider, and reason (rate_limited/low_quota).",
+		}, []string{"service_type", "provider", "reason"})
+
+		collectors := []prometheus.Collector{requestCounter, requestDuration, configReloadCounters, candidateRequestCounter, candidateErrorCounter, tokenCounter, rateLimitedCounter, healthCheckCounter, keyCooldownCounter}
 
 		if includeKeyLabels {
 			candidateRequestKeyCounter = prometheus.NewCounterVec(prometheus.CounterOpts{
@@ -91,7 +123,31 @@ func ensureRegistered() {
 				Help:      "Total upstream candidate errors partitioned by service type, provider, and key name.",
 			}, []string{"service_type", "provider", "provider_key"})
 
-			collectors = append(collectors, candidateRequestKeyCounter, candidateErrorKeyCounter)
+			circuitStateGauge = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+				Namespace: "piapi",
+				Name:      "circuit_state",
+				Help:      "Circuit breaker state of each provider key per service type: 0 closed, 1 half-open, 2 open.",
+			}, []string{"service_type", "provider", "provider_key"})
+
+			healthCheckGauge = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+				Namespace: "piapi",
+				Name:      "health_check_up",
+				Help:      "Outcome of the latest active health check of each provider key per service type: 1 passing, 0 failing.",
+			}, []string{"service_type", "provider", "provider_key"})
+
+			keyInFlightGauge = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+				Namespace: "piapi",
+				Name:      "key_in_flight",
+				Help:      "Requests in flight on each provider key that has a concurrency limit.",
+			}, []string{"provider", "provider_key"})
+
+			keyQueueDepthGauge = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+				Namespace: "piapi",
+				Name:      "key_queue_depth",
+				Help:      "Requests waiting for a concurrency slot of each provider key.",
+			}, []string{"provider", "provider_key"})
+
+			collectors = append(collectors, candidateRequestKeyCounter, candidateErrorKeyCounter, circuitStateGauge, healthCheckGauge, keyInFlightGauge, keyQueueDepthGauge)
 		}
 
 		prometheus.MustRegister(collectors...)
@@ -151,6 +207,106 @@ func ObserveCandidateResult(serviceType, provider, providerKey string, status in
 	}
 }
 
+// ObserveTokens records token usage reported by an upstream response.
+func ObserveTokens(serviceType, provider string, prompt, completion, cacheRead, cacheWrite int64) {
+	ensureRegistered()
+	if serviceType == "" {
+		serviceType = "unknown"
+	}
+	if provider == "" {
+		provider = "unknown"
+	}
+	for _, t := range []struct {
+		name  string
+		count int64
+	}{
+		{"prompt", prompt},
+		{"completion", completion},
+		{"cache_read", cacheRead},
+		{"cache_write", cacheWrite},
+	} {
+		if t.count > 0 {
+			tokenCounter.WithLabelValues(serviceType, provider, t.name).Add(float64(t.count))
+		}
+	}
+}
+
+// ObserveRateLimited records a request rejected by a rate limit.
+func ObserveRateLimited(serviceType, limit string) {
+	ensureRegistered()
+	if serviceType == "" {
+		serviceType = "unknown"
+	}
+	if limit == "" {
+		limit = "unknown"
+	}
+	rateLimitedCounter.WithLabelValues(serviceType, limit).Inc()
+}
+
+// SetCircuitState records the circuit breaker state of a provider key, using the
+// values documented on piapi_circuit_state. It does nothing unless key labels are
+// enabled.
+func SetCircuitState(serviceType, provider, providerKey string, state int) {
+	ensureRegistered()
+	if circuitStateGauge == nil {
+		return
+	}
+	circuitStateGauge.WithLabelValues(serviceType, provider, providerKey).Set(float64(state))
+}
+
+// ForgetCircuit removes the circuit state of a provider key that is no longer
+// configured.
+func ForgetCircuit(serviceType, provider, providerKey string) {
+	ensureRegistered()
+	if circuitStateGauge == nil {
+		return
+	}
+	circuitStateGauge.DeleteLabelValues(serviceType, provider, providerKey)
+}
+
+// ObserveHealthCheck records the outcome of an active health check of a provider key.
+// The per-key gauge is only set when key labels are enabled.
+func ObserveHealthCheck(serviceType, provider, providerKey string, healthy bool) {
+	ensureRegistered()
+	up, result := 0.0, "failure"
+	if healthy {
+		up, result = 1, "success"
+	}
+	if healthCheckGauge != nil {
+		healthCheckGauge.WithLabelValues(serviceType, provider, providerKey).Set(up)
+	}
+	healthCheckCounter.WithLabelValues(serviceType, provider, result).Inc()
+}
+
+// ForgetHealthCheck removes the health check state of a provider key that is no
+// longer checked.
+func ForgetHealthCheck(serviceType, provider, providerKey string) {
+	ensureRegistered()
+	if healthCheckGauge == nil {
+		return
+	}
+	healthCheckGauge.DeleteLabelValues(serviceType, provider, providerKey)
+}
+
+// ObserveKeyCooldown records a provider key cooled down by upstream rate-limit
+// signals.
+func ObserveKeyCooldown(serviceType, provider, reason string) {
+	ensureRegistered()
+	keyCooldownCounter.WithLabelValues(serviceType, provider, reason).Inc()
+}
+
+// SetKeyConcurrency records the requests in flight on a concurrency-limited
+// provider key and those queued for one of its slots. It does nothing unless key
+// labels are enabled.
+func SetKeyConcurrency(provider, providerKey string, inFlight, queued int) {
+	ensureRegistered()
+	if keyInFlightGauge == nil || keyQueueDepthGauge == nil {
+		return
+	}
+	keyInFlightGauge.WithLabelValues(provider, providerKey).Set(float64(inFlight))
+	keyQueueDepthGauge.WithLabelValues(provider, providerKey).Set(float64(queued))
+}
+
 // Handler exposes the metrics endpoint compatible with Prometheus scraping.
 func Handler() http.Handler {
 	ensureRegistered()
@@ -175,3 +175,19 @@ func TestMultipleCalls(t *testing.T) {
 		t.Errorf("Expected status %d after multiple calls, got %d", http.StatusOK, rec.Code)
 	}
 }
+
+func TestKeyLabelledGaugesAreOptIn(t *testing.T) {
+	// Key labels are not enabled in this package's tests; the per-key gauges must
+	// neither panic nor be exported.
+	SetCircuitState("codex", "provider-alpha", "main", 2)
+	ForgetCircuit("codex", "provider-alpha", "main")
+	ObserveHealthCheck("codex", "provider-alpha", "main", true)
+	ForgetHealthCheck("codex", "provider-alpha", "main")
+	SetKeyConcurrency("provider-alpha", "main", 1, 2)
+
+	rec := httptest.NewRecorder()
+	Handler().ServeHTTP(rec, httptest.NewRequest("GET", "/metrics", nil))
+	if strings.Contains(rec.Body.String(), "provider_key=") {
+		t.Errorf("Expected no provider_key labels without key labels enabled")
+	}
+}
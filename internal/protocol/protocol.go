@@ -0,0 +1,334 @@
+// Package protocol translates requests and responses between the Anthropic Messages
+// API and the OpenAI Chat Completions API, so that a client speaking one can be
+// routed to an upstream that only speaks the other. OpenAI Responses API clients
+// can likewise be routed to Chat Completions upstreams.
+package protocol
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// Supported protocol names, as used by config.Service.Protocol.
+const (
+	// Anthropic is the Anthropic Messages API (POST /v1/messages).
+	Anthropic = "anthropic"
+	// OpenAI is the OpenAI Chat Completions API (POST /chat/completions).
+	OpenAI = "openai"
+	// Responses is the OpenAI Responses API (POST /responses).
+	Responses = "responses"
+)
+
+// Gemini names the Gemini API. It is only used to shape gateway errors for Gemini
+// clients; requests to it are never translated.
+const Gemini = "gemini"
+
+// DefaultAnthropicVersion is sent to Anthropic upstreams when the client sent none.
+const DefaultAnthropicVersion = "2023-06-01"
+
+// maxResponseBytes caps a non-streaming upstream response read for translation.
+const maxResponseBytes = 32 << 20
+
+// ErrTranslate marks failures to translate a request or response body.
+var ErrTranslate = errors.New("protocol translation failed")
+
+// Valid reports whether name is a supported protocol.
+func Valid(name string) bool {
+	return name == Anthropic || name == OpenAI || name == Responses
+}
+
+// Detect returns the protocol of a client request from its method and path relative
+// to the service, or "" when it is not a call of a generation endpoint that can be
+// translated. Other endpoints sharing a suffix, such as Assistants'
+// threads/{id}/messages, are not generation calls.
+func Detect(method, path string) string {
+	if method != http.MethodPost {
+		return ""
+	}
+	switch strings.TrimPrefix(strings.Trim(path, "/"), "v1/") {
+	case "messages":
+		return Anthropic
+	case "chat/completions":
+		return OpenAI
+	case "responses":
+		return Responses
+	default:
+		return ""
+	}
+}
+
+// Endpoint returns the path of the protocol's generation endpoint, relative to a
+// service base URL. Base URLs follow each vendor's SDK convention: Anthropic ones
+// exclude the /v1 prefix, OpenAI ones include it.
+func Endpoint(name string) string {
+	switch name {
+	case Anthropic:
+		return "v1/messages"
+	case OpenAI:
+		return "chat/completions"
+	case Responses:
+		return "responses"
+	default:
+		return ""
+	}
+}
+
+// Translation converts a single exchange from the client protocol to the upstream
+// protocol and back. It remembers details of the request needed to shape the
+// response, so a new one is needed for every upstream attempt.
+type Translation struct {
+	client   string
+	upstream string
+	// includeUsage reports whether an OpenAI client asked for a usage chunk.
+	includeUsage bool
+}
+
+// New returns the translation from client to upstream, or nil when the two already
+// speak the same protocol or no translation between them exists.
+func New(client, upstream string) *Translation {
+	switch {
+	case client == Anthropic && upstream == OpenAI,
+		client == OpenAI && upstream == Anthropic,
+		client == Responses && upstream == OpenAI:
+		return &Translation{client: client, upstream: upstream}
+	default:
+		return nil
+	}
+}
+
+// Client returns the protocol spoken by the client.
+func (t *Translation) Client() string {
+	return t.client
+}
+
+// Upstream returns the protocol spoken by the upstream.
+func (t *Translation) Upstream() string {
+	return t.upstream
+}
+
+// Request translates a client request body into the upstream protocol.
+func (t *Translation) Request(body []byte) ([]byte, error) {
+	var (
+		out []byte
+		err error
+	)
+	switch t.client {
+	case Anthropic:
+		out, err = anthropicToOpenAIRequest(body)
+	case OpenAI:
+		out, t.includeUsage, err = openAIToAnthropicRequest(body)
+	case Responses:
+		out, err = responsesToOpenAIRequest(body)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrTranslate, err)
+	}
+	return out, nil
+}
+
+// PrepareHeader adjusts outgoing request headers for the upstream protocol.
+func (t *Translation) PrepareHeader(h http.Header) {
+	// Let the transport negotiate and undo compression so the body can be parsed.
+	h.Del("Accept-Encoding")
+	h.Set("Content-Type", "application/json")
+	switch t.upstream {
+	case OpenAI:
+		h.Del("anthropic-version")
+		h.Del("anthropic-beta")
+	case Anthropic:
+		if h.Get("anthropic-version") == "" {
+			h.Set("anthropic-version", DefaultAnthropicVersion)
+		}
+	}
+}
+
+// Response rewrites res in place so that its body is in the client protocol.
+// Streaming bodies are transcoded incrementally as the client reads them.
+func (t *Translation) Response(res *http.Response) error {
+	if res.Body == nil || res.Body == http.NoBody {
+		return nil
+	}
+	mediaType, _, _ := mime.ParseMediaType(res.Header.Get("Content-Type"))
+	if res.StatusCode >= 200 && res.StatusCode < 300 && mediaType == "text/event-stream" {
+		var conv streamConverter
+		switch t.client {
+		case Anthropic:
+			conv = newOpenAIToAnthropicStream()
+		case OpenAI:
+			conv = newAnthropicToOpenAIStream(t.includeUsage)
+		case Responses:
+			conv = newOpenAIToResponsesStream()
+		}
+		res.Body = transcode(res.Body, conv)
+		res.ContentLength = -1
+		res.Header.Del("Content-Length")
+		return nil
+	}
+
+	data, err := io.ReadAll(io.LimitReader(res.Body, maxResponseBytes+1))
+	_ = res.Body.Close()
+	if err != nil {
+		return fmt.Errorf("%w: read upstream response: %v", ErrTranslate, err)
+	}
+	if len(data) > maxResponseBytes {
+		return fmt.Errorf("%w: upstream response exceeds %d bytes", ErrTranslate, maxResponseBytes)
+	}
+
+	var out []byte
+	if res.StatusCode >= 200 && res.StatusCode < 300 {
+		switch t.client {
+		case Anthropic:
+			out, err = openAIToAnthropicResponse(data)
+		case OpenAI:
+			out, err = anthropicToOpenAIResponse(data)
+		case Responses:
+			out, err = openAIToResponsesResponse(data)
+		}
+		if err != nil {
+			return fmt.Errorf("%w: %v", ErrTranslate, err)
+		}
+	} else {
+		message, errType := parseError(data)
+		if message == "" {
+			message = http.StatusText(res.StatusCode)
+		}
+		out = ErrorBody(t.client, res.StatusCode, errType, "", message)
+	}
+
+	res.Body = io.NopCloser(bytes.NewReader(out))
+	res.ContentLength = int64(len(out))
+	res.Header.Set("Content-Length", strconv.Itoa(len(out)))
+	res.Header.Set("Content-Type", "application/json")
+	res.Header.Del("Content-Encoding")
+	return nil
+}
+
+// ErrorBody renders an error in the shape the protocol's SDKs expect. errType is
+// the OpenAI error type; the Anthropic and Gemini types are derived from the status
+// code. The Responses API shares OpenAI's error shape.
+func ErrorBody(name string, status int, errType, code, message string) []byte {
+	var payload interface{}
+	switch name {
+	case Anthropic:
+		payload = map[string]interface{}{
+			"type": "error",
+			"error": map[string]string{
+				"type":    anthropicErrorType(status),
+				"message": message,
+			},
+		}
+	case Gemini:
+		payload = map[string]interface{}{
+			"error": map[string]interface{}{
+				"code":    status,
+				"message": message,
+				"status":  geminiErrorStatus(status),
+			},
+		}
+	default:
+		if errType == "" {
+			errType = openAIErrorType(status)
+		}
+		body := map[string]interface{}{
+			"message": message,
+			"type":    errType,
+		}
+		if code != "" {
+			body["code"] = code
+		}
+		payload = map[string]interface{}{"error": body}
+	}
+	data, _ := json.Marshal(payload)
+	return data
+}
+
+// geminiErrorStatus maps an HTTP status to the google.rpc.Code name Gemini reports.
+func geminiErrorStatus(status int) string {
+	switch status {
+	case http.StatusBadRequest:
+		return "INVALID_ARGUMENT"
+	case http.StatusUnauthorized:
+		return "UNAUTHENTICATED"
+	case http.StatusForbidden:
+		return "PERMISSION_DENIED"
+	case http.StatusNotFound:
+		return "NOT_FOUND"
+	case http.StatusTooManyRequests:
+		return "RESOURCE_EXHAUSTED"
+	case http.StatusServiceUnavailable:
+		return "UNAVAILABLE"
+	case http.StatusGatewayTimeout:
+		return "DEADLINE_EXCEEDED"
+	default:
+		return "INTERNAL"
+	}
+}
+
+func anthropicErrorType(status int) string {
+	switch status {
+	case http.StatusBadRequest:
+		return "invalid_request_error"
+	case http.StatusUnauthorized:
+		return "authentication_error"
+	case http.StatusForbidden:
+		return "permission_error"
+	case http.StatusNotFound:
+		return "not_found_error"
+	case http.StatusRequestEntityTooLarge:
+		return "request_too_large"
+	case http.StatusTooManyRequests:
+		return "rate_limit_error"
+	case http.StatusServiceUnavailable, 529:
+		return "overloaded_error"
+	default:
+		return "api_error"
+	}
+}
+
+func openAIErrorType(status int) string {
+	switch {
+	case status == http.StatusUnauthorized:
+		return "authentication_error"
+	case status == http.StatusForbidden:
+		return "permission_error"
+	case status == http.StatusTooManyRequests:
+		return "rate_limit_error"
+	case status >= 500:
+		return "server_error"
+	default:
+		return "invalid_request_error"
+	}
+}
+
+// parseError extracts the message of an error body in either protocol. errType is
+// only reported for OpenAI-style bodies, whose types are passed through.
+func parseError(data []byte) (message, errType string) {
+	var body struct {
+		Type  string `json:"type"`
+		Error *struct {
+			Type    string `json:"type"`
+			Message string `json:"message"`
+		} `json:"error"`
+	}
+	if err := json.Unmarshal(data, &body); err != nil || body.Error == nil {
+		return strings.TrimSpace(truncate(string(data), 512)), ""
+	}
+	if body.Type == "error" {
+		return body.Error.Message, ""
+	}
+	return body.Error.Message, body.Error.Type
+}
+
+func truncate(s string, n int) string {
+	if len(s) <= n {
+		return s
+	}
+	return s[:n]
+}
@@ -0,0 +1,493 @@
+package protocol
+
+import (
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func decodeJSON(t *testing.T, data []byte) map[string]interface{} {
+	t.Helper()
+	var out map[string]interface{}
+	if err := json.Unmarshal(data, &out); err != nil {
+		t.Fatalf("decode %s: %v", data, err)
+	}
+	return out
+}
+
+func assertJSONEqual(t *testing.T, got []byte, want string) {
+	t.Helper()
+	var g, w interface{}
+	if err := json.Unmarshal(got, &g); err != nil {
+		t.Fatalf("decode got %s: %v", got, err)
+	}
+	if err := json.Unmarshal([]byte(want), &w); err != nil {
+		t.Fatalf("decode want: %v", err)
+	}
+	if !reflect.DeepEqual(g, w) {
+		t.Fatalf("unexpected JSON\n got: %s\nwant: %s", got, want)
+	}
+}
+
+func TestDetect(t *testing.T) {
+	cases := map[string]string{
+		"v1/messages":                 Anthropic,
+		"/messages":                   Anthropic,
+		"v1/chat/completions":         OpenAI,
+		"chat/completions/":           OpenAI,
+		"v1/messages/count_tokens":    "",
+		"v1/models":                   "",
+		"v1/responses":                Responses,
+		"v1/responses/resp_1":         "",
+		"v1/chat/completions/abc/xyz": "",
+		"v1/threads/x/messages":       "",
+		"openai/v1/chat/completions":  "",
+	}
+	for path, want := range cases {
+		if got := Detect(http.MethodPost, path); got != want {
+			t.Fatalf("Detect(%q) = %q, want %q", path, got, want)
+		}
+	}
+	if got := Detect(http.MethodGet, "v1/responses"); got != "" {
+		t.Fatalf("expected GET requests not detected, got %q", got)
+	}
+	if New(OpenAI, OpenAI) != nil || New("", Anthropic) != nil || New(OpenAI, "") != nil {
+		t.Fatalf("expected no translation between identical or unknown protocols")
+	}
+	if New(Responses, Anthropic) != nil || New(OpenAI, Responses) != nil {
+		t.Fatalf("expected no translation for unsupported pairs")
+	}
+}
+
+func TestAnthropicToOpenAIRequest(t *testing.T) {
+	in := `{
+		"model": "claude-sonnet-4",
+		"max_tokens": 512,
+		"system": [{"type": "text", "text": "Be brief."}],
+		"stream": true,
+		"stop_sequences": ["END"],
+		"metadata": {"user_id": "u-1"},
+		"tools": [{"name": "get_weather", "description": "Weather", "input_schema": {"type": "object"}}],
+		"tool_choice": {"type": "any", "disable_parallel_tool_use": true},
+		"messages": [
+			{"role": "user", "content": "Weather in Paris?"},
+			{"role": "assistant", "content": [
+				{"type": "thinking", "thinking": "..."},
+				{"type": "text", "text": "Checking."},
+				{"type": "tool_use", "id": "toolu_1", "name": "get_weather", "input": {"city": "Paris"}}
+			]},
+			{"role": "user", "content": [
+				{"type": "tool_result", "tool_use_id": "toolu_1", "content": [{"type": "text", "text": "18C"}]},
+				{"type": "text", "text": "And this?"},
+				{"type": "image", "source": {"type": "base64", "media_type": "image/png", "data": "AAAA"}}
+			]}
+		]
+	}`
+	out, err := New(Anthropic, OpenAI).Request([]byte(in))
+	if err != nil {
+		t.Fatalf("translate: %v", err)
+	}
+	assertJSONEqual(t, out, `{
+		"model": "claude-sonnet-4",
+		"max_tokens": 512,
+		"stream": true,
+		"stream_options": {"include_usage": true},
+		"stop": ["END"],
+		"user": "u-1",
+		"tools": [{"type": "function", "function": {"name": "get_weather", "description": "Weather", "parameters": {"type": "object"}}}],
+		"tool_choice": "required",
+		"parallel_tool_calls": false,
+		"messages": [
+			{"role": "system", "content": "Be brief."},
+			{"role": "user", "content": "Weather in Paris?"},
+			{"role": "assistant", "content": "Checking.", "tool_calls": [
+				{"id": "toolu_1", "type": "function", "function": {"name": "get_weather", "arguments": "{\"city\": \"Paris\"}"}}
+			]},
+			{"role": "tool", "tool_call_id": "toolu_1", "content": "18C"},
+			{"role": "user", "content": [
+				{"type": "text", "text": "And this?"},
+				{"type": "image_url", "image_url": {"url": "data:image/png;base64,AAAA"}}
+			]}
+		]
+	}`)
+}
+
+func TestOpenAIToAnthropicRequest(t *testing.T) {
+	in := `{
+		"model": "gpt-4o",
+		"max_completion_tokens": 256,
+		"stop": "END",
+		"stream": true,
+		"stream_options": {"include_usage": true},
+		"tools": [{"type": "function", "function": {"name": "lookup", "parameters": {"type": "object", "properties": {"q": {"type": "string"}}}}}],
+		"tool_choice": {"type": "function", "function": {"name": "lookup"}},
+		"messages": [
+			{"role": "system", "content": "Be brief."},
+			{"role": "user", "content": [{"type": "text", "text": "Find it"}, {"type": "image_url", "image_url": {"url": "https://example.com/a.png"}}]},
+			{"role": "assistant", "content": null, "tool_calls": [
+				{"id": "call_1", "type": "function", "function": {"name": "lookup", "arguments": "{\"q\":\"a\"}"}},
+				{"id": "call_2", "type": "function", "function": {"name": "lookup", "arguments": "{\"q\":\"b\"}"}}
+			]},
+			{"role": "tool", "tool_call_id": "call_1", "content": "A"},
+			{"role": "tool", "tool_call_id": "call_2", "content": "B"}
+		]
+	}`
+	tr := New(OpenAI, Anthropic)
+	out, err := tr.Request([]byte(in))
+	if err != nil {
+		t.Fatalf("translate: %v", err)
+	}
+	if !tr.includeUsage {
+		t.Fatalf("expected include_usage to be remembered")
+	}
+	assertJSONEqual(t, out, `{
+		"model": "gpt-4o",
+		"max_tokens": 256,
+		"system": "Be brief.",
+		"stream": true,
+		"stop_sequences": ["END"],
+		"tools": [{"name": "lookup", "input_schema": {"type": "object", "properties": {"q": {"type": "string"}}}}],
+		"tool_choice": {"type": "tool", "name": "lookup"},
+		"messages": [
+			{"role": "user", "content": [
+				{"type": "text", "text": "Find it"},
+				{"type": "image", "source": {"type": "url", "url": "https://example.com/a.png"}}
+			]},
+			{"role": "assistant", "content": [
+				{"type": "tool_use", "id": "call_1", "name": "lookup", "input": {"q": "a"}},
+				{"type": "tool_use", "id": "call_2", "name": "lookup", "input": {"q": "b"}}
+			]},
+			{"role": "user", "content": [
+				{"type": "tool_result", "tool_use_id": "call_1", "content": [{"type": "text", "text": "A"}]},
+				{"type": "tool_result", "tool_use_id": "call_2", "content": [{"type": "text", "text": "B"}]}
+			]}
+		]
+	}`)
+
+	out, err = New(OpenAI, Anthropic).Request([]byte(`{"model":"gpt-4o","messages":[{"role":"user","content":"hi"}]}`))
+	if err != nil {
+		t.Fatalf("translate: %v", err)
+	}
+	if got := decodeJSON(t, out)["max_tokens"]; got != float64(defaultAnthropicMaxTokens) {
+		t.Fatalf("expected default max_tokens, got %v", got)
+	}
+}
+
+func TestResponsesToOpenAIRequest(t *testing.T) {
+	in := `{
+		"model": "gpt-5-codex",
+		"instructions": "You are a coding agent.",
+		"max_output_tokens": 512,
+		"stream": true,
+		"reasoning": {"effort": "high", "summary": "auto"},
+		"text": {"format": {"type": "json_schema", "name": "answer", "schema": {"type": "object"}, "strict": true}},
+		"tools": [
+			{"type": "function", "name": "shell", "description": "Run a command", "parameters": {"type": "object"}},
+			{"type": "web_search"}
+		],
+		"tool_choice": "auto",
+		"parallel_tool_calls": false,
+		"input": [
+			{"role": "developer", "content": "Use tabs."},
+			{"type": "message", "role": "user", "content": [{"type": "input_text", "text": "List files"}, {"type": "input_image", "image_url": "https://example.com/a.png"}, {"type": "input_file", "file_id": "file_1"}]},
+			{"type": "reasoning", "id": "rs_1", "summary": []},
+			{"type": "message", "role": "assistant", "content": [{"type": "output_text", "text": "Running ls."}, {"type": "refusal", "refusal": "No."}]},
+			{"type": "function_call", "call_id": "call_1", "name": "shell", "arguments": "{\"cmd\":\"ls\"}"},
+			{"type": "function_call_output", "call_id": "call_1", "output": "a.go"}
+		]
+	}`
+	out, err := New(Responses, OpenAI).Request([]byte(in))
+	if err != nil {
+		t.Fatalf("translate: %v", err)
+	}
+	assertJSONEqual(t, out, `{
+		"model": "gpt-5-codex",
+		"max_tokens": 512,
+		"stream": true,
+		"stream_options": {"include_usage": true},
+		"reasoning_effort": "high",
+		"response_format": {"type": "json_schema", "json_schema": {"name": "answer", "schema": {"type": "object"}, "strict": true}},
+		"tools": [{"type": "function", "function": {"name": "shell", "description": "Run a command", "parameters": {"type": "object"}}}],
+		"tool_choice": "auto",
+		"parallel_tool_calls": false,
+		"messages": [
+			{"role": "system", "content": "You are a coding agent."},
+			{"role": "system", "content": "Use tabs."},
+			{"role": "user", "content": [
+				{"type": "text", "text": "List files"},
+				{"type": "image_url", "image_url": {"url": "https://example.com/a.png"}}
+			]},
+			{"role": "assistant", "content": "Running ls.", "tool_calls": [
+				{"id": "call_1", "type": "function", "function": {"name": "shell", "arguments": "{\"cmd\":\"ls\"}"}}
+			]},
+			{"role": "tool", "tool_call_id": "call_1", "content": "a.go"}
+		]
+	}`)
+
+	out, err = New(Responses, OpenAI).Request([]byte(`{"model":"gpt-5","input":"hi"}`))
+	if err != nil {
+		t.Fatalf("translate: %v", err)
+	}
+	assertJSONEqual(t, out, `{"model":"gpt-5","messages":[{"role":"user","content":"hi"}]}`)
+
+	_, err = New(Responses, OpenAI).Request([]byte(`{"model":"gpt-5","input":"hi","previous_response_id":"resp_1"}`))
+	if !errors.Is(err, ErrTranslate) || !strings.Contains(err.Error(), "previous_response_id") {
+		t.Fatalf("expected previous_response_id to be rejected, got %v", err)
+	}
+}
+
+func newResponse(status int, contentType, body string) *http.Response {
+	return &http.Response{
+		StatusCode: status,
+		Header:     http.Header{"Content-Type": []string{contentType}},
+		Body:       io.NopCloser(strings.NewReader(body)),
+	}
+}
+
+func readBody(t *testing.T, res *http.Response) string {
+	t.Helper()
+	data, err := io.ReadAll(res.Body)
+	if err != nil {
+		t.Fatalf("read body: %v", err)
+	}
+	_ = res.Body.Close()
+	return string(data)
+}
+
+func TestTranslateJSONResponses(t *testing.T) {
+	res := newResponse(http.StatusOK, "application/json", `{
+		"id": "chatcmpl-1", "object": "chat.completion", "model": "gpt-4o",
+		"choices": [{"index": 0, "finish_reason": "tool_calls", "message": {"role": "assistant", "content": "Sure.",
+			"tool_calls": [{"id": "call_1", "type": "function", "function": {"name": "lookup", "arguments": "{\"q\":\"a\"}"}}]}}],
+		"usage": {"prompt_tokens": 30, "completion_tokens": 5, "total_tokens": 35, "prompt_tokens_details": {"cached_tokens": 10}}
+	}`)
+	if err := New(Anthropic, OpenAI).Response(res); err != nil {
+		t.Fatalf("translate: %v", err)
+	}
+	assertJSONEqual(t, []byte(readBody(t, res)), `{
+		"id": "chatcmpl-1", "type": "message", "role": "assistant", "model": "gpt-4o",
+		"content": [
+			{"type": "text", "text": "Sure."},
+			{"type": "tool_use", "id": "call_1", "name": "lookup", "input": {"q": "a"}}
+		],
+		"stop_reason": "tool_use", "stop_sequence": null,
+		"usage": {"input_tokens": 20, "output_tokens": 5, "cache_read_input_tokens": 10}
+	}`)
+
+	res = newResponse(http.StatusOK, "application/json", `{
+		"id": "msg_1", "type": "message", "role": "assistant", "model": "claude-sonnet-4",
+		"content": [{"type": "text", "text": "Hello"}],
+		"stop_reason": "max_tokens",
+		"usage": {"input_tokens": 12, "output_tokens": 4, "cache_read_input_tokens": 8}
+	}`)
+	if err := New(OpenAI, Anthropic).Response(res); err != nil {
+		t.Fatalf("translate: %v", err)
+	}
+	out := decodeJSON(t, []byte(readBody(t, res)))
+	delete(out, "created")
+	data, _ := json.Marshal(out)
+	assertJSONEqual(t, data, `{
+		"id": "msg_1", "object": "chat.completion", "model": "claude-sonnet-4",
+		"choices": [{"index": 0, "finish_reason": "length", "message": {"role": "assistant", "content": "Hello"}}],
+		"usage": {"prompt_tokens": 20, "completion_tokens": 4, "total_tokens": 24, "prompt_tokens_details": {"cached_tokens": 8}}
+	}`)
+}
+
+func TestTranslateResponsesJSONResponse(t *testing.T) {
+	res := newResponse(http.StatusOK, "application/json", `{
+		"id": "chatcmpl-1", "object": "chat.completion", "created": 1700000000, "model": "gpt-4o",
+		"choices": [{"index": 0, "finish_reason": "tool_calls", "message": {"role": "assistant", "content": "Sure.",
+			"tool_calls": [{"id": "call_1", "type": "function", "function": {"name": "shell", "arguments": "{}"}}]}}],
+		"usage": {"prompt_tokens": 30, "completion_tokens": 5, "total_tokens": 35,
+			"prompt_tokens_details": {"cached_tokens": 10}, "completion_tokens_details": {"reasoning_tokens": 2}}
+	}`)
+	if err := New(Responses, OpenAI).Response(res); err != nil {
+		t.Fatalf("translate: %v", err)
+	}
+	assertJSONEqual(t, []byte(readBody(t, res)), `{
+		"id": "resp_chatcmpl-1", "object": "response", "created_at": 1700000000, "status": "completed",
+		"error": null, "incomplete_details": null, "model": "gpt-4o",
+		"output": [
+			{"type": "message", "id": "msg_chatcmpl-1", "status": "completed", "role": "assistant",
+				"content": [{"type": "output_text", "text": "Sure.", "annotations": []}]},
+			{"type": "function_call", "id": "fc_call_1", "status": "completed", "call_id": "call_1", "name": "shell", "arguments": "{}"}
+		],
+		"usage": {"input_tokens": 30, "input_tokens_details": {"cached_tokens": 10},
+			"output_tokens": 5, "output_tokens_details": {"reasoning_tokens": 2}, "total_tokens": 35}
+	}`)
+
+	res = newResponse(http.StatusBadRequest, "application/json", `{"error":{"message":"bad model","type":"invalid_request_error"}}`)
+	if err := New(Responses, OpenAI).Response(res); err != nil {
+		t.Fatalf("translate: %v", err)
+	}
+	assertJSONEqual(t, []byte(readBody(t, res)), `{"error":{"type":"invalid_request_error","message":"bad model"}}`)
+}
+
+func TestTranslateErrorResponses(t *testing.T) {
+	res := newResponse(http.StatusTooManyRequests, "application/json", `{"error":{"message":"slow down","type":"requests","code":"rate_limit_exceeded"}}`)
+	if err := New(Anthropic, OpenAI).Response(res); err != nil {
+		t.Fatalf("translate: %v", err)
+	}
+	assertJSONEqual(t, []byte(readBody(t, res)), `{"type":"error","error":{"type":"rate_limit_error","message":"slow down"}}`)
+
+	res = newResponse(http.StatusBadRequest, "application/json", `{"type":"error","error":{"type":"invalid_request_error","message":"bad"}}`)
+	if err := New(OpenAI, Anthropic).Response(res); err != nil {
+		t.Fatalf("translate: %v", err)
+	}
+	assertJSONEqual(t, []byte(readBody(t, res)), `{"error":{"type":"invalid_request_error","message":"bad"}}`)
+}
+
+// parseSSE splits an event stream into (event name, JSON data) pairs.
+func parseSSE(t *testing.T, stream string) [][2]string {
+	t.Helper()
+	var events [][2]string
+	err := readEvents(strings.NewReader(stream), func(ev sseEvent) error {
+		events = append(events, [2]string{ev.name, string(ev.data)})
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("parse stream: %v", err)
+	}
+	return events
+}
+
+func TestTranscodeOpenAIStreamToAnthropic(t *testing.T) {
+	upstream := strings.Join([]string{
+		`data: {"id":"chatcmpl-1","model":"gpt-4o","choices":[{"index":0,"delta":{"role":"assistant","content":""}}]}`,
+		`data: {"id":"chatcmpl-1","model":"gpt-4o","choices":[{"index":0,"delta":{"content":"Hel"}}]}`,
+		`data: {"id":"chatcmpl-1","model":"gpt-4o","choices":[{"index":0,"delta":{"content":"lo"}}]}`,
+		`data: {"id":"chatcmpl-1","model":"gpt-4o","choices":[{"index":0,"delta":{"tool_calls":[{"index":0,"id":"call_1","type":"function","function":{"name":"lookup","arguments":""}}]}}]}`,
+		`data: {"id":"chatcmpl-1","model":"gpt-4o","choices":[{"index":0,"delta":{"tool_calls":[{"index":0,"function":{"arguments":"{\"q\":"}}]}}]}`,
+		`data: {"id":"chatcmpl-1","model":"gpt-4o","choices":[{"index":0,"delta":{"tool_calls":[{"index":0,"function":{"arguments":"\"a\"}"}}]}}]}`,
+		`data: {"id":"chatcmpl-1","model":"gpt-4o","choices":[{"index":0,"delta":{},"finish_reason":"tool_calls"}]}`,
+		`data: {"id":"chatcmpl-1","model":"gpt-4o","choices":[],"usage":{"prompt_tokens":9,"completion_tokens":3,"total_tokens":12}}`,
+		`data: [DONE]`,
+		``,
+	}, "\n\n")
+	res := newResponse(http.StatusOK, "text/event-stream", upstream)
+	if err := New(Anthropic, OpenAI).Response(res); err != nil {
+		t.Fatalf("translate: %v", err)
+	}
+	events := parseSSE(t, readBody(t, res))
+
+	names := make([]string, 0, len(events))
+	for _, ev := range events {
+		names = append(names, ev[0])
+	}
+	wantNames := []string{
+		"message_start",
+		"content_block_start", "content_block_delta", "content_block_delta", "content_block_stop",
+		"content_block_start", "content_block_delta", "content_block_delta", "content_block_stop",
+		"message_delta", "message_stop",
+	}
+	if !reflect.DeepEqual(names, wantNames) {
+		t.Fatalf("unexpected events: %v", names)
+	}
+	assertJSONEqual(t, []byte(events[5][1]), `{"type":"content_block_start","index":1,"content_block":{"type":"tool_use","id":"call_1","name":"lookup","input":{}}}`)
+	assertJSONEqual(t, []byte(events[7][1]), `{"type":"content_block_delta","index":1,"delta":{"type":"input_json_delta","partial_json":"\"a\"}"}}`)
+	assertJSONEqual(t, []byte(events[9][1]), `{"type":"message_delta","delta":{"stop_reason":"tool_use","stop_sequence":null},"usage":{"input_tokens":9,"output_tokens":3}}`)
+}
+
+func TestTranscodeAnthropicStreamToOpenAI(t *testing.T) {
+	upstream := strings.Join([]string{
+		"event: message_start\ndata: {\"type\":\"message_start\",\"message\":{\"id\":\"msg_1\",\"model\":\"claude-sonnet-4\",\"usage\":{\"input_tokens\":11,\"output_tokens\":1}}}",
+		"event: content_block_start\ndata: {\"type\":\"content_block_start\",\"index\":0,\"content_block\":{\"type\":\"text\",\"text\":\"\"}}",
+		"event: ping\ndata: {\"type\":\"ping\"}",
+		"event: content_block_delta\ndata: {\"type\":\"content_block_delta\",\"index\":0,\"delta\":{\"type\":\"text_delta\",\"text\":\"Hi\"}}",
+		"event: content_block_stop\ndata: {\"type\":\"content_block_stop\",\"index\":0}",
+		"event: content_block_start\ndata: {\"type\":\"content_block_start\",\"index\":1,\"content_block\":{\"type\":\"tool_use\",\"id\":\"toolu_1\",\"name\":\"lookup\",\"input\":{}}}",
+		"event: content_block_delta\ndata: {\"type\":\"content_block_delta\",\"index\":1,\"delta\":{\"type\":\"input_json_delta\",\"partial_json\":\"{\\\"q\\\":1}\"}}",
+		"event: content_block_stop\ndata: {\"type\":\"content_block_stop\",\"index\":1}",
+		"event: message_delta\ndata: {\"type\":\"message_delta\",\"delta\":{\"stop_reason\":\"tool_use\"},\"usage\":{\"output_tokens\":7}}",
+		"event: message_stop\ndata: {\"type\":\"message_stop\"}",
+		"",
+	}, "\n\n")
+	tr := New(OpenAI, Anthropic)
+	tr.includeUsage = true
+	res := newResponse(http.StatusOK, "text/event-stream", upstream)
+	if err := tr.Response(res); err != nil {
+		t.Fatalf("translate: %v", err)
+	}
+	events := parseSSE(t, readBody(t, res))
+	if len(events) != 7 {
+		t.Fatalf("expected 7 chunks, got %d: %v", len(events), events)
+	}
+	chunk := func(i int) map[string]interface{} {
+		out := decodeJSON(t, []byte(events[i][1]))
+		delete(out, "created")
+		return out
+	}
+	delta := func(i int) string {
+		choices := chunk(i)["choices"].([]interface{})
+		data, _ := json.Marshal(choices[0])
+		return string(data)
+	}
+	assertJSONEqual(t, []byte(delta(0)), `{"index":0,"delta":{"role":"assistant","content":""},"finish_reason":null}`)
+	assertJSONEqual(t, []byte(delta(1)), `{"index":0,"delta":{"content":"Hi"},"finish_reason":null}`)
+	assertJSONEqual(t, []byte(delta(2)), `{"index":0,"delta":{"tool_calls":[{"index":0,"id":"toolu_1","type":"function","function":{"name":"lookup","arguments":""}}]},"finish_reason":null}`)
+	assertJSONEqual(t, []byte(delta(3)), `{"index":0,"delta":{"tool_calls":[{"index":0,"function":{"arguments":"{\"q\":1}"}}]},"finish_reason":null}`)
+	assertJSONEqual(t, []byte(delta(4)), `{"index":0,"delta":{},"finish_reason":"tool_calls"}`)
+	usage, _ := json.Marshal(chunk(5)["usage"])
+	assertJSONEqual(t, usage, `{"prompt_tokens":11,"completion_tokens":7,"total_tokens":18}`)
+	if events[6][1] != "[DONE]" {
+		t.Fatalf("expected stream to end with [DONE], got %q", events[6][1])
+	}
+	if chunk(0)["id"] != "msg_1" || chunk(0)["object"] != "chat.completion.chunk" {
+		t.Fatalf("unexpected chunk envelope: %v", chunk(0))
+	}
+}
+
+func TestTranscodeOpenAIStreamToResponses(t *testing.T) {
+	upstream := strings.Join([]string{
+		`data: {"id":"chatcmpl-1","created":1700000000,"model":"gpt-4o","choices":[{"index":0,"delta":{"role":"assistant","content":""}}]}`,
+		`data: {"id":"chatcmpl-1","model":"gpt-4o","choices":[{"index":0,"delta":{"content":"Hel"}}]}`,
+		`data: {"id":"chatcmpl-1","model":"gpt-4o","choices":[{"index":0,"delta":{"content":"lo"}}]}`,
+		`data: {"id":"chatcmpl-1","model":"gpt-4o","choices":[{"index":0,"delta":{"tool_calls":[{"index":0,"id":"call_1","type":"function","function":{"name":"shell","arguments":""}}]}}]}`,
+		`data: {"id":"chatcmpl-1","model":"gpt-4o","choices":[{"index":0,"delta":{"tool_calls":[{"index":0,"function":{"arguments":"{}"}}]}}]}`,
+		`data: {"id":"chatcmpl-1","model":"gpt-4o","choices":[{"index":0,"delta":{},"finish_reason":"tool_calls"}]}`,
+		`data: {"id":"chatcmpl-1","model":"gpt-4o","choices":[],"usage":{"prompt_tokens":9,"completion_tokens":3,"total_tokens":12}}`,
+		`data: [DONE]`,
+		``,
+	}, "\n\n")
+	res := newResponse(http.StatusOK, "text/event-stream", upstream)
+	if err := New(Responses, OpenAI).Response(res); err != nil {
+		t.Fatalf("translate: %v", err)
+	}
+	events := parseSSE(t, readBody(t, res))
+
+	names := make([]string, 0, len(events))
+	for i, ev := range events {
+		names = append(names, ev[0])
+		data := decodeJSON(t, []byte(ev[1]))
+		if data["type"] != ev[0] || data["sequence_number"] != float64(i+1) {
+			t.Fatalf("event %d: unexpected type or sequence number: %s", i, ev[1])
+		}
+	}
+	wantNames := []string{
+		"response.created", "response.in_progress",
+		"response.output_item.added", "response.content_part.added",
+		"response.output_text.delta", "response.output_text.delta",
+		"response.output_text.done", "response.content_part.done", "response.output_item.done",
+		"response.output_item.added", "response.function_call_arguments.delta",
+		"response.function_call_arguments.done", "response.output_item.done",
+		"response.completed",
+	}
+	if !reflect.DeepEqual(names, wantNames) {
+		t.Fatalf("unexpected events: %v", names)
+	}
+	assertJSONEqual(t, []byte(events[6][1]), `{"type":"response.output_text.done","sequence_number":7,"item_id":"msg_chatcmpl-1_0","output_index":0,"content_index":0,"text":"Hello"}`)
+	assertJSONEqual(t, []byte(events[12][1]), `{"type":"response.output_item.done","sequence_number":13,"output_index":1,
+		"item":{"type":"function_call","id":"fc_call_1","status":"completed","call_id":"call_1","name":"shell","arguments":"{}"}}`)
+	assertJSONEqual(t, []byte(events[13][1]), `{"type":"response.completed","sequence_number":14,"response":{
+		"id":"resp_chatcmpl-1","object":"response","created_at":1700000000,"status":"completed",
+		"error":null,"incomplete_details":null,"model":"gpt-4o",
+		"output":[
+			{"type":"message","id":"msg_chatcmpl-1_0","status":"completed","role":"assistant","content":[{"type":"output_text","text":"Hello","annotations":[]}]},
+			{"type":"function_call","id":"fc_call_1","status":"completed","call_id":"call_1","name":"shell","arguments":"{}"}
+		],
+		"usage":{"input_tokens":9,"input_tokens_details":{"cached_tokens":0},"output_tokens":3,"output_tokens_details":{"reasoning_tokens":0},"total_tokens":12}}}`)
+}
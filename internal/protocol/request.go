@@ -0,0 +1,702 @@
+package protocol
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"strings"
+)
+
+// defaultAnthropicMaxTokens fills max_tokens, which Anthropic requires, when an
+// OpenAI client did not set a limit.
+const defaultAnthropicMaxTokens = 4096
+
+// anthropicToOpenAIRequest converts a Messages request into a Chat Completions request.
+func anthropicToOpenAIRequest(body []byte) ([]byte, error) {
+	var in anthropicRequest
+	if err := json.Unmarshal(body, &in); err != nil {
+		return nil, fmt.Errorf("decode anthropic request: %w", err)
+	}
+
+	out := openAIRequest{
+		Model:       in.Model,
+		Temperature: in.Temperature,
+		TopP:        in.TopP,
+		Stream:      in.Stream,
+	}
+	if in.MaxTokens > 0 {
+		maxTokens := in.MaxTokens
+		out.MaxTokens = &maxTokens
+	}
+	if in.Stream {
+		// Usage only arrives in the final chunk when asked for.
+		out.StreamOptions = &openAIStreamOptions{IncludeUsage: true}
+	}
+	if len(in.StopSequences) > 0 {
+		out.Stop, _ = json.Marshal(in.StopSequences)
+	}
+	if in.Metadata != nil {
+		out.User = in.Metadata.UserID
+	}
+
+	if system, err := anthropicSystemText(in.System); err != nil {
+		return nil, err
+	} else if system != "" {
+		out.Messages = append(out.Messages, openAIMessage{Role: "system", Content: jsonString(system)})
+	}
+	for i, msg := range in.Messages {
+		converted, err := anthropicMessageToOpenAI(msg)
+		if err != nil {
+			return nil, fmt.Errorf("messages[%d]: %w", i, err)
+		}
+		out.Messages = append(out.Messages, converted...)
+	}
+
+	for _, tool := range in.Tools {
+		out.Tools = append(out.Tools, openAITool{
+			Type: "function",
+			Function: openAIFunction{
+				Name:        tool.Name,
+				Description: tool.Description,
+				Parameters:  tool.InputSchema,
+			},
+		})
+	}
+	if tc := in.ToolChoice; tc != nil {
+		switch tc.Type {
+		case "auto":
+			out.ToolChoice = jsonString("auto")
+		case "any":
+			out.ToolChoice = jsonString("required")
+		case "none":
+			out.ToolChoice = jsonString("none")
+		case "tool":
+			out.ToolChoice, _ = json.Marshal(map[string]interface{}{
+				"type":     "function",
+				"function": map[string]string{"name": tc.Name},
+			})
+		}
+		if tc.DisableParallelToolUse && len(out.Tools) > 0 {
+			disabled := false
+			out.ParallelToolCalls = &disabled
+		}
+	}
+
+	return json.Marshal(out)
+}
+
+// anthropicSystemText flattens the system prompt, a string or a list of text blocks.
+func anthropicSystemText(raw json.RawMessage) (string, error) {
+	raw = bytes.TrimSpace(raw)
+	if len(raw) == 0 || string(raw) == "null" {
+		return "", nil
+	}
+	var blocks anthropicContent
+	if err := json.Unmarshal(raw, &blocks); err != nil {
+		return "", fmt.Errorf("decode system: %w", err)
+	}
+	return blocks.text("\n"), nil
+}
+
+// text joins the text blocks of c.
+func (c anthropicContent) text(sep string) string {
+	parts := make([]string, 0, len(c))
+	for _, b := range c {
+		if b.Type == "text" && b.Text != "" {
+			parts = append(parts, b.Text)
+		}
+	}
+	return strings.Join(parts, sep)
+}
+
+// anthropicMessageToOpenAI converts one message. Tool results become separate
+// "tool" messages, which OpenAI expects right after the assistant's tool calls.
+func anthropicMessageToOpenAI(msg anthropicMessage) ([]openAIMessage, error) {
+	switch msg.Role {
+	case "assistant":
+		out := openAIMessage{Role: "assistant"}
+		if text := msg.Content.text(""); text != "" {
+			out.Content = jsonString(text)
+		}
+		for _, b := range msg.Content {
+			if b.Type != "tool_use" {
+				continue
+			}
+			args := "{}"
+			if len(bytes.TrimSpace(b.Input)) > 0 {
+				args = string(b.Input)
+			}
+			out.ToolCalls = append(out.ToolCalls, openAIToolCall{
+				ID:       b.ID,
+				Type:     "function",
+				Function: openAIFunctionCall{Name: b.Name, Arguments: args},
+			})
+		}
+		if out.Content == nil && len(out.ToolCalls) == 0 {
+			out.Content = jsonString("")
+		}
+		return []openAIMessage{out}, nil
+	case "user":
+		var (
+			out   []openAIMessage
+			parts []openAIPart
+		)
+		for _, b := range msg.Content {
+			switch b.Type {
+			case "tool_result":
+				content := b.Content.text("\n")
+				if b.IsError && content == "" {
+					content = "error"
+				}
+				out = append(out, openAIMessage{Role: "tool", ToolCallID: b.ToolUseID, Content: jsonString(content)})
+			case "text":
+				parts = append(parts, openAIPart{Type: "text", Text: b.Text})
+			case "image":
+				if url := anthropicImageURL(b.Source); url != "" {
+					parts = append(parts, openAIPart{Type: "image_url", ImageURL: &openAIImageURL{URL: url}})
+				}
+			}
+		}
+		switch {
+		case len(parts) == 1 && parts[0].Type == "text":
+			out = append(out, openAIMessage{Role: "user", Content: jsonString(parts[0].Text)})
+		case len(parts) > 0:
+			content, err := json.Marshal(parts)
+			if err != nil {
+				return nil, err
+			}
+			out = append(out, openAIMessage{Role: "user", Content: content})
+		}
+		return out, nil
+	default:
+		return nil, fmt.Errorf("unsupported role %q", msg.Role)
+	}
+}
+
+func anthropicImageURL(src *anthropicImageSource) string {
+	if src == nil {
+		return ""
+	}
+	switch src.Type {
+	case "base64":
+		return "data:" + src.MediaType + ";base64," + src.Data
+	case "url":
+		return src.URL
+	default:
+		return ""
+	}
+}
+
+// openAIToAnthropicRequest converts a Chat Completions request into a Messages
+// request. includeUsage reports whether the client asked for streamed usage.
+func openAIToAnthropicRequest(body []byte) (out []byte, includeUsage bool, err error) {
+	var in openAIRequest
+	if err := json.Unmarshal(body, &in); err != nil {
+		return nil, false, fmt.Errorf("decode openai request: %w", err)
+	}
+
+	req := anthropicRequest{
+		Model:       in.Model,
+		MaxTokens:   defaultAnthropicMaxTokens,
+		Temperature: in.Temperature,
+		TopP:        in.TopP,
+		Stream:      in.Stream,
+	}
+	switch {
+	case in.MaxCompletionTokens != nil && *in.MaxCompletionTokens > 0:
+		req.MaxTokens = *in.MaxCompletionTokens
+	case in.MaxTokens != nil && *in.MaxTokens > 0:
+		req.MaxTokens = *in.MaxTokens
+	}
+	if in.StreamOptions != nil {
+		includeUsage = in.StreamOptions.IncludeUsage
+	}
+	if stops, err := openAIStop(in.Stop); err != nil {
+		return nil, false, err
+	} else {
+		req.StopSequences = stops
+	}
+	if in.User != "" {
+		req.Metadata = &anthropicMetadata{UserID: in.User}
+	}
+
+	var system []string
+	for i, msg := range in.Messages {
+		switch msg.Role {
+		case "system", "developer":
+			text, err := openAIContentText(msg.Content)
+			if err != nil {
+				return nil, false, fmt.Errorf("messages[%d]: %w", i, err)
+			}
+			if text != "" {
+				system = append(system, text)
+			}
+			continue
+		}
+		converted, err := openAIMessageToAnthropic(msg)
+		if err != nil {
+			return nil, false, fmt.Errorf("messages[%d]: %w", i, err)
+		}
+		// Anthropic requires alternating roles, so consecutive messages of the same
+		// role (such as several tool results) are merged.
+		if n := len(req.Messages); n > 0 && req.Messages[n-1].Role == converted.Role {
+			req.Messages[n-1].Content = append(req.Messages[n-1].Content, converted.Content...)
+			continue
+		}
+		req.Messages = append(req.Messages, converted)
+	}
+	if len(system) > 0 {
+		req.System = jsonString(strings.Join(system, "\n\n"))
+	}
+
+	for _, tool := range in.Tools {
+		if tool.Type != "" && tool.Type != "function" {
+			continue
+		}
+		schema := tool.Function.Parameters
+		if len(bytes.TrimSpace(schema)) == 0 || string(schema) == "null" {
+			schema = json.RawMessage(`{"type":"object","properties":{}}`)
+		}
+		req.Tools = append(req.Tools, anthropicTool{
+			Name:        tool.Function.Name,
+			Description: tool.Function.Description,
+			InputSchema: schema,
+		})
+	}
+	if choice, err := openAIToolChoice(in.ToolChoice); err != nil {
+		return nil, false, err
+	} else {
+		req.ToolChoice = choice
+	}
+	if in.ParallelToolCalls != nil && !*in.ParallelToolCalls && len(req.Tools) > 0 {
+		if req.ToolChoice == nil {
+			req.ToolChoice = &anthropicToolChoice{Type: "auto"}
+		}
+		if req.ToolChoice.Type != "none" {
+			req.ToolChoice.DisableParallelToolUse = true
+		}
+	}
+
+	out, err = json.Marshal(req)
+	return out, includeUsage, err
+}
+
+func openAIMessageToAnthropic(msg openAIMessage) (anthropicMessage, error) {
+	switch msg.Role {
+	case "tool":
+		text, err := openAIContentText(msg.Content)
+		if err != nil {
+			return anthropicMessage{}, err
+		}
+		block := anthropicBlock{Type: "tool_result", ToolUseID: msg.ToolCallID}
+		if text != "" {
+			block.Content = anthropicContent{{Type: "text", Text: text}}
+		}
+		return anthropicMessage{Role: "user", Content: anthropicContent{block}}, nil
+	case "assistant":
+		out := anthropicMessage{Role: "assistant"}
+		text, err := openAIContentText(msg.Content)
+		if err != nil {
+			return out, err
+		}
+		if text != "" {
+			out.Content = append(out.Content, anthropicBlock{Type: "text", Text: text})
+		}
+		for _, call := range msg.ToolCalls {
+			input := json.RawMessage(call.Function.Arguments)
+			if !json.Valid(input) {
+				input = json.RawMessage(`{}`)
+			}
+			out.Content = append(out.Content, anthropicBlock{
+				Type:  "tool_use",
+				ID:    call.ID,
+				Name:  call.Function.Name,
+				Input: input,
+			})
+		}
+		return out, nil
+	case "user":
+		content, err := openAIUserContent(msg.Content)
+		if err != nil {
+			return anthropicMessage{}, err
+		}
+		return anthropicMessage{Role: "user", Content: content}, nil
+	default:
+		return anthropicMessage{}, fmt.Errorf("unsupported role %q", msg.Role)
+	}
+}
+
+// openAIContentText flattens message content, a string or a list of parts.
+func openAIContentText(raw json.RawMessage) (string, error) {
+	parts, err := openAIParts(raw)
+	if err != nil {
+		return "", err
+	}
+	texts := make([]string, 0, len(parts))
+	for _, p := range parts {
+		if p.Type == "text" && p.Text != "" {
+			texts = append(texts, p.Text)
+		}
+	}
+	return strings.Join(texts, "\n"), nil
+}
+
+func openAIUserContent(raw json.RawMessage) (anthropicContent, error) {
+	parts, err := openAIParts(raw)
+	if err != nil {
+		return nil, err
+	}
+	out := make(anthropicContent, 0, len(parts))
+	for _, p := range parts {
+		switch p.Type {
+		case "text":
+			out = append(out, anthropicBlock{Type: "text", Text: p.Text})
+		case "image_url":
+			if p.ImageURL != nil {
+				out = append(out, anthropicBlock{Type: "image", Source: anthropicImageSourceFromURL(p.ImageURL.URL)})
+			}
+		}
+	}
+	return out, nil
+}
+
+func openAIParts(raw json.RawMessage) ([]openAIPart, error) {
+	raw = bytes.TrimSpace(raw)
+	if len(raw) == 0 || string(raw) == "null" {
+		return nil, nil
+	}
+	if raw[0] == '"' {
+		var text string
+		if err := json.Unmarshal(raw, &text); err != nil {
+			return nil, err
+		}
+		return []openAIPart{{Type: "text", Text: text}}, nil
+	}
+	var parts []openAIPart
+	if err := json.Unmarshal(raw, &parts); err != nil {
+		return nil, fmt.Errorf("decode content: %w", err)
+	}
+	return parts, nil
+}
+
+// anthropicImageSourceFromURL turns an image URL, possibly a base64 data URL, into
+// an Anthropic image source.
+func anthropicImageSourceFromURL(url string) *anthropicImageSource {
+	if rest, ok := strings.CutPrefix(url, "data:"); ok {
+		if meta, data, ok := strings.Cut(rest, ","); ok && strings.HasSuffix(meta, ";base64") {
+			return &anthropicImageSource{
+				Type:      "base64",
+				MediaType: strings.TrimSuffix(meta, ";base64"),
+				Data:      data,
+			}
+		}
+	}
+	return &anthropicImageSource{Type: "url", URL: url}
+}
+
+func openAIStop(raw json.RawMessage) ([]string, error) {
+	raw = bytes.TrimSpace(raw)
+	if len(raw) == 0 || string(raw) == "null" {
+		return nil, nil
+	}
+	if raw[0] == '"' {
+		var stop string
+		if err := json.Unmarshal(raw, &stop); err != nil {
+			return nil, err
+		}
+		return []string{stop}, nil
+	}
+	var stops []string
+	if err := json.Unmarshal(raw, &stops); err != nil {
+		return nil, fmt.Errorf("decode stop: %w", err)
+	}
+	return stops, nil
+}
+
+func openAIToolChoice(raw json.RawMessage) (*anthropicToolChoice, error) {
+	raw = bytes.TrimSpace(raw)
+	if len(raw) == 0 || string(raw) == "null" {
+		return nil, nil
+	}
+	if raw[0] == '"' {
+		var mode string
+		if err := json.Unmarshal(raw, &mode); err != nil {
+			return nil, err
+		}
+		switch mode {
+		case "auto":
+			return &anthropicToolChoice{Type: "auto"}, nil
+		case "required":
+			return &anthropicToolChoice{Type: "any"}, nil
+		case "none":
+			return &anthropicToolChoice{Type: "none"}, nil
+		default:
+			return nil, fmt.Errorf("unsupported tool_choice %q", mode)
+		}
+	}
+	var choice struct {
+		Function struct {
+			Name string `json:"name"`
+		} `json:"function"`
+	}
+	if err := json.Unmarshal(raw, &choice); err != nil {
+		return nil, fmt.Errorf("decode tool_choice: %w", err)
+	}
+	return &anthropicToolChoice{Type: "tool", Name: choice.Function.Name}, nil
+}
+
+// responsesToOpenAIRequest converts a Responses request into a Chat Completions
+// request. Hosted tools and reasoning items cannot be expressed in Chat Completions
+// and are dropped; previous_response_id is rejected, as the gateway stores no
+// conversation state.
+func responsesToOpenAIRequest(body []byte) ([]byte, error) {
+	var in responsesRequest
+	if err := json.Unmarshal(body, &in); err != nil {
+		return nil, fmt.Errorf("decode responses request: %w", err)
+	}
+	if in.PreviousResponseID != "" {
+		return nil, fmt.Errorf("previous_response_id is not supported for this model; send the full conversation in input")
+	}
+
+	out := openAIRequest{
+		Model:       in.Model,
+		MaxTokens:   in.MaxOutputTokens,
+		Temperature: in.Temperature,
+		TopP:        in.TopP,
+		Stream:      in.Stream,
+		User:        in.User,
+	}
+	if in.Stream {
+		out.StreamOptions = &openAIStreamOptions{IncludeUsage: true}
+	}
+	if in.Reasoning != nil {
+		out.ReasoningEffort = in.Reasoning.Effort
+	}
+	if in.Text != nil && in.Text.Format != nil {
+		format, err := responsesTextFormatToOpenAI(in.Text.Format)
+		if err != nil {
+			return nil, err
+		}
+		out.ResponseFormat = format
+	}
+
+	if in.Instructions != "" {
+		out.Messages = append(out.Messages, openAIMessage{Role: "system", Content: jsonString(in.Instructions)})
+	}
+	messages, err := responsesInputToOpenAI(in.Input)
+	if err != nil {
+		return nil, err
+	}
+	out.Messages = append(out.Messages, messages...)
+
+	for _, tool := range in.Tools {
+		if tool.Type != "function" {
+			continue
+		}
+		out.Tools = append(out.Tools, openAITool{
+			Type: "function",
+			Function: openAIFunction{
+				Name:        tool.Name,
+				Description: tool.Description,
+				Parameters:  tool.Parameters,
+				Strict:      tool.Strict,
+			},
+		})
+	}
+	// Chat Completions rejects tool settings without tools.
+	if len(out.Tools) > 0 {
+		choice, err := responsesToolChoice(in.ToolChoice)
+		if err != nil {
+			return nil, err
+		}
+		out.ToolChoice = choice
+		out.ParallelToolCalls = in.ParallelToolCalls
+	}
+	return json.Marshal(out)
+}
+
+// responsesInputToOpenAI converts the input, a string or a list of items, into
+// messages. Consecutive function calls are grouped into one assistant message.
+func responsesInputToOpenAI(raw json.RawMessage) ([]openAIMessage, error) {
+	raw = bytes.TrimSpace(raw)
+	if len(raw) == 0 || string(raw) == "null" {
+		return nil, nil
+	}
+	if raw[0] == '"' {
+		return []openAIMessage{{Role: "user", Content: raw}}, nil
+	}
+	var items []responsesInputItem
+	if err := json.Unmarshal(raw, &items); err != nil {
+		return nil, fmt.Errorf("decode input: %w", err)
+	}
+
+	var out []openAIMessage
+	for i, item := range items {
+		kind := item.Type
+		if kind == "" && item.Role != "" {
+			kind = "message"
+		}
+		switch kind {
+		case "message":
+			msg, err := responsesMessageToOpenAI(item)
+			if err != nil {
+				return nil, fmt.Errorf("input[%d]: %w", i, err)
+			}
+			out = append(out, msg)
+		case "function_call":
+			call := openAIToolCall{
+				ID:       item.CallID,
+				Type:     "function",
+				Function: openAIFunctionCall{Name: item.Name, Arguments: item.Arguments},
+			}
+			if n := len(out); n > 0 && out[n-1].Role == "assistant" {
+				out[n-1].ToolCalls = append(out[n-1].ToolCalls, call)
+				continue
+			}
+			out = append(out, openAIMessage{Role: "assistant", ToolCalls: []openAIToolCall{call}})
+		case "function_call_output":
+			output, err := responsesText(item.Output)
+			if err != nil {
+				return nil, fmt.Errorf("input[%d]: %w", i, err)
+			}
+			out = append(out, openAIMessage{Role: "tool", ToolCallID: item.CallID, Content: jsonString(output)})
+		}
+	}
+	return out, nil
+}
+
+func responsesMessageToOpenAI(item responsesInputItem) (openAIMessage, error) {
+	role := item.Role
+	switch role {
+	case "user", "assistant":
+	case "system", "developer":
+		role = "system"
+	default:
+		return openAIMessage{}, fmt.Errorf("unsupported role %q", item.Role)
+	}
+	parts, err := responsesParts(item.Content)
+	if err != nil {
+		return openAIMessage{}, err
+	}
+	hasImage := false
+	for _, p := range parts {
+		if p.Type == "image_url" {
+			hasImage = true
+		}
+	}
+	// Only user messages may carry images; everything else is sent as plain text,
+	// which every Chat Completions implementation accepts.
+	if role != "user" || !hasImage {
+		texts := make([]string, 0, len(parts))
+		for _, p := range parts {
+			if p.Type == "text" {
+				texts = append(texts, p.Text)
+			}
+		}
+		return openAIMessage{Role: role, Content: jsonString(strings.Join(texts, "\n"))}, nil
+	}
+	content, err := json.Marshal(parts)
+	if err != nil {
+		return openAIMessage{}, err
+	}
+	return openAIMessage{Role: role, Content: content}, nil
+}
+
+// responsesParts converts message content, a string or a list of content parts,
+// into Chat Completions parts.
+func responsesParts(raw json.RawMessage) ([]openAIPart, error) {
+	raw = bytes.TrimSpace(raw)
+	if len(raw) == 0 || string(raw) == "null" {
+		return nil, nil
+	}
+	if raw[0] == '"' {
+		var text string
+		if err := json.Unmarshal(raw, &text); err != nil {
+			return nil, err
+		}
+		return []openAIPart{{Type: "text", Text: text}}, nil
+	}
+	var parts []responsesContentPart
+	if err := json.Unmarshal(raw, &parts); err != nil {
+		return nil, fmt.Errorf("decode content: %w", err)
+	}
+	out := make([]openAIPart, 0, len(parts))
+	for _, p := range parts {
+		switch p.Type {
+		case "input_text", "output_text", "text":
+			out = append(out, openAIPart{Type: "text", Text: p.Text})
+		case "input_image":
+			if p.ImageURL != "" {
+				out = append(out, openAIPart{Type: "image_url", ImageURL: &openAIImageURL{URL: p.ImageURL}})
+			}
+		default:
+			// Parts Chat Completions cannot express, such as refusal or input_file,
+			// are dropped.
+		}
+	}
+	return out, nil
+}
+
+// responsesText flattens a function call output, a string or a list of content
+// parts, into text.
+func responsesText(raw json.RawMessage) (string, error) {
+	parts, err := responsesParts(raw)
+	if err != nil {
+		return "", err
+	}
+	texts := make([]string, 0, len(parts))
+	for _, p := range parts {
+		if p.Type == "text" {
+			texts = append(texts, p.Text)
+		}
+	}
+	return strings.Join(texts, "\n"), nil
+}
+
+func responsesToolChoice(raw json.RawMessage) (json.RawMessage, error) {
+	raw = bytes.TrimSpace(raw)
+	if len(raw) == 0 || string(raw) == "null" || raw[0] == '"' {
+		// "auto", "none" and "required" mean the same in both APIs.
+		return raw, nil
+	}
+	var choice struct {
+		Type string `json:"type"`
+		Name string `json:"name"`
+	}
+	if err := json.Unmarshal(raw, &choice); err != nil {
+		return nil, fmt.Errorf("decode tool_choice: %w", err)
+	}
+	if choice.Type != "function" {
+		return nil, fmt.Errorf("unsupported tool_choice type %q", choice.Type)
+	}
+	return json.Marshal(map[string]interface{}{
+		"type":     "function",
+		"function": map[string]string{"name": choice.Name},
+	})
+}
+
+func responsesTextFormatToOpenAI(format *responsesTextFormat) (json.RawMessage, error) {
+	switch format.Type {
+	case "", "text":
+		return nil, nil
+	case "json_object":
+		return json.RawMessage(`{"type":"json_object"}`), nil
+	case "json_schema":
+		return json.Marshal(map[string]interface{}{
+			"type": "json_schema",
+			"json_schema": struct {
+				Name        string          `json:"name"`
+				Description string          `json:"description,omitempty"`
+				Schema      json.RawMessage `json:"schema,omitempty"`
+				Strict      *bool           `json:"strict,omitempty"`
+			}{format.Name, format.Description, format.Schema, format.Strict},
+		})
+	default:
+		return nil, fmt.Errorf("unsupported text format %q", format.Type)
+	}
+}
+
+func jsonString(s string) json.RawMessage {
+	data, _ := json.Marshal(s)
+	return data
+}
@@ -0,0 +1,231 @@
+package protocol
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// openAIToAnthropicResponse converts a Chat Completions response into a Messages response.
+func openAIToAnthropicResponse(body []byte) ([]byte, error) {
+	var in openAIResponse
+	if err := json.Unmarshal(body, &in); err != nil {
+		return nil, fmt.Errorf("decode openai response: %w", err)
+	}
+	out := anthropicResponse{
+		ID:      in.ID,
+		Type:    "message",
+		Role:    "assistant",
+		Model:   in.Model,
+		Content: anthropicContent{},
+	}
+	if len(in.Choices) > 0 {
+		choice := in.Choices[0]
+		if msg := choice.Message; msg != nil {
+			if msg.Content != nil && *msg.Content != "" {
+				out.Content = append(out.Content, anthropicBlock{Type: "text", Text: *msg.Content})
+			}
+			for _, call := range msg.ToolCalls {
+				input := json.RawMessage(call.Function.Arguments)
+				if len(bytes.TrimSpace(input)) == 0 || !json.Valid(input) {
+					input = json.RawMessage(`{}`)
+				}
+				out.Content = append(out.Content, anthropicBlock{Type: "tool_use", ID: call.ID, Name: call.Function.Name, Input: input})
+			}
+		}
+		reason := anthropicStopReason(choice.FinishReason)
+		out.StopReason = &reason
+	}
+	if in.Usage != nil {
+		out.Usage = anthropicUsageFromOpenAI(*in.Usage)
+	}
+	return json.Marshal(out)
+}
+
+// anthropicToOpenAIResponse converts a Messages response into a Chat Completions response.
+func anthropicToOpenAIResponse(body []byte) ([]byte, error) {
+	var in anthropicResponse
+	if err := json.Unmarshal(body, &in); err != nil {
+		return nil, fmt.Errorf("decode anthropic response: %w", err)
+	}
+	msg := &openAIResponseMessage{Role: "assistant"}
+	var text strings.Builder
+	for _, b := range in.Content {
+		switch b.Type {
+		case "text":
+			text.WriteString(b.Text)
+		case "tool_use":
+			args := "{}"
+			if len(bytes.TrimSpace(b.Input)) > 0 {
+				args = string(b.Input)
+			}
+			msg.ToolCalls = append(msg.ToolCalls, openAIToolCall{
+				ID:       b.ID,
+				Type:     "function",
+				Function: openAIFunctionCall{Name: b.Name, Arguments: args},
+			})
+		}
+	}
+	if text.Len() > 0 || len(msg.ToolCalls) == 0 {
+		content := text.String()
+		msg.Content = &content
+	}
+	reason := openAIFinishReason(in.StopReason)
+	usage := openAIUsageFromAnthropic(in.Usage)
+	out := openAIResponse{
+		ID:      in.ID,
+		Object:  "chat.completion",
+		Created: time.Now().Unix(),
+		Model:   in.Model,
+		Choices: []openAIChoice{{Index: 0, Message: msg, FinishReason: &reason}},
+		Usage:   &usage,
+	}
+	return json.Marshal(out)
+}
+
+func anthropicStopReason(finish *string) string {
+	if finish == nil {
+		return "end_turn"
+	}
+	switch *finish {
+	case "length":
+		return "max_tokens"
+	case "tool_calls", "function_call":
+		return "tool_use"
+	case "content_filter":
+		return "refusal"
+	default:
+		return "end_turn"
+	}
+}
+
+func openAIFinishReason(stop *string) string {
+	if stop == nil {
+		return "stop"
+	}
+	switch *stop {
+	case "max_tokens":
+		return "length"
+	case "tool_use":
+		return "tool_calls"
+	case "refusal":
+		return "content_filter"
+	default:
+		return "stop"
+	}
+}
+
+// anthropicUsageFromOpenAI splits cached tokens out of the prompt count, since
+// Anthropic's input_tokens excludes cache reads.
+func anthropicUsageFromOpenAI(u openAIUsage) anthropicUsage {
+	out := anthropicUsage{InputTokens: u.PromptTokens, OutputTokens: u.CompletionTokens}
+	if d := u.PromptTokensDetails; d != nil && d.CachedTokens > 0 && d.CachedTokens <= u.PromptTokens {
+		out.InputTokens -= d.CachedTokens
+		out.CacheReadInputTokens = d.CachedTokens
+	}
+	return out
+}
+
+// openAIUsageFromAnthropic folds cache tokens into the prompt count, as OpenAI
+// reports cached tokens as part of prompt_tokens.
+func openAIUsageFromAnthropic(u anthropicUsage) openAIUsage {
+	prompt := u.InputTokens + u.CacheReadInputTokens + u.CacheCreationInputTokens
+	out := openAIUsage{
+		PromptTokens:     prompt,
+		CompletionTokens: u.OutputTokens,
+		TotalTokens:      prompt + u.OutputTokens,
+	}
+	if u.CacheReadInputTokens > 0 {
+		out.PromptTokensDetails = &openAITokensDetails{CachedTokens: u.CacheReadInputTokens}
+	}
+	return out
+}
+
+// openAIToResponsesResponse converts a Chat Completions response into a Responses
+// response.
+func openAIToResponsesResponse(body []byte) ([]byte, error) {
+	var in openAIResponse
+	if err := json.Unmarshal(body, &in); err != nil {
+		return nil, fmt.Errorf("decode openai response: %w", err)
+	}
+	out := responsesResponse{
+		ID:        responsesID("resp_", in.ID),
+		Object:    "response",
+		CreatedAt: in.Created,
+		Status:    "completed",
+		Model:     in.Model,
+		Output:    []interface{}{},
+	}
+	if len(in.Choices) > 0 {
+		choice := in.Choices[0]
+		if msg := choice.Message; msg != nil {
+			if msg.Content != nil && *msg.Content != "" {
+				out.Output = append(out.Output, responsesMessage{
+					Type:    "message",
+					ID:      responsesID("msg_", in.ID),
+					Status:  "completed",
+					Role:    "assistant",
+					Content: []responsesOutputText{newResponsesOutputText(*msg.Content)},
+				})
+			}
+			for _, call := range msg.ToolCalls {
+				out.Output = append(out.Output, responsesFunctionCall{
+					Type:      "function_call",
+					ID:        responsesID("fc_", call.ID),
+					Status:    "completed",
+					CallID:    call.ID,
+					Name:      call.Function.Name,
+					Arguments: call.Function.Arguments,
+				})
+			}
+		}
+		out.Status, out.IncompleteDetails = responsesStatus(choice.FinishReason)
+	}
+	if in.Usage != nil {
+		usage := responsesUsageFromOpenAI(*in.Usage)
+		out.Usage = &usage
+	}
+	return json.Marshal(out)
+}
+
+// responsesID derives a Responses-style identifier from an upstream one.
+func responsesID(prefix, id string) string {
+	if strings.HasPrefix(id, prefix) {
+		return id
+	}
+	return prefix + id
+}
+
+func responsesStatus(finish *string) (string, *responsesIncomplete) {
+	if finish == nil {
+		return "completed", nil
+	}
+	switch *finish {
+	case "length":
+		return "incomplete", &responsesIncomplete{Reason: "max_output_tokens"}
+	case "content_filter":
+		return "incomplete", &responsesIncomplete{Reason: "content_filter"}
+	default:
+		return "completed", nil
+	}
+}
+
+func responsesUsageFromOpenAI(u openAIUsage) responsesUsage {
+	out := responsesUsage{
+		InputTokens:  u.PromptTokens,
+		OutputTokens: u.CompletionTokens,
+		TotalTokens:  u.TotalTokens,
+	}
+	if out.TotalTokens == 0 {
+		out.TotalTokens = u.PromptTokens + u.CompletionTokens
+	}
+	if d := u.PromptTokensDetails; d != nil {
+		out.InputTokensDetails.CachedTokens = d.CachedTokens
+	}
+	if d := u.CompletionTokensDetails; d != nil {
+		out.OutputTokensDetails.ReasoningTokens = d.ReasoningTokens
+	}
+	return out
+}
@@ -0,0 +1,168 @@
+package protocol
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"sync"
+)
+
+// maxSSELineBytes caps a single line of an upstream event stream.
+const maxSSELineBytes = 4 << 20
+
+// sseEvent is one server-sent event; name is empty for unnamed events.
+type sseEvent struct {
+	name string
+	data []byte
+}
+
+// streamConverter turns upstream events into client events.
+type streamConverter interface {
+	event(ev sseEvent, w *sseWriter) error
+	// finish is called once the upstream stream ended cleanly.
+	finish(w *sseWriter) error
+}
+
+// sseWriter writes whole events to the client in one call each, so a reader never
+// observes half an event.
+type sseWriter struct {
+	w   io.Writer
+	buf bytes.Buffer
+}
+
+// send writes an event whose data is v encoded as JSON. An empty name writes a
+// data-only event, as OpenAI streams use.
+func (s *sseWriter) send(name string, v interface{}) error {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	return s.sendRaw(name, data)
+}
+
+func (s *sseWriter) sendRaw(name string, data []byte) error {
+	s.buf.Reset()
+	if name != "" {
+		s.buf.WriteString("event: ")
+		s.buf.WriteString(name)
+		s.buf.WriteByte('\n')
+	}
+	s.buf.WriteString("data: ")
+	s.buf.Write(data)
+	s.buf.WriteString("\n\n")
+	_, err := s.w.Write(s.buf.Bytes())
+	return err
+}
+
+// readEvents parses an event stream and calls fn for every event carrying data.
+func readEvents(r io.Reader, fn func(sseEvent) error) error {
+	reader := bufio.NewReaderSize(r, 64<<10)
+	var (
+		name string
+		data bytes.Buffer
+		line []byte
+	)
+	dispatch := func() error {
+		defer func() {
+			name = ""
+			data.Reset()
+		}()
+		if data.Len() == 0 {
+			return nil
+		}
+		return fn(sseEvent{name: name, data: append([]byte(nil), data.Bytes()...)})
+	}
+	for {
+		chunk, isPrefix, err := reader.ReadLine()
+		if err != nil {
+			if errors.Is(err, io.EOF) {
+				return dispatch()
+			}
+			return err
+		}
+		line = append(line, chunk...)
+		if len(line) > maxSSELineBytes {
+			return fmt.Errorf("event stream line exceeds %d bytes", maxSSELineBytes)
+		}
+		if isPrefix {
+			continue
+		}
+		field, value := splitField(line)
+		line = line[:0]
+		switch field {
+		case "":
+			if err := dispatch(); err != nil {
+				return err
+			}
+		case "event":
+			name = string(value)
+		case "data":
+			if data.Len() > 0 {
+				data.WriteByte('\n')
+			}
+			data.Write(value)
+		}
+	}
+}
+
+// splitField splits an SSE line into its field name and value. Blank lines yield an
+// empty field; comment lines yield "#".
+func splitField(line []byte) (string, []byte) {
+	if len(line) == 0 {
+		return "", nil
+	}
+	if line[0] == ':' {
+		return "#", nil
+	}
+	idx := bytes.IndexByte(line, ':')
+	if idx < 0 {
+		return string(line), nil
+	}
+	value := line[idx+1:]
+	if len(value) > 0 && value[0] == ' ' {
+		value = value[1:]
+	}
+	return string(line[:idx]), value
+}
+
+// transcode returns a body that yields src converted by conv. The conversion runs
+// in its own goroutine and stops when either side is closed.
+func transcode(src io.ReadCloser, conv streamConverter) io.ReadCloser {
+	pr, pw := io.Pipe()
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		w := &sseWriter{w: pw}
+		err := readEvents(src, func(ev sseEvent) error {
+			return conv.event(ev, w)
+		})
+		if err == nil {
+			err = conv.finish(w)
+		}
+		_ = pw.CloseWithError(err)
+	}()
+	return &transcodedBody{PipeReader: pr, src: src, done: done}
+}
+
+type transcodedBody struct {
+	*io.PipeReader
+	src  io.ReadCloser
+	done chan struct{}
+	once sync.Once
+}
+
+// Close stops the conversion and returns once its goroutine has exited, so src is
+// not read after Close returns. Closing src unblocks a read the goroutine may be
+// waiting in; src must therefore allow Close during a Read.
+func (b *transcodedBody) Close() error {
+	var err error
+	b.once.Do(func() {
+		_ = b.PipeReader.Close()
+		err = b.src.Close()
+		<-b.done
+	})
+	return err
+}
@@ -0,0 +1,680 @@
+package protocol
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"time"
+)
+
+var doneMarker = []byte("[DONE]")
+
+// openAIToAnthropicStream transcodes Chat Completions chunks into Messages events.
+type openAIToAnthropicStream struct {
+	started  bool
+	finished bool
+	id       string
+	model    string
+	// next is the index of the next content block; open is the index of the block
+	// currently open, or -1.
+	next     int
+	open     int
+	openKind string
+	toolCall int
+	stop     string
+	usage    anthropicUsage
+}
+
+func newOpenAIToAnthropicStream() *openAIToAnthropicStream {
+	return &openAIToAnthropicStream{open: -1, toolCall: -1}
+}
+
+func (s *openAIToAnthropicStream) event(ev sseEvent, w *sseWriter) error {
+	if s.finished {
+		return nil
+	}
+	if bytes.Equal(bytes.TrimSpace(ev.data), doneMarker) {
+		return s.finish(w)
+	}
+	var chunk struct {
+		openAIResponse
+		Error *struct {
+			Message string `json:"message"`
+		} `json:"error"`
+	}
+	if err := json.Unmarshal(ev.data, &chunk); err != nil {
+		return fmt.Errorf("decode openai chunk: %w", err)
+	}
+	if chunk.Error != nil {
+		s.finished = true
+		return w.sendRaw("error", ErrorBody(Anthropic, 500, "", "", chunk.Error.Message))
+	}
+	if s.id == "" {
+		s.id, s.model = chunk.ID, chunk.Model
+	}
+	if err := s.start(w); err != nil {
+		return err
+	}
+	if chunk.Usage != nil {
+		s.usage = anthropicUsageFromOpenAI(*chunk.Usage)
+	}
+	for _, choice := range chunk.Choices {
+		if d := choice.Delta; d != nil {
+			if d.Content != nil && *d.Content != "" {
+				if err := s.openBlock(w, "text", -1, textBlock{Type: "text"}); err != nil {
+					return err
+				}
+				if err := s.delta(w, textDelta{Type: "text_delta", Text: *d.Content}); err != nil {
+					return err
+				}
+			}
+			for _, call := range d.ToolCalls {
+				if call.ID != "" || s.openKind != "tool_use" || call.Index != s.toolCall {
+					block := toolUseBlock{Type: "tool_use", ID: call.ID, Name: call.Function.Name, Input: json.RawMessage(`{}`)}
+					if err := s.openBlock(w, "tool_use", call.Index, block); err != nil {
+						return err
+					}
+				}
+				if call.Function.Arguments != "" {
+					if err := s.delta(w, inputJSONDelta{Type: "input_json_delta", PartialJSON: call.Function.Arguments}); err != nil {
+						return err
+					}
+				}
+			}
+		}
+		if choice.FinishReason != nil {
+			s.stop = anthropicStopReason(choice.FinishReason)
+		}
+	}
+	return nil
+}
+
+func (s *openAIToAnthropicStream) start(w *sseWriter) error {
+	if s.started {
+		return nil
+	}
+	s.started = true
+	return w.send("message_start", messageStartEvent{
+		Type: "message_start",
+		Message: anthropicResponse{
+			ID:      s.id,
+			Type:    "message",
+			Role:    "assistant",
+			Model:   s.model,
+			Content: anthropicContent{},
+		},
+	})
+}
+
+// openBlock closes the open content block, if any, and starts a new one.
+func (s *openAIToAnthropicStream) openBlock(w *sseWriter, kind string, toolCall int, block interface{}) error {
+	if s.open >= 0 && s.openKind == kind && kind == "text" {
+		return nil
+	}
+	if err := s.closeBlock(w); err != nil {
+		return err
+	}
+	s.open, s.openKind, s.toolCall = s.next, kind, toolCall
+	s.next++
+	return w.send("content_block_start", blockStartEvent{Type: "content_block_start", Index: s.open, ContentBlock: block})
+}
+
+func (s *openAIToAnthropicStream) closeBlock(w *sseWriter) error {
+	if s.open < 0 {
+		return nil
+	}
+	index := s.open
+	s.open, s.openKind = -1, ""
+	return w.send("content_block_stop", blockStopEvent{Type: "content_block_stop", Index: index})
+}
+
+func (s *openAIToAnthropicStream) delta(w *sseWriter, delta interface{}) error {
+	return w.send("content_block_delta", blockDeltaEvent{Type: "content_block_delta", Index: s.open, Delta: delta})
+}
+
+func (s *openAIToAnthropicStream) finish(w *sseWriter) error {
+	if s.finished {
+		return nil
+	}
+	s.finished = true
+	if err := s.start(w); err != nil {
+		return err
+	}
+	if err := s.closeBlock(w); err != nil {
+		return err
+	}
+	stop := s.stop
+	if stop == "" {
+		stop = "end_turn"
+	}
+	delta := messageDeltaEvent{Type: "message_delta", Usage: s.usage}
+	delta.Delta.StopReason = stop
+	if err := w.send("message_delta", delta); err != nil {
+		return err
+	}
+	return w.send("message_stop", messageStopEvent{Type: "message_stop"})
+}
+
+// Anthropic stream event payloads, declared as structs so "type" leads each object
+// as it does in Anthropic's own streams.
+
+type messageStartEvent struct {
+	Type    string            `json:"type"`
+	Message anthropicResponse `json:"message"`
+}
+
+type blockStartEvent struct {
+	Type         string      `json:"type"`
+	Index        int         `json:"index"`
+	ContentBlock interface{} `json:"content_block"`
+}
+
+type textBlock struct {
+	Type string `json:"type"`
+	Text string `json:"text"`
+}
+
+type toolUseBlock struct {
+	Type  string          `json:"type"`
+	ID    string          `json:"id"`
+	Name  string          `json:"name"`
+	Input json.RawMessage `json:"input"`
+}
+
+type blockDeltaEvent struct {
+	Type  string      `json:"type"`
+	Index int         `json:"index"`
+	Delta interface{} `json:"delta"`
+}
+
+type textDelta struct {
+	Type string `json:"type"`
+	Text string `json:"text"`
+}
+
+type inputJSONDelta struct {
+	Type        string `json:"type"`
+	PartialJSON string `json:"partial_json"`
+}
+
+type blockStopEvent struct {
+	Type  string `json:"type"`
+	Index int    `json:"index"`
+}
+
+type messageDeltaEvent struct {
+	Type  string `json:"type"`
+	Delta struct {
+		StopReason   string  `json:"stop_reason"`
+		StopSequence *string `json:"stop_sequence"`
+	} `json:"delta"`
+	Usage anthropicUsage `json:"usage"`
+}
+
+type messageStopEvent struct {
+	Type string `json:"type"`
+}
+
+// anthropicToOpenAIStream transcodes Messages events into Chat Completions chunks.
+type anthropicToOpenAIStream struct {
+	includeUsage bool
+	finished     bool
+	id           string
+	model        string
+	created      int64
+	// tools maps Anthropic content block indexes to OpenAI tool call indexes.
+	tools        map[int]int
+	finishReason string
+	usage        anthropicUsage
+}
+
+func newAnthropicToOpenAIStream(includeUsage bool) *anthropicToOpenAIStream {
+	return &anthropicToOpenAIStream{
+		includeUsage: includeUsage,
+		created:      time.Now().Unix(),
+		tools:        make(map[int]int),
+	}
+}
+
+type anthropicStreamEvent struct {
+	Type         string                  `json:"type"`
+	Index        int                     `json:"index"`
+	Message      *anthropicStreamMessage `json:"message"`
+	ContentBlock *anthropicBlock         `json:"content_block"`
+	Delta        *struct {
+		Type        string  `json:"type"`
+		Text        string  `json:"text"`
+		PartialJSON string  `json:"partial_json"`
+		StopReason  *string `json:"stop_reason"`
+	} `json:"delta"`
+	Usage *anthropicUsage `json:"usage"`
+	Error *struct {
+		Type    string `json:"type"`
+		Message string `json:"message"`
+	} `json:"error"`
+}
+
+type anthropicStreamMessage struct {
+	ID    string         `json:"id"`
+	Model string         `json:"model"`
+	Usage anthropicUsage `json:"usage"`
+}
+
+func (s *anthropicToOpenAIStream) event(ev sseEvent, w *sseWriter) error {
+	if s.finished {
+		return nil
+	}
+	var e anthropicStreamEvent
+	if err := json.Unmarshal(ev.data, &e); err != nil {
+		return fmt.Errorf("decode anthropic event: %w", err)
+	}
+	switch e.Type {
+	case "message_start":
+		if e.Message != nil {
+			s.id, s.model = e.Message.ID, e.Message.Model
+			s.usage = e.Message.Usage
+		}
+		empty := ""
+		return s.chunk(w, openAIDelta{Role: "assistant", Content: &empty}, nil)
+	case "content_block_start":
+		if e.ContentBlock == nil || e.ContentBlock.Type != "tool_use" {
+			return nil
+		}
+		idx := len(s.tools)
+		s.tools[e.Index] = idx
+		return s.chunk(w, openAIDelta{ToolCalls: []openAIToolCallDelta{{
+			Index:    idx,
+			ID:       e.ContentBlock.ID,
+			Type:     "function",
+			Function: openAIFunctionCallDelta{Name: e.ContentBlock.Name},
+		}}}, nil)
+	case "content_block_delta":
+		if e.Delta == nil {
+			return nil
+		}
+		switch e.Delta.Type {
+		case "text_delta":
+			text := e.Delta.Text
+			return s.chunk(w, openAIDelta{Content: &text}, nil)
+		case "input_json_delta":
+			idx, ok := s.tools[e.Index]
+			if !ok || e.Delta.PartialJSON == "" {
+				return nil
+			}
+			return s.chunk(w, openAIDelta{ToolCalls: []openAIToolCallDelta{{
+				Index:    idx,
+				Function: openAIFunctionCallDelta{Arguments: e.Delta.PartialJSON},
+			}}}, nil)
+		}
+		return nil
+	case "message_delta":
+		if e.Delta != nil && e.Delta.StopReason != nil {
+			s.finishReason = openAIFinishReason(e.Delta.StopReason)
+		}
+		if e.Usage != nil {
+			s.usage.OutputTokens = e.Usage.OutputTokens
+			if e.Usage.InputTokens > 0 {
+				s.usage.InputTokens = e.Usage.InputTokens
+			}
+		}
+		return nil
+	case "message_stop":
+		return s.finish(w)
+	case "error":
+		s.finished = true
+		message := "upstream stream error"
+		if e.Error != nil && e.Error.Message != "" {
+			message = e.Error.Message
+		}
+		if err := w.sendRaw("", ErrorBody(OpenAI, 500, "", "", message)); err != nil {
+			return err
+		}
+		return w.sendRaw("", doneMarker)
+	default:
+		return nil
+	}
+}
+
+func (s *anthropicToOpenAIStream) chunk(w *sseWriter, delta openAIDelta, finish *string) error {
+	return w.send("", openAIResponse{
+		ID:      s.id,
+		Object:  "chat.completion.chunk",
+		Created: s.created,
+		Model:   s.model,
+		Choices: []openAIChoice{{Index: 0, Delta: &delta, FinishReason: finish}},
+	})
+}
+
+func (s *anthropicToOpenAIStream) finish(w *sseWriter) error {
+	if s.finished {
+		return nil
+	}
+	s.finished = true
+	reason := s.finishReason
+	if reason == "" {
+		reason = "stop"
+	}
+	if err := s.chunk(w, openAIDelta{}, &reason); err != nil {
+		return err
+	}
+	if s.includeUsage {
+		usage := openAIUsageFromAnthropic(s.usage)
+		if err := w.send("", openAIResponse{
+			ID:      s.id,
+			Object:  "chat.completion.chunk",
+			Created: s.created,
+			Model:   s.model,
+			Choices: []openAIChoice{},
+			Usage:   &usage,
+		}); err != nil {
+			return err
+		}
+	}
+	return w.sendRaw("", doneMarker)
+}
+
+// openAIToResponsesStream transcodes Chat Completions chunks into Responses events.
+type openAIToResponsesStream struct {
+	started  bool
+	finished bool
+	seq      int
+	id       string
+	model    string
+	created  int64
+	// output collects the completed items for the final response.
+	output []interface{}
+	// open is the output index of the item currently open, or -1.
+	open     int
+	openKind string
+	// messageID, text and call describe the open item.
+	messageID string
+	text      strings.Builder
+	call      responsesFunctionCall
+	toolCall  int
+
+	finishReason *string
+	usage        *openAIUsage
+}
+
+func newOpenAIToResponsesStream() *openAIToResponsesStream {
+	return &openAIToResponsesStream{open: -1, toolCall: -1, created: time.Now().Unix()}
+}
+
+func (s *openAIToResponsesStream) event(ev sseEvent, w *sseWriter) error {
+	if s.finished {
+		return nil
+	}
+	if bytes.Equal(bytes.TrimSpace(ev.data), doneMarker) {
+		return s.finish(w)
+	}
+	var chunk struct {
+		openAIResponse
+		Error *struct {
+			Message string `json:"message"`
+		} `json:"error"`
+	}
+	if err := json.Unmarshal(ev.data, &chunk); err != nil {
+		return fmt.Errorf("decode openai chunk: %w", err)
+	}
+	if s.id == "" {
+		s.id, s.model = responsesID("resp_", chunk.ID), chunk.Model
+		if chunk.Created > 0 {
+			s.created = chunk.Created
+		}
+	}
+	if err := s.start(w); err != nil {
+		return err
+	}
+	if chunk.Error != nil {
+		s.finished = true
+		res := s.response("failed")
+		res.Error = &responsesError{Code: "server_error", Message: chunk.Error.Message}
+		return s.send(w, responseEvent{Type: "response.failed", SequenceNumber: s.next(), Response: res})
+	}
+	if chunk.Usage != nil {
+		s.usage = chunk.Usage
+	}
+	for _, choice := range chunk.Choices {
+		if d := choice.Delta; d != nil {
+			if d.Content != nil && *d.Content != "" {
+				if err := s.openMessage(w); err != nil {
+					return err
+				}
+				s.text.WriteString(*d.Content)
+				if err := s.send(w, textDeltaEvent{
+					Type:           "response.output_text.delta",
+					SequenceNumber: s.next(),
+					ItemID:         s.messageID,
+					OutputIndex:    s.open,
+					Delta:          *d.Content,
+				}); err != nil {
+					return err
+				}
+			}
+			for _, call := range d.ToolCalls {
+				if call.ID != "" || s.openKind != "function_call" || call.Index != s.toolCall {
+					if err := s.openFunctionCall(w, call); err != nil {
+						return err
+					}
+				}
+				if call.Function.Arguments != "" {
+					s.call.Arguments += call.Function.Arguments
+					if err := s.send(w, argumentsDeltaEvent{
+						Type:           "response.function_call_arguments.delta",
+						SequenceNumber: s.next(),
+						ItemID:         s.call.ID,
+						OutputIndex:    s.open,
+						Delta:          call.Function.Arguments,
+					}); err != nil {
+						return err
+					}
+				}
+			}
+		}
+		if choice.FinishReason != nil {
+			s.finishReason = choice.FinishReason
+		}
+	}
+	return nil
+}
+
+// send writes an event named after its type.
+func (s *openAIToResponsesStream) send(w *sseWriter, ev responsesStreamEvent) error {
+	return w.send(ev.eventType(), ev)
+}
+
+// next returns the sequence number of the next event.
+func (s *openAIToResponsesStream) next() int {
+	s.seq++
+	return s.seq
+}
+
+func (s *openAIToResponsesStream) response(status string) responsesResponse {
+	return responsesResponse{
+		ID:        s.id,
+		Object:    "response",
+		CreatedAt: s.created,
+		Status:    status,
+		Model:     s.model,
+		Output:    []interface{}{},
+	}
+}
+
+func (s *openAIToResponsesStream) start(w *sseWriter) error {
+	if s.started {
+		return nil
+	}
+	s.started = true
+	if err := s.send(w, responseEvent{Type: "response.created", SequenceNumber: s.next(), Response: s.response("in_progress")}); err != nil {
+		return err
+	}
+	return s.send(w, responseEvent{Type: "response.in_progress", SequenceNumber: s.next(), Response: s.response("in_progress")})
+}
+
+func (s *openAIToResponsesStream) openMessage(w *sseWriter) error {
+	if s.openKind == "message" {
+		return nil
+	}
+	if err := s.closeItem(w); err != nil {
+		return err
+	}
+	s.open, s.openKind = len(s.output), "message"
+	s.messageID = fmt.Sprintf("msg_%s_%d", strings.TrimPrefix(s.id, "resp_"), s.open)
+	s.text.Reset()
+	id := s.messageID
+	item := responsesMessage{Type: "message", ID: id, Status: "in_progress", Role: "assistant", Content: []responsesOutputText{}}
+	if err := s.send(w, outputItemEvent{Type: "response.output_item.added", SequenceNumber: s.next(), OutputIndex: s.open, Item: item}); err != nil {
+		return err
+	}
+	return s.send(w, contentPartEvent{Type: "response.content_part.added", SequenceNumber: s.next(), ItemID: id, OutputIndex: s.open, Part: newResponsesOutputText("")})
+}
+
+func (s *openAIToResponsesStream) openFunctionCall(w *sseWriter, call openAIToolCallDelta) error {
+	if err := s.closeItem(w); err != nil {
+		return err
+	}
+	s.open, s.openKind, s.toolCall = len(s.output), "function_call", call.Index
+	s.call = responsesFunctionCall{
+		Type:   "function_call",
+		ID:     responsesID("fc_", call.ID),
+		Status: "in_progress",
+		CallID: call.ID,
+		Name:   call.Function.Name,
+	}
+	return s.send(w, outputItemEvent{Type: "response.output_item.added", SequenceNumber: s.next(), OutputIndex: s.open, Item: s.call})
+}
+
+// closeItem finishes the open item, if any, and records it for the final response.
+func (s *openAIToResponsesStream) closeItem(w *sseWriter) error {
+	var item interface{}
+	switch s.openKind {
+	case "message":
+		id := s.messageID
+		text := s.text.String()
+		if err := s.send(w, textDoneEvent{Type: "response.output_text.done", SequenceNumber: s.next(), ItemID: id, OutputIndex: s.open, Text: text}); err != nil {
+			return err
+		}
+		part := newResponsesOutputText(text)
+		if err := s.send(w, contentPartEvent{Type: "response.content_part.done", SequenceNumber: s.next(), ItemID: id, OutputIndex: s.open, Part: part}); err != nil {
+			return err
+		}
+		item = responsesMessage{Type: "message", ID: id, Status: "completed", Role: "assistant", Content: []responsesOutputText{part}}
+	case "function_call":
+		s.call.Status = "completed"
+		if err := s.send(w, argumentsDoneEvent{
+			Type:           "response.function_call_arguments.done",
+			SequenceNumber: s.next(),
+			ItemID:         s.call.ID,
+			OutputIndex:    s.open,
+			Arguments:      s.call.Arguments,
+		}); err != nil {
+			return err
+		}
+		item = s.call
+	default:
+		return nil
+	}
+	if err := s.send(w, outputItemEvent{Type: "response.output_item.done", SequenceNumber: s.next(), OutputIndex: s.open, Item: item}); err != nil {
+		return err
+	}
+	s.output = append(s.output, item)
+	s.open, s.openKind = -1, ""
+	return nil
+}
+
+func (s *openAIToResponsesStream) finish(w *sseWriter) error {
+	if s.finished {
+		return nil
+	}
+	s.finished = true
+	if err := s.start(w); err != nil {
+		return err
+	}
+	if err := s.closeItem(w); err != nil {
+		return err
+	}
+	status, incomplete := responsesStatus(s.finishReason)
+	res := s.response(status)
+	res.IncompleteDetails = incomplete
+	res.Output = append(res.Output, s.output...)
+	if s.usage != nil {
+		usage := responsesUsageFromOpenAI(*s.usage)
+		res.Usage = &usage
+	}
+	name := "response.completed"
+	if status == "incomplete" {
+		name = "response.incomplete"
+	}
+	return s.send(w, responseEvent{Type: name, SequenceNumber: s.next(), Response: res})
+}
+
+// Responses stream event payloads. Each is written as an event named after its type.
+
+type responsesStreamEvent interface {
+	eventType() string
+}
+
+type responseEvent struct {
+	Type           string            `json:"type"`
+	SequenceNumber int               `json:"sequence_number"`
+	Response       responsesResponse `json:"response"`
+}
+
+type outputItemEvent struct {
+	Type           string      `json:"type"`
+	SequenceNumber int         `json:"sequence_number"`
+	OutputIndex    int         `json:"output_index"`
+	Item           interface{} `json:"item"`
+}
+
+type contentPartEvent struct {
+	Type           string              `json:"type"`
+	SequenceNumber int                 `json:"sequence_number"`
+	ItemID         string              `json:"item_id"`
+	OutputIndex    int                 `json:"output_index"`
+	ContentIndex   int                 `json:"content_index"`
+	Part           responsesOutputText `json:"part"`
+}
+
+type textDeltaEvent struct {
+	Type           string `json:"type"`
+	SequenceNumber int    `json:"sequence_number"`
+	ItemID         string `json:"item_id"`
+	OutputIndex    int    `json:"output_index"`
+	ContentIndex   int    `json:"content_index"`
+	Delta          string `json:"delta"`
+}
+
+type textDoneEvent struct {
+	Type           string `json:"type"`
+	SequenceNumber int    `json:"sequence_number"`
+	ItemID         string `json:"item_id"`
+	OutputIndex    int    `json:"output_index"`
+	ContentIndex   int    `json:"content_index"`
+	Text           string `json:"text"`
+}
+
+type argumentsDeltaEvent struct {
+	Type           string `json:"type"`
+	SequenceNumber int    `json:"sequence_number"`
+	ItemID         string `json:"item_id"`
+	OutputIndex    int    `json:"output_index"`
+	Delta          string `json:"delta"`
+}
+
+type argumentsDoneEvent struct {
+	Type           string `json:"type"`
+	SequenceNumber int    `json:"sequence_number"`
+	ItemID         string `json:"item_id"`
+	OutputIndex    int    `json:"output_index"`
+	Arguments      string `json:"arguments"`
+}
+
+func (e responseEvent) eventType() string       { return e.Type }
+func (e outputItemEvent) eventType() string     { return e.Type }
+func (e contentPartEvent) eventType() string    { return e.Type }
+func (e textDeltaEvent) eventType() string      { return e.Type }
+func (e textDoneEvent) eventType() string       { return e.Type }
+func (e argumentsDeltaEvent) eventType() string { return e.Type }
+func (e argumentsDoneEvent) eventType() string  { return e.Type }
@@ -0,0 +1,90 @@
+package server
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"piapi/internal/config"
+)
+
+// clientKeyQueryParam carries the piapi key for the query credential style, the
+// parameter Gemini clients use.
+const clientKeyQueryParam = "key"
+
+// clientCredentialHeaders are removed from every proxied request, whichever styles
+// are enabled, so that a client's piapi key never reaches an upstream.
+var clientCredentialHeaders = []string{"Authorization", "x-api-key", "x-goog-api-key"}
+
+var errMissingAPIKey = errors.New("missing API key")
+
+// extractAPIKey returns the piapi key from the first of styles that r carries.
+func extractAPIKey(r *http.Request, styles []string) (string, error) {
+	var firstErr error
+	for _, style := range styles {
+		var (
+			key string
+			err error
+		)
+		switch style {
+		case config.ClientAuthBearer:
+			key, err = bearerToken(r.Header.Get("Authorization"))
+		case config.ClientAuthXAPIKey:
+			key = strings.TrimSpace(r.Header.Get("x-api-key"))
+		case config.ClientAuthXGoogAPIKey:
+			key = strings.TrimSpace(r.Header.Get("x-goog-api-key"))
+		case config.ClientAuthQuery:
+			key = strings.TrimSpace(r.URL.Query().Get(clientKeyQueryParam))
+		}
+		if key != "" {
+			return key, nil
+		}
+		if err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+	if firstErr != nil {
+		return "", firstErr
+	}
+	return "", fmt.Errorf("%w (accepted: %s)", errMissingAPIKey, strings.Join(styles, ", "))
+}
+
+// bearerToken parses an Authorization header; an absent header is not an error.
+func bearerToken(header string) (string, error) {
+	if header == "" {
+		return "", nil
+	}
+	if len(header) >= 7 && strings.EqualFold(header[:7], "Bearer ") {
+		token := strings.TrimSpace(header[7:])
+		if token == "" {
+			return "", fmt.Errorf("empty bearer token")
+		}
+		return token, nil
+	}
+	return "", fmt.Errorf("unsupported authorization scheme")
+}
+
+// acceptsQueryKey reports whether styles include the query credential style.
+func acceptsQueryKey(styles []string) bool {
+	for _, style := range styles {
+		if style == config.ClientAuthQuery {
+			return true
+		}
+	}
+	return false
+}
+
+// stripClientKey removes the client key parameter from a raw query string.
+func stripClientKey(rawQuery string) string {
+	if rawQuery == "" {
+		return rawQuery
+	}
+	values, err := url.ParseQuery(rawQuery)
+	if err != nil || !values.Has(clientKeyQueryParam) {
+		return rawQuery
+	}
+	values.Del(clientKeyQueryParam)
+	return values.Encode()
+}
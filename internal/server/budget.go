@@ -0,0 +1,101 @@
+package server
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"piapi/internal/config"
+	"piapi/internal/ledger"
+	"piapi/internal/logging"
+)
+
+// budgetExceededError describes the first exhausted budget found for a request.
+type budgetExceededError struct {
+	user        string
+	serviceType string // empty for the user-wide budget
+	balance     ledger.Balance
+	limit       ledger.Limit
+}
+
+func (e *budgetExceededError) Error() string {
+	scope := fmt.Sprintf("user '%s'", e.user)
+	if e.serviceType != "" {
+		scope += fmt.Sprintf(" service '%s'", e.serviceType)
+	}
+	var used string
+	switch {
+	case e.limit.Tokens > 0 && e.balance.Used.Tokens >= e.limit.Tokens+e.balance.Credit.Tokens:
+		used = fmt.Sprintf("used %d of %d tokens", e.balance.Used.Tokens, e.limit.Tokens+e.balance.Credit.Tokens)
+	default:
+		used = fmt.Sprintf("used %.4f of %.4f cost", e.balance.Used.Cost, e.limit.Cost+e.balance.Credit.Cost)
+	}
+	return fmt.Sprintf("%s budget exhausted for %s: %s, resets at %s",
+		e.balance.Period, scope, used, e.balance.ResetAt.Format(time.RFC3339))
+}
+
+// budgetLimit converts a configured budget limit; nil means no cap.
+func budgetLimit(l *config.BudgetLimit) ledger.Limit {
+	if l == nil {
+		return ledger.Limit{}
+	}
+	return ledger.Limit{Tokens: l.Tokens, Cost: l.Cost}
+}
+
+// checkBudget returns an error when the user-wide or per-service budget of the route's
+// user is exhausted. Without a ledger budgets are not enforced.
+func (g *Gateway) checkBudget(route *config.Route, serviceType string) *budgetExceededError {
+	if g.Ledger == nil || route.User.Name == "" {
+		return nil
+	}
+	scopes := []struct {
+		serviceType string
+		budget      *config.BudgetConfig
+	}{
+		{"", route.User.Budget},
+		{serviceType, route.User.Services[serviceType].Budget},
+	}
+	for _, scope := range scopes {
+		if scope.budget == nil {
+			continue
+		}
+		for _, p := range []struct {
+			period ledger.Period
+			limit  ledger.Limit
+		}{
+			{ledger.Daily, budgetLimit(scope.budget.Daily)},
+			{ledger.Monthly, budgetLimit(scope.budget.Monthly)},
+		} {
+			if p.limit.IsZero() {
+				continue
+			}
+			balance := g.Ledger.Balance(route.User.Name, scope.serviceType, p.period)
+			if balance.Exhausted(p.limit) {
+				return &budgetExceededError{
+					user:        route.User.Name,
+					serviceType: scope.serviceType,
+					balance:     balance,
+					limit:       p.limit,
+				}
+			}
+		}
+	}
+	return nil
+}
+
+func writeBudgetExceeded(w http.ResponseWriter, err *budgetExceededError) {
+	w.Header().Set("Retry-After", strconv.Itoa(retryAfterSeconds(time.Until(err.balance.ResetAt))))
+	http.Error(w, err.Error(), http.StatusTooManyRequests)
+}
+
+// recordUsage adds a completed request's tokens and estimated cost to the ledger.
+func (g *Gateway) recordUsage(user, serviceType string, usage *logging.TokenUsage, cost float64) {
+	if g.Ledger == nil || usage == nil {
+		return
+	}
+	g.Ledger.Record(user, serviceType, ledger.Usage{
+		Tokens: usage.PromptTokens + usage.CompletionTokens,
+		Cost:   cost,
+	})
+}
@@ -0,0 +1,41 @@
+package server
+
+import (
+	"net/http"
+	"strings"
+
+	"piapi/internal/protocol"
+)
+
+// clientProtocol reports which API dialect the client speaks, so that gateway-generated
+// errors can use the error shape its SDK expects. It defaults to OpenAI.
+func clientProtocol(r *http.Request, rest string) string {
+	if r.Header.Get("anthropic-version") != "" {
+		return protocol.Anthropic
+	}
+	// Gemini methods are addressed as models/{model}:generateContent and similar.
+	if r.Header.Get("x-goog-api-key") != "" || strings.Contains(rest, ":") {
+		return protocol.Gemini
+	}
+	// Also covers Anthropic endpoints below /messages, such as count_tokens.
+	for _, segment := range strings.Split(rest, "/") {
+		if segment == "messages" {
+			return protocol.Anthropic
+		}
+	}
+	return protocol.OpenAI
+}
+
+// writeProviderError writes an error body in the client's API dialect. errType is
+// the OpenAI error type; the Anthropic type is derived from the status code.
+func writeProviderError(w http.ResponseWriter, r *http.Request, rest string, status int, errType, code, message string) {
+	writeProtocolError(w, clientProtocol(r, rest), status, errType, code, message)
+}
+
+func writeProtocolError(w http.ResponseWriter, proto string, status int, errType, code, message string) {
+	data := protocol.ErrorBody(proto, status, errType, code, message)
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	w.WriteHeader(status)
+	_, _ = w.Write(data)
+}
@@ -1,11 +1,16 @@
 package server
 
 import (
+	"bytes"
+	"compress/gzip"
+	"context"
 	"errors"
 	"fmt"
+	"io"
 	"net/http"
 	"net/http/httputil"
 	"net/url"
+	"strconv"
 	"strings"
 	"time"
 
@@ -13,16 +18,75 @@ import (
 	"go.uber.org/zap"
 
 	"piapi/internal/config"
+	"piapi/internal/ledger"
 	"piapi/internal/logging"
 	"piapi/internal/metrics"
+	"piapi/internal/protocol"
 )
 
+// defaultRetryBodyLimit caps how much of a request body is buffered for failover replays.
+const defaultRetryBodyLimit = 8 << 20
+
+// errRetryUpstream signals from ModifyResponse that the response was discarded in favour of a retry.
+var errRetryUpstream = errors.New("upstream response discarded for failover")
+
 // Gateway handles incoming piapi requests and proxies them to upstream providers.
 type Gateway struct {
-	Config    *config.Manager
-	BasePath  string
+	Config   *config.Manager
+	BasePath string
+	// Transport, when set, replaces http.DefaultTransport for providers without
+	// transport settings or connection timeouts.
 	Transport http.RoundTripper
 	Logger    *zap.Logger
+	// MaxRetryBodyBytes caps the request body buffered for failover; larger bodies are
+	// streamed through and never retried. Zero selects defaultRetryBodyLimit.
+	MaxRetryBodyBytes int64
+	// Ledger, when set, persists token usage and enforces user budgets.
+	Ledger *ledger.Ledger
+	// WriteTimeout is the write timeout of the server running the gateway. It is
+	// lifted for attempts bounded by their service's total or streamIdle timeout,
+	// so long streams are not cut off, and restored for attempts that are not.
+	WriteTimeout time.Duration
+}
+
+// upstreamAttempt tracks a single proxied call to one candidate.
+type upstreamAttempt struct {
+	route       *config.Route
+	started     time.Time
+	upstreamURL string
+	// model is the model name sent upstream, after aliasing and the service's model map.
+	model      string
+	status     int
+	errMessage string
+	// next, when set, is consulted before a failure is written to the client.
+	// A non-nil route means the failure is swallowed and the request moves on.
+	next      func() *config.Route
+	nextRoute *config.Route
+	// usage parses token counts out of the upstream response.
+	usage *usageTracker
+	// translation, when set, converts the response into the client's protocol.
+	translation *protocol.Translation
+	// timedOut records that the attempt was already reported as an upstream timeout.
+	timedOut bool
+}
+
+func (a *upstreamAttempt) failover() bool {
+	if a.next == nil {
+		return false
+	}
+	a.nextRoute = a.next()
+	return a.nextRoute != nil
+}
+
+func (a *upstreamAttempt) logEntry() logging.UpstreamAttempt {
+	return logging.UpstreamAttempt{
+		Provider:    a.route.Provider.Name,
+		ProviderKey: a.route.UpstreamKeyName,
+		Model:       a.model,
+		StatusCode:  a.status,
+		LatencyMs:   time.Since(a.started).Milliseconds(),
+		Error:       a.errMessage,
+	}
 }
 
 // ServeHTTP implements http.Handler.
@@ -38,11 +102,25 @@ func (g *Gateway) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 		userName        string
 		providerName    string
 		providerKeyName string
+		model           string
+		upstreamModel   string
 		upstreamURL     string
 		errMessage      string
+		attempts        []logging.UpstreamAttempt
+		usage           *logging.TokenUsage
+		pricing         *config.PricingConfig
+		// current is the attempt being proxied. It is still set if the proxy aborted
+		// a response it had started to stream.
+		current *upstreamAttempt
 	)
 
 	defer func() {
+		if current != nil {
+			upstreamURL = current.upstreamURL
+			attempts = append(attempts, current.logEntry())
+			errMessage = current.errMessage
+			usage = current.usage.result()
+		}
 		status := lrw.Status()
 		latency := time.Since(start)
 
@@ -54,29 +132,49 @@ func (g *Gateway) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 			zap.String("service_type", serviceType),
 			zap.String("upstream_provider", providerName),
 			zap.String("upstream_key", providerKeyName),
+			zap.String("model", model),
+			zap.String("upstream_model", upstreamModel),
 			zap.String("upstream_url", upstreamURL),
 			zap.Int("status", status),
 			zap.Duration("latency", latency),
 		}
+		if len(attempts) > 1 {
+			fields = append(fields, zap.Int("attempts", len(attempts)))
+		}
 		if errMessage != "" {
 			fields = append(fields, zap.String("error", errMessage))
 		}
+		var cost float64
+		if usage != nil {
+			cost = pricing.Cost(usage.PromptTokens, usage.CompletionTokens, usage.CacheReadTokens, usage.CacheWriteTokens)
+			g.recordUsage(userName, serviceType, usage, cost)
+			fields = append(fields,
+				zap.Int64("prompt_tokens", usage.PromptTokens),
+				zap.Int64("completion_tokens", usage.CompletionTokens),
+			)
+			metrics.ObserveTokens(serviceType, providerName, usage.PromptTokens, usage.CompletionTokens, usage.CacheReadTokens, usage.CacheWriteTokens)
+		}
 
 		// Record to global request log store for dashboard
 		if logging.GlobalRequestLogStore != nil {
 			logging.GlobalRequestLogStore.Add(logging.RequestLogEntry{
-				Timestamp:   start,
-				RequestID:   requestID,
-				User:        userName,
-				ServiceType: serviceType,
-				Provider:    providerName,
-				ProviderKey: providerKeyName,
-				Method:      r.Method,
-				Path:        r.URL.Path,
-				UpstreamURL: upstreamURL,
-				StatusCode:  status,
-				LatencyMs:   latency.Milliseconds(),
-				Error:       errMessage,
+				Timestamp:     start,
+				RequestID:     requestID,
+				User:          userName,
+				ServiceType:   serviceType,
+				Provider:      providerName,
+				ProviderKey:   providerKeyName,
+				Model:         model,
+				UpstreamModel: upstreamModel,
+				Method:        r.Method,
+				Path:          r.URL.Path,
+				UpstreamURL:   upstreamURL,
+				StatusCode:    status,
+				LatencyMs:     latency.Milliseconds(),
+				Error:         errMessage,
+				Attempts:      attempts,
+				Usage:         usage,
+				Cost:          cost,
 			})
 		}
 
@@ -106,12 +204,20 @@ func (g *Gateway) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	apiKey, err := extractAPIKey(r.Header.Get("Authorization"))
+	authStyles := config.DefaultClientAuthStyles
+	if g.Config != nil {
+		authStyles = g.Config.ClientAuthStyles(serviceType)
+	}
+	apiKey, err := extractAPIKey(r, authStyles)
 	if err != nil {
 		errMessage = err.Error()
-		http.Error(lrw, errMessage, http.StatusUnauthorized)
+		writeProviderError(lrw, r, rest, http.StatusUnauthorized, "invalid_request_error", "invalid_api_key", errMessage)
 		return
 	}
+	clientQuery := r.URL.RawQuery
+	if acceptsQueryKey(authStyles) {
+		clientQuery = stripClientKey(clientQuery)
+	}
 
 	if g.Config == nil {
 		errMessage = config.ErrConfigNotLoaded.Error()
@@ -119,50 +225,305 @@ func (g *Gateway) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	route, err := g.Config.Resolve(apiKey, serviceType)
+	release, err := g.Config.AcquireRateLimit(apiKey, serviceType)
 	if err != nil {
 		errMessage = err.Error()
-		switch {
-		case errors.Is(err, config.ErrUserNotFound):
-			http.Error(lrw, http.StatusText(http.StatusUnauthorized), http.StatusUnauthorized)
-		case errors.Is(err, config.ErrServiceNotFound):
-			http.Error(lrw, http.StatusText(http.StatusNotFound), http.StatusNotFound)
-		case errors.Is(err, config.ErrNoActiveUpstream):
-			http.Error(lrw, http.StatusText(http.StatusServiceUnavailable), http.StatusServiceUnavailable)
-		case errors.Is(err, config.ErrAPIKeyRequired), errors.Is(err, config.ErrServiceTypeRequired):
-			http.Error(lrw, http.StatusText(http.StatusBadRequest), http.StatusBadRequest)
-		default:
-			http.Error(lrw, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		var limited *config.RateLimitError
+		if errors.As(err, &limited) {
+			userName = limited.User
+			metrics.ObserveRateLimited(serviceType, limited.Limit)
 		}
+		writeRouteError(lrw, r, rest, err)
 		return
 	}
+	defer release()
 
-	userName = route.User.Name
-	providerName = route.Provider.Name
-	providerKeyName = route.UpstreamKeyName
+	body, replayable, err := bufferRequestBody(r, g.retryBodyLimit())
+	if err != nil {
+		errMessage = fmt.Sprintf("read request body: %v", err)
+		http.Error(lrw, "failed to read request body", http.StatusBadRequest)
+		return
+	}
+	model = requestModel(r, body)
 
-	target, err := url.Parse(route.Service.BaseURL)
+	route, err := g.Config.ResolveWithOptions(apiKey, serviceType, config.ResolveOptions{Model: model, Context: r.Context(), Header: r.Header, Body: body})
 	if err != nil {
-		errMessage = fmt.Sprintf("invalid base url: %v", err)
-		http.Error(lrw, "invalid upstream configuration", http.StatusInternalServerError)
+		errMessage = err.Error()
+		var unsupported *config.ModelNotSupportedError
+		if errors.As(err, &unsupported) {
+			userName = unsupported.User
+			writeProviderError(lrw, r, rest, http.StatusNotFound, "invalid_request_error", "model_not_found",
+				fmt.Sprintf("The model '%s' is not available for service '%s' on this gateway.", model, serviceType))
+			return
+		}
+		writeRouteError(lrw, r, rest, err)
 		return
 	}
 
-	if target.Scheme == "" || target.Host == "" {
-		errMessage = "invalid upstream configuration: missing scheme or host"
-		http.Error(lrw, "invalid upstream configuration", http.StatusInternalServerError)
+	// Attempts release their key's slot as they finish; this covers the attempt
+	// that is abandoned before reaching the upstream.
+	defer func() { route.Release() }()
+	userName = route.User.Name
+
+	if exceeded := g.checkBudget(route, serviceType); exceeded != nil {
+		errMessage = exceeded.Error()
+		writeBudgetExceeded(lrw, exceeded)
 		return
 	}
 
-	reqLogger := logger.With(
-		zap.String("request_id", requestID),
-		zap.String("user", userName),
-		zap.String("service_type", serviceType),
-		zap.String("upstream_provider", providerName),
-	)
+	maxAttempts := route.Failover.MaxAttempts
+	if !replayable {
+		maxAttempts = 1
+	}
+	deadline := route.Failover.Deadline.Std()
+	tried := make([]string, 0, maxAttempts)
+	clientProto := protocol.Detect(r.Method, rest)
+
+	for {
+		providerName = route.Provider.Name
+		providerKeyName = route.UpstreamKeyName
+		pricing = route.Service.Pricing
+		tried = append(tried, route.CandidateID())
+
+		target, err := url.Parse(route.Service.BaseURL)
+		if err != nil {
+			errMessage = fmt.Sprintf("invalid base url: %v", err)
+			http.Error(lrw, "invalid upstream configuration", http.StatusInternalServerError)
+			return
+		}
 
-	proxy := g.buildProxy(target, route, rest, r.URL.RawQuery, reqLogger, &errMessage, &upstreamURL)
-	proxy.ServeHTTP(lrw, r)
+		if target.Scheme == "" || target.Host == "" {
+			errMessage = "invalid upstream configuration: missing scheme or host"
+			http.Error(lrw, "invalid upstream configuration", http.StatusInternalServerError)
+			return
+		}
+
+		reqLogger := logger.With(
+			zap.String("request_id", requestID),
+			zap.String("user", userName),
+			zap.String("service_type", serviceType),
+			zap.String("upstream_provider", providerName),
+		)
+
+		attempt := &upstreamAttempt{route: route, started: time.Now(), model: route.UpstreamModel}
+		if len(tried) < maxAttempts {
+			attempt.next = func() *config.Route {
+				if r.Context().Err() != nil {
+					return nil
+				}
+				if deadline > 0 && time.Since(start) >= deadline {
+					return nil
+				}
+				next, err := g.Config.ResolveWithOptions(apiKey, serviceType, config.ResolveOptions{Exclude: tried, Model: model, Context: r.Context(), Header: r.Header, Body: body})
+				if err != nil {
+					return nil
+				}
+				return next
+			}
+		}
+		upstreamModel = route.UpstreamModel
+		attemptBody := body
+		if upstreamModel != model {
+			if rewritten, ok := rewriteModel(body, upstreamModel); ok {
+				attemptBody = rewritten
+			}
+		}
+		upstreamRest, rawQuery := rest, clientQuery
+		upstreamProto := route.Service.Protocol
+		if clientProto == protocol.Responses && !route.Service.ChatOnly {
+			// Only chat-only upstreams lack the Responses API among OpenAI ones, which
+			// serve it natively. Anthropic upstreams have none and cannot be reached.
+			if upstreamProto == protocol.Anthropic {
+				errMessage = fmt.Sprintf("provider '%s' serves the Anthropic Messages API, which cannot handle Responses API requests", providerName)
+				writeProviderError(lrw, r, rest, http.StatusBadRequest, "invalid_request_error", "", errMessage)
+				return
+			}
+			upstreamProto = protocol.Responses
+		}
+		if translation := protocol.New(clientProto, upstreamProto); translation != nil {
+			if !replayable {
+				errMessage = "request body too large for protocol translation"
+				writeProviderError(lrw, r, rest, http.StatusRequestEntityTooLarge, "invalid_request_error", "", errMessage)
+				return
+			}
+			translated, err := translation.Request(attemptBody)
+			if err != nil {
+				errMessage = err.Error()
+				writeProviderError(lrw, r, rest, http.StatusBadRequest, "invalid_request_error", "", err.Error())
+				return
+			}
+			attemptBody = translated
+			attempt.translation = translation
+			// Client query parameters belong to the client's API and are dropped.
+			upstreamRest, rawQuery = protocol.Endpoint(translation.Upstream()), ""
+		}
+		if replayable {
+			resetRequestBody(r, attemptBody)
+		} else {
+			prependRequestBody(r, attemptBody, len(body))
+		}
+
+		g.setWriteDeadline(w, start, route.Service.Timeouts)
+		ctx, cancel := attemptContext(r.Context(), route.Service.Timeouts)
+		proxy := g.buildProxy(target, upstreamRest, rawQuery, reqLogger, attempt, cancel)
+		current = attempt
+		func() {
+			defer route.Release()
+			defer cancel(nil)
+			proxy.ServeHTTP(lrw, r.WithContext(ctx))
+		}()
+		current = nil
+
+		upstreamURL = attempt.upstreamURL
+		attempts = append(attempts, attempt.logEntry())
+		if attempt.nextRoute == nil {
+			errMessage = attempt.errMessage
+			usage = attempt.usage.result()
+			return
+		}
+
+		reqLogger.Warn("failing over to next upstream candidate",
+			zap.String("failed_key", providerKeyName),
+			zap.Int("failed_status", attempt.status),
+			zap.String("next_provider", attempt.nextRoute.Provider.Name),
+			zap.String("next_key", attempt.nextRoute.UpstreamKeyName),
+		)
+		route = attempt.nextRoute
+	}
+}
+
+// writeRouteError maps rate limiting and routing errors from the config manager to
+// client responses. Unknown keys are reported in the client's error shape, so SDKs
+// surface them as authentication errors.
+func writeRouteError(w http.ResponseWriter, r *http.Request, rest string, err error) {
+	var limited *config.RateLimitError
+	switch {
+	case errors.As(err, &limited):
+		w.Header().Set("Retry-After", strconv.Itoa(retryAfterSeconds(limited.RetryAfter)))
+		http.Error(w, http.StatusText(http.StatusTooManyRequests), http.StatusTooManyRequests)
+	case errors.Is(err, config.ErrUserNotFound):
+		writeProviderError(w, r, rest, http.StatusUnauthorized, "invalid_request_error", "invalid_api_key", "Invalid API key.")
+	case errors.Is(err, config.ErrServiceNotFound):
+		http.Error(w, http.StatusText(http.StatusNotFound), http.StatusNotFound)
+	case errors.Is(err, config.ErrUpstreamBusy):
+		w.Header().Set("Retry-After", "1")
+		http.Error(w, http.StatusText(http.StatusServiceUnavailable), http.StatusServiceUnavailable)
+	case errors.Is(err, config.ErrNoActiveUpstream):
+		http.Error(w, http.StatusText(http.StatusServiceUnavailable), http.StatusServiceUnavailable)
+	case errors.Is(err, config.ErrAPIKeyRequired), errors.Is(err, config.ErrServiceTypeRequired):
+		http.Error(w, http.StatusText(http.StatusBadRequest), http.StatusBadRequest)
+	default:
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+	}
+}
+
+// retryAfterSeconds rounds a wait up to whole seconds, as Retry-After requires.
+func retryAfterSeconds(d time.Duration) int {
+	secs := int((d + time.Second - 1) / time.Second)
+	if secs < 1 {
+		secs = 1
+	}
+	return secs
+}
+
+func (g *Gateway) retryBodyLimit() int64 {
+	if g.MaxRetryBodyBytes > 0 {
+		return g.MaxRetryBodyBytes
+	}
+	return defaultRetryBodyLimit
+}
+
+// bufferRequestBody reads up to limit bytes of the request body so it can be replayed
+// on another candidate. When the body is larger, body holds the consumed prefix,
+// replayable is false and the caller must put the prefix back with
+// prependRequestBody before proxying.
+func bufferRequestBody(r *http.Request, limit int64) (body []byte, replayable bool, err error) {
+	if r.Body == nil || r.Body == http.NoBody {
+		return nil, true, nil
+	}
+	buf, err := io.ReadAll(io.LimitReader(r.Body, limit+1))
+	if err != nil {
+		return nil, false, err
+	}
+	if int64(len(buf)) > limit {
+		return buf, false, nil
+	}
+	_ = r.Body.Close()
+	resetRequestBody(r, buf)
+	return buf, true, nil
+}
+
+// resetRequestBody rewinds the request to a fresh reader over body before each attempt.
+func resetRequestBody(r *http.Request, body []byte) {
+	if body == nil {
+		r.Body = http.NoBody
+		r.ContentLength = 0
+		r.GetBody = nil
+		return
+	}
+	r.Body = io.NopCloser(bytes.NewReader(body))
+	r.ContentLength = int64(len(body))
+	r.GetBody = func() (io.ReadCloser, error) {
+		return io.NopCloser(bytes.NewReader(body)), nil
+	}
+}
+
+// prependRequestBody stitches a (possibly rewritten) prefix back in front of the
+// unread remainder of a body too large to buffer. consumed is the length of the
+// prefix as originally read.
+func prependRequestBody(r *http.Request, prefix []byte, consumed int) {
+	r.Body = struct {
+		io.Reader
+		io.Closer
+	}{io.MultiReader(bytes.NewReader(prefix), r.Body), r.Body}
+	if r.ContentLength > 0 {
+		r.ContentLength += int64(len(prefix) - consumed)
+	}
+}
+
+// isRetryableStatus reports whether an upstream status may be retried on another
+// candidate. 401 and 429 apply to the key that received them, so another key may
+// succeed. A 403 is retried only when rejectsKey says so.
+func isRetryableStatus(status int) bool {
+	switch status {
+	case http.StatusUnauthorized, http.StatusTooManyRequests:
+		return true
+	}
+	return status >= 500
+}
+
+// maxAuthErrorBodyBytes caps how much of a 403 response is read to classify it.
+const maxAuthErrorBodyBytes = 64 << 10
+
+// rejectsKey reports whether a 403 response says the upstream rejected the key
+// itself rather than the request. The part of the body it reads is put back.
+func rejectsKey(res *http.Response) bool {
+	if res.Body == nil || res.Body == http.NoBody {
+		return false
+	}
+	peeked, err := io.ReadAll(io.LimitReader(res.Body, maxAuthErrorBodyBytes))
+	res.Body = struct {
+		io.Reader
+		io.Closer
+	}{io.MultiReader(bytes.NewReader(peeked), res.Body), res.Body}
+	if err != nil {
+		return false
+	}
+	switch strings.ToLower(strings.TrimSpace(res.Header.Get("Content-Encoding"))) {
+	case "", "identity":
+	case "gzip":
+		zr, err := gzip.NewReader(bytes.NewReader(peeked))
+		if err != nil {
+			return false
+		}
+		// A body cut off at the cap fails to decode, which is not an auth error.
+		if peeked, err = io.ReadAll(io.LimitReader(zr, maxAuthErrorBodyBytes)); err != nil {
+			return false
+		}
+	default:
+		return false
+	}
+	return config.IsAuthErrorBody(peeked)
 }
 
 func (g *Gateway) basePath() string {
@@ -191,27 +552,28 @@ func extractServiceType(path, base string) (serviceType, rest string, err error)
 	return serviceType, rest, nil
 }
 
-func extractAPIKey(header string) (string, error) {
-	if header == "" {
-		return "", fmt.Errorf("missing Authorization header")
-	}
-	if len(header) >= 7 && strings.EqualFold(header[:7], "Bearer ") {
-		token := strings.TrimSpace(header[7:])
-		if token == "" {
-			return "", fmt.Errorf("empty bearer token")
-		}
-		return token, nil
-	}
-	return "", fmt.Errorf("unsupported authorization scheme")
-}
-
-func (g *Gateway) buildProxy(target *url.URL, route *config.Route, rest string, originalRawQuery string, logger *zap.Logger, errMsg *string, upstreamURL *string) *httputil.ReverseProxy {
+// buildProxy builds the reverse proxy for one attempt. cancel cancels the context
+// the attempt's request is served with.
+func (g *Gateway) buildProxy(target *url.URL, rest string, originalRawQuery string, logger *zap.Logger, attempt *upstreamAttempt, cancel context.CancelCauseFunc) *httputil.ReverseProxy {
+	route := attempt.route
+	timeouts := route.Service.Timeouts
 	director := func(req *http.Request) {
 		req.URL.Scheme = target.Scheme
 		req.URL.Host = target.Host
 		req.Host = target.Host
 
-		req.Header.Del("Authorization")
+		for _, name := range clientCredentialHeaders {
+			req.Header.Del(name)
+		}
+		for _, name := range clientOnlyHeaders {
+			req.Header.Del(name)
+		}
+		if attempt.translation != nil {
+			attempt.translation.PrepareHeader(req.Header)
+		}
+		// The policy runs before the upstream credential is set, so it can never
+		// replace or remove it.
+		applyRequestHeaders(req.Header, route, RequestIDFromContext(req.Context()))
 
 		path := joinPaths(target.Path, rest)
 		req.URL.Path = path
@@ -234,30 +596,105 @@ func (g *Gateway) buildProxy(target *url.URL, route *config.Route, rest string,
 			req.Header.Set("Authorization", "Bearer "+route.UpstreamKeyValue)
 		}
 
-		if upstreamURL != nil {
-			*upstreamURL = req.URL.String()
+		if auth != nil && auth.Mode == config.AuthModeQuery {
+			attempt.upstreamURL = logging.GlobalRedactor.RedactURL(req.URL.String(), auth.Name)
+		} else {
+			attempt.upstreamURL = logging.GlobalRedactor.Redact(req.URL.String())
 		}
 	}
 
-	proxy := &httputil.ReverseProxy{Director: director}
-	if g.Transport != nil {
-		proxy.Transport = g.Transport
+	proxy := &httputil.ReverseProxy{Director: director, Transport: g.Transport}
+	if route.Transport != nil {
+		proxy.Transport = route.Transport
 	}
 	// Report final response status back to config manager for health tracking
-	if g.Config != nil {
-		proxy.ModifyResponse = func(res *http.Response) error {
-			g.Config.ReportResult(route.User.APIKey, route.Service.Type, route.Provider.Name, route.UpstreamKeyName, res.StatusCode, nil)
-			return nil
+	proxy.ModifyResponse = func(res *http.Response) error {
+		attempt.status = res.StatusCode
+		var authErr error
+		report := func(status int, err error) {
+			if g.Config != nil {
+				g.Config.ReportResult(route.UserID, route.Service.Type, route.Provider.Name, route.UpstreamKeyName, status, err)
+			}
+		}
+		if boundsResponse(timeouts) {
+			// The body may still time out, so the result is reported once it is done:
+			// as the timeout that cut it off, or else with the response status. For a
+			// translated response this can run on the translation goroutine; closing
+			// the body waits for it to exit, and the proxy does so before attempt is
+			// read again.
+			wrapTimeoutBody(res, timeouts.StreamIdle.Std(), cancel, func(err error) {
+				if err == nil {
+					report(res.StatusCode, authErr)
+					return
+				}
+				attempt.timedOut = true
+				attempt.errMessage = err.Error()
+				logger.Warn("upstream response timed out", zap.Error(err))
+				report(0, err)
+			})
+		}
+		if res.StatusCode == http.StatusForbidden && rejectsKey(res) {
+			authErr = config.ErrUpstreamAuth
 		}
+		retryable := isRetryableStatus(res.StatusCode) || authErr != nil
+		if !boundsResponse(timeouts) {
+			report(res.StatusCode, authErr)
+		}
+		if g.Config != nil {
+			g.Config.ReportRateLimits(route.Service.Type, route.Provider.Name, route.UpstreamKeyName, res.StatusCode, res.Header)
+			if !retryable {
+				g.Config.ReportLatency(route.Service.Type, route.Provider.Name, route.UpstreamKeyName, time.Since(attempt.started))
+			}
+		}
+		if retryable {
+			attempt.errMessage = fmt.Sprintf("upstream status %d", res.StatusCode)
+			if attempt.failover() {
+				return errRetryUpstream
+			}
+		}
+		if tracker := newUsageTracker(res); tracker != nil {
+			attempt.usage = tracker
+			tracker.wrap(res)
+		}
+		if attempt.translation != nil {
+			if err := attempt.translation.Response(res); err != nil {
+				return err
+			}
+		}
+		applyResponseHeaders(res.Header, route, RequestIDFromContext(res.Request.Context()))
+		return nil
 	}
 
 	proxy.ErrorHandler = func(rw http.ResponseWriter, req *http.Request, err error) {
-		if errMsg != nil {
-			*errMsg = fmt.Sprintf("proxy error: %v", err)
+		if errors.Is(err, errRetryUpstream) {
+			return
 		}
+		if timeout := upstreamTimeout(req, err); timeout != nil {
+			attempt.errMessage = timeout.Error()
+			logger.Warn("upstream request timed out", zap.Error(timeout))
+			if g.Config != nil && !attempt.timedOut {
+				g.Config.ReportResult(route.UserID, route.Service.Type, route.Provider.Name, route.UpstreamKeyName, 0, timeout)
+			}
+			if attempt.failover() {
+				return
+			}
+			http.Error(rw, "upstream request timed out", http.StatusGatewayTimeout)
+			return
+		}
+		if errors.Is(err, protocol.ErrTranslate) {
+			// The upstream answered; only its response could not be converted.
+			attempt.errMessage = err.Error()
+			logger.Warn("failed to translate upstream response", zap.Error(err))
+			writeProtocolError(rw, attempt.translation.Client(), http.StatusBadGateway, "server_error", "", "upstream response could not be translated")
+			return
+		}
+		attempt.errMessage = fmt.Sprintf("proxy error: %v", err)
 		logger.Warn("upstream proxy error", zap.Error(err))
 		if g.Config != nil {
-			g.Config.ReportResult(route.User.APIKey, route.Service.Type, route.Provider.Name, route.UpstreamKeyName, 0, err)
+			g.Config.ReportResult(route.UserID, route.Service.Type, route.Provider.Name, route.UpstreamKeyName, 0, err)
+		}
+		if attempt.failover() {
+			return
 		}
 		http.Error(rw, "upstream request failed", http.StatusBadGateway)
 	}
@@ -3,12 +3,15 @@ package server
 import (
 	"bytes"
 	"context"
+	"encoding/json"
+	"encoding/pem"
 	"errors"
 	"fmt"
 	"io"
 	"net"
 	"net/http"
 	"net/http/httptest"
+	"net/url"
 	"os"
 	"path/filepath"
 	"strings"
@@ -18,6 +21,8 @@ import (
 	"go.uber.org/zap"
 
 	"piapi/internal/config"
+	"piapi/internal/ledger"
+	"piapi/internal/logging"
 	"piapi/internal/metrics"
 )
 
@@ -124,6 +129,10 @@ users:
 	if body := rr.Body.String(); body != "ok" {
 		t.Fatalf("unexpected body: %s", body)
 	}
+	logs := logging.GlobalRequestLogStore.Query(logging.QueryOptions{User: "tester", Limit: 1})
+	if len(logs) != 1 || !strings.HasSuffix(logs[0].UpstreamURL, "?api_key=****") {
+		t.Fatalf("expected the query credential masked in the request log, got %+v", logs)
+	}
 }
 
 func TestGatewayRejectsMissingAuth(t *testing.T) {
@@ -416,3 +425,1846 @@ users:
 		t.Fatalf("expected upstream2 hit after config reload")
 	}
 }
+
+func TestGatewayFailsOverToNextCandidate(t *testing.T) {
+	var failingHits int
+	failing := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		failingHits++
+		body, _ := io.ReadAll(r.Body)
+		if string(body) != `{"prompt":"hi"}` {
+			t.Errorf("unexpected body on first attempt: %s", body)
+		}
+		http.Error(w, "overloaded", http.StatusServiceUnavailable)
+	}))
+	defer failing.Close()
+
+	healthy := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		if string(body) != `{"prompt":"hi"}` {
+			t.Errorf("request body not replayed: %s", body)
+		}
+		if r.Header.Get("Authorization") != "Bearer key-b" {
+			t.Errorf("unexpected auth header on failover: %s", r.Header.Get("Authorization"))
+		}
+		w.WriteHeader(http.StatusOK)
+		_, _ = w.Write([]byte("saved"))
+	}))
+	defer healthy.Close()
+
+	yaml := fmt.Sprintf(`
+providers:
+  - name: alpha
+    apiKeys:
+      a: key-a
+    services:
+      - type: codex
+        baseUrl: %s
+  - name: beta
+    apiKeys:
+      b: key-b
+    services:
+      - type: codex
+        baseUrl: %s
+users:
+  - name: failover-user
+    apiKey: user-key
+    services:
+      codex:
+        strategy: round_robin
+        candidates:
+          - providerName: alpha
+            providerKeyName: a
+          - providerName: beta
+            providerKeyName: b
+`, failing.URL, healthy.URL)
+
+	manager := config.NewManager()
+	if err := manager.LoadFromFile(writeTempConfig(t, yaml)); err != nil {
+		t.Fatalf("load config: %v", err)
+	}
+	gateway := &Gateway{Config: manager}
+
+	req := httptest.NewRequest(http.MethodPost, "/piapi/codex/chat", strings.NewReader(`{"prompt":"hi"}`))
+	req.Header.Set("Authorization", "Bearer user-key")
+	rr := httptest.NewRecorder()
+	gateway.ServeHTTP(rr, req)
+
+	if rr.Code != http.StatusOK || rr.Body.String() != "saved" {
+		t.Fatalf("expected failover success, got %d %q", rr.Code, rr.Body.String())
+	}
+	if failingHits != 1 {
+		t.Fatalf("expected one hit on failing upstream, got %d", failingHits)
+	}
+
+	stats, err := manager.RuntimeStatus("user-key", "codex")
+	if err != nil {
+		t.Fatalf("runtime status: %v", err)
+	}
+	for _, s := range stats {
+		if s.TotalRequests != 1 {
+			t.Fatalf("expected each attempt reported once, got %+v", s)
+		}
+	}
+
+	logs := logging.GlobalRequestLogStore.Query(logging.QueryOptions{User: "failover-user", Limit: 1})
+	if len(logs) != 1 {
+		t.Fatalf("expected request log entry, got %d", len(logs))
+	}
+	entry := logs[0]
+	if len(entry.Attempts) != 2 {
+		t.Fatalf("expected 2 attempts logged, got %+v", entry.Attempts)
+	}
+	if entry.Attempts[0].Provider != "alpha" || entry.Attempts[0].StatusCode != http.StatusServiceUnavailable {
+		t.Fatalf("unexpected first attempt: %+v", entry.Attempts[0])
+	}
+	if entry.Attempts[1].Provider != "beta" || entry.Attempts[1].StatusCode != http.StatusOK {
+		t.Fatalf("unexpected second attempt: %+v", entry.Attempts[1])
+	}
+	if entry.Provider != "beta" || entry.Error != "" {
+		t.Fatalf("unexpected final entry: %+v", entry)
+	}
+}
+
+func TestGatewayFailsOverOnConnectionError(t *testing.T) {
+	dead := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	deadURL := dead.URL
+	dead.Close()
+
+	healthy := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer healthy.Close()
+
+	yaml := fmt.Sprintf(`
+providers:
+  - name: alpha
+    apiKeys:
+      a: key-a
+    services:
+      - type: codex
+        baseUrl: %s
+  - name: beta
+    apiKeys:
+      b: key-b
+    services:
+      - type: codex
+        baseUrl: %s
+users:
+  - name: tester
+    apiKey: user-key
+    services:
+      codex:
+        strategy: sticky_healthy
+        candidates:
+          - providerName: alpha
+            providerKeyName: a
+          - providerName: beta
+            providerKeyName: b
+`, deadURL, healthy.URL)
+
+	manager := config.NewManager()
+	if err := manager.LoadFromFile(writeTempConfig(t, yaml)); err != nil {
+		t.Fatalf("load config: %v", err)
+	}
+	gateway := &Gateway{Config: manager}
+
+	req := httptest.NewRequest(http.MethodGet, "/piapi/codex/models", nil)
+	req.Header.Set("Authorization", "Bearer user-key")
+	rr := httptest.NewRecorder()
+	gateway.ServeHTTP(rr, req)
+
+	if rr.Code != http.StatusOK {
+		t.Fatalf("expected failover after connection error, got %d", rr.Code)
+	}
+}
+
+func TestGatewayFailoverRespectsMaxAttempts(t *testing.T) {
+	var hits int
+	failing := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		hits++
+		http.Error(w, "upstream exploded", http.StatusInternalServerError)
+	}))
+	defer failing.Close()
+
+	yaml := fmt.Sprintf(`
+providers:
+  - name: alpha
+    apiKeys:
+      a: key-a
+      b: key-b
+    services:
+      - type: codex
+        baseUrl: %s
+users:
+  - name: tester
+    apiKey: user-key
+    services:
+      codex:
+        strategy: round_robin
+        failover:
+          maxAttempts: 1
+        candidates:
+          - providerName: alpha
+            providerKeyName: a
+          - providerName: alpha
+            providerKeyName: b
+`, failing.URL)
+
+	manager := config.NewManager()
+	if err := manager.LoadFromFile(writeTempConfig(t, yaml)); err != nil {
+		t.Fatalf("load config: %v", err)
+	}
+	gateway := &Gateway{Config: manager}
+
+	req := httptest.NewRequest(http.MethodGet, "/piapi/codex/models", nil)
+	req.Header.Set("Authorization", "Bearer user-key")
+	rr := httptest.NewRecorder()
+	gateway.ServeHTTP(rr, req)
+
+	if rr.Code != http.StatusInternalServerError {
+		t.Fatalf("expected upstream status passed through, got %d", rr.Code)
+	}
+	if !strings.Contains(rr.Body.String(), "upstream exploded") {
+		t.Fatalf("expected upstream body passed through, got %q", rr.Body.String())
+	}
+	if hits != 1 {
+		t.Fatalf("expected a single attempt, got %d", hits)
+	}
+}
+
+func TestGatewayRecordsStreamedTokenUsage(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/event-stream")
+		flusher := w.(http.Flusher)
+		_, _ = io.WriteString(w, "event: message_start\ndata: {\"type\":\"message_start\",\"message\":{\"usage\":{\"input_tokens\":11,\"output_tokens\":1}}}\n\n")
+		flusher.Flush()
+		_, _ = io.WriteString(w, "event: message_delta\ndata: {\"type\":\"message_delta\",\"usage\":{\"output_tokens\":21}}\n\n")
+		flusher.Flush()
+	}))
+	defer upstream.Close()
+
+	yaml := fmt.Sprintf(`
+providers:
+  - name: anthropic
+    apiKeys:
+      main: upstream-key
+    services:
+      - type: claude
+        baseUrl: %s
+users:
+  - name: usage-user
+    apiKey: user-key
+    services:
+      claude:
+        providerName: anthropic
+        providerKeyName: main
+`, upstream.URL)
+
+	manager := config.NewManager()
+	if err := manager.LoadFromFile(writeTempConfig(t, yaml)); err != nil {
+		t.Fatalf("load config: %v", err)
+	}
+	gateway := &Gateway{Config: manager}
+
+	req := httptest.NewRequest(http.MethodPost, "/piapi/claude/v1/messages", strings.NewReader(`{"stream":true}`))
+	req.Header.Set("Authorization", "Bearer user-key")
+	rr := httptest.NewRecorder()
+	gateway.ServeHTTP(rr, req)
+
+	if rr.Code != http.StatusOK || !strings.Contains(rr.Body.String(), "message_delta") {
+		t.Fatalf("unexpected stream response: %d %q", rr.Code, rr.Body.String())
+	}
+
+	logs := logging.GlobalRequestLogStore.Query(logging.QueryOptions{User: "usage-user", Limit: 1})
+	if len(logs) != 1 || logs[0].Usage == nil {
+		t.Fatalf("expected usage on request log entry, got %+v", logs)
+	}
+	if got := *logs[0].Usage; got.PromptTokens != 11 || got.CompletionTokens != 21 {
+		t.Fatalf("unexpected usage: %+v", got)
+	}
+
+	metricsRR := httptest.NewRecorder()
+	metrics.Handler().ServeHTTP(metricsRR, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+	if !strings.Contains(metricsRR.Body.String(), `piapi_tokens_total{provider="anthropic",service_type="claude",type="completion"} 21`) {
+		t.Fatalf("expected completion token counter in metrics output")
+	}
+}
+
+func TestGatewayRateLimitReturns429WithRetryAfter(t *testing.T) {
+	var hits int
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		hits++
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer upstream.Close()
+
+	yaml := fmt.Sprintf(`
+providers:
+  - name: upstream
+    apiKeys:
+      main: upstream-key
+    services:
+      - type: codex
+        baseUrl: %s
+users:
+  - name: limited-user
+    apiKey: user-key
+    services:
+      codex:
+        providerName: upstream
+        providerKeyName: main
+        rateLimit:
+          requestsPerMinute: 1
+`, upstream.URL)
+
+	manager := config.NewManager()
+	if err := manager.LoadFromFile(writeTempConfig(t, yaml)); err != nil {
+		t.Fatalf("load config: %v", err)
+	}
+	gateway := &Gateway{Config: manager}
+
+	send := func() *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodPost, "/piapi/codex/chat", strings.NewReader(`{}`))
+		req.Header.Set("Authorization", "Bearer user-key")
+		rr := httptest.NewRecorder()
+		gateway.ServeHTTP(rr, req)
+		return rr
+	}
+
+	if rr := send(); rr.Code != http.StatusOK {
+		t.Fatalf("expected first request to pass, got %d", rr.Code)
+	}
+	rr := send()
+	if rr.Code != http.StatusTooManyRequests {
+		t.Fatalf("expected 429, got %d", rr.Code)
+	}
+	if got := rr.Header().Get("Retry-After"); got == "" || got == "0" {
+		t.Fatalf("expected Retry-After header, got %q", got)
+	}
+	if hits != 1 {
+		t.Fatalf("expected rejected request not to reach upstream, got %d hits", hits)
+	}
+
+	logs := logging.GlobalRequestLogStore.Query(logging.QueryOptions{User: "limited-user", Limit: 1})
+	if len(logs) != 1 || logs[0].StatusCode != http.StatusTooManyRequests {
+		t.Fatalf("expected rejected request logged for user, got %+v", logs)
+	}
+}
+
+func TestGatewayEnforcesTokenBudget(t *testing.T) {
+	var hits int
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		hits++
+		w.Header().Set("Content-Type", "application/json")
+		_, _ = io.WriteString(w, `{"usage":{"prompt_tokens":1000000,"completion_tokens":500000}}`)
+	}))
+	defer upstream.Close()
+
+	yaml := fmt.Sprintf(`
+providers:
+  - name: upstream
+    apiKeys:
+      main: upstream-key
+    services:
+      - type: codex
+        baseUrl: %s
+        pricing:
+          prompt: 2
+          completion: 8
+users:
+  - name: budget-user
+    apiKey: user-key
+    budget:
+      daily:
+        tokens: 1000000
+    services:
+      codex:
+        providerName: upstream
+        providerKeyName: main
+`, upstream.URL)
+
+	manager := config.NewManager()
+	if err := manager.LoadFromFile(writeTempConfig(t, yaml)); err != nil {
+		t.Fatalf("load config: %v", err)
+	}
+	usageLedger, err := ledger.Open(filepath.Join(t.TempDir(), "ledger.json"))
+	if err != nil {
+		t.Fatalf("open ledger: %v", err)
+	}
+	gateway := &Gateway{Config: manager, Ledger: usageLedger}
+
+	send := func() *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodPost, "/piapi/codex/chat", strings.NewReader(`{}`))
+		req.Header.Set("Authorization", "Bearer user-key")
+		rr := httptest.NewRecorder()
+		gateway.ServeHTTP(rr, req)
+		return rr
+	}
+
+	if rr := send(); rr.Code != http.StatusOK {
+		t.Fatalf("expected first request within budget, got %d", rr.Code)
+	}
+	balance := usageLedger.Balance("budget-user", "codex", ledger.Daily)
+	if balance.Used.Tokens != 1500000 || balance.Used.Cost != 6 {
+		t.Fatalf("unexpected recorded usage: %+v", balance.Used)
+	}
+
+	rr := send()
+	if rr.Code != http.StatusTooManyRequests {
+		t.Fatalf("expected 429 once budget is exhausted, got %d", rr.Code)
+	}
+	if rr.Header().Get("Retry-After") == "" || !strings.Contains(rr.Body.String(), "daily budget exhausted") {
+		t.Fatalf("expected budget error with Retry-After, got %q %q", rr.Header().Get("Retry-After"), rr.Body.String())
+	}
+	if hits != 1 {
+		t.Fatalf("expected rejected request not to reach upstream, got %d hits", hits)
+	}
+
+	logs := logging.GlobalRequestLogStore.Query(logging.QueryOptions{User: "budget-user", Limit: 2})
+	if len(logs) != 2 || logs[1].Cost != 6 {
+		t.Fatalf("expected priced usage on request log, got %+v", logs)
+	}
+}
+
+func TestGatewayRoutesByRequestModel(t *testing.T) {
+	var gptHits, claudeHits int
+	gpt := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		gptHits++
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer gpt.Close()
+	claude := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		claudeHits++
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer claude.Close()
+
+	yaml := fmt.Sprintf(`
+providers:
+  - name: gpt
+    apiKeys:
+      main: gpt-key
+    services:
+      - type: mixed
+        baseUrl: %s
+        models: ["gpt-*"]
+  - name: claude
+    apiKeys:
+      main: claude-key
+    services:
+      - type: mixed
+        baseUrl: %s
+        models: ["claude-*"]
+users:
+  - name: model-user
+    apiKey: user-key
+    services:
+      mixed:
+        strategy: round_robin
+        candidates:
+          - providerName: gpt
+            providerKeyName: main
+          - providerName: claude
+            providerKeyName: main
+`, gpt.URL, claude.URL)
+
+	manager := config.NewManager()
+	if err := manager.LoadFromFile(writeTempConfig(t, yaml)); err != nil {
+		t.Fatalf("load config: %v", err)
+	}
+	gateway := &Gateway{Config: manager}
+
+	send := func(path, body string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodPost, "/piapi/mixed/"+path, strings.NewReader(body))
+		req.Header.Set("Authorization", "Bearer user-key")
+		req.Header.Set("Content-Type", "application/json")
+		rr := httptest.NewRecorder()
+		gateway.ServeHTTP(rr, req)
+		return rr
+	}
+
+	for i := 0; i < 3; i++ {
+		if rr := send("v1/chat/completions", `{"messages":[{"role":"user","content":"hi"}],"model":"gpt-4o"}`); rr.Code != http.StatusOK {
+			t.Fatalf("expected 200, got %d", rr.Code)
+		}
+	}
+	if rr := send("v1/messages", `{"model":"claude-sonnet-4","max_tokens":16}`); rr.Code != http.StatusOK {
+		t.Fatalf("expected 200, got %d", rr.Code)
+	}
+	if gptHits != 3 || claudeHits != 1 {
+		t.Fatalf("expected 3 gpt and 1 claude hits, got %d and %d", gptHits, claudeHits)
+	}
+
+	rr := send("v1/chat/completions", `{"model":"gemini-pro"}`)
+	if rr.Code != http.StatusNotFound {
+		t.Fatalf("expected 404 for unsupported model, got %d", rr.Code)
+	}
+	var openaiErr struct {
+		Error struct {
+			Message string `json:"message"`
+			Type    string `json:"type"`
+			Code    string `json:"code"`
+		} `json:"error"`
+	}
+	if err := json.Unmarshal(rr.Body.Bytes(), &openaiErr); err != nil {
+		t.Fatalf("decode error body: %v", err)
+	}
+	if openaiErr.Error.Code != "model_not_found" || !strings.Contains(openaiErr.Error.Message, "gemini-pro") {
+		t.Fatalf("unexpected OpenAI-style error: %s", rr.Body.String())
+	}
+
+	rr = send("v1/messages", `{"model":"gemini-pro"}`)
+	var anthropicErr struct {
+		Type  string `json:"type"`
+		Error struct {
+			Type string `json:"type"`
+		} `json:"error"`
+	}
+	if err := json.Unmarshal(rr.Body.Bytes(), &anthropicErr); err != nil {
+		t.Fatalf("decode error body: %v", err)
+	}
+	if rr.Code != http.StatusNotFound || anthropicErr.Type != "error" || anthropicErr.Error.Type != "not_found_error" {
+		t.Fatalf("unexpected Anthropic-style error (%d): %s", rr.Code, rr.Body.String())
+	}
+	if gptHits != 3 || claudeHits != 1 {
+		t.Fatalf("unsupported models must not reach upstream")
+	}
+
+	logs := logging.GlobalRequestLogStore.Query(logging.QueryOptions{User: "model-user", Limit: 1})
+	if len(logs) != 1 || logs[0].Model != "gemini-pro" {
+		t.Fatalf("expected requested model in request log, got %+v", logs)
+	}
+}
+
+func TestPeekModel(t *testing.T) {
+	cases := map[string]string{
+		`{"model":"gpt-4o"}`:                                 "gpt-4o",
+		`{"messages":[{"model":"nested"}],"model":"o3"}`:     "o3",
+		`{"metadata":{"model":"nested"}}`:                    "",
+		`{"model":42}`:                                       "",
+		`[{"model":"gpt-4o"}]`:                               "",
+		`{"model":"claude-sonnet-4","messages":[{"role":"us`: "claude-sonnet-4",
+		`{"messages":[{"role":"user","content":"trunc`:       "",
+	}
+	for body, want := range cases {
+		if got := peekModel([]byte(body)); got != want {
+			t.Fatalf("peekModel(%s) = %q, want %q", body, got, want)
+		}
+	}
+}
+
+func TestGatewayRewritesModelPerProvider(t *testing.T) {
+	var mappedBodies, plainBodies []string
+	mapped := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		mappedBodies = append(mappedBodies, string(body))
+		w.WriteHeader(http.StatusBadGateway)
+	}))
+	defer mapped.Close()
+	plain := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		if r.ContentLength != int64(len(body)) {
+			t.Errorf("content length %d does not match body length %d", r.ContentLength, len(body))
+		}
+		plainBodies = append(plainBodies, string(body))
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer plain.Close()
+
+	yaml := fmt.Sprintf(`
+providers:
+  - name: router
+    apiKeys:
+      main: router-key
+    services:
+      - type: claude_code
+        baseUrl: %s
+        modelMap:
+          claude-sonnet-4: anthropic/claude-sonnet-4
+  - name: direct
+    apiKeys:
+      main: direct-key
+    services:
+      - type: claude_code
+        baseUrl: %s
+users:
+  - name: rewrite-user
+    apiKey: user-key
+    services:
+      claude_code:
+        strategy: sticky_healthy
+        modelAliases:
+          smart: claude-sonnet-4
+        candidates:
+          - providerName: router
+            providerKeyName: main
+          - providerName: direct
+            providerKeyName: main
+`, mapped.URL, plain.URL)
+
+	manager := config.NewManager()
+	if err := manager.LoadFromFile(writeTempConfig(t, yaml)); err != nil {
+		t.Fatalf("load config: %v", err)
+	}
+	gateway := &Gateway{Config: manager}
+
+	req := httptest.NewRequest(http.MethodPost, "/piapi/claude_code/v1/messages", strings.NewReader(`{"model": "smart", "max_tokens": 16}`))
+	req.Header.Set("Authorization", "Bearer user-key")
+	req.Header.Set("Content-Type", "application/json")
+	rr := httptest.NewRecorder()
+	gateway.ServeHTTP(rr, req)
+
+	if rr.Code != http.StatusOK {
+		t.Fatalf("expected failover to succeed, got %d", rr.Code)
+	}
+	if len(mappedBodies) != 1 || mappedBodies[0] != `{"model": "anthropic/claude-sonnet-4", "max_tokens": 16}` {
+		t.Fatalf("unexpected body at mapped provider: %q", mappedBodies)
+	}
+	if len(plainBodies) != 1 || plainBodies[0] != `{"model": "claude-sonnet-4", "max_tokens": 16}` {
+		t.Fatalf("unexpected body at direct provider: %q", plainBodies)
+	}
+
+	logs := logging.GlobalRequestLogStore.Query(logging.QueryOptions{User: "rewrite-user", Limit: 1})
+	if len(logs) != 1 {
+		t.Fatalf("expected one log entry, got %d", len(logs))
+	}
+	entry := logs[0]
+	if entry.Model != "smart" || entry.UpstreamModel != "claude-sonnet-4" {
+		t.Fatalf("unexpected logged models: %q -> %q", entry.Model, entry.UpstreamModel)
+	}
+	if len(entry.Attempts) != 2 || entry.Attempts[0].Model != "anthropic/claude-sonnet-4" || entry.Attempts[1].Model != "claude-sonnet-4" {
+		t.Fatalf("unexpected attempt models: %+v", entry.Attempts)
+	}
+}
+
+func TestRewriteModel(t *testing.T) {
+	body := []byte(`{"messages":[{"model":"keep"}], "model" :  "gpt-4o" ,"stream":true}`)
+	out, ok := rewriteModel(body, `vendor/gpt-4o"x`)
+	if !ok {
+		t.Fatalf("expected model to be rewritten")
+	}
+	if want := `{"messages":[{"model":"keep"}], "model" :  "vendor/gpt-4o\"x" ,"stream":true}`; string(out) != want {
+		t.Fatalf("unexpected rewrite:\n got %s\nwant %s", out, want)
+	}
+	if _, ok := rewriteModel([]byte(`{"messages":[]}`), "x"); ok {
+		t.Fatalf("expected no rewrite without a model field")
+	}
+}
+
+func TestGatewayTranslatesAnthropicClientToOpenAIUpstream(t *testing.T) {
+	var upstreamPath string
+	var upstreamBody map[string]interface{}
+	var upstreamHeader http.Header
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		upstreamPath = r.URL.Path + "?" + r.URL.RawQuery
+		upstreamHeader = r.Header.Clone()
+		upstreamBody = nil
+		_ = json.NewDecoder(r.Body).Decode(&upstreamBody)
+		if upstreamBody["stream"] == true {
+			w.Header().Set("Content-Type", "text/event-stream")
+			for _, chunk := range []string{
+				`{"id":"chatcmpl-1","model":"gpt-4o","choices":[{"index":0,"delta":{"role":"assistant","content":"Hi"}}]}`,
+				`{"id":"chatcmpl-1","model":"gpt-4o","choices":[{"index":0,"delta":{"tool_calls":[{"index":0,"id":"call_1","type":"function","function":{"name":"lookup","arguments":"{}"}}]}}]}`,
+				`{"id":"chatcmpl-1","model":"gpt-4o","choices":[{"index":0,"delta":{},"finish_reason":"tool_calls"}]}`,
+				`{"id":"chatcmpl-1","model":"gpt-4o","choices":[],"usage":{"prompt_tokens":21,"completion_tokens":6,"total_tokens":27}}`,
+				`[DONE]`,
+			} {
+				_, _ = fmt.Fprintf(w, "data: %s\n\n", chunk)
+			}
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		_, _ = io.WriteString(w, `{"id":"chatcmpl-2","object":"chat.completion","model":"gpt-4o","choices":[{"index":0,"message":{"role":"assistant","content":"Hello"},"finish_reason":"stop"}],"usage":{"prompt_tokens":5,"completion_tokens":2,"total_tokens":7}}`)
+	}))
+	defer upstream.Close()
+
+	yaml := fmt.Sprintf(`
+providers:
+  - name: openai-compatible
+    apiKeys:
+      main: upstream-key
+    services:
+      - type: claude_code
+        baseUrl: %s/v1
+        protocol: openai
+users:
+  - name: translate-anthropic
+    apiKey: user-key
+    services:
+      claude_code:
+        providerName: openai-compatible
+        providerKeyName: main
+`, upstream.URL)
+
+	manager := config.NewManager()
+	if err := manager.LoadFromFile(writeTempConfig(t, yaml)); err != nil {
+		t.Fatalf("load config: %v", err)
+	}
+	gateway := &Gateway{Config: manager}
+
+	send := func(body string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodPost, "/piapi/claude_code/v1/messages?beta=true", strings.NewReader(body))
+		req.Header.Set("Authorization", "Bearer user-key")
+		req.Header.Set("Content-Type", "application/json")
+		req.Header.Set("anthropic-version", "2023-06-01")
+		rr := httptest.NewRecorder()
+		gateway.ServeHTTP(rr, req)
+		return rr
+	}
+
+	rr := send(`{"model":"gpt-4o","max_tokens":64,"system":"Be brief.","messages":[{"role":"user","content":"hi"}]}`)
+	if rr.Code != http.StatusOK {
+		t.Fatalf("expected 200, got %d: %s", rr.Code, rr.Body.String())
+	}
+	if upstreamPath != "/v1/chat/completions?" {
+		t.Fatalf("unexpected upstream path %q", upstreamPath)
+	}
+	if upstreamHeader.Get("anthropic-version") != "" || upstreamHeader.Get("Authorization") != "Bearer upstream-key" {
+		t.Fatalf("unexpected upstream headers: %v", upstreamHeader)
+	}
+	messages, _ := upstreamBody["messages"].([]interface{})
+	if len(messages) != 2 || messages[0].(map[string]interface{})["role"] != "system" {
+		t.Fatalf("unexpected translated messages: %v", upstreamBody["messages"])
+	}
+	var message struct {
+		Type    string `json:"type"`
+		Content []struct {
+			Text string `json:"text"`
+		} `json:"content"`
+		StopReason string `json:"stop_reason"`
+	}
+	if err := json.Unmarshal(rr.Body.Bytes(), &message); err != nil {
+		t.Fatalf("decode response: %v", err)
+	}
+	if message.Type != "message" || len(message.Content) != 1 || message.Content[0].Text != "Hello" || message.StopReason != "end_turn" {
+		t.Fatalf("unexpected translated response: %s", rr.Body.String())
+	}
+
+	rr = send(`{"model":"gpt-4o","max_tokens":64,"stream":true,"messages":[{"role":"user","content":"hi"}]}`)
+	if rr.Code != http.StatusOK {
+		t.Fatalf("expected 200, got %d", rr.Code)
+	}
+	if upstreamBody["stream_options"] == nil {
+		t.Fatalf("expected usage to be requested from the upstream stream")
+	}
+	body := rr.Body.String()
+	for _, want := range []string{"event: message_start", `"type":"text_delta","text":"Hi"`, `"type":"tool_use"`, `"stop_reason":"tool_use"`, "event: message_stop"} {
+		if !strings.Contains(body, want) {
+			t.Fatalf("expected %q in translated stream:\n%s", want, body)
+		}
+	}
+
+	logs := logging.GlobalRequestLogStore.Query(logging.QueryOptions{User: "translate-anthropic", Limit: 1})
+	if len(logs) != 1 || logs[0].Usage == nil || logs[0].Usage.PromptTokens != 21 || logs[0].Usage.CompletionTokens != 6 {
+		t.Fatalf("expected usage from the upstream stream, got %+v", logs)
+	}
+
+	// Endpoints that merely end in /messages are not generation calls.
+	req := httptest.NewRequest(http.MethodGet, "/piapi/claude_code/threads/x/messages?limit=2", nil)
+	req.Header.Set("Authorization", "Bearer user-key")
+	rr = httptest.NewRecorder()
+	gateway.ServeHTTP(rr, req)
+	if rr.Code != http.StatusOK || upstreamPath != "/v1/threads/x/messages?limit=2" {
+		t.Fatalf("expected the request passed through untranslated, got %d for %q", rr.Code, upstreamPath)
+	}
+	if !strings.Contains(rr.Body.String(), `"object":"chat.completion"`) {
+		t.Fatalf("expected the upstream body as is, got %s", rr.Body.String())
+	}
+}
+
+func TestGatewayAbortsTranslatedStream(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/event-stream")
+		for {
+			_, _ = io.WriteString(w, `data: {"id":"chatcmpl-1","model":"gpt-4o","choices":[{"index":0,"delta":{"content":"Hi"}}],"usage":{"prompt_tokens":3,"completion_tokens":1}}`+"\n\n")
+			w.(http.Flusher).Flush()
+			select {
+			case <-r.Context().Done():
+				return
+			case <-time.After(time.Millisecond):
+			}
+		}
+	}))
+	defer upstream.Close()
+
+	yaml := fmt.Sprintf(`
+providers:
+  - name: openai-compatible
+    apiKeys:
+      main: upstream-key
+    services:
+      - type: claude_code
+        baseUrl: %s/v1
+        protocol: openai
+users:
+  - name: abort-translated
+    apiKey: user-key
+    services:
+      claude_code:
+        providerName: openai-compatible
+        providerKeyName: main
+`, upstream.URL)
+
+	manager := config.NewManager()
+	if err := manager.LoadFromFile(writeTempConfig(t, yaml)); err != nil {
+		t.Fatalf("load config: %v", err)
+	}
+	gateway := &Gateway{Config: manager}
+
+	// Writes to the client fail once the stream started, so the proxy aborts and
+	// closes the translated body while the upstream is still being read; run with
+	// -race.
+	req := httptest.NewRequest(http.MethodPost, "/piapi/claude_code/v1/messages",
+		strings.NewReader(`{"model":"gpt-4o","max_tokens":64,"stream":true,"messages":[{"role":"user","content":"hi"}]}`))
+	req.Header.Set("Authorization", "Bearer user-key")
+	rw := &brokenClientWriter{ResponseRecorder: httptest.NewRecorder(), limit: 4096}
+	gateway.ServeHTTP(rw, req)
+
+	if rw.Code != http.StatusOK || rw.Body.Len() == 0 {
+		t.Fatalf("expected the stream to start, got %d", rw.Code)
+	}
+	logs := logging.GlobalRequestLogStore.Query(logging.QueryOptions{User: "abort-translated", Limit: 1})
+	if len(logs) != 1 || logs[0].Usage == nil || logs[0].Usage.PromptTokens != 3 {
+		t.Fatalf("expected usage from the aborted stream, got %+v", logs)
+	}
+}
+
+// brokenClientWriter fails every write once limit bytes were written, as a
+// connection to a client that went away does. The failing write takes a moment,
+// as a write timing out would, so the upstream is read on meanwhile.
+type brokenClientWriter struct {
+	*httptest.ResponseRecorder
+	limit int
+}
+
+func (w *brokenClientWriter) Write(p []byte) (int, error) {
+	if w.Body.Len() >= w.limit {
+		time.Sleep(20 * time.Millisecond)
+		return 0, errors.New("client went away")
+	}
+	return w.ResponseRecorder.Write(p)
+}
+
+func TestGatewayTranslatesOpenAIClientToAnthropicUpstream(t *testing.T) {
+	var upstreamPath string
+	var upstreamBody map[string]interface{}
+	var upstreamHeader http.Header
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		upstreamPath = r.URL.Path
+		upstreamHeader = r.Header.Clone()
+		upstreamBody = nil
+		_ = json.NewDecoder(r.Body).Decode(&upstreamBody)
+		if upstreamBody["stream"] == true {
+			w.Header().Set("Content-Type", "text/event-stream")
+			for _, ev := range []string{
+				"event: message_start\ndata: {\"type\":\"message_start\",\"message\":{\"id\":\"msg_1\",\"model\":\"claude-sonnet-4\",\"usage\":{\"input_tokens\":13,\"output_tokens\":1}}}",
+				"event: content_block_start\ndata: {\"type\":\"content_block_start\",\"index\":0,\"content_block\":{\"type\":\"text\",\"text\":\"\"}}",
+				"event: content_block_delta\ndata: {\"type\":\"content_block_delta\",\"index\":0,\"delta\":{\"type\":\"text_delta\",\"text\":\"Hey\"}}",
+				"event: content_block_stop\ndata: {\"type\":\"content_block_stop\",\"index\":0}",
+				"event: message_delta\ndata: {\"type\":\"message_delta\",\"delta\":{\"stop_reason\":\"end_turn\"},\"usage\":{\"output_tokens\":4}}",
+				"event: message_stop\ndata: {\"type\":\"message_stop\"}",
+			} {
+				_, _ = fmt.Fprintf(w, "%s\n\n", ev)
+			}
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusBadRequest)
+		_, _ = io.WriteString(w, `{"type":"error","error":{"type":"invalid_request_error","message":"max_tokens too large"}}`)
+	}))
+	defer upstream.Close()
+
+	yaml := fmt.Sprintf(`
+providers:
+  - name: anthropic-compatible
+    apiKeys:
+      main: upstream-key
+    services:
+      - type: codex
+        baseUrl: %s
+        protocol: anthropic
+        auth:
+          mode: header
+          name: x-api-key
+users:
+  - name: translate-openai
+    apiKey: user-key
+    services:
+      codex:
+        providerName: anthropic-compatible
+        providerKeyName: main
+`, upstream.URL)
+
+	manager := config.NewManager()
+	if err := manager.LoadFromFile(writeTempConfig(t, yaml)); err != nil {
+		t.Fatalf("load config: %v", err)
+	}
+	gateway := &Gateway{Config: manager}
+
+	send := func(body string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodPost, "/piapi/codex/v1/chat/completions", strings.NewReader(body))
+		req.Header.Set("Authorization", "Bearer user-key")
+		req.Header.Set("Content-Type", "application/json")
+		rr := httptest.NewRecorder()
+		gateway.ServeHTTP(rr, req)
+		return rr
+	}
+
+	rr := send(`{"model":"claude-sonnet-4","stream":true,"stream_options":{"include_usage":true},"messages":[{"role":"system","content":"Be brief."},{"role":"user","content":"hi"}]}`)
+	if rr.Code != http.StatusOK {
+		t.Fatalf("expected 200, got %d: %s", rr.Code, rr.Body.String())
+	}
+	if upstreamPath != "/v1/messages" {
+		t.Fatalf("unexpected upstream path %q", upstreamPath)
+	}
+	if upstreamHeader.Get("anthropic-version") == "" || upstreamHeader.Get("x-api-key") == "" || upstreamHeader.Get("Authorization") != "" {
+		t.Fatalf("unexpected upstream headers: %v", upstreamHeader)
+	}
+	if upstreamBody["system"] != "Be brief." {
+		t.Fatalf("expected system prompt to be lifted, got %v", upstreamBody)
+	}
+	body := rr.Body.String()
+	for _, want := range []string{`"object":"chat.completion.chunk"`, `"content":"Hey"`, `"finish_reason":"stop"`, `"prompt_tokens":13`, "data: [DONE]"} {
+		if !strings.Contains(body, want) {
+			t.Fatalf("expected %q in translated stream:\n%s", want, body)
+		}
+	}
+
+	rr = send(`{"model":"claude-sonnet-4","messages":[{"role":"user","content":"hi"}]}`)
+	if rr.Code != http.StatusBadRequest {
+		t.Fatalf("expected upstream 400 to pass through, got %d", rr.Code)
+	}
+	var apiErr struct {
+		Error struct {
+			Message string `json:"message"`
+		} `json:"error"`
+	}
+	if err := json.Unmarshal(rr.Body.Bytes(), &apiErr); err != nil || apiErr.Error.Message != "max_tokens too large" {
+		t.Fatalf("expected OpenAI-style error, got %s", rr.Body.String())
+	}
+}
+
+func TestGatewayBridgesResponsesClientToChatUpstream(t *testing.T) {
+	var upstreamPath string
+	var upstreamBody map[string]interface{}
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		upstreamPath = r.URL.Path
+		upstreamBody = nil
+		_ = json.NewDecoder(r.Body).Decode(&upstreamBody)
+		w.Header().Set("Content-Type", "text/event-stream")
+		for _, chunk := range []string{
+			`{"id":"chatcmpl-9","model":"deepseek-chat","choices":[{"index":0,"delta":{"role":"assistant","content":"Done"}}]}`,
+			`{"id":"chatcmpl-9","model":"deepseek-chat","choices":[{"index":0,"delta":{},"finish_reason":"stop"}]}`,
+			`{"id":"chatcmpl-9","model":"deepseek-chat","choices":[],"usage":{"prompt_tokens":17,"completion_tokens":2,"total_tokens":19}}`,
+			`[DONE]`,
+		} {
+			_, _ = fmt.Fprintf(w, "data: %s\n\n", chunk)
+		}
+	}))
+	defer upstream.Close()
+
+	yaml := fmt.Sprintf(`
+providers:
+  - name: chat-only
+    apiKeys:
+      main: upstream-key
+    services:
+      - type: codex
+        baseUrl: %s/v1
+        protocol: openai
+        chatOnly: true
+users:
+  - name: responses-user
+    apiKey: user-key
+    services:
+      codex:
+        providerName: chat-only
+        providerKeyName: main
+`, upstream.URL)
+
+	manager := config.NewManager()
+	if err := manager.LoadFromFile(writeTempConfig(t, yaml)); err != nil {
+		t.Fatalf("load config: %v", err)
+	}
+	gateway := &Gateway{Config: manager}
+
+	send := func(body string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodPost, "/piapi/codex/responses", strings.NewReader(body))
+		req.Header.Set("Authorization", "Bearer user-key")
+		req.Header.Set("Content-Type", "application/json")
+		rr := httptest.NewRecorder()
+		gateway.ServeHTTP(rr, req)
+		return rr
+	}
+
+	rr := send(`{"model":"deepseek-chat","stream":true,"instructions":"Be terse.","input":[{"role":"user","content":[{"type":"input_text","text":"go"}]}]}`)
+	if rr.Code != http.StatusOK {
+		t.Fatalf("expected 200, got %d: %s", rr.Code, rr.Body.String())
+	}
+	if upstreamPath != "/v1/chat/completions" {
+		t.Fatalf("unexpected upstream path %q", upstreamPath)
+	}
+	if messages, ok := upstreamBody["messages"].([]interface{}); !ok || len(messages) != 2 {
+		t.Fatalf("expected instructions and input as messages, got %v", upstreamBody)
+	}
+	body := rr.Body.String()
+	for _, want := range []string{"event: response.created", `"delta":"Done"`, "event: response.completed", `"input_tokens":17`} {
+		if !strings.Contains(body, want) {
+			t.Fatalf("expected %q in translated stream:\n%s", want, body)
+		}
+	}
+	logs := logging.GlobalRequestLogStore.Query(logging.QueryOptions{User: "responses-user", Limit: 1})
+	if len(logs) != 1 || logs[0].Usage == nil || logs[0].Usage.PromptTokens != 17 || logs[0].Usage.CompletionTokens != 2 {
+		t.Fatalf("expected usage from the upstream stream, got %+v", logs)
+	}
+
+	upstreamPath = ""
+	rr = send(`{"model":"deepseek-chat","previous_response_id":"resp_1","input":"continue"}`)
+	if rr.Code != http.StatusBadRequest || upstreamPath != "" {
+		t.Fatalf("expected previous_response_id to be rejected locally, got %d (upstream %q)", rr.Code, upstreamPath)
+	}
+	if !strings.Contains(rr.Body.String(), "previous_response_id") {
+		t.Fatalf("expected error to name previous_response_id, got %s", rr.Body.String())
+	}
+
+	// Without chatOnly an openai upstream serves the Responses API itself.
+	if err := manager.LoadFromFile(writeTempConfig(t, strings.Replace(yaml, "        chatOnly: true\n", "", 1))); err != nil {
+		t.Fatalf("reload config: %v", err)
+	}
+	upstreamPath = ""
+	send(`{"model":"deepseek-chat","input":"hi","previous_response_id":"resp_1"}`)
+	if upstreamPath != "/v1/responses" {
+		t.Fatalf("expected /responses to pass through natively, got %q", upstreamPath)
+	}
+
+	// An Anthropic upstream has no Responses API; the gateway rejects the request.
+	if err := manager.LoadFromFile(writeTempConfig(t, strings.Replace(yaml, "protocol: openai\n        chatOnly: true\n", "protocol: anthropic\n", 1))); err != nil {
+		t.Fatalf("reload config: %v", err)
+	}
+	upstreamPath = ""
+	rr = send(`{"model":"deepseek-chat","input":"hi"}`)
+	if rr.Code != http.StatusBadRequest || upstreamPath != "" {
+		t.Fatalf("expected a local 400 for an Anthropic upstream, got %d (upstream %q)", rr.Code, upstreamPath)
+	}
+	if !strings.Contains(rr.Body.String(), "Responses API") {
+		t.Fatalf("expected the error to explain the mismatch, got %s", rr.Body.String())
+	}
+}
+
+func TestGatewayAcceptsClientCredentialStyles(t *testing.T) {
+	var upstreamHeader http.Header
+	var upstreamQuery url.Values
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		upstreamHeader = r.Header.Clone()
+		upstreamQuery = r.URL.Query()
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer upstream.Close()
+
+	yaml := fmt.Sprintf(`
+providers:
+  - name: upstream
+    apiKeys:
+      main: upstream-key
+    services:
+      - type: claude_code
+        baseUrl: %[1]s
+        auth:
+          mode: header
+          name: x-api-key
+      - type: gemini
+        baseUrl: %[1]s
+        auth:
+          mode: query
+          name: key
+users:
+  - name: styles-user
+    apiKey: user-key
+    services:
+      claude_code:
+        providerName: upstream
+        providerKeyName: main
+      gemini:
+        providerName: upstream
+        providerKeyName: main
+clientAuth:
+  gemini:
+    styles: [x-goog-api-key, query]
+`, upstream.URL)
+
+	manager := config.NewManager()
+	if err := manager.LoadFromFile(writeTempConfig(t, yaml)); err != nil {
+		t.Fatalf("load config: %v", err)
+	}
+	gateway := &Gateway{Config: manager}
+
+	serve := func(req *http.Request) *httptest.ResponseRecorder {
+		rr := httptest.NewRecorder()
+		gateway.ServeHTTP(rr, req)
+		return rr
+	}
+
+	// Anthropic SDK style; the client key must not reach the upstream.
+	req := httptest.NewRequest(http.MethodPost, "/piapi/claude_code/v1/messages", strings.NewReader(`{}`))
+	req.Header.Set("x-api-key", "user-key")
+	req.Header.Set("anthropic-version", "2023-06-01")
+	if rr := serve(req); rr.Code != http.StatusOK {
+		t.Fatalf("expected x-api-key to authenticate, got %d: %s", rr.Code, rr.Body.String())
+	}
+	if got := upstreamHeader.Values("x-api-key"); len(got) != 1 || !strings.HasSuffix(got[0], "upstream-key") {
+		t.Fatalf("expected only the upstream key to be forwarded, got %v", got)
+	}
+
+	// Query keys are opt-in per service type and stripped before forwarding.
+	req = httptest.NewRequest(http.MethodPost, "/piapi/gemini/v1beta/models/gemini-pro:generateContent?key=user-key&alt=sse", strings.NewReader(`{}`))
+	if rr := serve(req); rr.Code != http.StatusOK {
+		t.Fatalf("expected ?key= to authenticate, got %d: %s", rr.Code, rr.Body.String())
+	}
+	if upstreamQuery.Get("key") != "upstream-key" || upstreamQuery.Get("alt") != "sse" {
+		t.Fatalf("unexpected upstream query %v", upstreamQuery)
+	}
+
+	req = httptest.NewRequest(http.MethodPost, "/piapi/claude_code/v1/messages?key=user-key", strings.NewReader(`{}`))
+	req.Header.Set("anthropic-version", "2023-06-01")
+	rr := serve(req)
+	if rr.Code != http.StatusUnauthorized {
+		t.Fatalf("expected ?key= to be rejected where not enabled, got %d", rr.Code)
+	}
+	var anthropicErr struct {
+		Type  string `json:"type"`
+		Error struct {
+			Type string `json:"type"`
+		} `json:"error"`
+	}
+	if err := json.Unmarshal(rr.Body.Bytes(), &anthropicErr); err != nil || anthropicErr.Error.Type != "authentication_error" {
+		t.Fatalf("expected Anthropic-style authentication error, got %s", rr.Body.String())
+	}
+
+	req = httptest.NewRequest(http.MethodPost, "/piapi/gemini/v1beta/models/gemini-pro:generateContent", strings.NewReader(`{}`))
+	req.Header.Set("x-goog-api-key", "wrong-key")
+	rr = serve(req)
+	var geminiErr struct {
+		Error struct {
+			Code   int    `json:"code"`
+			Status string `json:"status"`
+		} `json:"error"`
+	}
+	if err := json.Unmarshal(rr.Body.Bytes(), &geminiErr); err != nil || rr.Code != http.StatusUnauthorized ||
+		geminiErr.Error.Code != http.StatusUnauthorized || geminiErr.Error.Status != "UNAUTHENTICATED" {
+		t.Fatalf("expected Gemini-style authentication error, got %d: %s", rr.Code, rr.Body.String())
+	}
+}
+
+func TestGatewayAppliesHeaderPolicy(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if got := r.Header.Get("Cookie"); got != "" {
+			t.Errorf("expected client cookie stripped, got %q", got)
+		}
+		if got := r.Header.Get("X-Debug"); got != "" {
+			t.Errorf("expected X-Debug removed, got %q", got)
+		}
+		if got := r.Header.Get("Anthropic-Version"); got != "2023-06-01" {
+			t.Errorf("expected anthropic-version set, got %q", got)
+		}
+		if got := r.Header.Values("Anthropic-Beta"); len(got) != 2 || got[0] != "client-beta" || got[1] != "tools-2024" {
+			t.Errorf("expected anthropic-beta appended, got %q", got)
+		}
+		if got := r.Header.Get("X-End-User"); got != "header-user/req-42" {
+			t.Errorf("expected templated X-End-User, got %q", got)
+		}
+		if got := r.Header.Get("x-api-key"); got != "Bearer upstream-key" {
+			t.Errorf("expected the upstream credential to win over the policy, got %q", got)
+		}
+		w.Header().Set("Server", "upstream/1.0")
+		w.Header().Set("X-Upstream-Trace", "abc")
+		_, _ = w.Write([]byte("ok"))
+	}))
+	defer upstream.Close()
+
+	yaml := fmt.Sprintf(`
+providers:
+  - name: upstream
+    apiKeys:
+      main: upstream-key
+    services:
+      - type: claude
+        baseUrl: %s
+        auth:
+          mode: header
+          name: x-api-key
+        headers:
+          request:
+            set:
+              anthropic-version: "2023-06-01"
+              x-api-key: from-policy
+            add:
+              anthropic-beta: tools-2024
+          response:
+            remove: [server]
+users:
+  - name: header-user
+    apiKey: user-key
+    services:
+      claude:
+        providerName: upstream
+        providerKeyName: main
+        headers:
+          request:
+            set:
+              x-end-user: "{{user}}/{{request_id}}"
+            remove: [x-debug]
+          response:
+            set:
+              x-piapi-provider: "{{provider}}"
+`, upstream.URL)
+
+	manager := config.NewManager()
+	if err := manager.LoadFromFile(writeTempConfig(t, yaml)); err != nil {
+		t.Fatalf("load config: %v", err)
+	}
+	gateway := &Gateway{Config: manager}
+
+	req := httptest.NewRequest(http.MethodPost, "/piapi/claude/v1/messages", strings.NewReader(`{}`))
+	req = req.WithContext(ContextWithRequestID(req.Context(), "req-42"))
+	req.Header.Set("Authorization", "Bearer user-key")
+	req.Header.Set("Cookie", "session=abc")
+	req.Header.Set("X-Debug", "1")
+	req.Header.Set("Anthropic-Beta", "client-beta")
+	rr := httptest.NewRecorder()
+	gateway.ServeHTTP(rr, req)
+
+	if rr.Code != http.StatusOK {
+		t.Fatalf("unexpected status %d: %s", rr.Code, rr.Body.String())
+	}
+	if got := rr.Header().Get("Server"); got != "" {
+		t.Fatalf("expected Server response header removed, got %q", got)
+	}
+	if got := rr.Header().Get("X-Piapi-Provider"); got != "upstream" {
+		t.Fatalf("expected templated response header, got %q", got)
+	}
+	if got := rr.Header().Get("X-Upstream-Trace"); got != "abc" {
+		t.Fatalf("expected other response headers kept, got %q", got)
+	}
+}
+
+func TestGatewayTimesOutSlowUpstream(t *testing.T) {
+	release := make(chan struct{})
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case <-release:
+		case <-r.Context().Done():
+		}
+	}))
+	defer upstream.Close()
+	defer close(release)
+
+	yaml := fmt.Sprintf(`
+providers:
+  - name: slow
+    apiKeys:
+      main: upstream-key
+    services:
+      - type: codex
+        baseUrl: %s
+        timeouts:
+          responseHeader: 50ms
+          total: 5s
+users:
+  - name: timeout-user
+    apiKey: user-key
+    services:
+      codex:
+        providerName: slow
+        providerKeyName: main
+`, upstream.URL)
+
+	manager := config.NewManager()
+	if err := manager.LoadFromFile(writeTempConfig(t, yaml)); err != nil {
+		t.Fatalf("load config: %v", err)
+	}
+	gateway := &Gateway{Config: manager}
+
+	req := httptest.NewRequest(http.MethodPost, "/piapi/codex/chat", strings.NewReader(`{}`))
+	req.Header.Set("Authorization", "Bearer user-key")
+	rr := httptest.NewRecorder()
+	gateway.ServeHTTP(rr, req)
+
+	if rr.Code != http.StatusGatewayTimeout {
+		t.Fatalf("expected 504, got %d %q", rr.Code, rr.Body.String())
+	}
+	stats, err := manager.RuntimeStatus("user-key", "codex")
+	if err != nil {
+		t.Fatalf("runtime status: %v", err)
+	}
+	if len(stats) != 1 || stats[0].TotalErrors != 1 || stats[0].TotalTimeouts != 1 {
+		t.Fatalf("expected the timeout recorded as a failure, got %+v", stats)
+	}
+	logs := logging.GlobalRequestLogStore.Query(logging.QueryOptions{User: "timeout-user", Limit: 1})
+	if len(logs) != 1 || !strings.Contains(logs[0].Error, "upstream timeout") {
+		t.Fatalf("expected timeout error in request log, got %+v", logs)
+	}
+}
+
+func TestGatewayCutsStalledStream(t *testing.T) {
+	release := make(chan struct{})
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/event-stream")
+		_, _ = io.WriteString(w, "data: {\"delta\":\"first\"}\n\n")
+		w.(http.Flusher).Flush()
+		select {
+		case <-release:
+		case <-r.Context().Done():
+		}
+	}))
+	defer upstream.Close()
+	defer close(release)
+
+	yaml := fmt.Sprintf(`
+providers:
+  - name: stalling
+    apiKeys:
+      main: upstream-key
+    services:
+      - type: codex
+        baseUrl: %s
+        timeouts:
+          streamIdle: 100ms
+users:
+  - name: stall-user
+    apiKey: user-key
+    services:
+      codex:
+        providerName: stalling
+        providerKeyName: main
+`, upstream.URL)
+
+	manager := config.NewManager()
+	if err := manager.LoadFromFile(writeTempConfig(t, yaml)); err != nil {
+		t.Fatalf("load config: %v", err)
+	}
+	gatewayServer := httptest.NewServer(&Gateway{Config: manager})
+	defer gatewayServer.Close()
+
+	req, _ := http.NewRequest(http.MethodPost, gatewayServer.URL+"/piapi/codex/chat", strings.NewReader(`{"stream":true}`))
+	req.Header.Set("Authorization", "Bearer user-key")
+	res, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("request: %v", err)
+	}
+	body, readErr := io.ReadAll(res.Body)
+	res.Body.Close()
+	if res.StatusCode != http.StatusOK || !strings.Contains(string(body), "first") {
+		t.Fatalf("expected the stream to start, got %d %q", res.StatusCode, body)
+	}
+	if readErr == nil {
+		t.Fatalf("expected the stalled stream to be cut off")
+	}
+
+	stats, err := manager.RuntimeStatus("user-key", "codex")
+	if err != nil {
+		t.Fatalf("runtime status: %v", err)
+	}
+	// The 200 and the timeout that cut it off are one failed request.
+	if len(stats) != 1 || stats[0].TotalRequests != 1 || stats[0].TotalErrors != 1 || stats[0].TotalTimeouts != 1 {
+		t.Fatalf("expected the stream idle timeout recorded once, got %+v", stats)
+	}
+	logs := logging.GlobalRequestLogStore.Query(logging.QueryOptions{User: "stall-user", Limit: 1})
+	if len(logs) != 1 || len(logs[0].Attempts) != 1 || !strings.Contains(logs[0].Error, "stream idle") {
+		t.Fatalf("expected the aborted attempt logged, got %+v", logs)
+	}
+}
+
+func TestGatewayLiftsWriteTimeoutOnlyForBoundedServices(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/event-stream")
+		for i := 0; i < 8; i++ {
+			_, _ = fmt.Fprintf(w, "data: {\"delta\":\"%d\"}\n\n", i)
+			w.(http.Flusher).Flush()
+			select {
+			case <-r.Context().Done():
+				return
+			case <-time.After(50 * time.Millisecond):
+			}
+		}
+		_, _ = io.WriteString(w, "data: [DONE]\n\n")
+	}))
+	defer upstream.Close()
+
+	yaml := fmt.Sprintf(`
+providers:
+  - name: streaming
+    apiKeys:
+      main: upstream-key
+    services:
+      - type: codex
+        baseUrl: %[1]s
+        timeouts:
+          streamIdle: 1s
+      - type: plain
+        baseUrl: %[1]s
+users:
+  - name: deadline-user
+    apiKey: user-key
+    services:
+      codex:
+        providerName: streaming
+        providerKeyName: main
+      plain:
+        providerName: streaming
+        providerKeyName: main
+`, upstream.URL)
+
+	manager := config.NewManager()
+	if err := manager.LoadFromFile(writeTempConfig(t, yaml)); err != nil {
+		t.Fatalf("load config: %v", err)
+	}
+	const writeTimeout = 200 * time.Millisecond
+	gatewayServer := httptest.NewUnstartedServer(&Gateway{Config: manager, WriteTimeout: writeTimeout})
+	gatewayServer.Config.WriteTimeout = writeTimeout
+	gatewayServer.Start()
+	defer gatewayServer.Close()
+
+	stream := func(serviceType string) (string, error) {
+		req, _ := http.NewRequest(http.MethodPost, gatewayServer.URL+"/piapi/"+serviceType+"/chat", strings.NewReader(`{"stream":true}`))
+		req.Header.Set("Authorization", "Bearer user-key")
+		res, err := http.DefaultClient.Do(req)
+		if err != nil {
+			return "", err
+		}
+		defer res.Body.Close()
+		body, err := io.ReadAll(res.Body)
+		return string(body), err
+	}
+
+	// The stream outlasts the write timeout; its service's streamIdle bounds it instead.
+	if body, err := stream("codex"); err != nil || !strings.Contains(body, "[DONE]") {
+		t.Fatalf("expected the bounded stream to complete, got %q, %v", body, err)
+	}
+	// A service without stream timeouts is still held to the write timeout.
+	if body, err := stream("plain"); err == nil && strings.Contains(body, "[DONE]") {
+		t.Fatalf("expected the unbounded stream cut off by the write timeout, got %q", body)
+	}
+}
+
+func TestGatewayUsesProviderTransport(t *testing.T) {
+	private := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write([]byte("private ca"))
+	}))
+	defer private.Close()
+	caFile := filepath.Join(t.TempDir(), "ca.pem")
+	caPEM := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: private.Certificate().Raw})
+	if err := os.WriteFile(caFile, caPEM, 0o600); err != nil {
+		t.Fatalf("write ca file: %v", err)
+	}
+
+	proxied := make(chan string, 1)
+	proxy := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		proxied <- r.URL.String()
+		_, _ = w.Write([]byte("via proxy"))
+	}))
+	defer proxy.Close()
+
+	yaml := fmt.Sprintf(`
+providers:
+  - name: selfhosted
+    apiKeys:
+      main: key-a
+    transport:
+      caFile: %s
+      serverName: example.com
+    services:
+      - type: vllm
+        baseUrl: %s
+  - name: corporate
+    apiKeys:
+      main: key-b
+    transport:
+      proxy: %s
+    services:
+      - type: codex
+        baseUrl: http://upstream.invalid/v1
+users:
+  - name: transport-user
+    apiKey: user-key
+    services:
+      vllm:
+        providerName: selfhosted
+        providerKeyName: main
+      codex:
+        providerName: corporate
+        providerKeyName: main
+`, caFile, private.URL, proxy.URL)
+
+	manager := config.NewManager()
+	if err := manager.LoadFromFile(writeTempConfig(t, yaml)); err != nil {
+		t.Fatalf("load config: %v", err)
+	}
+	gateway := &Gateway{Config: manager}
+
+	for path, want := range map[string]string{
+		"/piapi/vllm/v1/models":  "private ca",
+		"/piapi/codex/responses": "via proxy",
+	} {
+		req := httptest.NewRequest(http.MethodGet, path, nil)
+		req.Header.Set("Authorization", "Bearer user-key")
+		rr := httptest.NewRecorder()
+		gateway.ServeHTTP(rr, req)
+		if rr.Code != http.StatusOK || rr.Body.String() != want {
+			t.Fatalf("%s: expected %q, got %d %q", path, want, rr.Code, rr.Body.String())
+		}
+	}
+	if got := <-proxied; got != "http://upstream.invalid/v1/responses" {
+		t.Fatalf("unexpected proxied request %q", got)
+	}
+}
+
+func TestGatewayCoolsDownRateLimitedKey(t *testing.T) {
+	var limitedHits int
+	limited := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		limitedHits++
+		w.Header().Set("Retry-After", "120")
+		http.Error(w, "slow down", http.StatusTooManyRequests)
+	}))
+	defer limited.Close()
+
+	healthy := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+		_, _ = w.Write([]byte("ok"))
+	}))
+	defer healthy.Close()
+
+	yaml := fmt.Sprintf(`
+providers:
+  - name: alpha
+    apiKeys:
+      a: key-a
+    services:
+      - type: codex
+        baseUrl: %s
+  - name: beta
+    apiKeys:
+      b: key-b
+    services:
+      - type: codex
+        baseUrl: %s
+users:
+  - name: cooldown-user
+    apiKey: user-key
+    services:
+      codex:
+        strategy: round_robin
+        candidates:
+          - providerName: alpha
+            providerKeyName: a
+          - providerName: beta
+            providerKeyName: b
+`, limited.URL, healthy.URL)
+
+	manager := config.NewManager()
+	if err := manager.LoadFromFile(writeTempConfig(t, yaml)); err != nil {
+		t.Fatalf("load config: %v", err)
+	}
+	gateway := &Gateway{Config: manager}
+
+	for i := 0; i < 3; i++ {
+		req := httptest.NewRequest(http.MethodPost, "/piapi/codex/chat", strings.NewReader(`{"prompt":"hi"}`))
+		req.Header.Set("Authorization", "Bearer user-key")
+		rr := httptest.NewRecorder()
+		gateway.ServeHTTP(rr, req)
+		if rr.Code != http.StatusOK {
+			t.Fatalf("request %d: expected failover past the 429, got %d", i, rr.Code)
+		}
+	}
+	if limitedHits != 1 {
+		t.Fatalf("expected the rate-limited key skipped after its 429, got %d hits", limitedHits)
+	}
+
+	stats, err := manager.RuntimeStatus("user-key", "codex")
+	if err != nil {
+		t.Fatalf("runtime status: %v", err)
+	}
+	alpha := stats[0]
+	if alpha.CooldownUntil == nil || time.Until(*alpha.CooldownUntil) < 110*time.Second {
+		t.Fatalf("expected a cooldown following Retry-After, got %+v", alpha)
+	}
+	if alpha.CircuitState != "closed" || alpha.TotalErrors != 0 {
+		t.Fatalf("expected a 429 not to count against the circuit breaker, got %+v", alpha)
+	}
+}
+
+func TestGatewayFailsOverOnlyOnKeyRejecting403(t *testing.T) {
+	forbiddenBody := `{"type":"error","error":{"type":"permission_error","message":"model not available"}}`
+	var forbiddenHits, healthyHits int
+	forbidden := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		forbiddenHits++
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusForbidden)
+		_, _ = io.WriteString(w, forbiddenBody)
+	}))
+	defer forbidden.Close()
+
+	healthy := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		healthyHits++
+		_, _ = w.Write([]byte("ok"))
+	}))
+	defer healthy.Close()
+
+	yaml := fmt.Sprintf(`
+providers:
+  - name: alpha
+    apiKeys:
+      a: key-a
+    services:
+      - type: codex
+        baseUrl: %s
+  - name: beta
+    apiKeys:
+      b: key-b
+    services:
+      - type: codex
+        baseUrl: %s
+users:
+  - name: forbidden-user
+    apiKey: user-key
+    services:
+      codex:
+        strategy: sticky_healthy
+        candidates:
+          - providerName: alpha
+            providerKeyName: a
+          - providerName: beta
+            providerKeyName: b
+`, forbidden.URL, healthy.URL)
+
+	manager := config.NewManager()
+	if err := manager.LoadFromFile(writeTempConfig(t, yaml)); err != nil {
+		t.Fatalf("load config: %v", err)
+	}
+	gateway := &Gateway{Config: manager}
+	send := func() *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodPost, "/piapi/codex/chat", strings.NewReader(`{"model":"restricted"}`))
+		req.Header.Set("Authorization", "Bearer user-key")
+		rr := httptest.NewRecorder()
+		gateway.ServeHTTP(rr, req)
+		return rr
+	}
+
+	// A 403 refusing the request is passed to the client and leaves the key valid.
+	for i := 0; i < 3; i++ {
+		rr := send()
+		if rr.Code != http.StatusForbidden || !strings.Contains(rr.Body.String(), "permission_error") {
+			t.Fatalf("request %d: expected the upstream 403 passed through, got %d %q", i, rr.Code, rr.Body.String())
+		}
+	}
+	if healthyHits != 0 {
+		t.Fatalf("expected no failover on a model access 403, got %d hits", healthyHits)
+	}
+	keys, err := manager.KeyHealth()
+	if err != nil {
+		t.Fatalf("key health: %v", err)
+	}
+	for _, k := range keys {
+		if k.Invalid {
+			t.Fatalf("expected the key kept valid, got %+v", k)
+		}
+	}
+
+	// A 403 rejecting the key fails over.
+	forbiddenBody = `{"error":{"message":"Incorrect API key provided","type":"invalid_request_error","code":"invalid_api_key"}}`
+	if rr := send(); rr.Code != http.StatusOK || rr.Body.String() != "ok" {
+		t.Fatalf("expected failover past the 403, got %d %q", rr.Code, rr.Body.String())
+	}
+	if forbiddenHits != 4 || healthyHits != 1 {
+		t.Fatalf("unexpected hits: forbidden %d, healthy %d", forbiddenHits, healthyHits)
+	}
+}
+
+func TestGatewayQueuesOnSaturatedKey(t *testing.T) {
+	entered := make(chan struct{}, 1)
+	unblock := make(chan struct{})
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Query().Get("block") != "" {
+			entered <- struct{}{}
+			<-unblock
+		}
+		w.WriteHeader(http.StatusOK)
+		_, _ = w.Write([]byte("ok"))
+	}))
+	defer upstream.Close()
+
+	yaml := fmt.Sprintf(`
+providers:
+  - name: alpha
+    apiKeys:
+      a: key-a
+    keyLimits:
+      a:
+        maxConcurrent: 1
+        queueTimeout: 20ms
+    services:
+      - type: codex
+        baseUrl: %s
+users:
+  - name: queue-user
+    apiKey: user-key
+    services:
+      codex:
+        providerName: alpha
+        providerKeyName: a
+`, upstream.URL)
+
+	manager := config.NewManager()
+	if err := manager.LoadFromFile(writeTempConfig(t, yaml)); err != nil {
+		t.Fatalf("load config: %v", err)
+	}
+	gateway := &Gateway{Config: manager}
+	send := func(target string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodPost, target, strings.NewReader(`{"prompt":"hi"}`))
+		req.Header.Set("Authorization", "Bearer user-key")
+		rr := httptest.NewRecorder()
+		gateway.ServeHTTP(rr, req)
+		return rr
+	}
+
+	done := make(chan int, 1)
+	go func() { done <- send("/piapi/codex/chat?block=1").Code }()
+	<-entered
+
+	rr := send("/piapi/codex/chat")
+	if rr.Code != http.StatusServiceUnavailable || rr.Header().Get("Retry-After") != "1" {
+		t.Fatalf("expected 503 with Retry-After once the queue wait timed out, got %d %q", rr.Code, rr.Header().Get("Retry-After"))
+	}
+
+	close(unblock)
+	if code := <-done; code != http.StatusOK {
+		t.Fatalf("expected the blocked request to complete, got %d", code)
+	}
+	if rr := send("/piapi/codex/chat"); rr.Code != http.StatusOK {
+		t.Fatalf("expected the slot released after the request, got %d", rr.Code)
+	}
+}
+
+func TestGatewayRoutesLeastLatencyByTimeToFirstByte(t *testing.T) {
+	var slowHits, fastHits int
+	slow := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		slowHits++
+		time.Sleep(30 * time.Millisecond)
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer slow.Close()
+	fast := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fastHits++
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer fast.Close()
+
+	yaml := fmt.Sprintf(`
+providers:
+  - name: slow
+    apiKeys:
+      s: key-s
+    services:
+      - type: codex
+        baseUrl: %s
+  - name: fast
+    apiKeys:
+      f: key-f
+    services:
+      - type: codex
+        baseUrl: %s
+users:
+  - name: latency-user
+    apiKey: user-key
+    services:
+      codex:
+        strategy: least_latency
+        candidates:
+          - providerName: slow
+            providerKeyName: s
+          - providerName: fast
+            providerKeyName: f
+`, slow.URL, fast.URL)
+
+	manager := config.NewManager()
+	if err := manager.LoadFromFile(writeTempConfig(t, yaml)); err != nil {
+		t.Fatalf("load config: %v", err)
+	}
+	gateway := &Gateway{Config: manager}
+
+	for i := 0; i < 6; i++ {
+		req := httptest.NewRequest(http.MethodPost, "/piapi/codex/chat", strings.NewReader(`{"prompt":"hi"}`))
+		req.Header.Set("Authorization", "Bearer user-key")
+		rr := httptest.NewRecorder()
+		gateway.ServeHTTP(rr, req)
+		if rr.Code != http.StatusOK {
+			t.Fatalf("request %d: expected 200, got %d", i, rr.Code)
+		}
+	}
+	if slowHits != 1 || fastHits != 5 {
+		t.Fatalf("expected the slow upstream measured once and then avoided, got slow=%d fast=%d", slowHits, fastHits)
+	}
+
+	stats, err := manager.RuntimeStatus("user-key", "codex")
+	if err != nil {
+		t.Fatalf("runtime status: %v", err)
+	}
+	if stats[0].LatencyEWMAMs < 30 || stats[1].LatencySamples != 5 || stats[0].InFlight != 0 || stats[1].InFlight != 0 {
+		t.Fatalf("expected latencies and released requests reported, got %+v", stats)
+	}
+}
+
+func TestGatewayConsistentHashKeepsSessionOnKey(t *testing.T) {
+	hits := map[string]int{}
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		hits[r.Header.Get("Authorization")]++
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer upstream.Close()
+
+	yaml := fmt.Sprintf(`
+providers:
+  - name: alpha
+    apiKeys:
+      a: key-a
+      b: key-b
+      c: key-c
+    services:
+      - type: claude
+        baseUrl: %s
+users:
+  - name: session-user
+    apiKey: user-key
+    services:
+      claude:
+        strategy: consistent_hash
+        consistentHash:
+          header: X-Claude-Session
+        candidates:
+          - providerName: alpha
+            providerKeyName: a
+          - providerName: alpha
+            providerKeyName: b
+          - providerName: alpha
+            providerKeyName: c
+`, upstream.URL)
+
+	manager := config.NewManager()
+	if err := manager.LoadFromFile(writeTempConfig(t, yaml)); err != nil {
+		t.Fatalf("load config: %v", err)
+	}
+	gateway := &Gateway{Config: manager}
+
+	for i := 0; i < 5; i++ {
+		req := httptest.NewRequest(http.MethodPost, "/piapi/claude/v1/messages", strings.NewReader(`{"messages":[]}`))
+		req.Header.Set("Authorization", "Bearer user-key")
+		req.Header.Set("X-Claude-Session", "session-42")
+		rr := httptest.NewRecorder()
+		gateway.ServeHTTP(rr, req)
+		if rr.Code != http.StatusOK {
+			t.Fatalf("request %d: expected 200, got %d", i, rr.Code)
+		}
+	}
+	if len(hits) != 1 {
+		t.Fatalf("expected every turn of the session sent with one key, got %v", hits)
+	}
+}
@@ -0,0 +1,40 @@
+package server
+
+import (
+	"net/http"
+
+	"piapi/internal/config"
+)
+
+// clientOnlyHeaders are removed from every proxied request: they belong to the
+// client's session with the gateway, not to the upstream.
+var clientOnlyHeaders = []string{"Cookie"}
+
+// headerVars returns the values of the placeholders a header policy may use.
+func headerVars(route *config.Route, requestID string) map[string]string {
+	return map[string]string{
+		"user":           route.User.Name,
+		"request_id":     requestID,
+		"service":        route.Service.Type,
+		"provider":       route.Provider.Name,
+		"provider_key":   route.UpstreamKeyName,
+		"model":          route.Model,
+		"upstream_model": route.UpstreamModel,
+	}
+}
+
+// applyRequestHeaders applies the request rules of route's header policy.
+func applyRequestHeaders(h http.Header, route *config.Route, requestID string) {
+	if route.Headers == nil || route.Headers.Request == nil {
+		return
+	}
+	route.Headers.Request.Apply(h, headerVars(route, requestID))
+}
+
+// applyResponseHeaders applies the response rules of route's header policy.
+func applyResponseHeaders(h http.Header, route *config.Route, requestID string) {
+	if route.Headers == nil || route.Headers.Response == nil {
+		return
+	}
+	route.Headers.Response.Apply(h, headerVars(route, requestID))
+}
@@ -0,0 +1,95 @@
+package server
+
+import (
+	"bytes"
+	"encoding/json"
+	"mime"
+	"net/http"
+	"strings"
+)
+
+// maxModelPeekBytes caps how much of the request body is scanned for the model field.
+const maxModelPeekBytes = 1 << 20
+
+// requestModel returns the top-level "model" field of a JSON request body. body may
+// be a truncated prefix; a model that only appears past the cap is not found.
+func requestModel(r *http.Request, body []byte) string {
+	if len(body) == 0 {
+		return ""
+	}
+	if ct := r.Header.Get("Content-Type"); ct != "" {
+		mediaType, _, err := mime.ParseMediaType(ct)
+		if err != nil || (mediaType != "application/json" && !strings.HasSuffix(mediaType, "+json")) {
+			return ""
+		}
+	}
+	if len(body) > maxModelPeekBytes {
+		body = body[:maxModelPeekBytes]
+	}
+	return peekModel(body)
+}
+
+// rewriteModel replaces the value of the top-level "model" field, leaving the rest
+// of the body byte for byte intact. ok is false when the field was not found.
+func rewriteModel(body []byte, model string) (out []byte, ok bool) {
+	dec := json.NewDecoder(bytes.NewReader(body))
+	if tok, err := dec.Token(); err != nil || tok != json.Delim('{') {
+		return nil, false
+	}
+	for dec.More() {
+		tok, err := dec.Token()
+		if err != nil {
+			return nil, false
+		}
+		keyEnd := dec.InputOffset()
+		var value json.RawMessage
+		if err := dec.Decode(&value); err != nil {
+			return nil, false
+		}
+		if key, _ := tok.(string); key != "model" {
+			continue
+		}
+		end := int(dec.InputOffset())
+		start := end - len(value)
+		if start < int(keyEnd) {
+			return nil, false
+		}
+		encoded, err := json.Marshal(model)
+		if err != nil {
+			return nil, false
+		}
+		out = make([]byte, 0, len(body)-len(value)+len(encoded))
+		out = append(out, body[:start]...)
+		out = append(out, encoded...)
+		out = append(out, body[end:]...)
+		return out, true
+	}
+	return nil, false
+}
+
+// peekModel scans the keys of a top-level JSON object without decoding nested values.
+func peekModel(body []byte) string {
+	dec := json.NewDecoder(bytes.NewReader(body))
+	if tok, err := dec.Token(); err != nil || tok != json.Delim('{') {
+		return ""
+	}
+	for dec.More() {
+		tok, err := dec.Token()
+		if err != nil {
+			return ""
+		}
+		key, _ := tok.(string)
+		if key == "model" {
+			var model string
+			if err := dec.Decode(&model); err != nil {
+				return ""
+			}
+			return strings.TrimSpace(model)
+		}
+		var skip json.RawMessage
+		if err := dec.Decode(&skip); err != nil {
+			return ""
+		}
+	}
+	return ""
+}
@@ -0,0 +1,121 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+
+	"piapi/internal/config"
+)
+
+// timeoutError describes an upstream call cut off by one of its service's timeouts.
+func timeoutError(phase string, d time.Duration) error {
+	return fmt.Errorf("%w: %s timeout of %s exceeded", config.ErrUpstreamTimeout, phase, d)
+}
+
+// attemptContext derives the context of one upstream attempt. The total timeout
+// cancels it with a timeoutError as the cause; cancel must be called once the
+// attempt is done.
+func attemptContext(parent context.Context, timeouts *config.TimeoutConfig) (context.Context, context.CancelCauseFunc) {
+	ctx, cancel := context.WithCancelCause(parent)
+	if timeouts == nil || timeouts.Total == 0 {
+		return ctx, cancel
+	}
+	total := timeouts.Total.Std()
+	timer := time.AfterFunc(total, func() { cancel(timeoutError("total", total)) })
+	return ctx, func(cause error) {
+		timer.Stop()
+		cancel(cause)
+	}
+}
+
+// boundsResponse reports whether timeouts bound how long an upstream response can
+// take to stream.
+func boundsResponse(timeouts *config.TimeoutConfig) bool {
+	return timeouts != nil && (timeouts.Total > 0 || timeouts.StreamIdle > 0)
+}
+
+// setWriteDeadline lifts the server's write deadline for an attempt whose service
+// bounds the response, and restores it, counted from the request's start, for one
+// whose service does not.
+func (g *Gateway) setWriteDeadline(w http.ResponseWriter, start time.Time, timeouts *config.TimeoutConfig) {
+	rc := http.NewResponseController(w)
+	switch {
+	case boundsResponse(timeouts):
+		_ = rc.SetWriteDeadline(time.Time{})
+	case g.WriteTimeout > 0:
+		_ = rc.SetWriteDeadline(start.Add(g.WriteTimeout))
+	}
+}
+
+// upstreamTimeout reports whether a proxy error was caused by an upstream timeout,
+// returning an error wrapping config.ErrUpstreamTimeout if so.
+func upstreamTimeout(req *http.Request, err error) error {
+	if cause := context.Cause(req.Context()); errors.Is(cause, config.ErrUpstreamTimeout) {
+		return cause
+	}
+	if errors.Is(err, context.Canceled) {
+		return nil
+	}
+	var netErr net.Error
+	if errors.As(err, &netErr) && netErr.Timeout() {
+		return fmt.Errorf("%w: %v", config.ErrUpstreamTimeout, err)
+	}
+	return nil
+}
+
+// timeoutBody enforces the stream idle timeout on a response body and reports how
+// the body ended. The idle timer restarts after every read, so only a stalled
+// stream is aborted.
+type timeoutBody struct {
+	io.ReadCloser
+	ctx    context.Context
+	idle   time.Duration
+	timer  *time.Timer
+	once   sync.Once
+	onDone func(error)
+}
+
+// wrapTimeoutBody installs a timeoutBody on res. cancel must cancel the context of
+// the request that produced res. onDone is called once, with the timeout error when
+// one cut the body off, or with nil when the body is closed otherwise.
+func wrapTimeoutBody(res *http.Response, idle time.Duration, cancel context.CancelCauseFunc, onDone func(error)) {
+	body := &timeoutBody{
+		ReadCloser: res.Body,
+		ctx:        res.Request.Context(),
+		idle:       idle,
+		onDone:     onDone,
+	}
+	if idle > 0 {
+		body.timer = time.AfterFunc(idle, func() { cancel(timeoutError("stream idle", idle)) })
+	}
+	res.Body = body
+}
+
+func (b *timeoutBody) Read(p []byte) (int, error) {
+	n, err := b.ReadCloser.Read(p)
+	if err == nil && b.timer != nil {
+		b.timer.Reset(b.idle)
+	}
+	if err != nil && err != io.EOF {
+		if cause := context.Cause(b.ctx); errors.Is(cause, config.ErrUpstreamTimeout) {
+			b.once.Do(func() { b.onDone(cause) })
+			err = cause
+		}
+	}
+	return n, err
+}
+
+func (b *timeoutBody) Close() error {
+	if b.timer != nil {
+		b.timer.Stop()
+	}
+	err := b.ReadCloser.Close()
+	b.once.Do(func() { b.onDone(nil) })
+	return err
+}
@@ -0,0 +1,274 @@
+package server
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"io"
+	"mime"
+	"net/http"
+	"strings"
+	"sync"
+
+	"piapi/internal/logging"
+)
+
+const (
+	// maxUsageJSONBytes caps how much of a non-streaming response is retained for usage parsing.
+	maxUsageJSONBytes = 4 << 20
+	// maxUsageSSELineBytes caps a single buffered SSE line; longer lines are skipped.
+	maxUsageSSELineBytes = 1 << 20
+)
+
+var usageMarker = []byte(`"usage"`)
+
+// usageTracker extracts token usage from an upstream response body as it streams
+// through to the client. Non-streaming JSON bodies are parsed once fully read; SSE
+// streams are scanned line by line so no event is held back. A translated response
+// is read on the converting goroutine while the proxy may close it or, after an
+// aborted stream, read the result, so mu guards the state below.
+type usageTracker struct {
+	mu        sync.Mutex
+	streaming bool
+	gzipped   bool
+	disabled  bool
+	buf       bytes.Buffer
+	usage     logging.TokenUsage
+	found     bool
+	finished  bool
+}
+
+// newUsageTracker returns nil when the response cannot carry a usage block we understand.
+func newUsageTracker(res *http.Response) *usageTracker {
+	if res == nil || res.Body == nil || res.StatusCode < 200 || res.StatusCode >= 300 {
+		return nil
+	}
+	mediaType, _, _ := mime.ParseMediaType(res.Header.Get("Content-Type"))
+	t := &usageTracker{}
+	switch {
+	case mediaType == "text/event-stream":
+		t.streaming = true
+	case mediaType == "application/json" || strings.HasSuffix(mediaType, "+json"):
+	default:
+		return nil
+	}
+	switch strings.ToLower(strings.TrimSpace(res.Header.Get("Content-Encoding"))) {
+	case "", "identity":
+	case "gzip":
+		if t.streaming {
+			return nil
+		}
+		t.gzipped = true
+	default:
+		return nil
+	}
+	return t
+}
+
+// wrap installs the tracker on the response body.
+func (t *usageTracker) wrap(res *http.Response) {
+	res.Body = &usageBody{ReadCloser: res.Body, tracker: t}
+}
+
+func (t *usageTracker) feed(p []byte) {
+	if len(p) == 0 {
+		return
+	}
+	if t.disabled || t.finished {
+		return
+	}
+	if !t.streaming {
+		if t.buf.Len()+len(p) > maxUsageJSONBytes {
+			t.disabled = true
+			t.buf.Reset()
+			return
+		}
+		t.buf.Write(p)
+		return
+	}
+	for len(p) > 0 {
+		idx := bytes.IndexByte(p, '\n')
+		if idx < 0 {
+			if t.buf.Len()+len(p) > maxUsageSSELineBytes {
+				// Drop the oversized line; parsing resumes at the next newline.
+				t.buf.Reset()
+				t.buf.WriteByte(0)
+			} else {
+				t.buf.Write(p)
+			}
+			return
+		}
+		if t.buf.Len() > 0 {
+			if t.buf.Len()+idx <= maxUsageSSELineBytes {
+				t.buf.Write(p[:idx])
+				t.scanLine(t.buf.Bytes())
+			}
+			t.buf.Reset()
+		} else {
+			t.scanLine(p[:idx])
+		}
+		p = p[idx+1:]
+	}
+}
+
+func (t *usageTracker) scanLine(line []byte) {
+	line = bytes.TrimRight(line, "\r")
+	if !bytes.HasPrefix(line, []byte("data:")) {
+		return
+	}
+	payload := bytes.TrimSpace(line[len("data:"):])
+	if !bytes.Contains(payload, usageMarker) {
+		return
+	}
+	t.merge(payload)
+}
+
+func (t *usageTracker) finish() {
+	if t.finished {
+		return
+	}
+	t.finished = true
+	if t.streaming {
+		if t.buf.Len() > 0 {
+			t.scanLine(t.buf.Bytes())
+		}
+		t.buf.Reset()
+		return
+	}
+	if t.disabled || t.buf.Len() == 0 {
+		return
+	}
+	payload := t.buf.Bytes()
+	if t.gzipped {
+		zr, err := gzip.NewReader(bytes.NewReader(payload))
+		if err != nil {
+			return
+		}
+		decoded, err := io.ReadAll(io.LimitReader(zr, maxUsageJSONBytes))
+		if err != nil {
+			return
+		}
+		payload = decoded
+	}
+	t.merge(payload)
+	t.buf.Reset()
+}
+
+func (t *usageTracker) merge(payload []byte) {
+	fields, ok := extractUsageFields(payload)
+	if !ok {
+		return
+	}
+	fields.applyTo(&t.usage)
+	t.found = true
+}
+
+// result returns the usage found so far, or nil if the upstream reported none.
+func (t *usageTracker) result() *logging.TokenUsage {
+	if t == nil {
+		return nil
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.finish()
+	if !t.found {
+		return nil
+	}
+	out := t.usage
+	return &out
+}
+
+// usageBody tees everything read by the proxy into the tracker.
+type usageBody struct {
+	io.ReadCloser
+	tracker *usageTracker
+}
+
+func (b *usageBody) Read(p []byte) (int, error) {
+	n, err := b.ReadCloser.Read(p)
+	b.tracker.mu.Lock()
+	b.tracker.feed(p[:n])
+	if err == io.EOF {
+		b.tracker.finish()
+	}
+	b.tracker.mu.Unlock()
+	return n, err
+}
+
+func (b *usageBody) Close() error {
+	b.tracker.mu.Lock()
+	b.tracker.finish()
+	b.tracker.mu.Unlock()
+	return b.ReadCloser.Close()
+}
+
+// usageFields is the union of the OpenAI (Chat Completions and Responses) and
+// Anthropic Messages usage objects. Pointers distinguish absent from zero so that
+// partial usage in later stream events only overrides what they actually carry.
+type usageFields struct {
+	PromptTokens             *int64 `json:"prompt_tokens"`
+	CompletionTokens         *int64 `json:"completion_tokens"`
+	InputTokens              *int64 `json:"input_tokens"`
+	OutputTokens             *int64 `json:"output_tokens"`
+	CacheCreationInputTokens *int64 `json:"cache_creation_input_tokens"`
+	CacheReadInputTokens     *int64 `json:"cache_read_input_tokens"`
+	PromptTokensDetails      *struct {
+		CachedTokens *int64 `json:"cached_tokens"`
+	} `json:"prompt_tokens_details"`
+	InputTokensDetails *struct {
+		CachedTokens *int64 `json:"cached_tokens"`
+	} `json:"input_tokens_details"`
+}
+
+// usageEnvelope covers where usage appears: top level (OpenAI chat, Anthropic
+// responses and message_delta), under "message" (Anthropic message_start) and under
+// "response" (OpenAI Responses stream events).
+type usageEnvelope struct {
+	Usage   *usageFields `json:"usage"`
+	Message *struct {
+		Usage *usageFields `json:"usage"`
+	} `json:"message"`
+	Response *struct {
+		Usage *usageFields `json:"usage"`
+	} `json:"response"`
+}
+
+func extractUsageFields(payload []byte) (*usageFields, bool) {
+	if !bytes.Contains(payload, usageMarker) {
+		return nil, false
+	}
+	var env usageEnvelope
+	if err := json.Unmarshal(payload, &env); err != nil {
+		return nil, false
+	}
+	switch {
+	case env.Usage != nil:
+		return env.Usage, true
+	case env.Message != nil && env.Message.Usage != nil:
+		return env.Message.Usage, true
+	case env.Response != nil && env.Response.Usage != nil:
+		return env.Response.Usage, true
+	}
+	return nil, false
+}
+
+func (f *usageFields) applyTo(u *logging.TokenUsage) {
+	set := func(dst *int64, vals ...*int64) {
+		for _, v := range vals {
+			if v != nil {
+				*dst = *v
+				return
+			}
+		}
+	}
+	set(&u.PromptTokens, f.PromptTokens, f.InputTokens)
+	set(&u.CompletionTokens, f.CompletionTokens, f.OutputTokens)
+	set(&u.CacheWriteTokens, f.CacheCreationInputTokens)
+	set(&u.CacheReadTokens, f.CacheReadInputTokens)
+	if f.PromptTokensDetails != nil {
+		set(&u.CacheReadTokens, f.PromptTokensDetails.CachedTokens)
+	}
+	if f.InputTokensDetails != nil {
+		set(&u.CacheReadTokens, f.InputTokensDetails.CachedTokens)
+	}
+}
@@ -0,0 +1,141 @@
+package server
+
+import (
+	"bytes"
+	"compress/gzip"
+	"io"
+	"net/http"
+	"strings"
+	"testing"
+
+	"piapi/internal/logging"
+)
+
+func readThroughTracker(t *testing.T, header http.Header, body []byte, chunk int) *logging.TokenUsage {
+	t.Helper()
+	res := &http.Response{
+		StatusCode: http.StatusOK,
+		Header:     header,
+		Body:       io.NopCloser(bytes.NewReader(body)),
+	}
+	tracker := newUsageTracker(res)
+	if tracker == nil {
+		return nil
+	}
+	tracker.wrap(res)
+
+	buf := make([]byte, chunk)
+	var relayed bytes.Buffer
+	for {
+		n, err := res.Body.Read(buf)
+		relayed.Write(buf[:n])
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatalf("read body: %v", err)
+		}
+	}
+	_ = res.Body.Close()
+	if !bytes.Equal(relayed.Bytes(), body) {
+		t.Fatalf("body altered while tracking usage")
+	}
+	return tracker.result()
+}
+
+func TestUsageTrackerParsesResponses(t *testing.T) {
+	jsonHeader := http.Header{"Content-Type": []string{"application/json"}}
+	sseHeader := http.Header{"Content-Type": []string{"text/event-stream; charset=utf-8"}}
+
+	cases := []struct {
+		name   string
+		header http.Header
+		body   string
+		want   *logging.TokenUsage
+	}{
+		{
+			name:   "openai chat json",
+			header: jsonHeader,
+			body:   `{"id":"x","choices":[],"usage":{"prompt_tokens":12,"completion_tokens":5,"total_tokens":17,"prompt_tokens_details":{"cached_tokens":4}}}`,
+			want:   &logging.TokenUsage{PromptTokens: 12, CompletionTokens: 5, CacheReadTokens: 4},
+		},
+		{
+			name:   "anthropic messages json",
+			header: jsonHeader,
+			body:   `{"type":"message","usage":{"input_tokens":20,"output_tokens":7,"cache_creation_input_tokens":3,"cache_read_input_tokens":9}}`,
+			want:   &logging.TokenUsage{PromptTokens: 20, CompletionTokens: 7, CacheReadTokens: 9, CacheWriteTokens: 3},
+		},
+		{
+			name:   "openai chat stream",
+			header: sseHeader,
+			body: "data: {\"choices\":[{\"delta\":{\"content\":\"hi\"}}]}\n\n" +
+				"data: {\"choices\":[],\"usage\":{\"prompt_tokens\":8,\"completion_tokens\":2}}\n\n" +
+				"data: [DONE]\n\n",
+			want: &logging.TokenUsage{PromptTokens: 8, CompletionTokens: 2},
+		},
+		{
+			name:   "anthropic messages stream",
+			header: sseHeader,
+			body: "event: message_start\n" +
+				"data: {\"type\":\"message_start\",\"message\":{\"usage\":{\"input_tokens\":30,\"output_tokens\":1,\"cache_read_input_tokens\":10}}}\n\n" +
+				"event: content_block_delta\n" +
+				"data: {\"type\":\"content_block_delta\",\"delta\":{\"text\":\"hello\"}}\n\n" +
+				"event: message_delta\n" +
+				"data: {\"type\":\"message_delta\",\"usage\":{\"output_tokens\":15}}\n\n",
+			want: &logging.TokenUsage{PromptTokens: 30, CompletionTokens: 15, CacheReadTokens: 10},
+		},
+		{
+			name:   "openai responses stream",
+			header: sseHeader,
+			body: "event: response.completed\r\n" +
+				"data: {\"type\":\"response.completed\",\"response\":{\"usage\":{\"input_tokens\":40,\"output_tokens\":6,\"input_tokens_details\":{\"cached_tokens\":32}}}}\r\n\r\n",
+			want: &logging.TokenUsage{PromptTokens: 40, CompletionTokens: 6, CacheReadTokens: 32},
+		},
+		{
+			name:   "no usage",
+			header: jsonHeader,
+			body:   `{"data":[]}`,
+		},
+		{
+			name:   "not json",
+			header: http.Header{"Content-Type": []string{"text/plain"}},
+			body:   `"usage":{"prompt_tokens":1}`,
+		},
+	}
+
+	for _, tc := range cases {
+		for _, chunk := range []int{3, 4096} {
+			got := readThroughTracker(t, tc.header, []byte(tc.body), chunk)
+			switch {
+			case tc.want == nil && got != nil:
+				t.Fatalf("%s (chunk %d): expected no usage, got %+v", tc.name, chunk, got)
+			case tc.want != nil && (got == nil || *got != *tc.want):
+				t.Fatalf("%s (chunk %d): expected %+v, got %+v", tc.name, chunk, tc.want, got)
+			}
+		}
+	}
+}
+
+func TestUsageTrackerDecodesGzipJSON(t *testing.T) {
+	var compressed bytes.Buffer
+	zw := gzip.NewWriter(&compressed)
+	_, _ = zw.Write([]byte(`{"usage":{"prompt_tokens":3,"completion_tokens":4}}`))
+	_ = zw.Close()
+
+	header := http.Header{
+		"Content-Type":     []string{"application/json"},
+		"Content-Encoding": []string{"gzip"},
+	}
+	got := readThroughTracker(t, header, compressed.Bytes(), 16)
+	if got == nil || got.PromptTokens != 3 || got.CompletionTokens != 4 {
+		t.Fatalf("unexpected usage from gzip body: %+v", got)
+	}
+}
+
+func TestUsageTrackerSkipsOversizedJSON(t *testing.T) {
+	body := `{"pad":"` + strings.Repeat("x", maxUsageJSONBytes) + `","usage":{"prompt_tokens":1}}`
+	got := readThroughTracker(t, http.Header{"Content-Type": []string{"application/json"}}, []byte(body), 64<<10)
+	if got != nil {
+		t.Fatalf("expected oversized body to be skipped, got %+v", got)
+	}
+}
@@ -25,7 +25,7 @@ export default function ObservabilityPage() {
           </p>
           <pre className="bg-muted/50 p-4 rounded-sm text-xs overflow-auto">
             <code>{`curl -H "Authorization: Bearer <ADMIN_TOKEN>" \
-  "http://<host>:9200/piadmin/api/stats/routes?apiKey=<user_api_key>&service=<service_type>"`}</code>
+  "http://<host>:9200/piadmin/api/stats/routes?user=<user_name>&service=<service_type>"`}</code>
           </pre>
           <p>返回结果包含每个候选的请求数、错误数、错误率、最后一次错误信息以及当前健康状态。</p>
           <p>
@@ -38,6 +38,12 @@ export default function ObservabilityPage() {
             <li>
               <code>effective_weight</code>：实际参与调度的权重。对于 <code>adaptive_rr</code>，它会随质量动态变化。
             </li>
+            <li>
+              <code>latency_ewma_ms</code>：首字节时间的指数滑动平均，<code>least_latency</code> 据此选择候选。
+            </li>
+            <li>
+              <code>in_flight</code>：该 key 当前在途的请求数，<code>least_outstanding</code> 据此选择候选。
+            </li>
           </ul>
           <p>
             默认情况下窗口半衰期为 60s，可通过环境变量
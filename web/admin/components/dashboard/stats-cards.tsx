@@ -1,6 +1,6 @@
 "use client"
 
-import { Activity, CheckCircle2, XCircle, Clock } from "lucide-react"
+import { Activity, CheckCircle2, XCircle, Clock, Coins } from "lucide-react"
 import type { DashboardStats } from "@/lib/api"
 
 interface StatsCardsProps {
@@ -27,6 +27,8 @@ export function StatsCards({
         success_count: 0,
         error_count: 0,
         avg_latency_ms: 0,
+        prompt_tokens: 0,
+        completion_tokens: 0,
       }
     }
 
@@ -40,6 +42,8 @@ export function StatsCards({
         success_count: rs.success_count ?? 0,
         error_count: rs.error_count ?? 0,
         avg_latency_ms: rs.avg_latency_ms ?? 0,
+        prompt_tokens: rs.token_usage?.prompt_tokens ?? 0,
+        completion_tokens: rs.token_usage?.completion_tokens ?? 0,
       }
     }
 
@@ -60,6 +64,8 @@ export function StatsCards({
         success_count: 0,
         error_count: 0,
         avg_latency_ms: 0,
+        prompt_tokens: 0,
+        completion_tokens: 0,
       }
     }
 
@@ -74,6 +80,8 @@ export function StatsCards({
       success_count: success,
       error_count: error,
       avg_latency_ms: 0, // Dimension stats don't have latency data
+      prompt_tokens: dimensionStats.prompt_tokens || 0,
+      completion_tokens: dimensionStats.completion_tokens || 0,
     }
   }
 
@@ -106,12 +114,18 @@ export function StatsCards({
       icon: Clock,
       description: "响应时间",
     },
+    {
+      title: "Token 用量",
+      value: (requestStats.prompt_tokens + requestStats.completion_tokens).toLocaleString(),
+      icon: Coins,
+      description: `输入 ${requestStats.prompt_tokens.toLocaleString()} / 输出 ${requestStats.completion_tokens.toLocaleString()}`,
+    },
   ]
 
   if (isLoading) {
     return (
-      <div className="grid gap-4 md:grid-cols-2 lg:grid-cols-4">
-        {[1, 2, 3, 4].map((i) => (
+      <div className="grid gap-4 md:grid-cols-2 lg:grid-cols-5">
+        {[1, 2, 3, 4, 5].map((i) => (
           <div key={i} className="space-y-2">
             <div className="h-4 w-24 bg-muted animate-pulse rounded" />
             <div className="h-8 w-16 bg-muted animate-pulse rounded" />
@@ -123,7 +137,7 @@ export function StatsCards({
   }
 
   return (
-    <div className="grid gap-6 md:grid-cols-2 lg:grid-cols-4">
+    <div className="grid gap-6 md:grid-cols-2 lg:grid-cols-5">
       {statItems.map((item) => {
         const Icon = item.icon
         return (
@@ -17,7 +17,7 @@ import type { Provider } from "@/hooks/use-providers"
 interface ServiceRouteCardProps {
   serviceType: string
   route: UserServiceRoute
-  userApiKey: string
+  userName: string
   providers: Provider[]
   onUpdateRoute: (serviceType: string, updatedRoute: UserServiceRoute) => Promise<void>
 }
@@ -42,7 +42,7 @@ const DEFAULT_STRATEGIES = [
   {
     value: "weighted_rr",
     label: "静态加权轮询 (weighted_rr)",
-    description: "按照配置权重分配流量，权重固定不随运行状况变化",
+    description: "按照配置权重平滑分配流量，各候选穿插命中，权重固定不随运行状况变化",
   },
   {
     value: "adaptive_rr",
@@ -54,6 +54,21 @@ const DEFAULT_STRATEGIES = [
     label: "粘性健康优先 (sticky_healthy)",
     description: "粘住最近成功的候选，除非失败或被禁用才切换到下一家，适合主节点稳定时的优先命中",
   },
+  {
+    value: "least_latency",
+    label: "最低延迟优先 (least_latency)",
+    description: "选择首字节时间滑动平均最低的候选，尚未测量的候选会先被尝试",
+  },
+  {
+    value: "least_outstanding",
+    label: "最少在途请求 (least_outstanding)",
+    description: "随机抽取两个候选，选择在途请求更少的一个，适合请求耗时差异大的场景",
+  },
+  {
+    value: "consistent_hash",
+    label: "会话一致性哈希 (consistent_hash)",
+    description: "按会话头、用户或提示前缀固定命中同一个 key，提升提示缓存命中率；候选不可用时只迁移其上的会话",
+  },
 ]
 
 function normalizeRoute(route: UserServiceRoute): NormalizedRoute {
@@ -138,7 +153,7 @@ function findProvider(providers: Provider[], name: string | undefined) {
   return providers.find((p) => p.name === name)
 }
 
-export function ServiceRouteCard({ serviceType, route, userApiKey, providers, onUpdateRoute }: ServiceRouteCardProps) {
+export function ServiceRouteCard({ serviceType, route, userName, providers, onUpdateRoute }: ServiceRouteCardProps) {
   const normalized = useMemo(() => normalizeRoute(route), [route])
   const [formRoute, setFormRoute] = useState<NormalizedRoute>(normalized)
   const [errorMessage, setErrorMessage] = useState("")
@@ -150,7 +165,7 @@ export function ServiceRouteCard({ serviceType, route, userApiKey, providers, on
 
   const isDirty = useMemo(() => JSON.stringify(formRoute) !== JSON.stringify(normalized), [formRoute, normalized])
 
-  const { stats, isLoading, error } = useRouteStats(userApiKey, serviceType)
+  const { stats, isLoading, error } = useRouteStats(userName, serviceType)
 
   const statsByKey = useMemo(() => {
     const map = new Map<string, CandidateRuntimeStatus>()
@@ -335,8 +350,14 @@ export function ServiceRouteCard({ serviceType, route, userApiKey, providers, on
                   const statusLabel = candidate.enabled
                     ? stat
                       ? stat.healthy
-                        ? "健康"
-                        : "异常"
+                        ? stat.cooldown_until && new Date(stat.cooldown_until) > new Date()
+                          ? "限流冷却"
+                          : "健康"
+                        : stat.invalid
+                          ? "key 已失效"
+                          : stat.circuit_state === "half_open"
+                          ? "半开"
+                          : "熔断"
                       : "未知"
                     : "已停用"
 
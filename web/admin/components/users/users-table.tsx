@@ -3,6 +3,7 @@
 import { Fragment, useMemo, useState } from "react"
 import type { User, UserServiceRoute } from "@/hooks/use-users"
 import type { Provider } from "@/hooks/use-providers"
+import { apiClient } from "@/lib/api"
 import { Button } from "@/components/ui/button"
 import { Input } from "@/components/ui/input"
 import { Switch } from "@/components/ui/switch"
@@ -99,6 +100,7 @@ const routesToServicesMap = (routes: RouteFormEntry[]): User["services"] => {
 
 export function UsersTable({ users, providers, onAdd, onUpdate, onDelete }: UsersTableProps) {
   const [visibleKeys, setVisibleKeys] = useState<Set<string>>(new Set())
+  const [revealedKeys, setRevealedKeys] = useState<Record<string, string>>({})
   const [isOpen, setIsOpen] = useState(false)
   const [formData, setFormData] = useState<User>({ name: "", api_key: generateApiKey(), services: {} })
   const [errors, setErrors] = useState<string[]>([])
@@ -203,7 +205,26 @@ const findProvider = (providers: Provider[], name: string | undefined) =>
     return routeErrors
   }
 
-  const toggleKeyVisibility = (name: string) => {
+  // The config API only returns masked keys; the full key is fetched on demand.
+  const revealUserKey = async (user: User) => {
+    if (revealedKeys[user.name]) {
+      return revealedKeys[user.name]
+    }
+    try {
+      const { value } = await apiClient.revealSecret({ user: user.name })
+      setRevealedKeys((prev) => ({ ...prev, [user.name]: value }))
+      return value
+    } catch (err) {
+      console.warn("Failed to reveal user key", err)
+      return user.api_key
+    }
+  }
+
+  const toggleKeyVisibility = async (user: User) => {
+    const name = user.name
+    if (!visibleKeys.has(name)) {
+      await revealUserKey(user)
+    }
     setVisibleKeys((prev) => {
       const next = new Set(prev)
       if (next.has(name)) {
@@ -255,7 +276,7 @@ const findProvider = (providers: Provider[], name: string | undefined) =>
     const baseUrl = process.env.NEXT_PUBLIC_API_BASE ?? fallbackOrigin
     const lines: string[] = []
     lines.push(`User: ${user.name}`)
-    lines.push(`API Key: ${user.api_key}`)
+    lines.push(`API Key: ${await revealUserKey(user)}`)
 
     if (services.length > 0) {
       lines.push("Services:")
@@ -707,10 +728,10 @@ const findProvider = (providers: Provider[], name: string | undefined) =>
                     <td className="px-6 py-4">
                       <div className="flex items-center gap-2">
                         <span className="font-mono text-xs bg-secondary/50 px-2 py-1 rounded-sm">
-                          {isVisible ? user.api_key : "••••••••••••••••••••••••"}
+                          {isVisible ? revealedKeys[user.name] ?? user.api_key : "••••••••••••••••••••••••"}
                         </span>
                         <button
-                          onClick={() => toggleKeyVisibility(user.name)}
+                          onClick={() => void toggleKeyVisibility(user)}
                           className="p-1 hover:bg-secondary/50 rounded-sm transition-colors"
                           title={isVisible ? "Hide" : "Show"}
                         >
@@ -776,7 +797,7 @@ const findProvider = (providers: Provider[], name: string | undefined) =>
                             key={serviceType}
                             serviceType={serviceType}
                             route={route}
-                            userApiKey={user.api_key}
+                            userName={user.name}
                             providers={providers}
                             onUpdateRoute={(targetService, updatedRoute) =>
                               handleUpdateRouteForUser(user, targetService, updatedRoute)
@@ -3,11 +3,11 @@
 import useSWR from "swr"
 import { apiClient, type CandidateRuntimeStatus } from "@/lib/api"
 
-export function useRouteStats(apiKey?: string, serviceType?: string) {
-  const key = apiKey && serviceType ? ["route-stats", apiKey, serviceType] : null
+export function useRouteStats(userName?: string, serviceType?: string) {
+  const key = userName && serviceType ? ["route-stats", userName, serviceType] : null
   const { data, error, isLoading, mutate } = useSWR<CandidateRuntimeStatus[]>(
     key,
-    () => apiClient.getRouteStats(apiKey!, serviceType!),
+    () => apiClient.getRouteStats(userName!, serviceType!),
     {
       refreshInterval: 10000,
       revalidateOnFocus: false,
@@ -14,12 +14,98 @@ export interface Service {
     name: string
     prefix?: string
   }
+  pricing?: PricingConfig
+  models?: string[]
+  model_map?: Record<string, string>
+  protocol?: string
+  chat_only?: boolean
+  headers?: HeaderPolicy
+  timeouts?: TimeoutConfig
+  circuit_breaker?: CircuitBreakerConfig
+  upstream_rate_limit?: UpstreamRateLimitConfig
+  health_check?: HealthCheckConfig
+}
+
+export interface UpstreamRateLimitConfig {
+  default_cooldown?: string
+  max_cooldown?: string
+  min_remaining_requests?: number
+  min_remaining_tokens?: number
+}
+
+export interface HealthCheckConfig {
+  path: string
+  method?: string
+  body?: string
+  expected_status?: number
+  interval?: string
+  timeout?: string
+}
+
+export interface HealthCheckStatus {
+  healthy: boolean
+  status?: number
+  error?: string
+  latency_ms: number
+  checked_at: string
+  consecutive_failures?: number
+}
+
+export interface CircuitBreakerConfig {
+  failure_threshold?: number
+  window?: string
+  open_timeout?: string
+  max_open_timeout?: string
+  half_open_requests?: number
+}
+
+export interface TimeoutConfig {
+  connect?: string
+  tls_handshake?: string
+  response_header?: string
+  total?: string
+  stream_idle?: string
+}
+
+export interface HeaderRules {
+  set?: Record<string, string>
+  add?: Record<string, string>
+  remove?: string[]
+}
+
+export interface HeaderPolicy {
+  request?: HeaderRules
+  response?: HeaderRules
+}
+
+export interface PricingConfig {
+  prompt?: number
+  completion?: number
+  cache_read?: number
+  cache_write?: number
 }
 
 export interface Provider {
   name: string
   api_keys: ApiKey
   services: Service[]
+  transport?: TransportConfig
+  key_limits?: Record<string, KeyLimitConfig>
+}
+
+export interface KeyLimitConfig {
+  max_concurrent: number
+  max_queue?: number
+  queue_timeout?: string
+}
+
+export interface TransportConfig {
+  proxy?: string
+  ca_file?: string
+  cert_file?: string
+  key_file?: string
+  server_name?: string
+  http2?: boolean
 }
 
 export interface UserServiceRoute {
@@ -27,6 +113,38 @@ export interface UserServiceRoute {
   provider_key_name?: string
   strategy?: string
   candidates?: UserServiceCandidate[]
+  failover?: FailoverConfig
+  rate_limit?: RateLimitConfig
+  budget?: BudgetConfig
+  model_aliases?: Record<string, string>
+  headers?: HeaderPolicy
+  consistent_hash?: ConsistentHashConfig
+}
+
+export interface ConsistentHashConfig {
+  source?: 'header' | 'user' | 'prompt'
+  header?: string
+  prompt_prefix?: number
+}
+
+export interface FailoverConfig {
+  max_attempts?: number
+  deadline?: string
+}
+
+export interface RateLimitConfig {
+  requests_per_minute?: number
+  max_concurrent?: number
+}
+
+export interface BudgetLimit {
+  tokens?: number
+  cost?: number
+}
+
+export interface BudgetConfig {
+  daily?: BudgetLimit
+  monthly?: BudgetLimit
 }
 
 export interface UserServiceCandidate {
@@ -35,14 +153,63 @@ export interface UserServiceCandidate {
   weight?: number
   enabled?: boolean
   tags?: string[]
+  models?: string[]
+  headers?: HeaderPolicy
 }
 
 export interface User {
   name: string
   api_key: string
+  api_key_hash?: string
   services: {
     [serviceType: string]: UserServiceRoute
   }
+  rate_limit?: RateLimitConfig
+  budget?: BudgetConfig
+}
+
+export interface UserKey {
+  user: string
+  api_key: string
+  api_key_hash: string
+}
+
+export type SecretTarget = { provider: string; key: string } | { user: string }
+
+export interface RevealedSecret {
+  provider?: string
+  key?: string
+  user?: string
+  value: string
+}
+
+export interface RateLimitStatus {
+  user: string
+  service_type?: string
+  requests_per_minute?: number
+  max_concurrent?: number
+  available_requests?: number
+  in_flight: number
+  rejected: number
+  last_rejected?: string
+}
+
+export interface BudgetPeriodStatus {
+  period: 'daily' | 'monthly'
+  start: string
+  reset_at: string
+  used: { tokens: number; cost: number }
+  credit: { tokens: number; cost: number }
+  limit: BudgetLimit
+  remaining: { tokens: number; cost: number }
+  exhausted: boolean
+}
+
+export interface BudgetStatus {
+  user: string
+  service_type?: string
+  daily?: BudgetPeriodStatus
+  monthly?: BudgetPeriodStatus
 }
 
 export interface CandidateRuntimeStatus {
@@ -51,21 +218,59 @@ export interface CandidateRuntimeStatus {
   weight: number
   enabled: boolean
   healthy: boolean
+  circuit_state?: 'closed' | 'half_open' | 'open'
+  invalid?: boolean
+  invalid_since?: string
+  invalid_status?: number
   unhealthy_until?: string
+  cooldown_until?: string
   total_requests: number
   total_errors: number
+  total_timeouts?: number
   error_rate: number
   smoothed_error_rate?: number
   effective_weight?: number
+  latency_ewma_ms?: number
+  latency_samples?: number
+  in_flight: number
   last_status: number
   last_error?: string
   last_updated?: string
   tags?: string[]
+  health_check?: HealthCheckStatus
+}
+
+export interface KeyHealthStatus {
+  provider_name: string
+  provider_key_name: string
+  service_type: string
+  routes: number
+  healthy: boolean
+  circuit_state: 'closed' | 'half_open' | 'open'
+  invalid: boolean
+  invalid_since?: string
+  invalid_status?: number
+  unhealthy_until?: string
+  cooldown_until?: string
+  total_requests: number
+  total_errors: number
+  latency_ewma_ms?: number
+  latency_samples?: number
+  in_flight: number
+  last_status: number
+  last_error?: string
+  last_updated?: string
+  health_check?: HealthCheckStatus
 }
 
 export interface Config {
   providers: Provider[]
   users: User[]
+  client_auth?: Record<string, ClientAuthConfig>
+}
+
+export interface ClientAuthConfig {
+  styles: string[]
 }
 
 export interface RequestLogEntry {
@@ -75,12 +280,30 @@ export interface RequestLogEntry {
   service_type: string
   provider: string
   provider_key: string
+  model?: string
+  upstream_model?: string
   method: string
   path: string
   upstream_url: string
   status_code: number
   latency_ms: number
   error?: string
+  usage?: TokenUsage
+}
+
+export interface TokenUsage {
+  prompt_tokens: number
+  completion_tokens: number
+  cache_read_tokens?: number
+  cache_write_tokens?: number
+}
+
+export interface DimensionStats {
+  total: number
+  success: number
+  error: number
+  prompt_tokens?: number
+  completion_tokens?: number
 }
 
 export interface DashboardLogsResponse {
@@ -95,11 +318,13 @@ export interface DashboardStats {
     error_count: number
     success_rate: number
     avg_latency_ms: number
-    by_service: Record<string, { total: number; success: number; error: number }>
-    by_provider: Record<string, { total: number; success: number; error: number }>
-    by_user: Record<string, { total: number; success: number; error: number }>
+    token_usage?: TokenUsage & { total_tokens: number }
+    by_service: Record<string, DimensionStats>
+    by_provider: Record<string, DimensionStats>
+    by_user: Record<string, DimensionStats>
   }
   providers: string[]
+  invalid_keys?: KeyHealthStatus[]
   users: string[]
   service_types: string[]
 }
@@ -187,11 +412,74 @@ class ApiClient {
     return this.request<string>('/config/raw')
   }
 
-  async getRouteStats(apiKey: string, service: string): Promise<CandidateRuntimeStatus[]> {
-    const params = new URLSearchParams({ apiKey, service })
+  async getRouteStats(user: string, service: string): Promise<CandidateRuntimeStatus[]> {
+    const params = new URLSearchParams({ user, service })
     return this.request<CandidateRuntimeStatus[]>(`/stats/routes?${params.toString()}`)
   }
 
+  async getRateLimitStats(): Promise<RateLimitStatus[]> {
+    return this.request<RateLimitStatus[]>('/stats/ratelimits')
+  }
+
+  async getBudgets(user?: string): Promise<BudgetStatus[]> {
+    const params = new URLSearchParams()
+    if (user) params.set('user', user)
+    const query = params.toString()
+    return this.request<BudgetStatus[]>(`/budgets${query ? `?${query}` : ''}`)
+  }
+
+  async resetBudget(user: string, options?: { service_type?: string; period?: 'daily' | 'monthly' }): Promise<BudgetStatus[]> {
+    return this.request<BudgetStatus[]>('/budgets/reset', {
+      method: 'POST',
+      body: JSON.stringify({ user, ...options }),
+    })
+  }
+
+  /**
+   * Generate a new key for a user. Only its hash is stored in the configuration;
+   * the returned key cannot be retrieved again.
+   */
+  async rotateUserKey(user: string): Promise<UserKey> {
+    return this.request<UserKey>('/users/key', {
+      method: 'POST',
+      body: JSON.stringify({ user }),
+    })
+  }
+
+  /**
+   * Reveal the full value of a provider key or user key. Configuration endpoints
+   * only return masked secrets.
+   */
+  async revealSecret(target: SecretTarget): Promise<RevealedSecret> {
+    return this.request<RevealedSecret>('/secrets/reveal', {
+      method: 'POST',
+      body: JSON.stringify(target),
+    })
+  }
+
+  /**
+   * Put a provider key that was marked invalid after repeated authentication failures
+   * back into rotation.
+   */
+  async enableKey(provider: string, key: string): Promise<KeyHealthStatus[]> {
+    return this.request<KeyHealthStatus[]>('/keys/enable', {
+      method: 'POST',
+      body: JSON.stringify({ provider, key }),
+    })
+  }
+
+  async topUpBudget(
+    user: string,
+    period: 'daily' | 'monthly',
+    amount: { tokens?: number; cost?: number },
+    serviceType?: string,
+  ): Promise<BudgetStatus[]> {
+    return this.request<BudgetStatus[]>('/budgets/topup', {
+      method: 'POST',
+      body: JSON.stringify({ user, service_type: serviceType, period, ...amount }),
+    })
+  }
+
   /**
    * Get dashboard logs with optional filters
    */
@@ -343,7 +631,41 @@ class ApiClient {
         yaml += `    - name: ${provider.name}\n`
         yaml += `      apiKeys:\n`
         for (const [keyName, keyValue] of Object.entries(provider.api_keys)) {
-          yaml += `        ${keyName}: ${keyValue}\n`
+          // Quoted, as masked values start with "*", which YAML reads as an alias.
+          yaml += `        ${keyName}: ${JSON.stringify(keyValue)}\n`
+        }
+        if (provider.transport) {
+          const { proxy, ca_file, cert_file, key_file, server_name, http2 } = provider.transport
+          const fields: [string, string | undefined][] = [
+            ['proxy', proxy],
+            ['caFile', ca_file],
+            ['certFile', cert_file],
+            ['keyFile', key_file],
+            ['serverName', server_name],
+          ]
+          const set = fields.filter(([, value]) => value)
+          if (set.length > 0 || http2 !== undefined) {
+            yaml += `      transport:\n`
+            for (const [name, value] of set) {
+              yaml += `        ${name}: ${JSON.stringify(value)}\n`
+            }
+            if (http2 !== undefined) {
+              yaml += `        http2: ${http2}\n`
+            }
+          }
+        }
+        if (provider.key_limits && Object.keys(provider.key_limits).length > 0) {
+          yaml += `      keyLimits:\n`
+          for (const [keyName, limit] of Object.entries(provider.key_limits)) {
+            yaml += `        ${keyName}:\n`
+            yaml += `          maxConcurrent: ${limit.max_concurrent}\n`
+            if (limit.max_queue) {
+              yaml += `          maxQueue: ${limit.max_queue}\n`
+            }
+            if (limit.queue_timeout) {
+              yaml += `          queueTimeout: ${limit.queue_timeout}\n`
+            }
+          }
         }
         if (provider.services && provider.services.length > 0) {
           yaml += `      services:\n`
@@ -358,6 +680,97 @@ class ApiClient {
                 yaml += `            prefix: '${service.auth.prefix}'\n`
               }
             }
+            if (service.pricing) {
+              const fields: [string, number | undefined][] = [
+                ['prompt', service.pricing.prompt],
+                ['completion', service.pricing.completion],
+                ['cacheRead', service.pricing.cache_read],
+                ['cacheWrite', service.pricing.cache_write],
+              ]
+              const set = fields.filter(([, value]) => value)
+              if (set.length > 0) {
+                yaml += `          pricing:\n`
+                for (const [name, value] of set) {
+                  yaml += `            ${name}: ${value}\n`
+                }
+              }
+            }
+            yaml += this.modelsToYAML(service.models, '          ')
+            yaml += this.modelMapToYAML('modelMap', service.model_map, '          ')
+            if (service.protocol) {
+              yaml += `          protocol: ${service.protocol}\n`
+            }
+            if (service.chat_only) {
+              yaml += `          chatOnly: true\n`
+            }
+            yaml += this.headersToYAML(service.headers, '          ')
+            if (service.timeouts) {
+              const fields: [string, string | undefined][] = [
+                ['connect', service.timeouts.connect],
+                ['tlsHandshake', service.timeouts.tls_handshake],
+                ['responseHeader', service.timeouts.response_header],
+                ['total', service.timeouts.total],
+                ['streamIdle', service.timeouts.stream_idle],
+              ]
+              const set = fields.filter(([, value]) => value)
+              if (set.length > 0) {
+                yaml += `          timeouts:\n`
+                for (const [name, value] of set) {
+                  yaml += `            ${name}: ${value}\n`
+                }
+              }
+            }
+            if (service.circuit_breaker) {
+              const fields: [string, string | number | undefined][] = [
+                ['failureThreshold', service.circuit_breaker.failure_threshold],
+                ['window', service.circuit_breaker.window],
+                ['openTimeout', service.circuit_breaker.open_timeout],
+                ['maxOpenTimeout', service.circuit_breaker.max_open_timeout],
+                ['halfOpenRequests', service.circuit_breaker.half_open_requests],
+              ]
+              const set = fields.filter(([, value]) => value)
+              if (set.length > 0) {
+                yaml += `          circuitBreaker:\n`
+                for (const [name, value] of set) {
+                  yaml += `            ${name}: ${value}\n`
+                }
+              }
+            }
+            if (service.upstream_rate_limit) {
+              const fields: [string, string | number | undefined][] = [
+                ['defaultCooldown', service.upstream_rate_limit.default_cooldown],
+                ['maxCooldown', service.upstream_rate_limit.max_cooldown],
+                ['minRemainingRequests', service.upstream_rate_limit.min_remaining_requests],
+                ['minRemainingTokens', service.upstream_rate_limit.min_remaining_tokens],
+              ]
+              const set = fields.filter(([, value]) => value)
+              if (set.length > 0) {
+                yaml += `          upstreamRateLimit:\n`
+                for (const [name, value] of set) {
+                  yaml += `            ${name}: ${value}\n`
+                }
+              }
+            }
+            if (service.health_check?.path) {
+              const check = service.health_check
+              yaml += `          healthCheck:\n`
+              yaml += `            path: ${check.path}\n`
+              if (check.method) {
+                yaml += `            method: ${check.method}\n`
+              }
+              if (check.body) {
+                yaml += `            body: ${JSON.stringify(check.body)}\n`
+              }
+              if (check.expected_status) {
+                yaml += `            expectedStatus: ${check.expected_status}\n`
+              }
+              if (check.interval) {
+                yaml += `            interval: ${check.interval}\n`
+              }
+              if (check.timeout) {
+                yaml += `            timeout: ${check.timeout}\n`
+              }
+            }
           }
         }
       }
@@ -368,7 +781,13 @@ class ApiClient {
       yaml += 'users:\n'
       for (const user of config.users) {
         yaml += `    - name: ${user.name}\n`
-        yaml += `      apiKey: ${user.api_key}\n`
+        if (user.api_key_hash) {
+          yaml += `      apiKeyHash: ${user.api_key_hash}\n`
+        } else {
+          yaml += `      apiKey: ${JSON.stringify(user.api_key)}\n`
+        }
+        yaml += this.rateLimitToYAML(user.rate_limit, '      ')
+        yaml += this.budgetToYAML(user.budget, '      ')
         const services = user.services || {}
         if (Object.keys(services).length > 0) {
           yaml += `      services:\n`
@@ -392,6 +811,8 @@ class ApiClient {
                     yaml += `                - ${tag}\n`
                   }
                 }
+                yaml += this.modelsToYAML(candidate.models, '              ')
+                yaml += this.headersToYAML(candidate.headers, '              ')
               }
             } else {
               if (route.provider_name) {
@@ -401,13 +822,131 @@ class ApiClient {
                 yaml += `          providerKeyName: ${route.provider_key_name}\n`
               }
             }
+            if (route.failover) {
+              const { max_attempts, deadline } = route.failover
+              if (max_attempts || deadline) {
+                yaml += `          failover:\n`
+                if (max_attempts) {
+                  yaml += `            maxAttempts: ${max_attempts}\n`
+                }
+                if (deadline) {
+                  yaml += `            deadline: ${deadline}\n`
+                }
+              }
+            }
+            // Only accepted with the consistent_hash strategy.
+            if (route.consistent_hash && route.strategy === 'consistent_hash') {
+              const { source, header, prompt_prefix } = route.consistent_hash
+              if (source || header || prompt_prefix) {
+                yaml += `          consistentHash:\n`
+                if (source) {
+                  yaml += `            source: ${source}\n`
+                }
+                if (header) {
+                  yaml += `            header: ${JSON.stringify(header)}\n`
+                }
+                if (prompt_prefix) {
+                  yaml += `            promptPrefix: ${prompt_prefix}\n`
+                }
+              }
+            }
+            yaml += this.rateLimitToYAML(route.rate_limit, '          ')
+            yaml += this.budgetToYAML(route.budget, '          ')
+            yaml += this.modelMapToYAML('modelAliases', route.model_aliases, '          ')
+            yaml += this.headersToYAML(route.headers, '          ')
           }
         }
       }
     }
 
+    if (config.client_auth && Object.keys(config.client_auth).length > 0) {
+      yaml += 'clientAuth:\n'
+      for (const [serviceType, auth] of Object.entries(config.client_auth)) {
+        yaml += `  ${serviceType}:\n`
+        yaml += `    styles: [${auth.styles.join(', ')}]\n`
+      }
+    }
+
+    return yaml
+  }
+
+  private modelsToYAML(models: string[] | undefined, indent: string): string {
+    if (!models || models.length === 0) {
+      return ''
+    }
+    // Patterns are quoted because a leading "*" would otherwise parse as a YAML alias.
+    let yaml = `${indent}models:\n`
+    for (const model of models) {
+      yaml += `${indent}  - ${JSON.stringify(model)}\n`
+    }
+    return yaml
+  }
+
+  private modelMapToYAML(field: string, map: Record<string, string> | undefined, indent: string): string {
+    if (!map || Object.keys(map).length === 0) {
+      return ''
+    }
+    let yaml = `${indent}${field}:\n`
+    for (const [from, to] of Object.entries(map)) {
+      yaml += `${indent}  ${JSON.stringify(from)}: ${JSON.stringify(to)}\n`
+    }
     return yaml
   }
+
+  private headersToYAML(policy: HeaderPolicy | undefined, indent: string): string {
+    if (!policy) {
+      return ''
+    }
+    let body = ''
+    for (const [direction, rules] of [['request', policy.request], ['response', policy.response]] as const) {
+      if (!rules) {
+        continue
+      }
+      let section = this.modelMapToYAML('set', rules.set, `${indent}    `)
+      section += this.modelMapToYAML('add', rules.add, `${indent}    `)
+      if (rules.remove && rules.remove.length > 0) {
+        section += `${indent}    remove: [${rules.remove.map((name) => JSON.stringify(name)).join(', ')}]\n`
+      }
+      if (section) {
+        body += `${indent}  ${direction}:\n${section}`
+      }
+    }
+    return body ? `${indent}headers:\n${body}` : ''
+  }
+
+  private rateLimitToYAML(limit: RateLimitConfig | undefined, indent: string): string {
+    if (!limit || (!limit.requests_per_minute && !limit.max_concurrent)) {
+      return ''
+    }
+    let yaml = `${indent}rateLimit:\n`
+    if (limit.requests_per_minute) {
+      yaml += `${indent}  requestsPerMinute: ${limit.requests_per_minute}\n`
+    }
+    if (limit.max_concurrent) {
+      yaml += `${indent}  maxConcurrent: ${limit.max_concurrent}\n`
+    }
+    return yaml
+  }
+
+  private budgetToYAML(budget: BudgetConfig | undefined, indent: string): string {
+    if (!budget) {
+      return ''
+    }
+    let body = ''
+    for (const [period, limit] of [['daily', budget.daily], ['monthly', budget.monthly]] as const) {
+      if (!limit || (!limit.tokens && !limit.cost)) {
+        continue
+      }
+      body += `${indent}  ${period}:\n`
+      if (limit.tokens) {
+        body += `${indent}    tokens: ${limit.tokens}\n`
+      }
+      if (limit.cost) {
+        body += `${indent}    cost: ${limit.cost}\n`
+      }
+    }
+    return body ? `${indent}budget:\n${body}` : ''
+  }
 }
 
 // Export singleton instance